@@ -1,10 +1,19 @@
 package apexJSON
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
 )
 
 // Token types
@@ -22,8 +31,72 @@ const (
 	TokenComma
 )
 
+// Weak type coercions enabled through Options.WeakTypeCoercion
+const (
+	CoerceNumberToString Coercion = 1 << iota // Number token into a string, kept as the literal text
+	CoerceStringToNumber                      // String holding a valid JSON number into a numeric type
+	CoerceStringToBool                        // "1" and "0" into a bool
+
+	CoerceAll = CoerceNumberToString | CoerceStringToNumber | CoerceStringToBool
+)
+
+// Stream framings for Encoder.SetFraming and Decoder.SetFraming
+const (
+	Newline          Framing = iota // Values separated by newlines (the default)
+	LengthPrefixed32                // Each value preceded by its length as a big-endian uint32
+)
+
+// Policies for MarshalOptions.DangerousKeyPolicy
+const (
+	KeysAllow KeyPolicy = iota // Write dangerous keys like any other (the default)
+	KeysStrip                  // Leave out the members they key
+	KeysError                  // Fail with a *DangerousKeyError
+)
+
+// Policies for MappedRegion.Close while decoded strings still alias the region
+const (
+	CloseWait  ClosePolicy = iota // Block until every destination is released
+	CloseError                    // Fail with ErrRegionInUse and leave the region open
+	CloseCopy                     // Copy the remaining strings out of the region first
+)
+
+// States of a number being read by Decoder.readScalar, named for what was
+// read last
+const (
+	numberStart     numberState = iota
+	numberSign                  // Leading minus sign
+	numberZero                  // Leading zero of the integer part
+	numberInt                   // Digit of the integer part
+	numberDot                   // Decimal point
+	numberFrac                  // Digit of the fraction
+	numberExp                   // e or E
+	numberExpSign               // Sign of the exponent
+	numberExpDigits             // Digit of the exponent
+	numberEnd                   // The byte can't continue the number
+)
+
 const hex = "0123456789abcdef"
 
+// lineSepLead is the first byte of the UTF-8 encodings of U+2028 and U+2029
+const lineSepLead = 0xE2
+
+// cycleDepth is how deeply structs, maps and slices nest before Marshal
+// starts remembering the ones it is inside to detect a cycle, as
+// encoding/json does
+const cycleDepth = 1000
+
+// Buffer sizes of NewEncoder and NewDecoder, and the least NewEncoderSize
+// and NewDecoderSize start with whatever size they are given
+const (
+	defaultEncoderSize = 2048
+	defaultDecoderSize = 4096
+	minStreamSize      = 64
+)
+
+// defaultMaxFrameSize is the longest LengthPrefixed32 payload a Decoder
+// accepts unless SetMaxFrameSize says otherwise
+const defaultMaxFrameSize = 64 << 20
+
 const (
 	FloatPrecision2     = "%.2f"
 	FloatPrecision3     = "%.3f"
@@ -52,19 +125,56 @@ var (
 	jsonOpenBracket  = []byte{'['}[0]
 	jsonCloseBracket = []byte{']'}[0]
 	jsonQuoteComma   = []byte{'"', ','}
-	jsonEmpty        = []byte("empty")
-	jsonHexPrefix    = []byte("0x")
-	jsonMapOpen      = []byte("map[")
-	jsonMapClose     = []byte("]")
-	jsonNewline      = []byte{'\n'}
 )
-var escapeMap = [256][]byte{
-	'"':  []byte(`\"`),
-	'\\': []byte(`\\`),
-	'\n': []byte(`\n`),
-	'\r': []byte(`\r`),
-	'\t': []byte(`\t`),
-}
+
+// defaultOptions backs every Parser that wasn't given explicit options
+var defaultOptions Options
+
+// compatOptions replace defaultOptions for the package-level functions
+// after SetStdlibCompat(true)
+var compatOptions = Options{MarshalOptions: MarshalOptions{StdlibCompat: true}}
+
+// ErrPathNotFound is returned by ExtractErr, GetObjectErr and GetArrayErr
+// when the document is well formed but has no value at the requested path
+var ErrPathNotFound = errors.New("json: path not found")
+
+// ErrDecodeBudgetExceeded is matched by the *DecodeBudgetError returned when
+// a decode materializes more than Options.MaxDecodedElements values
+var ErrDecodeBudgetExceeded = errors.New("json: decode budget exceeded")
+
+// ErrRegionInUse is returned by MappedRegion.Close under CloseError while
+// decoded strings still alias the region
+var ErrRegionInUse = errors.New("json: mapped region still referenced")
+
+// ErrRegionClosed is returned by UnmarshalMapped and MappedRegion.Close once
+// the region has been closed
+var ErrRegionClosed = errors.New("json: mapped region closed")
+
+// ErrEncoderClosed is returned by the methods of an Encoder, and of its
+// ObjectEncoders, once the Encoder has been closed
+var ErrEncoderClosed = errors.New("json: encoder closed")
+
+// defaultEscapes is the escape table used unless MarshalOptions ask for more.
+// Control characters JSON doesn't give a short form are written as \u00XX,
+// and U+2028 and U+2029, line terminators in JavaScript, as \u2028 and \u2029.
+var defaultEscapes = func() escapeTable {
+	t := escapeTable{
+		'"':  []byte(`\"`),
+		'\\': []byte(`\\`),
+		'\b': []byte(`\b`),
+		'\f': []byte(`\f`),
+		'\n': []byte(`\n`),
+		'\r': []byte(`\r`),
+		'\t': []byte(`\t`),
+	}
+	for c := byte(0); c < 0x20; c++ {
+		if t[c] == nil {
+			t[c] = []byte{'\\', 'u', '0', '0', hex[c>>4], hex[c&0xF]}
+		}
+	}
+	t[lineSepLead] = []byte{}
+	return t
+}()
 
 func (e *SyntaxError) Error() string {
 	b := getBuilder()
@@ -73,23 +183,249 @@ func (e *SyntaxError) Error() string {
 	b.WriteString(strconv.FormatInt(e.Offset, 10))
 	b.WriteString(": ")
 	b.WriteString(e.Msg)
+	if e.ContextSnippet != "" {
+		b.WriteString(" near `")
+		b.WriteString(e.ContextSnippet)
+		b.WriteString("`")
+	}
 
 	return b.String()
 }
 
+// Unwrap returns io.ErrUnexpectedEOF for input that ended partway through
+// a value
+func (e *SyntaxError) Unwrap() error {
+	return e.err
+}
+
+// unexpectedEnd reports input that was truncated at offset
+func unexpectedEnd(offset int64) *SyntaxError {
+	return &SyntaxError{err: io.ErrUnexpectedEOF, Offset: offset, Msg: "unexpected end of JSON input"}
+}
+
+func (e *DecodeBudgetError) Error() string {
+	return "json: decode budget exceeded: " + strconv.Itoa(e.Elements) +
+		" elements materialized, limit " + strconv.Itoa(e.Limit) +
+		" (offset " + strconv.FormatInt(e.Offset, 10) + ")"
+}
+
+func (e *DecodeBudgetError) Unwrap() error {
+	return ErrDecodeBudgetExceeded
+}
+
+func (e *MarshalerError) Error() string {
+	src := e.sourceFunc
+	if src == "" {
+		src = "MarshalJSON"
+	}
+	return "json: error calling " + src + " for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+func (e *MarshalerError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UnmarshalerError) Error() string {
+	var field string
+	if e.Field != "" {
+		field = " field " + e.Field
+	}
+	return "json: error calling UnmarshalJSON for type " + e.Type.String() + field +
+		" at offset " + strconv.FormatInt(e.Offset, 10) + ": " + e.Err.Error()
+}
+
+func (e *UnmarshalerError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DangerousKeyError) Error() string {
+	return "json: dangerous object key " + strconv.Quote(e.Key)
+}
+
+func (e *UnknownCollisionError) Error() string {
+	return "json: Unknown member " + strconv.Quote(e.Key) + " is named like a field of " + e.Type.String()
+}
+
+func (e *EmbeddedError) Error() string {
+	msg := "json: "
+	if e.Path != "" {
+		msg += e.Path + ": "
+	}
+	if e.Offset >= 0 {
+		msg += "offset " + strconv.FormatInt(e.Offset, 10) + " of "
+	}
+	return msg + "embedded document: " + strings.TrimPrefix(e.Err.Error(), "json: ")
+}
+
+func (e *EmbeddedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MapKeyError) Error() string {
+	msg := "json: cannot use map key of type " + e.Type.String()
+	if e.reason != "" {
+		msg += ": " + e.reason
+	}
+	if e.Err != nil {
+		msg += ": " + strings.TrimPrefix(e.Err.Error(), "json: ")
+	}
+	return msg
+}
+
+func (e *MapKeyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FieldError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return "json: " + e.Path + ": " + strings.TrimPrefix(e.Err.Error(), "json: ")
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = strings.TrimPrefix(err.Error(), "json: ")
+	}
+	return "json: " + strings.Join(msgs, "; ")
+}
+
+func (e MultiError) Unwrap() []error {
+	return e
+}
+
+func (e *DocumentError) Error() string {
+	return fmt.Sprintf("json: document %d at offset %d: %s", e.Index, e.Offset, strings.TrimPrefix(e.Err.Error(), "json: "))
+}
+
+func (e *DocumentError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "json: Unmarshal(nil)"
+	}
+	if e.reason != "" {
+		return "json: Unmarshal(" + e.reason + " " + e.Type.String() + ")"
+	}
+	if e.Type.Kind() != reflect.Ptr {
+		return "json: Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "json: Unmarshal(nil " + e.Type.String() + ")"
+}
+
 func (e *UnmarshalTypeError) Error() string {
+	var near string
+	if e.ContextSnippet != "" {
+		near = " near `" + e.ContextSnippet + "`"
+	}
 	if e.Field != "" {
-		return fmt.Sprintf("json: cannot unmarshal %s into Go struct field %s of type %s",
-			e.Value, e.Field, e.Type.String())
+		return fmt.Sprintf("json: cannot unmarshal %s into Go struct field %s of type %s%s",
+			e.Value, e.Field, e.Type.String(), near)
+	}
+	return fmt.Sprintf("json: cannot unmarshal %s into Go value of type %s%s", e.Value, e.Type.String(), near)
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Path != "" {
+		return "json: unsupported type: " + e.Type.String() + " in field " + e.Path
 	}
-	return fmt.Sprintf("json: cannot unmarshal %s into Go value of type %s", e.Value, e.Type.String())
+	return "json: unsupported type: " + e.Type.String()
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "json: unsupported value: " + e.Str
 }
 
 // ### Core Functions ###
 
 func Marshal(v interface{}) ([]byte, error) {
-	buf := getBuffer()
+	if h := traceHooks.Load(); h != nil && h.OnEncodeStart != nil {
+		done := h.OnEncodeStart(reflect.TypeOf(v))
+		data, err := marshal(v)
+		done(len(data), err)
+		return data, err
+	}
+	return marshal(v)
+}
+
+// MarshalAppend appends the encoding of v, as Marshal writes it, to dst and
+// returns the extended slice. It allocates only when dst lacks the capacity.
+// On error dst is returned as it was passed, though the bytes past its
+// length may have been overwritten.
+func MarshalAppend(dst []byte, v interface{}) ([]byte, error) {
+	if h := traceHooks.Load(); h != nil && h.OnEncodeStart != nil {
+		done := h.OnEncodeStart(reflect.TypeOf(v))
+		data, err := marshalAppend(dst, v)
+		done(len(data)-len(dst), err)
+		return data, err
+	}
+	return marshalAppend(dst, v)
+}
+
+// marshalAppend is MarshalAppend without the trace hooks. A pooled Buffer
+// carries dst through the encode in place of its own memory.
+func marshalAppend(dst []byte, v interface{}) ([]byte, error) {
+	buf := getBufferSize(0)
+	own := buf.buf
+	buf.buf, buf.off = dst, len(dst)
+	if stdlibCompat.Load() {
+		buf.opts = &compatOptions.MarshalOptions
+		buf.esc, _ = escapeTableFor(buf.opts, true)
+	}
+
+	err := marshalValue(reflect.ValueOf(v), buf)
+	data := buf.buf[:buf.off]
+	buf.buf = own
+	putBuffer(buf)
+	if err != nil {
+		return dst, err
+	}
+	return data, nil
+}
+
+// MarshalWithOptions is like Marshal with the encode configured by opts.
+// The zero MarshalOptions give exactly the output of Marshal. It fails
+// without encoding anything if opts.ExtraEscapes is invalid.
+func MarshalWithOptions(v interface{}, opts MarshalOptions) ([]byte, error) {
+	if h := traceHooks.Load(); h != nil && h.OnEncodeStart != nil {
+		done := h.OnEncodeStart(reflect.TypeOf(v))
+		data, err := marshalWithOptions(v, &opts)
+		done(len(data), err)
+		return data, err
+	}
+	return marshalWithOptions(v, &opts)
+}
+
+// marshal is Marshal without the trace hooks
+func marshal(v interface{}) ([]byte, error) {
+	if stdlibCompat.Load() {
+		return marshalWithOptions(v, &compatOptions.MarshalOptions)
+	}
+	return marshalWithOptions(v, nil)
+}
+
+// marshalWithOptions is MarshalWithOptions without the trace hooks. A nil
+// opts uses the defaults.
+func marshalWithOptions(v interface{}, opts *MarshalOptions) ([]byte, error) {
+	var esc *escapeTable
+	if opts != nil {
+		var err error
+		if esc, err = escapeTableFor(opts, true); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := getBufferSize(max(sizeHint(reflect.TypeOf(v), opts), 256))
 	defer putBuffer(buf)
+	buf.opts, buf.esc = opts, esc
+	buf.startYields(nil)
 
 	if err := marshalValue(reflect.ValueOf(v), buf); err != nil {
 		return nil, err
@@ -100,60 +436,818 @@ func Marshal(v interface{}) ([]byte, error) {
 	copy(result, buf.buf[:buf.off])
 	return result, nil
 }
+
+// MarshalIndent is like Marshal but lays the output out like encoding/json's
+// MarshalIndent: each object member and array element starts on a new line,
+// beginning with prefix and then one copy of indent per level of nesting.
+// Empty objects and arrays stay as {} and [].
+func MarshalIndent(v interface{}, prefix, indent string) ([]byte, error) {
+	buf := getBufferSize(max(sizeHint(reflect.TypeOf(v), nil), 256))
+	defer putBuffer(buf)
+	buf.ind = &indenter{prefix: prefix, indent: indent}
+	if stdlibCompat.Load() {
+		buf.opts = &compatOptions.MarshalOptions
+		buf.esc, _ = escapeTableFor(buf.opts, true)
+	}
+
+	if err := marshalValue(reflect.ValueOf(v), buf); err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, buf.off)
+	copy(result, buf.buf[:buf.off])
+	return result, nil
+}
+
 func Unmarshal(data []byte, v interface{}) error {
 	p := NewParser(data)
-	// should I defer p.Close()?
-	return unmarshalValue(p, reflect.ValueOf(v).Elem())
+	if stdlibCompat.Load() {
+		p.opts = &compatOptions
+	}
+	if h := traceHooks.Load(); h != nil && h.OnDecodeStart != nil {
+		done := h.OnDecodeStart(len(data))
+		err := unmarshal(p, v)
+		done(err)
+		return err
+	}
+	return unmarshal(p, v)
+}
+
+// Valid reports whether data is a single valid JSON value surrounded by
+// optional whitespace. It accepts exactly the documents Unmarshal into an
+// interface{} and Extract with no path accept. Valid input is checked
+// without allocating, however deeply it nests, so it is cheap enough to
+// gate untrusted input before an expensive decode.
+func Valid(data []byte) bool {
+	p := Parser{data: data, opts: &defaultOptions}
+	_, _, err := p.document()
+	return err == nil
+}
+
+// ValidString is Valid for a string, without copying it
+func ValidString(s string) bool {
+	return Valid(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// Compact appends src to dst with the insignificant whitespace removed.
+// Strings are copied byte for byte, escapes included. src must be a single
+// valid JSON value as for Valid; otherwise the *SyntaxError is returned and
+// nothing is appended. No intermediate values are built: src is checked
+// with the parser's grammar and then copied in runs between the whitespace.
+func Compact(dst *Buffer, src []byte) error {
+	p := Parser{data: src, opts: &defaultOptions}
+	start, end, err := p.document()
+	if err != nil {
+		return err
+	}
+
+	run := start
+	for i := start; i < end; i++ {
+		switch c := src[i]; {
+		case c == jsonQuote:
+			// The string is known to be well formed, so only escaped
+			// quotes need care
+			for i++; src[i] != jsonQuote; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case isWhitespace(c):
+			dst.Write(src[run:i])
+			run = i + 1
+		}
+	}
+	dst.Write(src[run:end])
+	return nil
+}
+
+// Indent appends src to dst laid out as MarshalIndent lays out its output,
+// with prefix and indent as there. Keys keep their order and strings and
+// numbers are copied byte for byte, so no value is changed by a trip
+// through Go types. src must be a single valid JSON value as for Valid;
+// otherwise the *SyntaxError is returned and nothing is appended.
+func Indent(dst *Buffer, src []byte, prefix, indent string) error {
+	p := Parser{data: src, opts: &defaultOptions}
+	start, end, err := p.document()
+	if err != nil {
+		return err
+	}
+
+	ind := dst.ind
+	dst.ind = &indenter{prefix: prefix, indent: indent}
+	dst.writeRaw(src[start:end])
+	dst.ind = ind
+	return nil
+}
+
+// TranscodeBytes returns data, a single JSON value, compacted as by Compact
+// and with opts.DangerousKeyPolicy applied to the keys of objects at every
+// level, for passing documents on to JavaScript consumers. Keys are matched
+// as decoded. Strings and numbers are copied byte for byte, and the other
+// options don't apply. Invalid JSON is reported as for Valid.
+func TranscodeBytes(data []byte, opts MarshalOptions) ([]byte, error) {
+	p := Parser{data: data, opts: &defaultOptions}
+	start, end, err := p.document()
+	if err != nil {
+		return nil, err
+	}
+	p.data, p.pos = data[:end], start
+
+	buf := getBufferSize(end - start)
+	defer putBuffer(buf)
+	if err := transcodeKeys(&p, buf, &opts); err != nil {
+		return nil, err
+	}
+	result := make([]byte, buf.off)
+	copy(result, buf.buf[:buf.off])
+	return result, nil
+}
+
+// transcodeKeys copies the valid JSON value at p to dst without whitespace,
+// leaving out the object members whose keys o refuses
+func transcodeKeys(p *Parser, dst *Buffer, o *MarshalOptions) error {
+	type level struct {
+		object  bool
+		read    int // members read from p
+		written int // members written to dst
+	}
+	var open []level
+
+	for {
+		// A value starts here
+		p.skipWhitespace()
+		if c := p.data[p.pos]; c == '{' || c == '[' {
+			p.pos++
+			dst.WriteByte(c)
+			open = append(open, level{object: c == '{'})
+		} else {
+			start := p.pos
+			skipValue(p)
+			dst.Write(p.data[start:p.pos])
+		}
+
+		// Find the next value to write, closing the containers that end
+		// first and passing over the members that are left out
+		for {
+			if len(open) == 0 {
+				return nil
+			}
+			top := &open[len(open)-1]
+			if done, _ := p.nextMember(closer(top.object), top.read == 0); done {
+				dst.WriteByte(closer(top.object))
+				open = open[:len(open)-1]
+				continue
+			}
+			top.read++
+			if !top.object {
+				if top.written++; top.written > 1 {
+					dst.WriteByte(jsonComma)
+				}
+				break
+			}
+
+			keyStart := p.pos
+			_, raw := p.parseString()
+			keyEnd := p.pos
+			key, _ := p.unescape(raw)
+			keep, err := o.keepKey(GetString(key))
+			if err != nil {
+				return err
+			}
+			p.skipWhitespace()
+			p.pos++ // Skip colon
+			if !keep {
+				skipValue(p)
+				continue
+			}
+			if top.written++; top.written > 1 {
+				dst.WriteByte(jsonComma)
+			}
+			dst.Write(p.data[keyStart:keyEnd])
+			dst.WriteByte(':')
+			break
+		}
+	}
+}
+
+// UnmarshalValue decodes data directly into a reflect.Value. v must either
+// be settable (a field of an addressable struct, an element obtained from
+// reflect.New(t).Elem(), ...) or a non-nil pointer, in which case the value
+// it points to is decoded into. Anything else is reported up front as an
+// InvalidUnmarshalError rather than panicking inside reflect. A nil opts
+// uses the same defaults as Unmarshal.
+func UnmarshalValue(data []byte, v reflect.Value, opts *Options) error {
+	if !v.IsValid() {
+		return &InvalidUnmarshalError{}
+	}
+	if !v.CanSet() {
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return &InvalidUnmarshalError{Type: v.Type(), reason: "unsettable"}
+		}
+		v = v.Elem()
+	}
+
+	p := NewParser(data)
+	if opts != nil {
+		p.opts = opts
+	}
+	if err := p.precheck(); err != nil {
+		return p.finishDecode(err)
+	}
+	if p.opts.ZeroBeforeDecode {
+		v.SetZero()
+	}
+	return p.finishDecode(p.endOfInput(unmarshalValue(p, v)))
+}
+
+// unmarshal checks that v is a usable destination and decodes into it
+func unmarshal(p *Parser, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+	if err := p.precheck(); err != nil {
+		return p.finishDecode(err)
+	}
+	if p.opts.ZeroBeforeDecode {
+		rv.Elem().SetZero()
+	}
+	return p.finishDecode(p.endOfInput(unmarshalValue(p, rv.Elem())))
+}
+
+// UnmarshalMulti decodes input holding a sequence of JSON values separated
+// by optional whitespace, such as an NDJSON file, which Unmarshal rejects
+// after the first value. fn is called for each value in turn with its index
+// and a dec function that decodes the value into v like Unmarshal; a value
+// fn doesn't decode is skipped. Errors from dec, and for a malformed value
+// that ends the input, are *DocumentErrors with offsets into data. An error
+// returned by fn stops UnmarshalMulti and is returned as is.
+func UnmarshalMulti(data []byte, fn func(index int, dec func(v interface{}) error) error) error {
+	p := NewParser(data)
+	if stdlibCompat.Load() {
+		p.opts = &compatOptions
+	}
+	for index := 0; ; index++ {
+		p.skipWhitespace()
+		if p.pos >= len(data) {
+			return nil
+		}
+
+		start := p.pos
+		if !skipValue(p) {
+			err := p.decodeError(p.tokenError("invalid JSON value"))
+			return &DocumentError{Err: err, Index: index, Offset: int64(start)}
+		}
+		end := p.pos
+
+		dec := func(v interface{}) error {
+			// Limiting the parser to the value keeps the trailing data check
+			// of Unmarshal, with offsets still relative to all of data
+			dp := &Parser{data: data[:end], opts: p.opts, pos: start}
+			if err := unmarshal(dp, v); err != nil {
+				return &DocumentError{Err: err, Index: index, Offset: int64(start)}
+			}
+			return nil
+		}
+		if err := fn(index, dec); err != nil {
+			return err
+		}
+	}
 }
 
 func NewParser(data []byte) *Parser {
 	return &Parser{
 		data: data,
+		opts: &defaultOptions,
 		pos:  0,
 	}
 }
 
+// NewCodec returns a Codec with its own marshal buffer and parser scratch
+func NewCodec() *Codec {
+	return &Codec{
+		parser: Parser{opts: &defaultOptions},
+		buf:    &Buffer{buf: make([]byte, 0, 256)},
+	}
+}
+
+// Unmarshal behaves like the package-level Unmarshal, SetStdlibCompat and
+// trace hooks included, but reuses the codec's parser and unescape buffer
+// across calls
+func (c *Codec) Unmarshal(data []byte, v interface{}) error {
+	c.parser.data = data
+	c.parser.err = nil
+	c.parser.pos = 0
+	c.parser.elements = 0
+	c.parser.losses = 0
+	c.parser.opts = &defaultOptions
+	if stdlibCompat.Load() {
+		c.parser.opts = &compatOptions
+	}
+	var err error
+	if h := traceHooks.Load(); h != nil && h.OnDecodeStart != nil {
+		done := h.OnDecodeStart(len(data))
+		err = unmarshal(&c.parser, v)
+		done(err)
+	} else {
+		err = unmarshal(&c.parser, v)
+	}
+
+	// Drop the reference to the caller's input and don't hold on to
+	// scratch space grown by an unusually large document
+	c.parser.data = nil
+	if cap(c.parser.scratch) > 65536 {
+		c.parser.scratch = nil
+	}
+	return err
+}
+
+// Marshal behaves like the package-level Marshal, SetStdlibCompat and trace
+// hooks included, but encodes into the codec's buffer instead of one taken
+// from the pool
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	if h := traceHooks.Load(); h != nil && h.OnEncodeStart != nil {
+		done := h.OnEncodeStart(reflect.TypeOf(v))
+		data, err := c.marshal(v)
+		done(len(data), err)
+		return data, err
+	}
+	return c.marshal(v)
+}
+
+// marshal is Marshal without the trace hooks
+func (c *Codec) marshal(v interface{}) ([]byte, error) {
+	c.buf.Reset()
+	c.buf.opts, c.buf.esc = nil, nil
+	if stdlibCompat.Load() {
+		c.buf.opts = &compatOptions.MarshalOptions
+		c.buf.esc, _ = escapeTableFor(c.buf.opts, true)
+	}
+	if err := marshalValue(reflect.ValueOf(v), c.buf); err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, c.buf.off)
+	copy(result, c.buf.buf[:c.buf.off])
+	if cap(c.buf.buf) > 65536 {
+		c.buf.buf = make([]byte, 0, 256)
+	}
+	return result, nil
+}
+
+// NewMemo returns a Memo for v. Nothing is encoded until the first call to
+// Bytes, WriteTo or Encoder.EncodeMemo.
+func NewMemo(v interface{}) *Memo {
+	return &Memo{v: v}
+}
+
+// Bytes returns the encoding of the Memo's value, as Marshal would produce
+// it, encoding it first if needed. Concurrent callers wait for a single
+// encode and share its result, errors included. The slice is shared too and
+// must not be modified.
+func (m *Memo) Bytes() ([]byte, error) {
+	if r := m.encoded.Load(); r != nil {
+		return r.data, r.err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r := m.encoded.Load(); r != nil {
+		return r.data, r.err
+	}
+	data, err := marshal(m.v)
+	m.encoded.Store(&memoResult{data: data, err: err})
+	return data, err
+}
+
+// Invalidate drops the cached encoding, so the value is encoded again on
+// next use. Call it after the value changes; an encode already in progress
+// is waited for, so its result can't outlive the call.
+func (m *Memo) Invalidate() {
+	m.mu.Lock()
+	m.encoded.Store(nil)
+	m.mu.Unlock()
+}
+
+// WriteTo writes the encoding of the Memo's value to w, without copying it
+func (m *Memo) WriteTo(w io.Writer) (int64, error) {
+	data, err := m.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{
+	return NewEncoderSize(w, defaultEncoderSize)
+}
+
+// NewEncoderSize returns an Encoder whose buffer starts with room for size
+// bytes, at least 64, instead of NewEncoder's 2048, so large values don't
+// grow it on the first Encode. The buffer still grows for a larger value
+// and keeps its size for the next.
+func NewEncoderSize(w io.Writer, size int) *Encoder {
+	e := &Encoder{
 		w:          w,
-		buf:        getBufferSize(2048),
+		buf:        getBufferSize(max(size, minStreamSize)),
 		escapeHTML: true,
 	}
+	if stdlibCompat.Load() {
+		e.SetMarshalOptions(compatOptions.MarshalOptions)
+	}
+	return e
+}
+
+// NewEncoderBuffered returns an Encoder that writes to w through a
+// bufio.Writer of size bytes, so many small Encodes reach w as a few large
+// writes. Values are only sent once the buffer fills or on Flush or Close.
+// An error writing to w is returned by the Encode or Flush that hit it, and
+// by every later one.
+func NewEncoderBuffered(w io.Writer, size int) *Encoder {
+	bw := bufio.NewWriterSize(w, size)
+	e := NewEncoder(bw)
+	e.bw = bw
+	return e
+}
+
+// NewSharedEncoder returns an Encoder that many goroutines may call Encode
+// on at once. Each call encodes into its own pooled buffer, concurrently
+// with the others, and only the write to w is serialized, so every value
+// reaches w whole, in a single Write for the default framing. Options must
+// be set before the encoder is shared.
+func NewSharedEncoder(w io.Writer) *Encoder {
+	e := NewEncoder(w)
+	e.mu = new(sync.Mutex)
+	return e
 }
 
 func NewDecoder(r io.Reader) *Decoder {
-	fmt.Println("Creating new decoder")
+	return NewDecoderSize(r, defaultDecoderSize)
+}
+
+// NewDecoderSize returns a Decoder that reads r in chunks of size bytes,
+// at least 64, instead of NewDecoder's 4096; small sizes suit many
+// connections with short messages. A value longer than size grows the
+// buffer to hold it.
+func NewDecoderSize(r io.Reader, size int) *Decoder {
 	d := &Decoder{
-		r:         r,
-		buf:       make([]byte, 0, 4096),
-		tokenBuf:  *getTokenBuf(),
-		useNumber: false,
+		r:        r,
+		buf:      make([]byte, 0, max(size, minStreamSize)),
+		tokenBuf: *getTokenBuf(),
 	}
-	fmt.Printf("NewDecoder: buf len=%d, cap=%d\n", len(d.buf), cap(d.buf))
 	d.readPos = 0
+	d.opts.StdlibCompat = stdlibCompat.Load()
 	return d
 }
 
 func (e *Encoder) Encode(v interface{}) error {
+	if e.buf == nil {
+		return ErrEncoderClosed
+	}
+	if h := traceHooks.Load(); h != nil && h.OnEncodeStart != nil {
+		done := h.OnEncodeStart(reflect.TypeOf(v))
+		n, err := e.encode(v)
+		done(n, err)
+		return err
+	}
+	_, err := e.encode(v)
+	return err
+}
+
+// encode is Encode without the trace hooks. It returns the size of the
+// encoded value, before framing, once encoding succeeded.
+func (e *Encoder) encode(v interface{}) (int, error) {
+	if e.mu != nil {
+		return e.encodeShared(v)
+	}
+
 	e.buf.Reset()
+	if n := sizeHint(reflect.TypeOf(v), e.buf.opts); n > 0 {
+		e.buf.grow(n)
+	}
+
+	if e.framing == LengthPrefixed32 {
+		e.buf.startYields(nil)
+	} else {
+		e.buf.startYields(e.w)
+	}
+	err := marshalValue(reflect.ValueOf(v), e.buf)
+	written := e.buf.stopYields()
+	if err != nil {
+		return 0, err
+	}
+	n := written + e.buf.off
+	return n, e.write(e.buf)
+}
+
+// EncodeMemo writes the Memo's value like Encode, reusing its cached
+// encoding instead of encoding the value again. The encoding is the one
+// Marshal produces; the encoder's MarshalOptions don't apply to it.
+func (e *Encoder) EncodeMemo(m *Memo) error {
+	if e.buf == nil {
+		return ErrEncoderClosed
+	}
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if e.mu == nil {
+		e.buf.Reset()
+		e.buf.Write(data)
+		return e.write(e.buf)
+	}
+	buf := getBufferSize(len(data) + 1)
+	defer putBuffer(buf)
+	buf.Write(data)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.write(buf)
+}
+
+// encodeShared encodes v for an encoder made by NewSharedEncoder. e.buf only
+// carries the options; the value goes into a buffer of its own.
+func (e *Encoder) encodeShared(v interface{}) (int, error) {
+	buf := getBufferSize(max(sizeHint(reflect.TypeOf(v), e.buf.opts), 256))
+	defer putBuffer(buf)
+	buf.opts, buf.esc = e.buf.opts, e.buf.esc
+	buf.startYields(nil)
+
+	if err := marshalValue(reflect.ValueOf(v), buf); err != nil {
+		return 0, err
+	}
+	n := buf.off
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return n, e.write(buf)
+}
+
+// write sends the encoded value in buf to the underlying writer, framed as
+// configured
+func (e *Encoder) write(buf *Buffer) error {
+	if e.framing == LengthPrefixed32 {
+		return e.writeLengthPrefixed(buf.Bytes())
+	}
+
+	// Write the encoded value and its newline in a single Write
+	if !e.noNewline {
+		buf.WriteByte('\n')
+	}
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+// writeLengthPrefixed writes value as one LengthPrefixed32 frame
+func (e *Encoder) writeLengthPrefixed(value []byte) error {
+	if uint64(len(value)) > math.MaxUint32 {
+		return fmt.Errorf("json: encoded value of %d bytes does not fit a 32-bit length prefix", len(value))
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(value)))
+	if _, err := e.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(value)
+	return err
+}
+
+// SetMarshalOptions applies opts to every subsequent Encode. It fails, and
+// keeps the previous options, if opts.ExtraEscapes is invalid.
+func (e *Encoder) SetMarshalOptions(opts MarshalOptions) error {
+	if e.buf == nil {
+		return ErrEncoderClosed
+	}
+	esc, err := escapeTableFor(&opts, e.escapeHTML)
+	if err != nil {
+		return err
+	}
+	e.buf.opts, e.buf.esc = &opts, esc
+	return nil
+}
+
+// SetFraming selects how Encode delimits values in the stream
+func (e *Encoder) SetFraming(mode Framing) {
+	e.framing = mode
+}
+
+// Flush writes any values an encoder made by NewEncoderBuffered holds to
+// the underlying writer. It does nothing for other encoders, which write
+// each value as it is encoded.
+func (e *Encoder) Flush() error {
+	if e.buf == nil {
+		return ErrEncoderClosed
+	}
+	if e.bw == nil {
+		return nil
+	}
+	return e.bw.Flush()
+}
+
+// Close flushes the encoder, as Flush does, and returns its buffer to the
+// pool, reporting any error from the flush. Every later call fails with
+// ErrEncoderClosed, and so do ObjectEncoders not yet ended; closing again
+// does nothing. The underlying writer is not closed. A shared encoder must
+// be closed only once all its Encode calls have returned.
+func (e *Encoder) Close() error {
+	if e.buf == nil {
+		return nil
+	}
+	err := e.Flush()
+	putBuffer(e.buf)
+	e.buf = nil
+	return err
+}
+
+// SetWriteNewline controls whether the Newline framing ends each value
+// with '\n', as it does by default. Off writes the value alone, for a
+// response body or signed payload that must have no trailing whitespace;
+// consecutive values then run together, so it suits a single value per
+// writer, or values a Decoder splits by their syntax: objects, arrays and
+// strings.
+func (e *Encoder) SetWriteNewline(on bool) {
+	e.noNewline = !on
+}
 
-	if err := marshalValue(reflect.ValueOf(v), e.buf); err != nil {
+// BeginObject starts an object that is written member by member with the
+// returned ObjectEncoder, for documents assembled from several sources.
+// The object is sent to w, framed like an Encode, when its End is called;
+// the output is identical to encoding an equivalent struct.
+func (e *Encoder) BeginObject() *ObjectEncoder {
+	if e.buf == nil {
+		return &ObjectEncoder{e: e}
+	}
+	buf := getBufferSize(2048)
+	buf.opts, buf.esc = e.buf.opts, e.buf.esc
+	buf.WriteByte(jsonOpenBrace)
+	return &ObjectEncoder{e: e, buf: buf, open: []openValue{{object: true}}}
+}
+
+// Key writes the name of the next member of the innermost open object
+func (o *ObjectEncoder) Key(name string) error {
+	top, err := o.top()
+	if err != nil {
+		return err
+	}
+	if !top.object {
+		return fmt.Errorf("json: Key %q inside an array", name)
+	}
+	if top.keyed {
+		return fmt.Errorf("json: Key %q written before the value of the previous key", name)
+	}
+	if top.members > 0 {
+		o.buf.WriteByte(jsonComma)
+	}
+	writeObjectKey(o.buf, name)
+	top.keyed = true
+	return nil
+}
+
+// Value writes v as the value of the pending key, or as the next element
+// of the innermost open array
+func (o *ObjectEncoder) Value(v interface{}) error {
+	start, err := o.beginValue()
+	if err != nil {
+		return err
+	}
+	if err := marshalValue(reflect.ValueOf(v), o.buf); err != nil {
+		// Drop the partial value so the key or position can be written again
+		o.buf.off = start
 		return err
 	}
+	o.endValue()
+	return nil
+}
 
-	// Write the encoded value followed by a newline
-	if _, err := e.w.Write(e.buf.Bytes()); err != nil {
+// RawValue writes b, which must be a single valid JSON value, unchanged
+// in the position Value would write to
+func (o *ObjectEncoder) RawValue(b []byte) error {
+	start, err := o.beginValue()
+	if err != nil {
 		return err
 	}
-	if _, err := e.w.Write(jsonNewline); err != nil {
+	if !Valid(b) {
+		o.buf.off = start
+		return fmt.Errorf("json: RawValue is not a valid JSON value")
+	}
+	o.buf.Write(b)
+	o.endValue()
+	return nil
+}
+
+// BeginObject starts a nested object in the position Value would write to.
+// Its members follow until the matching End.
+func (o *ObjectEncoder) BeginObject() error {
+	return o.begin(true)
+}
+
+// BeginArray starts a nested array in the position Value would write to.
+// Its elements are written with Value, RawValue and the Begin methods until
+// the matching End.
+func (o *ObjectEncoder) BeginArray() error {
+	return o.begin(false)
+}
+
+// End closes the innermost open object or array. Ending the object made by
+// Encoder.BeginObject writes the document; any later call fails.
+func (o *ObjectEncoder) End() error {
+	top, err := o.top()
+	if err != nil {
 		return err
 	}
+	if top.keyed {
+		return fmt.Errorf("json: End called before the value of the last key")
+	}
+	if top.object {
+		o.buf.WriteByte(jsonCloseBrace)
+	} else {
+		o.buf.WriteByte(jsonCloseBracket)
+	}
+	o.open = o.open[:len(o.open)-1]
+	if len(o.open) > 0 {
+		o.endValue()
+		return nil
+	}
+
+	buf := o.buf
+	o.buf = nil
+	defer putBuffer(buf)
+	if o.e.mu != nil {
+		o.e.mu.Lock()
+		defer o.e.mu.Unlock()
+	}
+	return o.e.write(buf)
+}
+
+// top returns the innermost open object or array
+func (o *ObjectEncoder) top() (*openValue, error) {
+	if o.e.buf == nil {
+		return nil, ErrEncoderClosed
+	}
+	if o.buf == nil || len(o.open) == 0 {
+		return nil, fmt.Errorf("json: object already ended")
+	}
+	return &o.open[len(o.open)-1], nil
+}
+
+// beginValue checks that a value may be written now and writes the comma
+// before an array element. It returns the offset to truncate to if the
+// value then fails.
+func (o *ObjectEncoder) beginValue() (int, error) {
+	top, err := o.top()
+	if err != nil {
+		return 0, err
+	}
+	if top.object && !top.keyed {
+		return 0, fmt.Errorf("json: object value written without a Key")
+	}
+	start := o.buf.off
+	if !top.object && top.members > 0 {
+		o.buf.WriteByte(jsonComma)
+	}
+	return start, nil
+}
 
+// endValue records a completed value in the innermost open container
+func (o *ObjectEncoder) endValue() {
+	top := &o.open[len(o.open)-1]
+	top.members++
+	top.keyed = false
+}
+
+// begin opens a nested object or array
+func (o *ObjectEncoder) begin(object bool) error {
+	if _, err := o.beginValue(); err != nil {
+		return err
+	}
+	if object {
+		o.buf.WriteByte(jsonOpenBrace)
+	} else {
+		o.buf.WriteByte(jsonOpenBracket)
+	}
+	o.open = append(o.open, openValue{object: object})
 	return nil
 }
 
 func (d *Decoder) Decode(v interface{}) error {
-	fmt.Printf("Decode called: buf len=%d, readPos=%d\n", len(d.buf), d.readPos)
+	if h := traceHooks.Load(); h != nil && h.OnDecodeStart != nil {
+		done := h.OnDecodeStart(-1)
+		err := d.decode(v)
+		done(err)
+		return err
+	}
+	return d.decode(v)
+}
+
+// decode is Decode without the trace hooks
+func (d *Decoder) decode(v interface{}) error {
+	if d.framing == LengthPrefixed32 {
+		return d.decodeFrame(v)
+	}
+
 	// Skip any whitespace
 	if err := d.skipWhitespace(); err != nil {
 		if err == io.EOF {
@@ -161,34 +1255,198 @@ func (d *Decoder) Decode(v interface{}) error {
 		}
 		return err
 	}
+	if d.lenient {
+		if err := d.skipGarbage(); err != nil {
+			return err
+		}
+	}
 
 	// Create a parser from the buffer
+	start := d.inputOffset()
 	value, err := d.readValue()
 	if err != nil {
 		return err
 	}
 
-	// Unmarshal the value
-	err = Unmarshal(value, v)
+	return d.decodeValue(value, start, v)
+}
 
-	// Check if it's a pooled SyntaxError and return it to the pool
-	if syntaxErr, ok := err.(*SyntaxError); ok {
-		// Create a copy of the error information
-		errCopy := fmt.Errorf("json syntax error at offset %d: %s",
-			syntaxErr.Offset, syntaxErr.Msg)
+// decodeFrame reads one LengthPrefixed32 frame and decodes its payload,
+// which must hold exactly one value
+func (d *Decoder) decodeFrame(v interface{}) error {
+	if err := d.fill(4); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint32(d.buf[d.readPos:]))
+	if n == 0 {
+		return &SyntaxError{Offset: d.inputOffset(), Msg: "zero-length frame"}
+	}
+	// Check the prefix before buffering anything it claims
+	limit := d.maxFrame
+	if limit <= 0 {
+		limit = defaultMaxFrameSize
+	}
+	if n > limit {
+		return &SyntaxError{Offset: d.inputOffset(), Msg: fmt.Sprintf("frame of %d bytes exceeds the %d byte limit", n, limit)}
+	}
+	if err := d.fill(4 + n); err != nil {
+		return err
+	}
+
+	// Decoded strings may share the value's memory, so it must not alias
+	// the read buffer
+	start := d.inputOffset() + 4
+	value := make([]byte, n)
+	copy(value, d.buf[d.readPos+4:])
+	d.readPos += 4 + n
+
+	p := NewParser(value)
+	p.skipWhitespace()
+	if skipValue(p) {
+		if p.skipWhitespace(); p.pos < len(p.data) {
+			return &SyntaxError{Offset: start + int64(p.pos), Msg: "invalid character after top-level value in frame"}
+		}
+	}
+	return d.decodeValue(value, start, v)
+}
+
+// fill reads until at least n unread bytes are buffered. It returns io.EOF
+// if the stream ends before any of them arrive and a truncation error if it
+// ends part way.
+func (d *Decoder) fill(n int) error {
+	for len(d.buf)-d.readPos < n {
+		buffered := len(d.buf) - d.readPos
+		if err := d.refillBuffer(); err != nil {
+			if err == io.EOF && buffered > 0 {
+				return unexpectedEnd(d.offset + int64(len(d.buf)))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLenientStream makes Decode skip bytes that cannot start a value, such
+// as NUL padding, a byte order mark or a ^Z end-of-file marker, between
+// top-level values instead of failing. Each skipped run is reported by
+// SkippedRanges. A value that starts plausibly but is malformed is still an
+// error. It is not meant for streams that are walked token by token.
+func (d *Decoder) SetLenientStream(on bool) *Decoder {
+	d.lenient = on
+	return d
+}
+
+// SkippedRanges returns the runs of bytes skipped so far in lenient mode
+func (d *Decoder) SkippedRanges() []SkippedRange {
+	return d.skipped
+}
+
+// skipGarbage discards and records runs of bytes that can neither start a
+// value nor are whitespace, stopping at the next plausible value start
+func (d *Decoder) skipGarbage() error {
+	for {
+		start, n := d.inputOffset(), 0
+		var err error
+		for {
+			if d.readPos >= len(d.buf) {
+				if err = d.refillBuffer(); err != nil {
+					break
+				}
+			}
+			if c := d.buf[d.readPos]; isValueStart(c) || isWhitespace(c) {
+				break
+			}
+			d.readPos++
+			n++
+		}
+		if n > 0 {
+			d.skipped = append(d.skipped, SkippedRange{Offset: start, Length: n})
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if err := d.skipWhitespace(); err != nil {
+			return err
+		}
+	}
+}
+
+// isValueStart reports whether c can be the first byte of a JSON value
+func isValueStart(c byte) bool {
+	switch c {
+	case '{', '[', '"', '-', 't', 'f', 'n':
+		return true
+	}
+	return isDigit(c)
+}
+
+// SetFraming selects how values are delimited in the stream. With
+// LengthPrefixed32 each Decode reads exactly one frame, so a malformed
+// payload does not desynchronize the values after it.
+func (d *Decoder) SetFraming(mode Framing) *Decoder {
+	d.framing = mode
+	return d
+}
+
+// SetMaxFrameSize sets the longest LengthPrefixed32 payload Decode accepts;
+// a longer length prefix is a SyntaxError. n <= 0 restores the default of
+// 64 MiB.
+func (d *Decoder) SetMaxFrameSize(n int) *Decoder {
+	d.maxFrame = n
+	return d
+}
+
+// inputOffset returns the stream offset of the next unread byte
+func (d *Decoder) inputOffset() int64 {
+	return d.offset + int64(d.readPos)
+}
+
+// decodeValue unmarshals a complete value read from the stream at offset
+// start. Errors are returned with their offsets moved from the value to the
+// stream.
+func (d *Decoder) decodeValue(value []byte, start int64, v interface{}) error {
+	p := NewParser(value)
+	p.opts = &d.opts
+	err := unmarshal(p, v)
+
+	switch e := err.(type) {
+	case *SyntaxError:
+		// Copy the error with its offset relative to the stream
+		errCopy := &SyntaxError{
+			err:            e.err,
+			Offset:         start + e.Offset,
+			Msg:            e.Msg,
+			ContextSnippet: e.ContextSnippet,
+		}
 
 		// Return the original error to the pool
-		putSyntaxError(syntaxErr)
+		putSyntaxError(e)
 
 		return errCopy
+	case *UnmarshalTypeError:
+		e.Offset += start
+	case *UnmarshalerError:
+		e.Offset += start
+	case *DecodeBudgetError:
+		e.Offset += start
 	}
-
-	// For other error types, just return them directly
 	return err
 }
 
+// SetEscapeHTML controls whether U+2028 and U+2029 are escaped, as they are
+// by default, so output can be embedded in JavaScript. Unlike the standard
+// library, which always escapes them, off writes them as is, and <, > and &
+// are never escaped.
 func (e *Encoder) SetEscapeHTML(on bool) {
-	e.escapeHTML = on
+	if e.buf == nil {
+		return
+	}
+	// Options already passed validation, so this can't fail
+	esc, _ := escapeTableFor(e.buf.marshalOptions(), on)
+	e.escapeHTML, e.buf.esc = on, esc
 }
 
 // ValueType returns the type of the current JSON value
@@ -231,149 +1489,221 @@ func (d *Decoder) Close() {
 
 // GetObject extracts a map from JSON at the specified path
 func GetObject(data []byte, path ...string) (map[string]interface{}, bool) {
-	value, ok := Extract(data, path...)
-	if !ok {
-		return nil, false
+	obj, err := GetObjectErr(data, path...)
+	return obj, err == nil
+}
+
+// GetObjectErr extracts a map from JSON at the specified path, reporting
+// errors the same way as ExtractErr. A value at path that isn't an object
+// is reported as an *UnmarshalTypeError.
+func GetObjectErr(data []byte, path ...string) (map[string]interface{}, error) {
+	value, err := ExtractErr(data, path...)
+	if err != nil {
+		return nil, err
 	}
 
 	p := NewParser(value)
 
-	// Create a deferred error handler
-	var syntaxErr *SyntaxError = nil
-	defer func() {
-		if syntaxErr != nil {
-			putSyntaxError(syntaxErr)
-		}
-	}()
-
 	// Check if this is actually an object
 	if p.ValueType() != TokenObjectStart {
-		return nil, false
+		return nil, p.notContainer(reflect.TypeOf(map[string]interface{}(nil)))
 	}
+	return p.extractObject()
+}
 
-	// Get map from pool
-	result := getObjectMap()
+// extractObject parses the object at the current position. Nested objects
+// and arrays are parsed by the same Parser, so each byte is read once and
+// error offsets are always relative to the whole document.
+func (p *Parser) extractObject() (map[string]interface{}, error) {
+	v, err := p.extractTree()
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
 
-	// Skip the opening brace
-	p.pos++
+// extractElement parses the value at the current position into the
+// interface{} representation used by GetObject, GetArray and decoding into
+// an empty interface
+func (p *Parser) extractElement() (interface{}, error) {
+	switch p.ValueType() {
+	case TokenObjectStart, TokenArrayStart:
+		return p.extractTree()
+	}
+	return p.extractScalar()
+}
 
-	// Parse all key-value pairs
-	for {
-		p.skipWhitespace()
+// extractTree parses the object or array at the current position. Nesting
+// is tracked on an explicit stack rather than by recursion: members collect
+// in pooled scratch until their container ends, then are copied into a map
+// or slice of exactly the right size.
+func (p *Parser) extractTree() (interface{}, error) {
+	st := getTreeStack()
+	defer putTreeStack(st)
 
-		// Check for end of object
-		if p.pos >= len(p.data) || p.data[p.pos] == '}' {
-			p.pos++ // Skip closing brace
-			break
+	first := true
+	if err := st.open(p); err != nil {
+		return nil, err
+	}
+	for {
+		top := &st.frames[len(st.frames)-1]
+		end := byte(']')
+		if top.object {
+			end = '}'
 		}
-
-		// Parse key
-		tokenType, keyBytes := p.parseString()
-		if tokenType != TokenString {
-			syntaxErr = getSyntaxError()
-			syntaxErr.Offset = int64(p.pos)
-			syntaxErr.Msg = "expected string key in object"
-			putObjectMap(result)
-			return nil, false
+		done, err := p.nextMember(end, first)
+		if err != nil {
+			return nil, err
 		}
+		first = false
 
-		key := GetString(keyBytes)
+		if done {
+			v := st.close()
+			if len(st.frames) == 0 {
+				return v, nil
+			}
+			st.values = append(st.values, v)
+			continue
+		}
 
-		// Skip colon
-		p.skipWhitespace()
-		if p.pos >= len(p.data) || p.data[p.pos] != ':' {
-			syntaxErr = getSyntaxError()
-			syntaxErr.Offset = int64(p.pos)
-			syntaxErr.Msg = "expected colon after object key"
-			putObjectMap(result)
-			return nil, false
+		if top.object {
+			key, err := p.objectKey()
+			if err != nil {
+				return nil, err
+			}
+			st.keys = append(st.keys, key)
+		}
+		if err := p.countElement(); err != nil {
+			return nil, err
 		}
-		p.pos++
 
-		// Parse value based on type
-		p.skipWhitespace()
 		switch p.ValueType() {
-		case TokenString:
-			if val, ok := p.ExtractString(); ok {
-				result[key] = val
-			}
-		case TokenNumber:
-			if val, ok := p.ExtractNumber(); ok {
-				result[key] = val
-			}
-		case TokenBool:
-			if val, ok := p.ExtractBool(); ok {
-				result[key] = val
-			}
-		case TokenNull:
-			p.matchLiteral("null")
-			result[key] = nil
-		case TokenObjectStart:
-			if obj, ok := GetObject(p.data[p.pos:], ""); ok {
-				result[key] = obj
-				// Skip the object we just parsed
-				depth := 1
-				p.pos++
-				for depth > 0 && p.pos < len(p.data) {
-					if p.data[p.pos] == '{' {
-						depth++
-					} else if p.data[p.pos] == '}' {
-						depth--
-					}
-					p.pos++
-				}
+		case TokenObjectStart, TokenArrayStart:
+			if err := st.open(p); err != nil {
+				return nil, err
 			}
-		case TokenArrayStart:
-			if arr, ok := GetArray(p.data[p.pos:], ""); ok {
-				result[key] = arr
-				// Skip the array we just parsed
-				depth := 1
-				p.pos++
-				for depth > 0 && p.pos < len(p.data) {
-					if p.data[p.pos] == '[' {
-						depth++
-					} else if p.data[p.pos] == ']' {
-						depth--
-					}
-					p.pos++
-				}
+			first = true
+		default:
+			v, err := p.extractScalar()
+			if err != nil {
+				return nil, err
 			}
+			st.values = append(st.values, v)
 		}
+	}
+}
 
-		// Skip comma or end of object
-		p.skipWhitespace()
-		if p.pos >= len(p.data) {
-			syntaxErr = getSyntaxError()
-			syntaxErr.Offset = int64(p.pos)
-			syntaxErr.Msg = "unexpected end of JSON input"
-			putObjectMap(result)
-			return nil, false
-		}
+// open pushes the object or array starting at the current position
+func (st *treeStack) open(p *Parser) error {
+	if max := p.opts.MaxDepth; max > 0 && len(st.frames) >= max {
+		return &SyntaxError{Offset: int64(p.pos), Msg: "exceeded max depth"}
+	}
+	st.frames = append(st.frames, treeFrame{
+		values: len(st.values),
+		keys:   len(st.keys),
+		object: p.data[p.pos] == '{',
+	})
+	p.pos++
+	return nil
+}
 
-		if p.data[p.pos] == '}' {
-			p.pos++ // Skip closing brace
-			break
+// close pops the innermost container and returns it built from its members
+func (st *treeStack) close() interface{} {
+	f := st.frames[len(st.frames)-1]
+	st.frames = st.frames[:len(st.frames)-1]
+	values := st.values[f.values:]
+
+	var v interface{}
+	if f.object {
+		m := make(map[string]interface{}, len(values))
+		for i, key := range st.keys[f.keys:] {
+			m[key] = values[i]
 		}
+		st.keys = st.keys[:f.keys]
+		v = m
+	} else {
+		a := make([]interface{}, len(values))
+		copy(a, values)
+		v = a
+	}
 
-		if p.data[p.pos] != ',' {
-			syntaxErr = getSyntaxError()
-			syntaxErr.Offset = int64(p.pos)
-			syntaxErr.Msg = "expected comma after object property"
-			putObjectMap(result)
-			return nil, false
-		}
+	// Clear the scratch so the pool doesn't keep the values alive
+	clear(values)
+	st.values = st.values[:f.values]
+	return v
+}
 
-		p.pos++ // Skip comma
+// extractScalar parses the string, number, bool or null at the current
+// position
+func (p *Parser) extractScalar() (interface{}, error) {
+	switch p.ValueType() {
+	case TokenString:
+		tokenType, raw := p.parseString()
+		if tokenType != TokenString {
+			return nil, p.tokenError("invalid string")
+		}
+		val, ok := p.valueString(raw)
+		if !ok {
+			return nil, &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in string"}
+		}
+		return val, nil
+	case TokenNumber:
+		start := p.pos
+		tokenType, value := p.parseNumber()
+		if tokenType != TokenNumber {
+			return nil, p.tokenError("invalid number")
+		}
+		if p.opts.UseNumber {
+			return Number(value), nil
+		}
+		// The token is well formed, so the only error is overflow
+		n, err := strconv.ParseFloat(GetString(value), 64)
+		if err != nil {
+			if p.tracksPrecision() {
+				p.recordLoss(start)
+			}
+			rangeErr := numberRangeError(string(value), reflect.TypeOf(n))
+			rangeErr.Offset = int64(p.pos)
+			return nil, rangeErr
+		}
+		if p.tracksPrecision() && !floatRoundTrips(GetString(value), n, 64) {
+			if err := p.precisionLoss(string(value), start, reflect.TypeOf(n)); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	case TokenBool:
+		return p.ExtractBoolErr()
+	case TokenNull:
+		if p.matchLiteral("null") {
+			return nil, nil
+		}
+		return nil, p.tokenError("invalid literal")
 	}
+	return nil, p.tokenError("invalid JSON value")
+}
 
-	// Create a new map to return - we can't return the pooled one directly
-	finalResult := make(map[string]interface{}, len(result))
-	for k, v := range result {
-		finalResult[k] = v
+// notContainer reports that the value at the current position is not the
+// object or array wanted
+func (p *Parser) notContainer(want reflect.Type) error {
+	var kind string
+	switch p.ValueType() {
+	case TokenObjectStart:
+		kind = "object"
+	case TokenArrayStart:
+		kind = "array"
+	case TokenString:
+		kind = "string"
+	case TokenNumber:
+		kind = "number"
+	case TokenBool:
+		kind = "bool"
+	case TokenNull:
+		kind = "null"
+	default:
+		return p.tokenError("invalid JSON value")
 	}
-
-	putObjectMap(result)
-	return finalResult, true
+	return &UnmarshalTypeError{Value: kind, Type: want, Offset: int64(p.pos)}
 }
 
 // skipWhitespace skips whitespace in the decoder's buffer
@@ -390,39 +1720,36 @@ func (d *Decoder) skipWhitespace() error {
 
 		// Need more data - use refillBuffer instead of direct read
 		if err := d.refillBuffer(); err != nil {
-			if err == io.EOF {
-				return err
-			}
 			return err
 		}
-
-		// If buffer is still empty after refill, we're done
-		if len(d.buf) == 0 {
-			return io.EOF
-		}
 	}
 }
 
 func (d *Decoder) UseNumber() *Decoder {
-	d.useNumber = true
+	d.opts.UseNumber = true
+	return d
+}
+
+// SetAtomicDecode sets Options.AtomicDecode for every subsequent Decode, so
+// a malformed value leaves the destination untouched
+func (d *Decoder) SetAtomicDecode(on bool) *Decoder {
+	d.opts.AtomicDecode = on
+	return d
+}
+
+// SetOptions replaces the Options used for every subsequent Decode
+func (d *Decoder) SetOptions(opts Options) *Decoder {
+	d.opts = opts
 	return d
 }
 
 func (d *Decoder) readValue() ([]byte, error) {
-	// Get a fresh token buffer from the pool
-	oldBuf := d.tokenBuf
-	d.tokenBuf = *getTokenBuf()
-	defer func() {
-		// Always return the buffer to the pool if we exit early
-		if &d.tokenBuf != &oldBuf {
-			putTokenBuf(&d.tokenBuf)
-		}
-	}()
+	// Reuse the decoder's token buffer; the result is always copied out
+	d.tokenBuf = d.tokenBuf[:0]
 
 	// Make sure we have data to read
 	if len(d.buf) == 0 || d.readPos >= len(d.buf) {
 		if err := d.refillBuffer(); err != nil {
-			d.tokenBuf = oldBuf
 			return nil, err
 		}
 	}
@@ -433,15 +1760,17 @@ func (d *Decoder) readValue() ([]byte, error) {
 	escaped := false
 	buffers := make([][]byte, 0, 4)
 
-	// Record first character for validation
-	firstChar := d.buf[d.readPos]
+	// An unset limit becomes MaxInt so the string loop needs one comparison
+	strLen, maxString := 0, d.opts.MaxStringBytes
+	if maxString <= 0 {
+		maxString = math.MaxInt
+	}
 
 	// Skip initial whitespace
 	for d.readPos < len(d.buf) && isWhitespace(d.buf[d.readPos]) {
 		d.readPos++
 		if d.readPos >= len(d.buf) {
 			if err := d.refillBuffer(); err != nil {
-				d.tokenBuf = oldBuf
 				return nil, err
 			}
 		}
@@ -449,39 +1778,24 @@ func (d *Decoder) readValue() ([]byte, error) {
 
 	// Ensure we have non-whitespace data
 	if d.readPos >= len(d.buf) {
-		d.tokenBuf = oldBuf
 		return nil, io.EOF
 	}
 
-	// Main parsing loop
+	// Record first character for validation
+	firstChar := d.buf[d.readPos]
+	if firstChar != '{' && firstChar != '[' && firstChar != '"' {
+		return d.readScalar()
+	}
+
+	// Main parsing loop. The value ends only at its closing quote or
+	// bracket, so running out of input anywhere before that is truncation.
 	for {
 		// Ensure we have data
 		if d.readPos >= len(d.buf) {
 			if err := d.refillBuffer(); err != nil {
-				if err == io.EOF && len(d.tokenBuf) > 0 {
-					// We have a partial value but no more data
-					if depth > 0 {
-						// Unclosed object or array
-						d.tokenBuf = oldBuf
-						return nil, fmt.Errorf("unexpected end of JSON input: unclosed structure")
-					}
-
-					// Return what we have if it makes sense as a complete value
-					tokenStr := string(d.tokenBuf)
-					if isCompleteLiteral(tokenStr) {
-						result := AppendBuffers(append(buffers, d.tokenBuf))
-						d.tokenBuf = oldBuf
-						return result, nil
-					} else if len(d.tokenBuf) >= 2 &&
-						((d.tokenBuf[0] == '{' && d.tokenBuf[len(d.tokenBuf)-1] == '}') ||
-							(d.tokenBuf[0] == '[' && d.tokenBuf[len(d.tokenBuf)-1] == ']')) {
-						result := AppendBuffers(append(buffers, d.tokenBuf))
-						d.tokenBuf = oldBuf
-						return result, nil
-					}
+				if err == io.EOF {
+					return nil, unexpectedEnd(d.inputOffset())
 				}
-
-				d.tokenBuf = oldBuf
 				return nil, err
 			}
 		}
@@ -501,19 +1815,29 @@ func (d *Decoder) readValue() ([]byte, error) {
 				inString = false
 
 				// If we're at the top level and this is a standalone string, we're done
-				if depth == 0 && firstChar == '"' {
+				if depth == 0 {
 					result := AppendBuffers(append(buffers, d.tokenBuf))
-					d.tokenBuf = oldBuf
 					return result, nil
 				}
+				continue
+			}
+
+			// Stop accumulating an oversized string before it is buffered
+			if strLen++; strLen > maxString {
+				return nil, &SyntaxError{
+					Offset: d.inputOffset() - 1,
+					Msg:    "string exceeds MaxStringBytes (" + strconv.Itoa(maxString) + " bytes)",
+				}
 			}
 			continue // Skip other processing for string content
 		}
 
-		// Handle structural elements and literals when not in a string
+		// Handle structural elements when not in a string; scalars inside
+		// the value are checked when it is decoded
 		switch c {
 		case '"':
 			inString = true
+			strLen = 0
 
 		case '{', '[':
 			depth++
@@ -526,40 +1850,11 @@ func (d *Decoder) readValue() ([]byte, error) {
 				// Ensure brackets match: { must close with }, [ with ]
 				isValid := (firstChar == '{' && c == '}') || (firstChar == '[' && c == ']')
 				if !isValid {
-					d.tokenBuf = oldBuf
-					return nil, fmt.Errorf("mismatched brackets in JSON")
+					return nil, &SyntaxError{Offset: d.inputOffset() - 1, Msg: "mismatched brackets in JSON"}
 				}
 
 				result := AppendBuffers(append(buffers, d.tokenBuf))
-				d.tokenBuf = oldBuf
 				return result, nil
-			} else if depth < 0 {
-				// This means we have an extra closing brace/bracket
-				d.tokenBuf = oldBuf
-				return nil, fmt.Errorf("unexpected closing character in JSON")
-			}
-
-		case ' ', '\t', '\r', '\n':
-			// Whitespace terminates top-level literals (but not nested ones)
-			if depth == 0 && firstChar != '{' && firstChar != '[' && firstChar != '"' {
-				// Check if we have a complete literal (excluding this whitespace)
-				tokenLen := len(d.tokenBuf)
-				valueBytes := d.tokenBuf[:tokenLen-1] // Exclude the whitespace
-
-				if isCompleteLiteral(string(valueBytes)) {
-					result := AppendBuffers(append(buffers, valueBytes))
-					d.tokenBuf = oldBuf
-					// Adjust read position back by one since we didn't consume this whitespace
-					d.readPos--
-					return result, nil
-				}
-			}
-
-		case ',', ':':
-			// These characters are only valid inside objects/arrays
-			if depth == 0 {
-				d.tokenBuf = oldBuf
-				return nil, fmt.Errorf("unexpected character in JSON literal: %c", c)
 			}
 		}
 
@@ -570,336 +1865,650 @@ func (d *Decoder) readValue() ([]byte, error) {
 			copy(tokenCopy, d.tokenBuf)
 			buffers = append(buffers, tokenCopy)
 
-			putTokenBuf(&d.tokenBuf)
-			d.tokenBuf = *getTokenBuf()
+			d.tokenBuf = d.tokenBuf[:0]
+		}
+	}
+}
+
+// readScalar reads the top-level number, true, false or null at the current
+// position. The token ends where its grammar says it does, before the first
+// byte that cannot continue it, so no delimiter has to follow and the end of
+// a read never ends it early; only the end of the stream can cut it short.
+func (d *Decoder) readScalar() ([]byte, error) {
+	var word string
+	switch c := d.buf[d.readPos]; c {
+	case 't':
+		word = "true"
+	case 'f':
+		word = "false"
+	case 'n':
+		word = "null"
+	default:
+		if c != '-' && !isDigit(c) {
+			return nil, &SyntaxError{
+				Offset: d.inputOffset(),
+				Msg:    "invalid character " + strconv.Quote(string(c)) + " looking for beginning of value",
+			}
+		}
+	}
+
+	state := numberStart
+	for {
+		if d.readPos >= len(d.buf) {
+			if err := d.refillBuffer(); err != nil {
+				if err != io.EOF {
+					return nil, err
+				}
+				if word == "" && state.complete() {
+					break
+				}
+				return nil, unexpectedEnd(d.inputOffset())
+			}
+		}
+
+		c := d.buf[d.readPos]
+		if word != "" {
+			if c != word[len(d.tokenBuf)] {
+				return nil, &SyntaxError{Offset: d.inputOffset(), Msg: "invalid JSON literal"}
+			}
+			d.tokenBuf = append(d.tokenBuf, c)
+			d.readPos++
+			if len(d.tokenBuf) == len(word) {
+				break
+			}
+			continue
+		}
+
+		next := state.next(c)
+		if next == numberEnd {
+			if !state.complete() {
+				return nil, &SyntaxError{
+					Offset: d.inputOffset(),
+					Msg:    "invalid character " + strconv.Quote(string(c)) + " in numeric literal",
+				}
+			}
+			break
+		}
+		state = next
+		d.tokenBuf = append(d.tokenBuf, c)
+		d.readPos++
+	}
+	return AppendBuffers([][]byte{d.tokenBuf}), nil
+}
+
+// next returns the state after c in a number, or numberEnd if c can't
+// continue it
+func (s numberState) next(c byte) numberState {
+	digit := isDigit(c)
+	switch s {
+	case numberStart:
+		if c == '-' {
+			return numberSign
+		}
+		fallthrough
+	case numberSign:
+		if c == '0' {
+			return numberZero
+		}
+		if digit {
+			return numberInt
+		}
+	case numberInt:
+		if digit {
+			return numberInt
+		}
+		fallthrough
+	case numberZero:
+		if c == '.' {
+			return numberDot
+		}
+		if c == 'e' || c == 'E' {
+			return numberExp
+		}
+	case numberDot, numberFrac:
+		if digit {
+			return numberFrac
+		}
+		if s == numberFrac && (c == 'e' || c == 'E') {
+			return numberExp
+		}
+	case numberExp:
+		if c == '+' || c == '-' {
+			return numberExpSign
+		}
+		fallthrough
+	case numberExpSign, numberExpDigits:
+		if digit {
+			return numberExpDigits
 		}
 	}
+	return numberEnd
+}
+
+// complete reports whether a number may end in state s
+func (s numberState) complete() bool {
+	return s == numberZero || s == numberInt || s == numberFrac || s == numberExpDigits
 }
 
 // Helper function to refill the buffer
 func (d *Decoder) refillBuffer() error {
-	// Use a smaller fixed size instead of full capacity
-	fmt.Printf("refillBuffer: attempting to read with buf cap=%d\n", cap(d.buf))
-	temp := make([]byte, 512) // Or even smaller like 128
-	n, err := d.r.Read(temp)
-	fmt.Printf("refillBuffer: read %d bytes, err=%v\n", n, err)
-	if n > 0 {
-		fmt.Printf("refillBuffer: first byte=%d (%c)\n", temp[0], temp[0])
+	// Drop the bytes that have already been consumed so readPos can be
+	// reset without re-reading them
+	d.offset += int64(d.readPos)
+	n := copy(d.buf, d.buf[d.readPos:])
+	d.buf = d.buf[:n]
+	d.readPos = 0
+
+	if len(d.buf) == cap(d.buf) {
+		d.buf = append(d.buf, 0)[:len(d.buf)]
+	}
+
+	read, err := d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+	d.buf = d.buf[:len(d.buf)+read]
+
+	// EOF with data is not an error for us; the next read reports it
+	if read > 0 {
+		return nil
+	}
+	if err == nil {
+		return nil
 	}
-	// Handle EOF with data case explicitly
-	if err == io.EOF && n > 0 {
-		err = nil // EOF with data is not an error for us
+	return err
+}
+
+// peekByte returns the next non-whitespace byte without consuming it
+func (d *Decoder) peekByte() (byte, error) {
+	if err := d.skipWhitespace(); err != nil {
+		return 0, err
+	}
+	return d.buf[d.readPos], nil
+}
+
+// DecodeToChannel decodes a stream of JSON values from r and sends each one
+// to ch. The stream may be a single top-level array, whose elements are sent
+// one at a time, or a sequence of whitespace or newline separated values.
+// ch is closed when DecodeToChannel returns.
+//
+// Decoding stops with ctx.Err() as soon as ctx is cancelled, including while
+// blocked on a send. Errors in the framing of the stream always stop decoding;
+// an element that cannot be decoded into T stops decoding unless SkipMalformed
+// is given.
+func DecodeToChannel[T any](ctx context.Context, r io.Reader, ch chan<- T, opts ...DecodeOption) error {
+	defer close(ch)
+
+	var cfg streamConfig
+	for _, opt := range opts {
+		opt(&cfg)
 	}
 
-	if n > 0 {
-		// Append to existing buffer if needed
-		d.buf = append(d.buf, temp[:n]...)
-		// Or replace if empty: d.buf = temp[:n]
+	d := NewDecoder(r)
+	defer d.Close()
+	if cfg.opts != nil {
+		// Keep the compat mode NewDecoder picked up from SetStdlibCompat
+		compat := d.opts.StdlibCompat
+		d.opts = *cfg.opts
+		d.opts.StdlibCompat = d.opts.StdlibCompat || compat
 	}
 
-	if err != nil && err != io.EOF {
+	c, err := d.peekByte()
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
 		return err
 	}
+	inArray := c == '['
+	if inArray {
+		d.readPos++
+	}
 
-	d.readPos = 0
+	for index := 0; ; index++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if inArray {
+			c, err := d.peekByte()
+			if err != nil {
+				if err == io.EOF {
+					return unexpectedEnd(d.inputOffset())
+				}
+				return err
+			}
+			if c == ']' {
+				d.readPos++
+				break
+			}
+			if index > 0 {
+				if c != ',' {
+					return &SyntaxError{Offset: d.inputOffset(), Msg: "expected ',' or ']' after array element"}
+				}
+				d.readPos++
+			}
+		}
+
+		// Skip whitespace first so start is the offset of the value itself
+		err := d.skipWhitespace()
+		start := d.inputOffset()
+		var value []byte
+		if err == nil {
+			value, err = d.readValue()
+		}
+		if err != nil {
+			if err == io.EOF {
+				if !inArray {
+					return nil
+				}
+				return unexpectedEnd(d.inputOffset())
+			}
+			return err
+		}
+
+		var v T
+		if err := d.decodeValue(value, start, &v); err != nil {
+			if !cfg.skipMalformed {
+				return fmt.Errorf("json: element %d: %w", index, err)
+			}
+			if cfg.onSkip != nil {
+				cfg.onSkip(index, err)
+			}
+			continue
+		}
+
+		select {
+		case ch <- v:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Only whitespace may follow a top-level array
+	if c, err := d.peekByte(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return &SyntaxError{Offset: d.inputOffset(), Msg: "invalid character " + strconv.Quote(string(c)) + " after top-level array"}
+	}
 	return nil
 }
 
+// WithDecodeOptions sets the Options used to decode each streamed value.
+// StdlibCompat stays on if SetStdlibCompat turned it on.
+func WithDecodeOptions(opts Options) DecodeOption {
+	return func(c *streamConfig) {
+		c.opts = &opts
+	}
+}
+
+// SkipMalformed makes DecodeToChannel skip elements that fail to decode
+// instead of stopping. onSkip, if non-nil, is called with the element's
+// index in the stream and the decode error.
+func SkipMalformed(onSkip func(index int, err error)) DecodeOption {
+	return func(c *streamConfig) {
+		c.skipMalformed = true
+		c.onSkip = onSkip
+	}
+}
+
+// More reports whether there is another element in the current array or
+// object being streamed, or another value at the top level of the stream
+func (d *Decoder) More() bool {
+	if d.framing == LengthPrefixed32 {
+		return d.fill(1) == nil
+	}
+	c, err := d.peekByte()
+	return err == nil && c != ']' && c != '}'
+}
+
 // ### Extraction ###
 
-// Extract retrieves a value from JSON based on a path
+// Extract retrieves a value from JSON based on a path. It returns false
+// both when the path is absent and when the document is malformed; use
+// ExtractErr to tell the two apart.
 func Extract(data []byte, path ...string) ([]byte, bool) {
-	if len(path) == 0 {
-		return data, true
-	}
+	value, err := ExtractErr(data, path...)
+	return value, err == nil
+}
 
-	p := NewParser(data)
+// ExtractErr retrieves a value from JSON based on a path. It returns
+// ErrPathNotFound when the document has no value at path and a
+// *SyntaxError when the document is malformed; for truncated documents the
+// error also matches io.ErrUnexpectedEOF. With no path the whole document
+// must be a single valid value, exactly as Valid and Unmarshal require, and
+// that value is returned without the whitespace around it. With a path the
+// input up to the end of each object on the path is checked. Path segments
+// are matched against keys as decoded, so a key the document writes with
+// escapes, such as "\u0000" or "\"", is found by its plain text.
+//
+// When an object repeats a key the last occurrence wins, as it does for
+// Unmarshal and GetObject, so all three agree on what a document holds.
+// ExtractFirstErr stops at the first occurrence instead.
+func ExtractErr(data []byte, path ...string) ([]byte, error) {
+	return extract(data, path, false)
+}
+
+// ExtractFirst is Extract taking the first occurrence of a repeated key.
+// See ExtractFirstErr.
+func ExtractFirst(data []byte, path ...string) ([]byte, bool) {
+	value, err := ExtractFirstErr(data, path...)
+	return value, err == nil
+}
+
+// ExtractFirstErr is ExtractErr taking the first occurrence of a repeated
+// key, which saves scanning the rest of each object on the path. Only use
+// it on documents without duplicate keys, or where disagreeing with
+// Unmarshal about them is acceptable: input checked with ExtractFirstErr
+// and decoded with Unmarshal can be read two different ways.
+func ExtractFirstErr(data []byte, path ...string) ([]byte, error) {
+	return extract(data, path, true)
+}
+
+// DecodeEmbedded decodes into v the JSON document held in the string at
+// path in data, for payloads that were encoded twice. Finding the string
+// fails as ExtractErr does, and a value there that is not a string is an
+// *UnmarshalTypeError. Errors in the embedded document are an
+// *EmbeddedError giving both the path and the offset in the document.
+func DecodeEmbedded(data []byte, path []string, v interface{}) error {
+	if rv := reflect.ValueOf(v); rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+	value, err := ExtractErr(data, path...)
+	if err != nil {
+		return err
+	}
 
-	// Create a deferred error handler
-	var syntaxErr *SyntaxError = nil
-	defer func() {
-		if syntaxErr != nil {
-			putSyntaxError(syntaxErr)
+	// value is a slice of data, so its offset there follows from the
+	// capacities, and errors about it give offsets in data
+	base := int64(cap(data) - cap(value))
+	p := NewParser(value)
+	if p.ValueType() != TokenString {
+		err := p.notContainer(reflect.TypeOf(v).Elem())
+		if ute, ok := err.(*UnmarshalTypeError); ok {
+			ute.Field, ute.Offset = strings.Join(path, "."), base+ute.Offset
 		}
-	}()
+		return err
+	}
+	_, raw := p.parseString()
+	doc, ok := p.unescape(raw)
+	if !ok {
+		return &SyntaxError{Offset: base, Msg: "invalid escape sequence in string"}
+	}
+	if err := Unmarshal(doc, v); err != nil {
+		return embeddedError(strings.Join(path, "."), err)
+	}
+	return nil
+}
 
-	// Skip initial whitespace
-	p.skipWhitespace()
+// extract implements ExtractErr and, when first is set, ExtractFirstErr
+func extract(data []byte, path []string, first bool) ([]byte, error) {
+	p := NewParser(data)
+	if len(path) == 0 {
+		start, end, err := p.document()
+		if err != nil {
+			return nil, err
+		}
+		return data[start:end], nil
+	}
 
-	// Handle the root path segment
 	for _, segment := range path {
 		p.skipWhitespace()
 
 		if p.pos >= len(p.data) {
-			syntaxErr = getSyntaxError()
-			syntaxErr.Offset = int64(p.pos)
-			syntaxErr.Msg = "unexpected end of JSON input"
-			return nil, false
+			return nil, unexpectedEnd(int64(p.pos))
 		}
 
 		// Must be an object to extract by key
 		if p.data[p.pos] != '{' {
 			// Not a syntax error, just wrong path
-			return nil, false
+			return nil, ErrPathNotFound
 		}
 
 		p.pos++ // Skip '{'
 
-		found := false
-		for {
-			p.skipWhitespace()
-
-			if p.pos >= len(p.data) {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "unexpected end of JSON input"
-				return nil, false
+		// Start and end of the value of the chosen occurrence of segment
+		start, end := -1, -1
+		for firstMember := true; ; firstMember = false {
+			done, err := p.nextMember('}', firstMember)
+			if err != nil {
+				return nil, err
 			}
-
-			// Check for end of object
-			if p.data[p.pos] == '}' {
-				return nil, false // Key not found - not a syntax error
+			if done {
+				break
 			}
 
 			// Parse key
 			tokenType, keyBytes := p.parseString()
 			if tokenType != TokenString {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "expected string key in object"
-				return nil, false
+				return nil, p.tokenError("expected string key in object")
 			}
 
-			// Check if this is the key we want
-			key := GetString(keyBytes)
+			// Check if this is the key we want. Keys are compared unescaped,
+			// so a segment matches however the document spells the key.
+			unescaped, ok := p.unescape(keyBytes)
+			if !ok {
+				return nil, &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in object key"}
+			}
+			match := GetString(unescaped) == segment
 
 			// Skip colon
 			p.skipWhitespace()
 			if p.pos >= len(p.data) || p.data[p.pos] != ':' {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "expected colon after object key"
-				return nil, false
+				return nil, p.tokenError("expected colon after object key")
 			}
 			p.pos++ // Skip colon
 
-			if key == segment {
-				// Found our key
-				found = true
-				break
-			}
-
-			// Skip value
-			if !skipValue(p) {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "invalid JSON value"
-				return nil, false
-			}
-
-			// Skip comma or end of object
 			p.skipWhitespace()
-			if p.pos >= len(p.data) {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "unexpected end of JSON input"
-				return nil, false
-			}
-
-			if p.data[p.pos] == '}' {
-				return nil, false // Key not found - not a syntax error
+			valueStart := p.pos
+			if !skipValue(p) {
+				return nil, p.tokenError("invalid JSON value")
 			}
-
-			if p.data[p.pos] != ',' {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "expected comma after object property"
-				return nil, false
+			if match {
+				start, end = valueStart, p.pos
+				if first {
+					break
+				}
 			}
-
-			p.pos++ // Skip comma
 		}
 
-		if !found {
-			return nil, false // Not a syntax error
+		if start < 0 {
+			return nil, ErrPathNotFound // Not a syntax error
 		}
 
-		// If this is the last segment, extract the value
+		// If this is the last segment, return the value
 		if len(path) == 1 {
-			p.skipWhitespace()
-			start := p.pos
-			if !skipValue(p) {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "invalid JSON value"
-				return nil, false
-			}
-			return p.data[start:p.pos], true
+			return p.data[start:end], nil
 		}
 
-		// Otherwise, continue with the next path segment
+		// Otherwise, continue with the next path segment inside the value
+		p.pos = start
 		path = path[1:]
 	}
 
-	return nil, false
+	return nil, ErrPathNotFound
 }
 
-// GetArray extracts an array from JSON at the specified path
-func GetArray(data []byte, path ...string) ([]interface{}, bool) {
-	value, ok := Extract(data, path...)
-	if !ok {
+// ExtractMatch returns the members of the object at path whose unescaped
+// keys match re, in document order, without decoding the other members.
+// It returns false when there is no object at path or the document is
+// malformed, and an empty result when no key matches.
+func ExtractMatch(data []byte, re *regexp.Regexp, path ...string) ([]KV, bool) {
+	value, err := ExtractErr(data, path...)
+	if err != nil || len(value) == 0 || value[0] != '{' {
 		return nil, false
 	}
 
-	p := NewParser(value)
+	p := Parser{data: value, opts: &defaultOptions}
+	p.pos++ // Skip '{'
+
+	// Values are sliced from value while walking and copied into a single
+	// allocation at the end
+	var kvs []KV
+	size := 0
+	for first := true; ; first = false {
+		done, err := p.nextMember('}', first)
+		if err != nil {
+			return nil, false
+		}
+		if done {
+			break
+		}
 
-	// Create a deferred error handler
-	var syntaxErr *SyntaxError = nil
-	defer func() {
-		if syntaxErr != nil {
-			putSyntaxError(syntaxErr)
+		tokenType, keyBytes := p.parseString()
+		if tokenType != TokenString {
+			return nil, false
+		}
+		key, ok := p.unescape(keyBytes)
+		if !ok {
+			return nil, false
+		}
+		matched := re.Match(key)
+		var name string
+		if matched {
+			name = string(key)
 		}
-	}()
 
-	// Check if this is actually an array
-	if p.ValueType() != TokenArrayStart {
-		return nil, false
+		p.skipWhitespace()
+		if p.pos >= len(p.data) || p.data[p.pos] != ':' {
+			return nil, false
+		}
+		p.pos++
+		p.skipWhitespace()
+		start := p.pos
+		if !skipValue(&p) {
+			return nil, false
+		}
+		if matched {
+			kvs = append(kvs, KV{Key: name, Value: p.data[start:p.pos]})
+			size += p.pos - start
+		}
 	}
 
-	// Get slice from pool
-	result := getArraySlice()
-
-	// Skip opening bracket
-	p.pos++
+	values := make([]byte, 0, size)
+	for i := range kvs {
+		n := len(values)
+		values = append(values, kvs[i].Value...)
+		kvs[i].Value = values[n:len(values):len(values)]
+	}
+	if kvs == nil {
+		kvs = []KV{}
+	}
+	return kvs, true
+}
 
-	// Parse array elements
-	for {
-		p.skipWhitespace()
+// ShardArray splits the array at path into at most n arrays of contiguous
+// elements, each a valid JSON document of its own, so that workers can
+// decode them in parallel. Shards are balanced by the bytes their
+// elements take up rather than by element count and are never empty, so
+// an array of fewer than n elements gives one shard per element and an
+// empty array none. Elements are copied verbatim into a single allocation
+// shared by the shards. Errors are those of ExtractErr, or say the value
+// at path is not an array.
+func ShardArray(data []byte, path []string, n int) ([][]byte, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("json: ShardArray shard count %d is not positive", n)
+	}
+	value, err := ExtractErr(data, path...)
+	if err != nil {
+		return nil, err
+	}
+	if value[0] != '[' {
+		return nil, fmt.Errorf("json: ShardArray value at path is not an array")
+	}
 
-		// Check for end of array
-		if p.pos >= len(p.data) || p.data[p.pos] == ']' {
-			p.pos++ // Skip closing bracket
+	// Element i spans value[bounds[2*i]:bounds[2*i+1]]
+	p := Parser{data: value, opts: &defaultOptions}
+	p.pos++ // Skip '['
+	var bounds []int
+	size := 0
+	for first := true; ; first = false {
+		done, err := p.nextMember(']', first)
+		if err != nil {
+			return nil, err
+		}
+		if done {
 			break
 		}
-
-		// Expect comma between elements (but not before first element)
-		if len(result) > 0 {
-			if p.data[p.pos] != ',' {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "expected comma after array element"
-				putArraySlice(result)
-				return nil, false
+		p.skipWhitespace()
+		start := p.pos
+		if !skipValue(&p) {
+			return nil, p.tokenError("invalid JSON value")
+		}
+		bounds = append(bounds, start, p.pos)
+		size += p.pos - start
+	}
+	elems := len(bounds) / 2
+	if elems == 0 {
+		return nil, nil
+	}
+	n = min(n, elems)
+
+	// Cut where the running size comes closest to each multiple of size/n,
+	// leaving at least one element per shard
+	cuts := make([]int, n+1)
+	cuts[n] = elems
+	at, sum := 0, 0
+	for k := 1; k < n; k++ {
+		target := size * k / n
+		for last := elems - (n - k); at < last; at++ {
+			next := bounds[2*at+1] - bounds[2*at]
+			if sum+next > target && at > cuts[k-1] && sum+next-target >= target-sum {
+				break
 			}
-			p.pos++ // Skip comma
-			p.skipWhitespace()
+			sum += next
 		}
+		cuts[k] = at
+	}
 
-		// Parse value based on type
-		switch p.ValueType() {
-		case TokenString:
-			if val, ok := p.ExtractString(); ok {
-				result = append(result, val)
-			} else {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "invalid string in array"
-				putArraySlice(result)
-				return nil, false
-			}
-		case TokenNumber:
-			if val, ok := p.ExtractNumber(); ok {
-				result = append(result, val)
-			} else {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "invalid number in array"
-				putArraySlice(result)
-				return nil, false
-			}
-		case TokenBool:
-			if val, ok := p.ExtractBool(); ok {
-				result = append(result, val)
-			} else {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "invalid boolean in array"
-				putArraySlice(result)
-				return nil, false
-			}
-		case TokenNull:
-			if p.matchLiteral("null") {
-				result = append(result, nil)
-			} else {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "invalid null in array"
-				putArraySlice(result)
-				return nil, false
-			}
-		case TokenObjectStart:
-			if obj, ok := GetObject(p.data[p.pos:], ""); ok {
-				result = append(result, obj)
-				// Skip the object we just parsed
-				depth := 1
-				p.pos++
-				for depth > 0 && p.pos < len(p.data) {
-					if p.data[p.pos] == '{' {
-						depth++
-					} else if p.data[p.pos] == '}' {
-						depth--
-					}
-					p.pos++
-				}
-			} else {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "invalid object in array"
-				putArraySlice(result)
-				return nil, false
-			}
-		case TokenArrayStart:
-			if arr, ok := GetArray(p.data[p.pos:], ""); ok {
-				result = append(result, arr)
-				// Skip the array we just parsed
-				depth := 1
-				p.pos++
-				for depth > 0 && p.pos < len(p.data) {
-					if p.data[p.pos] == '[' {
-						depth++
-					} else if p.data[p.pos] == ']' {
-						depth--
-					}
-					p.pos++
-				}
-			} else {
-				syntaxErr = getSyntaxError()
-				syntaxErr.Offset = int64(p.pos)
-				syntaxErr.Msg = "invalid array in array"
-				putArraySlice(result)
-				return nil, false
+	// Each element is followed by a comma or the closing bracket, and each
+	// shard adds its opening one
+	buf := make([]byte, 0, size+elems+n)
+	shards := make([][]byte, n)
+	for k := range shards {
+		start := len(buf)
+		buf = append(buf, '[')
+		for i := cuts[k]; i < cuts[k+1]; i++ {
+			if i > cuts[k] {
+				buf = append(buf, ',')
 			}
-		default:
-			syntaxErr = getSyntaxError()
-			syntaxErr.Offset = int64(p.pos)
-			syntaxErr.Msg = "invalid JSON value in array"
-			putArraySlice(result)
-			return nil, false
+			buf = append(buf, value[bounds[2*i]:bounds[2*i+1]]...)
 		}
+		buf = append(buf, ']')
+		shards[k] = buf[start:len(buf):len(buf)]
 	}
+	return shards, nil
+}
+
+// GetArray extracts an array from JSON at the specified path
+func GetArray(data []byte, path ...string) ([]interface{}, bool) {
+	arr, err := GetArrayErr(data, path...)
+	return arr, err == nil
+}
 
-	// Create a new slice to return - we can't return the pooled one directly
-	finalResult := make([]interface{}, len(result))
-	copy(finalResult, result)
+// GetArrayErr extracts an array from JSON at the specified path, reporting
+// errors the same way as ExtractErr. A value at path that isn't an array is
+// reported as an *UnmarshalTypeError.
+func GetArrayErr(data []byte, path ...string) ([]interface{}, error) {
+	value, err := ExtractErr(data, path...)
+	if err != nil {
+		return nil, err
+	}
 
-	// Return the slice to the pool
-	putArraySlice(result)
+	p := NewParser(value)
 
-	return finalResult, true
+	// Check if this is actually an array
+	if p.ValueType() != TokenArrayStart {
+		return nil, p.notContainer(reflect.TypeOf([]interface{}(nil)))
+	}
+	return p.extractArray()
 }
 
-func structFields(t reflect.Type) []Field {
-	return getCachedFields(t)
+// extractArray parses the array at the current position
+func (p *Parser) extractArray() ([]interface{}, error) {
+	v, err := p.extractTree()
+	if err != nil {
+		return nil, err
+	}
+	return v.([]interface{}), nil
 }
 
 // Contains reports whether the tag options contain the specified option
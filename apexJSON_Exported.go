@@ -1,10 +0,0 @@
-package apexJSON
-
-import (
-	"reflect"
-)
-
-// Exported only for testing
-func MarshalValue(v reflect.Value, buf *Buffer) error {
-	return marshalValue(v, buf)
-}
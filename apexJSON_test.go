@@ -2,11 +2,29 @@ package apexJSON_test
 
 import (
 	"apexJSON"
+	"apexJSON/apexjsontest"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/bytedance/sonic"
@@ -16,7 +34,10 @@ import (
 	"github.com/tidwall/gjson"
 )
 
-// Test structures
+// Test structures. SimpleStruct, Address, User and the types User holds
+// have generated codecs, see TestGeneratedConformance.
+//
+//go:generate go run ./cmd/apexjsongen -type SimpleStruct,Address,User,Profile,Post,Comment,Settings -output fixtures_gen_test.go apexJSON_test.go
 type SimpleStruct struct {
 	Name string `json:"name"`
 	Age  int    `json:"age"`
@@ -255,6 +276,132 @@ func BenchmarkGjsonExtractNestedValue(b *testing.B) {
 	}
 }
 
+// sensorJSON is an object of 5000 members, one in ten of them with a key
+// matching sensorPattern
+var sensorJSON = func() []byte {
+	readings := make(map[string]interface{}, 5000)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("metric_%04d", i)
+		if i%10 == 0 {
+			key = fmt.Sprintf("sensor_%04d", i)
+		}
+		readings[key] = map[string]interface{}{"value": float64(i) / 3, "unit": "C", "ok": true}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"readings": readings})
+	return data
+}()
+
+var sensorPattern = regexp.MustCompile(`^sensor_`)
+
+func BenchmarkApexExtractMatch(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = apexJSON.ExtractMatch(sensorJSON, sensorPattern, "readings")
+	}
+}
+
+func BenchmarkApexGetObjectFilter(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		obj, _ := apexJSON.GetObject(sensorJSON, "readings")
+		var kvs []apexJSON.KV
+		for k, v := range obj {
+			if sensorPattern.MatchString(k) {
+				raw, _ := apexJSON.Marshal(v)
+				kvs = append(kvs, apexJSON.KV{Key: k, Value: raw})
+			}
+		}
+	}
+}
+
+// telemetry map benchmarks
+var telemetryMap = map[string]interface{}{
+	"host":       "edge-01",
+	"pid":        4242,
+	"bytes_in":   int64(987654321),
+	"bytes_out":  uint64(123456789),
+	"shard":      int32(7),
+	"cpu":        float32(0.25),
+	"load":       1.75,
+	"healthy":    true,
+	"error":      nil,
+	"reported":   time.Date(2024, 3, 18, 12, 0, 0, 0, time.UTC),
+	"tags":       []string{"prod", "eu-west", "canary"},
+	"ports":      []int{80, 443, 8080},
+	"history":    []interface{}{1.5, "spike", false},
+	"dimensions": map[string]interface{}{"region": "eu", "rack": 12},
+}
+
+func BenchmarkStdMarshalTelemetryMap(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, _ = json.Marshal(telemetryMap)
+	}
+}
+
+func BenchmarkApexMarshalTelemetryMap(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, _ = apexJSON.Marshal(telemetryMap)
+	}
+}
+
+// treeJSON is a document of about 5MB, three levels deep with 100k leaves,
+// for decoding into interface{}
+var treeJSON = func() []byte {
+	groups := make([]interface{}, 100)
+	for g := range groups {
+		items := make([]interface{}, 100)
+		for i := range items {
+			items[i] = map[string]interface{}{
+				"id": g*100 + i, "name": fmt.Sprintf("item-%d-%d", g, i), "score": float64(i) / 7,
+				"active": i%2 == 0, "tags": []interface{}{"a", "b", nil},
+				"note": "lorem ipsum dolor sit amet, consectetur adipiscing elit sed do eiusmod",
+			}
+		}
+		groups[g] = map[string]interface{}{"group": g, "items": items}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"groups": groups})
+	return data
+}()
+
+func BenchmarkStdUnmarshalInterfaceTree(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var v interface{}
+		_ = json.Unmarshal(treeJSON, &v)
+	}
+}
+
+func BenchmarkApexUnmarshalInterfaceTree(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var v interface{}
+		_ = apexJSON.Unmarshal(treeJSON, &v)
+	}
+}
+
+func TestMarshalTelemetryMap(t *testing.T) {
+	data, err := apexJSON.Marshal(telemetryMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := json.Marshal(telemetryMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got, want interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("apexJSON produced invalid JSON %s: %v", data, err)
+	}
+	if err := json.Unmarshal(expected, &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Marshal(telemetryMap) = %s, want %s", data, expected)
+	}
+}
+
 // real world benchmarks
 type User struct {
 	ID        int       `json:"id"`
@@ -443,7 +590,1546 @@ func BenchmarkGoccyUnmarshalComplexUser(b *testing.B) {
 	}
 }
 
-// profiling test functions
+// updateBaseline rewrites testdata/benchmark_baseline.json from this run
+// instead of checking against it
+var updateBaseline = flag.Bool("update-baseline", false, "rewrite the benchmark baseline")
+
+// benchBaseline is one entry of testdata/benchmark_baseline.json
+type benchBaseline struct {
+	NsPerOp     int64 `json:"ns_per_op"`
+	AllocsPerOp int64 `json:"allocs_per_op"`
+}
+
+// TestBenchmarkRegression runs the core apexJSON benchmarks a fixed number
+// of times and compares them with the checked-in baseline. Allocations are
+// stable enough to fail on; time varies with the machine, so only a large
+// slowdown is reported, and then only in the log. The race detector and
+// coverage instrumentation change both, so it is skipped under them.
+func TestBenchmarkRegression(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs benchmarks")
+	}
+	if raceEnabled || testing.CoverMode() != "" {
+		t.Skip("benchmarks are not comparable with the race detector or coverage on")
+	}
+	const path = "testdata/benchmark_baseline.json"
+	benchmarks := []struct {
+		name string
+		fn   func(b *testing.B)
+	}{
+		{"MarshalSimple", BenchmarkApexMarshalSimple},
+		{"MarshalComplexUser", BenchmarkApexMarshalComplexUser},
+		{"UnmarshalComplexUser", BenchmarkApexUnmarshalComplexUser},
+		{"ExtractNestedValue", BenchmarkApexExtractNestedValue},
+	}
+
+	benchtime := flag.Lookup("test.benchtime")
+	old := benchtime.Value.String()
+	if err := benchtime.Value.Set("2000x"); err != nil {
+		t.Fatal(err)
+	}
+	defer benchtime.Value.Set(old)
+
+	got := make(map[string]benchBaseline, len(benchmarks))
+	for _, bm := range benchmarks {
+		r := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			bm.fn(b)
+		})
+		got[bm.name] = benchBaseline{NsPerOp: r.NsPerOp(), AllocsPerOp: r.AllocsPerOp()}
+	}
+
+	if *updateBaseline {
+		data, err := json.MarshalIndent(got, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want map[string]benchBaseline
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+	for _, bm := range benchmarks {
+		g, w := got[bm.name], want[bm.name]
+		// A tenth over the baseline, rounded down, so one more allocation
+		// in a benchmark with fewer than ten still fails
+		if g.AllocsPerOp > w.AllocsPerOp+w.AllocsPerOp/10 {
+			t.Errorf("%s: %d allocs/op, baseline %d; run with -update-baseline if intended",
+				bm.name, g.AllocsPerOp, w.AllocsPerOp)
+		}
+		if g.NsPerOp > 3*w.NsPerOp {
+			t.Logf("%s: %d ns/op, over three times the baseline %d", bm.name, g.NsPerOp, w.NsPerOp)
+		}
+	}
+}
+
+// streamEvent is the value type of the stream tests
+type streamEvent struct {
+	ID   int    `json:"id"`
+	Kind string `json:"kind"`
+}
+
+func collectStream(ch <-chan streamEvent) []streamEvent {
+	var got []streamEvent
+	for ev := range ch {
+		got = append(got, ev)
+	}
+	return got
+}
+
+func TestDecodeToChannel(t *testing.T) {
+	want := []streamEvent{{1, "a"}, {2, "b"}, {3, "c"}}
+	inputs := map[string]string{
+		"array":  `[{"id":1,"kind":"a"}, {"id":2,"kind":"b"},{"id":3,"kind":"c"}]`,
+		"ndjson": "{\"id\":1,\"kind\":\"a\"}\n{\"id\":2,\"kind\":\"b\"}\n{\"id\":3,\"kind\":\"c\"}\n",
+	}
+	for name, input := range inputs {
+		ch := make(chan streamEvent)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- apexJSON.DecodeToChannel(context.Background(), strings.NewReader(input), ch)
+		}()
+		got := collectStream(ch)
+		if err := <-errc; err != nil {
+			t.Fatalf("%s: DecodeToChannel error: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+
+	ch := make(chan int, 8)
+	if err := apexJSON.DecodeToChannel(context.Background(), strings.NewReader("[1, 2,3 ]"), ch); err != nil {
+		t.Fatal(err)
+	}
+	var nums []int
+	for n := range ch {
+		nums = append(nums, n)
+	}
+	if !reflect.DeepEqual(nums, []int{1, 2, 3}) {
+		t.Errorf("got %v, want [1 2 3]", nums)
+	}
+}
+
+func TestDecodeToChannelKeepsCompat(t *testing.T) {
+	apexJSON.SetStdlibCompat(true)
+	defer apexJSON.SetStdlibCompat(false)
+
+	// Compat matches keys case-insensitively, as encoding/json does
+	ch := make(chan streamEvent, 1)
+	input := `{"ID":1,"Kind":"a"}`
+	if err := apexJSON.DecodeToChannel(context.Background(), strings.NewReader(input), ch, apexJSON.WithDecodeOptions(apexJSON.Options{UseNumber: true})); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ch; got != (streamEvent{1, "a"}) {
+		t.Errorf("got %+v, want {1 a}", got)
+	}
+}
+
+func TestDecodeToChannelMalformed(t *testing.T) {
+	input := `[{"id":1,"kind":"a"},{"id":"two","kind":"b"},{"id":3,"kind":"c"}]`
+
+	// Abort by default
+	ch := make(chan streamEvent, 8)
+	err := apexJSON.DecodeToChannel(context.Background(), strings.NewReader(input), ch)
+	if err == nil {
+		t.Fatal("expected error for malformed element")
+	}
+	if got := collectStream(ch); len(got) != 1 || got[0].ID != 1 {
+		t.Errorf("abort: got %+v, want only the first element", got)
+	}
+
+	// Skip and report
+	var skipped []int
+	ch = make(chan streamEvent, 8)
+	err = apexJSON.DecodeToChannel(context.Background(), strings.NewReader(input), ch,
+		apexJSON.SkipMalformed(func(index int, err error) {
+			skipped = append(skipped, index)
+		}))
+	if err != nil {
+		t.Fatalf("skip: unexpected error: %v", err)
+	}
+	if got := collectStream(ch); !reflect.DeepEqual(got, []streamEvent{{1, "a"}, {3, "c"}}) {
+		t.Errorf("skip: got %+v", got)
+	}
+	if !reflect.DeepEqual(skipped, []int{1}) {
+		t.Errorf("skip: skipped %v, want [1]", skipped)
+	}
+
+	// Broken framing always aborts
+	ch = make(chan streamEvent, 8)
+	err = apexJSON.DecodeToChannel(context.Background(), strings.NewReader(`[{"id":1} {"id":2}]`), ch,
+		apexJSON.SkipMalformed(nil))
+	if err == nil {
+		t.Error("expected error for missing comma")
+	}
+}
+
+func TestDecodeToChannelCancel(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i := 0; i < 1000; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(`{"id":1,"kind":"x"}`)
+	}
+	sb.WriteString("]")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan streamEvent)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- apexJSON.DecodeToChannel(ctx, strings.NewReader(sb.String()), ch)
+	}()
+
+	received := 0
+	for range ch {
+		received++
+		if received == 3 {
+			// Stop consuming mid-stream; the producer must not block forever
+			cancel()
+			break
+		}
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	for range ch {
+	}
+}
+
+func TestLengthPrefixedFraming(t *testing.T) {
+	var stream bytes.Buffer
+	enc := apexJSON.NewEncoder(&stream)
+	enc.SetFraming(apexJSON.LengthPrefixed32)
+	values := []streamEvent{{ID: 1, Kind: "a"}, {ID: 2, Kind: "line\nbreak"}, {ID: 3}}
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each frame is a 4-byte length followed by exactly that many bytes
+	raw := stream.Bytes()
+	first, _ := json.Marshal(values[0])
+	if n := binary.BigEndian.Uint32(raw); int(n) != len(first) || string(raw[4:4+n]) != string(first) {
+		t.Fatalf("first frame = %q, want %d-byte %s", raw[:4+n], len(first), first)
+	}
+
+	dec := apexJSON.NewDecoder(&stream).SetFraming(apexJSON.LengthPrefixed32)
+	for i, want := range values {
+		if !dec.More() {
+			t.Fatalf("More() = false before frame %d", i)
+		}
+		var got streamEvent
+		if err := dec.Decode(&got); err != nil || got != want {
+			t.Fatalf("frame %d: got %+v, %v; want %+v", i, got, err, want)
+		}
+	}
+	if dec.More() {
+		t.Error("More() = true at end of stream")
+	}
+	var v streamEvent
+	if err := dec.Decode(&v); err != io.EOF {
+		t.Errorf("Decode at end = %v, want io.EOF", err)
+	}
+}
+
+func TestEncoderWriteNewline(t *testing.T) {
+	w := &chunkWriter{}
+	enc := apexJSON.NewEncoder(w)
+	enc.Encode(streamEvent{ID: 1})
+	enc.SetWriteNewline(false)
+	enc.Encode(streamEvent{ID: 2})
+	enc.Encode([]int{3})
+	obj := enc.BeginObject()
+	obj.Key("id")
+	obj.Value(4)
+	if err := obj.End(); err != nil {
+		t.Fatal(err)
+	}
+	enc.SetWriteNewline(true)
+	enc.Encode("5")
+
+	// Each value, with its newline when there is one, is a single Write
+	want := []string{`{"id":1,"kind":""}` + "\n", `{"id":2,"kind":""}`, `[3]`, `{"id":4}`, `"5"` + "\n"}
+	if !slices.Equal(w.chunks, want) {
+		t.Errorf("Writes = %q, want %q", w.chunks, want)
+	}
+
+	// Values that delimit themselves still decode one by one
+	dec := apexJSON.NewDecoder(strings.NewReader(strings.Join(w.chunks, "")))
+	for i := 0; dec.More(); i++ {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+	}
+}
+
+func TestEncoderClose(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		var out bytes.Buffer
+		enc := apexJSON.NewEncoder(&out)
+		if shared {
+			enc = apexJSON.NewSharedEncoder(&out)
+		}
+		if err := enc.Encode(1); err != nil {
+			t.Fatal(err)
+		}
+		open := enc.BeginObject()
+		if err := enc.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		if err := enc.Close(); err != nil {
+			t.Errorf("second Close: %v", err)
+		}
+
+		// Nothing is written once closed, and nothing panics
+		enc.SetEscapeHTML(false)
+		errs := []error{
+			enc.Encode(2),
+			enc.EncodeMemo(apexJSON.NewMemo(3)),
+			enc.SetMarshalOptions(apexJSON.MarshalOptions{}),
+			open.Key("k"),
+			open.Value(4),
+			open.RawValue([]byte("5")),
+			open.End(),
+			enc.BeginObject().Key("k"),
+			enc.BeginObject().Value(6),
+			enc.BeginObject().RawValue([]byte("7")),
+			enc.BeginObject().End(),
+		}
+		for i, err := range errs {
+			if !errors.Is(err, apexJSON.ErrEncoderClosed) {
+				t.Errorf("shared %v: call %d after Close = %v, want ErrEncoderClosed", shared, i, err)
+			}
+		}
+		if out.String() != "1\n" {
+			t.Errorf("shared %v: wrote %q", shared, out.String())
+		}
+	}
+}
+
+// sizedReader records the size of each Read it is given
+type sizedReader struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.r.Read(p)
+}
+
+func TestStreamSizes(t *testing.T) {
+	long := streamEvent{ID: 1, Kind: strings.Repeat("k", 5000)}
+	for _, size := range []int{-1, 0, 1, 100, 1 << 20} {
+		var out bytes.Buffer
+		enc := apexJSON.NewEncoderSize(&out, size)
+		if err := enc.Encode(long); err != nil {
+			t.Fatalf("NewEncoderSize(%d): %v", size, err)
+		}
+		enc.Encode(streamEvent{ID: 2})
+		enc.Close()
+
+		r := &sizedReader{r: &out}
+		dec := apexJSON.NewDecoderSize(r, size)
+		for _, want := range []streamEvent{long, {ID: 2}} {
+			var got streamEvent
+			if err := dec.Decode(&got); err != nil || got != want {
+				t.Fatalf("NewDecoderSize(%d): got %.20v, %v", size, got, err)
+			}
+		}
+		if want := max(size, 64); r.sizes[0] != want {
+			t.Errorf("NewDecoderSize(%d) first read %d bytes, want %d", size, r.sizes[0], want)
+		}
+	}
+}
+
+func TestEncoderBuffered(t *testing.T) {
+	w := &chunkWriter{}
+	enc := apexJSON.NewEncoderBuffered(w, 4096)
+	for i := 0; i < 10; i++ {
+		if err := enc.Encode(streamEvent{ID: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.chunks) != 0 {
+		t.Fatalf("%d Writes before Flush", len(w.chunks))
+	}
+	if err := enc.Flush(); err != nil || len(w.chunks) != 1 || strings.Count(w.chunks[0], "\n") != 10 {
+		t.Fatalf("Flush = %v, Writes %q", err, w.chunks)
+	}
+	enc.Encode(streamEvent{ID: 10})
+	if err := enc.Close(); err != nil || len(w.chunks) != 2 || w.chunks[1] != `{"id":10,"kind":""}`+"\n" {
+		t.Fatalf("Close = %v, Writes %q", err, w.chunks)
+	}
+	if err := enc.Flush(); !errors.Is(err, apexJSON.ErrEncoderClosed) {
+		t.Errorf("Flush after Close = %v", err)
+	}
+
+	// A failed write surfaces from the Encode that filled the buffer, or
+	// from Flush and Close, and sticks
+	w = &chunkWriter{limit: 1}
+	enc = apexJSON.NewEncoderBuffered(w, 64)
+	var err error
+	for i := 0; err == nil && i < 100; i++ {
+		err = enc.Encode(streamEvent{ID: i, Kind: "kind"})
+	}
+	if err == nil || enc.Encode(1) == nil {
+		t.Errorf("Encode past a failed write = %v", err)
+	}
+	w = &chunkWriter{limit: 1}
+	enc = apexJSON.NewEncoderBuffered(w, 64)
+	enc.Encode(1)
+	enc.Flush()
+	enc.Encode(2)
+	if err := enc.Close(); err == nil || len(w.chunks) != 1 {
+		t.Errorf("Close with a failing writer = %v", err)
+	}
+
+	// Unbuffered encoders have nothing to flush
+	if err := apexJSON.NewEncoder(io.Discard).Flush(); err != nil {
+		t.Errorf("unbuffered Flush = %v", err)
+	}
+}
+
+// lineWriter checks that every Write it receives is one whole JSON value
+// followed by a newline, and that no two Writes overlap
+type lineWriter struct {
+	inFlight atomic.Int32
+	mu       sync.Mutex
+	lines    map[string]int
+	errs     []string
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if w.inFlight.Add(1) != 1 {
+		w.fail("overlapping Write calls")
+	}
+	defer w.inFlight.Add(-1)
+
+	line, ok := bytes.CutSuffix(p, []byte("\n"))
+	var ev streamEvent
+	switch {
+	case !ok || bytes.IndexByte(line, '\n') >= 0:
+		w.fail(fmt.Sprintf("Write of %d bytes is not exactly one line", len(p)))
+	case json.Unmarshal(line, &ev) != nil:
+		w.fail(fmt.Sprintf("unparseable line %.60q", line))
+	default:
+		w.mu.Lock()
+		w.lines[ev.Kind]++
+		w.mu.Unlock()
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) fail(msg string) {
+	w.mu.Lock()
+	w.errs = append(w.errs, msg)
+	w.mu.Unlock()
+}
+
+func TestSharedEncoderConcurrent(t *testing.T) {
+	const producers, perProducer = 100, 50
+	w := &lineWriter{lines: make(map[string]int)}
+	enc := apexJSON.NewSharedEncoder(w)
+
+	var wg sync.WaitGroup
+	for g := 0; g < producers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// Payloads from a few bytes to several pooled buffer sizes
+			kind := fmt.Sprintf("p%d-%s", g, strings.Repeat("x", g*97))
+			for i := 0; i < perProducer; i++ {
+				if err := enc.Encode(streamEvent{ID: i, Kind: kind}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, msg := range w.errs {
+		t.Error(msg)
+	}
+	if len(w.lines) != producers {
+		t.Fatalf("got values from %d producers, want %d", len(w.lines), producers)
+	}
+	for kind, n := range w.lines {
+		if n != perProducer {
+			t.Errorf("producer %.4s: %d values, want %d", kind, n, perProducer)
+		}
+	}
+}
+
+// frame builds one LengthPrefixed32 frame around payload
+func frame(payload string) string {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	return string(header[:]) + payload
+}
+
+// chunkWriter records each Write it receives, taking delay over each, and
+// fails the ones past the first limit when limit is positive
+type chunkWriter struct {
+	chunks []string
+	delay  time.Duration
+	limit  int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && len(w.chunks) == w.limit {
+		return 0, errors.New("writer full")
+	}
+	time.Sleep(w.delay)
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+func TestEncoderYieldEvery(t *testing.T) {
+	ints := make([]int, 5000)
+	for i := range ints {
+		ints[i] = i * 7919
+	}
+	values := []interface{}{
+		complexUser, []User{complexUser, complexUser}, ints,
+		map[string]interface{}{"users": []interface{}{complexUser, nil}, "strs": []string{"a", "b"}},
+		map[int][]float32{1: {1.5}, 2: nil}, 42,
+	}
+	for _, every := range []int{1, 10, 256} {
+		opts := apexJSON.MarshalOptions{YieldEvery: every, SortMapKeys: true}
+		for _, v := range values {
+			want, _ := apexJSON.MarshalWithOptions(v, apexJSON.MarshalOptions{SortMapKeys: true})
+			if got, err := apexJSON.MarshalWithOptions(v, opts); err != nil || string(got) != string(want) {
+				t.Errorf("MarshalWithOptions(%T) every %d = %s, %v, want %s", v, every, got, err, want)
+			}
+
+			// Each yield writes what the encode has so far
+			w := &chunkWriter{}
+			enc := apexJSON.NewEncoder(w)
+			enc.SetMarshalOptions(opts)
+			if err := enc.Encode(v); err != nil || strings.Join(w.chunks, "") != string(want)+"\n" {
+				t.Errorf("Encode(%T) every %d = %q, %v, want %s", v, every, w.chunks, err, want)
+			}
+			if least := len(want) / (every + 1024); len(w.chunks) < least {
+				t.Errorf("Encode(%T) every %d: %d writes, want at least %d", v, every, len(w.chunks), least)
+			}
+
+			// Length prefixes and shared encoders keep a value to one write
+			for _, shared := range []bool{false, true} {
+				w := &chunkWriter{}
+				enc := apexJSON.NewEncoder(w)
+				if shared {
+					enc = apexJSON.NewSharedEncoder(w)
+				} else {
+					enc.SetFraming(apexJSON.LengthPrefixed32)
+				}
+				enc.SetMarshalOptions(opts)
+				if err := enc.Encode(v); err != nil || len(w.chunks) > 2 {
+					t.Errorf("Encode(%T) shared %v every %d: %d writes, %v", v, shared, every, len(w.chunks), err)
+				}
+			}
+		}
+	}
+
+	// A write that fails at a yield stops the encode, leaving what was
+	// written before it
+	w := &chunkWriter{limit: 2}
+	enc := apexJSON.NewEncoder(w)
+	enc.SetMarshalOptions(apexJSON.MarshalOptions{YieldEvery: 100})
+	if err := enc.Encode(ints); err == nil || err.Error() != "writer full" {
+		t.Errorf("Encode to a failing writer = %v", err)
+	}
+	if len(w.chunks) != 2 || !strings.HasPrefix(w.chunks[0], "[0,7919,") {
+		t.Errorf("written before the failure: %.40q", w.chunks)
+	}
+}
+
+// TestEncoderYieldLatency encodes a large value on one thread to a slow
+// writer, with and without YieldEvery, while a probe goroutine asks to be
+// woken every 100µs, and checks yielding cuts how late the probe runs
+func TestEncoderYieldLatency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	users := make([]User, 10000)
+	for i := range users {
+		users[i] = complexUser
+	}
+	p99 := func(every int) time.Duration {
+		var delays []time.Duration
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				start := time.Now()
+				time.Sleep(100 * time.Microsecond)
+				delays = append(delays, time.Since(start)-100*time.Microsecond)
+			}
+		}()
+
+		enc := apexJSON.NewEncoder(&chunkWriter{delay: 20 * time.Microsecond})
+		enc.SetMarshalOptions(apexJSON.MarshalOptions{YieldEvery: every})
+		if err := enc.Encode(users); err != nil {
+			t.Fatal(err)
+		}
+		close(stop)
+		<-done
+		if len(delays) == 0 {
+			return time.Hour
+		}
+		slices.Sort(delays)
+		return delays[len(delays)*99/100]
+	}
+
+	unyielded, yielded := p99(0), p99(16<<10)
+	t.Logf("probe p99 delay: %v without YieldEvery, %v with", unyielded, yielded)
+	if yielded >= unyielded {
+		t.Errorf("YieldEvery did not cut the probe's p99 delay: %v, was %v", yielded, unyielded)
+	}
+}
+
+func TestObjectEncoder(t *testing.T) {
+	// A single metadata key keeps Marshal's output order fixed
+	c := complex
+	c.Metadata = map[string]interface{}{"owner": "system"}
+	want, err := apexJSON.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	o := apexJSON.NewEncoder(&out).BeginObject()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(o.Key("id"))
+	check(o.Value(c.ID))
+	check(o.Key("name"))
+	check(o.Value(c.Name))
+	check(o.Key("is_active"))
+	check(o.RawValue([]byte("true")))
+	check(o.Key("score"))
+	check(o.Value(c.Score))
+	check(o.Key("tags"))
+	check(o.BeginArray())
+	for _, tag := range c.Tags {
+		check(o.Value(tag))
+	}
+	check(o.End())
+	check(o.Key("data"))
+	check(o.Value(c.Data))
+	check(o.Key("metadata"))
+	check(o.BeginObject())
+	check(o.Key("owner"))
+	check(o.Value("system"))
+	check(o.End())
+	check(o.Key("address"))
+	check(o.BeginObject())
+	for _, kv := range [][2]string{{"street", c.Address.Street}, {"city", c.Address.City}, {"country", c.Address.Country}, {"zip", c.Address.Zip}} {
+		check(o.Key(kv[0]))
+		check(o.Value(kv[1]))
+	}
+	check(o.End())
+	if out.Len() != 0 {
+		t.Fatalf("wrote %q before the outer End", out.Bytes())
+	}
+	check(o.End())
+
+	if got := out.String(); got != string(want)+"\n" {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if err := o.End(); err == nil {
+		t.Error("End after the object was written did not fail")
+	}
+	if err := o.Key("late"); err == nil {
+		t.Error("Key after the object was written did not fail")
+	}
+	if err := o.Value(1); err == nil {
+		t.Error("Value after the object was written did not fail")
+	}
+	if err := o.RawValue([]byte("1")); err == nil {
+		t.Error("RawValue after the object was written did not fail")
+	}
+
+	// Misuse is reported without corrupting the document
+	out.Reset()
+	o = apexJSON.NewEncoder(&out).BeginObject()
+	if err := o.Value(1); err == nil {
+		t.Error("Value without a Key did not fail")
+	}
+	check(o.Key("list"))
+	if err := o.End(); err == nil {
+		t.Error("End with a pending Key did not fail")
+	}
+	if err := o.Key("other"); err == nil {
+		t.Error("Key with a pending Key did not fail")
+	}
+	check(o.BeginArray())
+	if err := o.Key("k"); err == nil {
+		t.Error("Key inside an array did not fail")
+	}
+	check(o.Value(1))
+	if err := o.Value(math.NaN()); err == nil {
+		t.Error("Value(NaN) did not fail")
+	}
+	if err := o.RawValue([]byte("{")); err == nil {
+		t.Error("RawValue accepted invalid JSON")
+	}
+	check(o.RawValue([]byte(`{"raw":true}`)))
+	check(o.End())
+	check(o.End())
+	if want := `{"list":[1,{"raw":true}]}` + "\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+// notification encodes as a streamEvent. It counts how often it is
+// encoded, and is slow to encode so that concurrent callers overlap.
+type notification struct {
+	Text  string
+	calls *atomic.Int32
+}
+
+func (n notification) MarshalJSON() ([]byte, error) {
+	n.calls.Add(1)
+	time.Sleep(time.Millisecond)
+	return apexJSON.Marshal(streamEvent{Kind: n.Text})
+}
+
+func TestMemo(t *testing.T) {
+	var calls atomic.Int32
+	n := &notification{Text: "hello", calls: &calls}
+	m := apexJSON.NewMemo(n)
+	if calls.Load() != 0 {
+		t.Fatal("NewMemo encoded the value")
+	}
+
+	var out bytes.Buffer
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	enc := apexJSON.NewEncoder(&out)
+	if err := enc.EncodeMemo(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), `{"id":0,"kind":"hello"}{"id":0,"kind":"hello"}`+"\n"; got != want || calls.Load() != 1 {
+		t.Errorf("got %q after %d encodes, want %q after 1", got, calls.Load(), want)
+	}
+
+	n.Text = "changed"
+	m.Invalidate()
+	if b, err := m.Bytes(); err != nil || string(b) != `{"id":0,"kind":"changed"}` || calls.Load() != 2 {
+		t.Errorf("after Invalidate: %s, %v after %d encodes", b, err, calls.Load())
+	}
+
+	// Errors are cached like results
+	bad := apexJSON.NewMemo(math.NaN())
+	if _, err := bad.Bytes(); err == nil {
+		t.Error("Bytes encoded NaN")
+	}
+	if _, err := bad.WriteTo(&out); err == nil {
+		t.Error("WriteTo encoded NaN")
+	}
+	if err := enc.EncodeMemo(bad); err == nil {
+		t.Error("EncodeMemo encoded NaN")
+	}
+}
+
+func TestMemoConcurrent(t *testing.T) {
+	var calls atomic.Int32
+	m := apexJSON.NewMemo(&notification{Text: "hello", calls: &calls})
+	const want = `{"id":0,"kind":"hello"}`
+
+	// Concurrent first calls share one encode
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b, err := m.Bytes(); err != nil || string(b) != want {
+				t.Errorf("Bytes = %s, %v", b, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("value encoded %d times, want 1", n)
+	}
+
+	// Readers racing with Invalidate always see a whole encoding
+	w := &lineWriter{lines: make(map[string]int)}
+	enc := apexJSON.NewSharedEncoder(w)
+	const readers, perReader, invalidations = 16, 50, 10
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perReader; j++ {
+				if i == 0 && j%(perReader/invalidations) == 0 {
+					m.Invalidate()
+				}
+				if err := enc.EncodeMemo(m); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, msg := range w.errs {
+		t.Error(msg)
+	}
+	if w.lines["hello"] != readers*perReader || len(w.lines) != 1 {
+		t.Errorf("lines = %v, want %d of %s", w.lines, readers*perReader, want)
+	}
+	if n := calls.Load(); n < 2 || n > invalidations+1 {
+		t.Errorf("value encoded %d times, want 2 to %d", n, invalidations+1)
+	}
+}
+
+func TestLengthPrefixedFramingErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		check  func(error) bool
+	}{
+		{"zero length", frame(""), func(err error) bool {
+			var se *apexJSON.SyntaxError
+			return errors.As(err, &se) && se.Offset == 0 && strings.Contains(se.Msg, "zero-length")
+		}},
+		{"truncated header", frame(`{"id":1}`)[:3], func(err error) bool { return errors.Is(err, io.ErrUnexpectedEOF) }},
+		{"truncated payload", frame(`{"id":1}`)[:8], func(err error) bool { return errors.Is(err, io.ErrUnexpectedEOF) }},
+		{"trailing data", frame(`{"id":1} 2`), func(err error) bool {
+			var se *apexJSON.SyntaxError
+			return errors.As(err, &se) && se.Offset == 13
+		}},
+		{"oversized length", "\xff\xff\xff\xff{}", func(err error) bool {
+			var se *apexJSON.SyntaxError
+			return errors.As(err, &se) && se.Offset == 0 && strings.Contains(se.Msg, "exceeds")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := apexJSON.NewDecoder(strings.NewReader(tt.stream)).SetFraming(apexJSON.LengthPrefixed32)
+			var v streamEvent
+			if err := dec.Decode(&v); !tt.check(err) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+
+	// A malformed payload is reported without losing the following frame
+	dec := apexJSON.NewDecoder(strings.NewReader(frame(`{"id":}`) + frame(`{"id":2}`))).SetFraming(apexJSON.LengthPrefixed32)
+	var v streamEvent
+	var se *apexJSON.SyntaxError
+	if err := dec.Decode(&v); !errors.As(err, &se) || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("malformed frame: got %v, want SyntaxError", err)
+	}
+	if err := dec.Decode(&v); err != nil || v.ID != 2 {
+		t.Errorf("next frame: got %+v, %v", v, err)
+	}
+
+	// SetMaxFrameSize bounds the payload, not the header
+	dec = apexJSON.NewDecoder(strings.NewReader(frame(`{"id":3}`) + frame(`{"id":40}`))).SetFraming(apexJSON.LengthPrefixed32).SetMaxFrameSize(8)
+	if err := dec.Decode(&v); err != nil || v.ID != 3 {
+		t.Errorf("frame at the limit: got %+v, %v", v, err)
+	}
+	if err := dec.Decode(&v); !errors.As(err, &se) || se.Offset != 12 {
+		t.Errorf("frame over the limit: got %v, want SyntaxError at offset 12", err)
+	}
+}
+
+func TestLenientStream(t *testing.T) {
+	stream := "\xef\xbb\xbf" + `{"id":1}` + "\n\x00\x00\n" + `{"id":2,"kind":"b"}` + "\r\n\x1a\x1a" + `{"id":3}` + "\n\x1a"
+	dec := apexJSON.NewDecoder(strings.NewReader(stream)).SetLenientStream(true)
+
+	var got []streamEvent
+	for {
+		var v streamEvent
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v)
+	}
+	want := []streamEvent{{ID: 1}, {ID: 2, Kind: "b"}, {ID: 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	wantSkips := []apexJSON.SkippedRange{{Offset: 0, Length: 3}, {Offset: 12, Length: 2}, {Offset: 36, Length: 2}, {Offset: 47, Length: 1}}
+	if skips := dec.SkippedRanges(); !reflect.DeepEqual(skips, wantSkips) {
+		t.Errorf("SkippedRanges() = %+v, want %+v", skips, wantSkips)
+	}
+
+	// Malformed values are still errors, and strict mode rejects garbage
+	dec = apexJSON.NewDecoder(strings.NewReader("\x00" + `{"id":}`)).SetLenientStream(true)
+	var v streamEvent
+	var se *apexJSON.SyntaxError
+	if err := dec.Decode(&v); !errors.As(err, &se) {
+		t.Errorf("malformed value: got %v, want SyntaxError", err)
+	}
+	if err := apexJSON.NewDecoder(strings.NewReader("\x00" + `{"id":1}`)).Decode(&v); err == nil {
+		t.Error("strict decoder accepted a leading NUL")
+	}
+}
+
+type truncationDoc struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Tags   []string `json:"tags"`
+	Flags  []bool   `json:"flags"`
+	Nested struct {
+		OK   bool    `json:"ok"`
+		N    float64 `json:"n"`
+		Next *int    `json:"next"`
+	} `json:"nested"`
+}
+
+func TestTruncationMatrix(t *testing.T) {
+	doc := `{"id": 12, "name":"a\"b", "tags":["x","yz"],"flags":[true,false],"nested":{"ok":true,"n":-1.5e3,"next":null}}`
+	tagsEnd := strings.Index(doc, `],"flags"`) + 1
+
+	isTruncation := func(err error) bool {
+		var syntaxErr *apexJSON.SyntaxError
+		return errors.Is(err, io.ErrUnexpectedEOF) && errors.As(err, &syntaxErr)
+	}
+
+	for cut := 0; cut < len(doc); cut++ {
+		data := []byte(doc[:cut])
+
+		var v truncationDoc
+		if err := apexJSON.Unmarshal(data, &v); !isTruncation(err) {
+			t.Errorf("Unmarshal(%q) error = %v, want truncation", data, err)
+		}
+
+		err := apexJSON.NewDecoder(strings.NewReader(doc[:cut])).Decode(&v)
+		if strings.TrimSpace(doc[:cut]) == "" {
+			if err != io.EOF {
+				t.Errorf("Decode(%q) error = %v, want io.EOF", data, err)
+			}
+		} else if !isTruncation(err) {
+			t.Errorf("Decode(%q) error = %v, want truncation", data, err)
+		}
+
+		if _, err := apexJSON.GetObjectErr(data); !isTruncation(err) {
+			t.Errorf("GetObjectErr(%q) error = %v, want truncation", data, err)
+		}
+
+		// A later "tags" would win, so the whole object must be there
+		raw, err := apexJSON.ExtractFirstErr(data, "tags")
+		if cut >= tagsEnd {
+			if err != nil || string(raw) != `["x","yz"]` {
+				t.Errorf("ExtractFirstErr(%q, tags) = %s, %v", data, raw, err)
+			}
+		} else if !isTruncation(err) {
+			t.Errorf("ExtractFirstErr(%q, tags) error = %v, want truncation", data, err)
+		}
+		if _, err := apexJSON.ExtractErr(data, "tags"); !isTruncation(err) {
+			t.Errorf("ExtractErr(%q, tags) error = %v, want truncation", data, err)
+		}
+
+		if _, err = apexJSON.GetArrayErr(data, "tags"); !isTruncation(err) {
+			t.Errorf("GetArrayErr(%q, tags) error = %v", data, err)
+		}
+
+		if _, err = apexJSON.GetObjectErr(data, "nested"); !isTruncation(err) {
+			t.Errorf("GetObjectErr(%q, nested) error = %v", data, err)
+		}
+	}
+
+	// The complete document decodes, and a stream ends cleanly with io.EOF
+	d := apexJSON.NewDecoder(strings.NewReader(doc + "\n"))
+	var v truncationDoc
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Decode(&v); err != io.EOF {
+		t.Errorf("Decode after last value = %v, want io.EOF", err)
+	}
+}
+
+func TestMalformedIsNotTruncation(t *testing.T) {
+	for _, doc := range []string{`{"id":tru}`, `{"id" 1}`, `{"tags":["x" "y"]}`, `{"id":1]`} {
+		data := []byte(doc)
+		var v truncationDoc
+		errs := map[string]error{
+			"Unmarshal":    apexJSON.Unmarshal(data, &v),
+			"Decode":       apexJSON.NewDecoder(strings.NewReader(doc)).Decode(&v),
+			"GetObjectErr": func() error { _, err := apexJSON.GetObjectErr(data); return err }(),
+		}
+		for name, err := range errs {
+			var syntaxErr *apexJSON.SyntaxError
+			if !errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s(%s) error = %v, want non-truncation SyntaxError", name, doc, err)
+			}
+		}
+	}
+
+	if _, err := apexJSON.ExtractErr([]byte(`{"a":{"b":1}}`), "a", "c"); err != apexJSON.ErrPathNotFound {
+		t.Errorf("ExtractErr missing key error = %v, want ErrPathNotFound", err)
+	}
+	var typeErr *apexJSON.UnmarshalTypeError
+	if _, err := apexJSON.GetArrayErr([]byte(`{"a":{"b":1}}`), "a"); !errors.As(err, &typeErr) {
+		t.Errorf("GetArrayErr on object error = %v, want UnmarshalTypeError", err)
+	}
+}
+
+// TestJSONTestSuiteConformance runs the test_parsing files of
+// github.com/nst/JSONTestSuite through the three entry points that decide
+// whether a document is JSON. y_ files must be accepted and n_ files rejected
+// by all of them; for i_ files either answer is allowed as long as they agree.
+//
+// The one intended difference: Unmarshal into an interface{} stores numbers
+// as float64 and reports out-of-range ones such as 1e999 as an
+// *UnmarshalTypeError. That is a value error, not a grammar one, so it counts
+// as accepted here.
+func TestUnmarshalMulti(t *testing.T) {
+	data := []byte("{\"kind\":\"a\",\"n\":1}\n{\"kind\":\"b\",\"n\":2}\r\n\n  [1,2]{\"kind\":3,\"n\":\"x\"}\t3\n")
+
+	// Single-document Unmarshal stays strict
+	var one interface{}
+	if err := apexJSON.Unmarshal(data, &one); err == nil {
+		t.Fatal("Unmarshal accepted several values")
+	}
+
+	var events []streamEvent
+	var errs []error
+	err := apexJSON.UnmarshalMulti(data, func(i int, dec func(v interface{}) error) error {
+		if i == 2 {
+			return nil // skip the array
+		}
+		var ev streamEvent
+		if err := dec(&ev); err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		events = append(events, ev)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Kind != "a" || events[1].Kind != "b" {
+		t.Errorf("decoded %+v", events)
+	}
+
+	// Errors name the document and where it starts in the whole input
+	if len(errs) != 2 {
+		t.Fatalf("got errors %v, want 2", errs)
+	}
+	var docErr *apexJSON.DocumentError
+	var typeErr *apexJSON.UnmarshalTypeError
+	if !errors.As(errs[0], &docErr) || docErr.Index != 3 || docErr.Offset != int64(bytes.Index(data, []byte(`{"kind":3`))) {
+		t.Errorf("first error = %#v", errs[0])
+	}
+	if !errors.As(errs[0], &typeErr) {
+		t.Errorf("first error does not wrap the type error: %v", errs[0])
+	}
+	if !errors.As(errs[1], &docErr) || docErr.Index != 4 {
+		t.Errorf("second error = %v", errs[1])
+	}
+
+	// A malformed value stops the split with its index and offset
+	bad := []byte("1 {\"a\":} 2")
+	calls := 0
+	err = apexJSON.UnmarshalMulti(bad, func(int, func(interface{}) error) error { calls++; return nil })
+	var syntaxErr *apexJSON.SyntaxError
+	if !errors.As(err, &docErr) || docErr.Index != 1 || docErr.Offset != 2 || !errors.As(err, &syntaxErr) || calls != 1 {
+		t.Errorf("malformed: err = %v after %d calls", err, calls)
+	}
+	err = apexJSON.UnmarshalMulti([]byte(`{"a":1} {"b":`), func(int, func(interface{}) error) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated: err = %v", err)
+	}
+
+	// An error from fn is returned unchanged
+	stop := errors.New("stop")
+	if err := apexJSON.UnmarshalMulti(data, func(int, func(interface{}) error) error { return stop }); err != stop {
+		t.Errorf("fn error = %v", err)
+	}
+	if err := apexJSON.UnmarshalMulti([]byte(" \n "), func(int, func(interface{}) error) error { return stop }); err != nil {
+		t.Errorf("empty input: err = %v", err)
+	}
+
+	// Values decode as Unmarshal does under SetStdlibCompat
+	apexJSON.SetStdlibCompat(true)
+	defer apexJSON.SetStdlibCompat(false)
+	var folded []streamEvent
+	err = apexJSON.UnmarshalMulti([]byte(`{"ID":1} {"Kind":"b"}`), func(_ int, dec func(interface{}) error) error {
+		var ev streamEvent
+		err := dec(&ev)
+		folded = append(folded, ev)
+		return err
+	})
+	if err != nil || !reflect.DeepEqual(folded, []streamEvent{{ID: 1}, {Kind: "b"}}) {
+		t.Errorf("compat: decoded %+v, %v", folded, err)
+	}
+}
+
+func TestParserExtractErrors(t *testing.T) {
+	tests := []struct {
+		in      string
+		extract func(p *apexJSON.Parser) (interface{}, error)
+		want    interface{}
+		msg     string // substring of the error, "" for success
+		offset  int64
+	}{
+		{` 12.5`, number, 12.5, "", 0},
+		{`1e999`, number, nil, "out of range", 0},
+		{`-x`, number, nil, "invalid number", 1},
+		{`  true`, boolean, true, "", 0},
+		{`fxlse`, boolean, nil, "expected true or false", 0},
+		{`fals`, boolean, nil, "unexpected end", 4},
+		{`tru`, boolean, nil, "unexpected end", 3},
+		{`"a\u00e9b"`, str, "aéb", "", 0},
+		{`"plain"`, str, "plain", "", 0},
+		{`"abc`, str, nil, "unterminated string", 0},
+		{`"a\qb"`, str, nil, "invalid escape", 2},
+		{"\"a\tb\"", str, nil, "control character", 2},
+		{`42`, str, nil, "expected string", 0},
+		{``, str, nil, "unexpected end", 0},
+	}
+	for _, tt := range tests {
+		p := apexJSON.NewParser([]byte(tt.in))
+		got, err := tt.extract(p)
+		if tt.msg == "" {
+			if err != nil || got != tt.want {
+				t.Errorf("%s: got %v, %v; want %v", tt.in, got, err, tt.want)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: err = %v, want %q", tt.in, err, tt.msg)
+			continue
+		}
+		var syntaxErr *apexJSON.SyntaxError
+		var typeErr *apexJSON.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr) && syntaxErr.Offset != tt.offset,
+			errors.As(err, &typeErr) && typeErr.Offset != tt.offset:
+			t.Errorf("%s: err %v at wrong offset, want %d", tt.in, err, tt.offset)
+		}
+
+		// A failed extraction leaves the position where it was, so trying
+		// again fails the same way
+		if _, again := tt.extract(p); again == nil || again.Error() != err.Error() {
+			t.Errorf("%s: retry err = %v, want %v", tt.in, again, err)
+		}
+	}
+
+	if _, err := apexJSON.NewParser([]byte(`"abc`)).ExtractStringErr(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("unterminated string is not truncation: %v", err)
+	}
+}
+
+func number(p *apexJSON.Parser) (interface{}, error) {
+	n, err := p.ExtractNumberErr()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func boolean(p *apexJSON.Parser) (interface{}, error) {
+	b, err := p.ExtractBoolErr()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func str(p *apexJSON.Parser) (interface{}, error) {
+	s, err := p.ExtractStringErr()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func TestJSONTestSuiteConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "JSONTestSuite", "test_parsing", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no JSONTestSuite files found")
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, extractErr := apexJSON.ExtractErr(data)
+		var v interface{}
+		unmarshalErr := apexJSON.Unmarshal(data, &v)
+		var typeErr *apexJSON.UnmarshalTypeError
+		if errors.As(unmarshalErr, &typeErr) {
+			unmarshalErr = nil
+		}
+
+		accepted := map[string]bool{
+			"Extract":   extractErr == nil,
+			"Valid":     apexJSON.Valid(data),
+			"Unmarshal": unmarshalErr == nil,
+		}
+		for fn, ok := range accepted {
+			switch {
+			case strings.HasPrefix(name, "y_") && !ok:
+				t.Errorf("%s rejected %s: %q", fn, name, data)
+			case strings.HasPrefix(name, "n_") && ok:
+				t.Errorf("%s accepted %s: %q", fn, name, data)
+			case ok != accepted["Valid"]:
+				t.Errorf("%s and Valid disagree on %s: %v vs %v", fn, name, ok, accepted["Valid"])
+			}
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	deep := strings.Repeat(`[{"a":`, 100000) + "1" + strings.Repeat("}]", 100000)
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{`{"a":[1,-2.5e+3,true,false,null,"é\"\\"]}`, true},
+		{" \t\n[]\r\n", true},
+		{`{"a":1} {"b":2}`, false},
+		{`[1,2]x`, false},
+		{`{"a":[1,2`, false},
+		{`"abc\`, false},
+		{`tru`, false},
+		{`01`, false},
+		{`1.`, false},
+		{`[1,]`, false},
+		{`{"a" 1}`, false},
+		{`[}`, false},
+		{``, false},
+		{deep, true},
+		{deep[:len(deep)-1], false},
+		{strings.Repeat("[", 1000000), false},
+	}
+	for _, tt := range tests {
+		name := tt.in
+		if len(name) > 40 {
+			name = name[:40] + "..."
+		}
+		if got := apexJSON.Valid([]byte(tt.in)); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", name, got, tt.want)
+		}
+		if got := apexJSON.ValidString(tt.in); got != tt.want {
+			t.Errorf("ValidString(%q) = %v, want %v", name, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{string(complexJSON), strings.Repeat("[", 256) + strings.Repeat("]", 256)} {
+		if n := testing.AllocsPerRun(10, func() { apexJSON.ValidString(in) }); n != 0 && !raceEnabled {
+			t.Errorf("ValidString allocates %v times on %d bytes", n, len(in))
+		}
+	}
+}
+
+func TestGetObjectMatchesStdlib(t *testing.T) {
+	doc := []byte(`{
+		"": {"": "empty", "x": 1},
+		"a": {"b": {"c": {"d": [1, "two", {"three": 3}], "e": null}}},
+		"rows": [{"id": 1, "tags": ["x"]}, {"id": 2, "tags": []}, [{"deep": true}]],
+		"brace": "}{][",
+		"esc": "line\nbreak \u00e9"
+	}`)
+
+	tests := []struct {
+		name string
+		path []string
+	}{
+		{"root", nil},
+		{"empty key", []string{""}},
+		{"three levels", []string{"a", "b", "c"}},
+		{"two levels", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := apexJSON.GetObjectErr(doc, tt.path...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want interface{}
+			raw, _ := apexJSON.Extract(doc, tt.path...)
+			if err := json.Unmarshal(raw, &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("GetObject(%q) = %#v, want %#v", tt.path, got, want)
+			}
+		})
+	}
+
+	rows, err := apexJSON.GetArrayErr(doc, "rows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want struct {
+		Rows []interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal(doc, &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, want.Rows) {
+		t.Errorf("GetArray(rows) = %#v, want %#v", rows, want.Rows)
+	}
+
+	if _, err := apexJSON.GetObjectErr(doc, "a", "missing"); err != apexJSON.ErrPathNotFound {
+		t.Errorf("missing key error = %v, want ErrPathNotFound", err)
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	// Repeated keys at the root, inside a repeated key, and in an object
+	// that only the last occurrence of its parent holds
+	doc := []byte(`{
+		"id": 1, "user": {"name": "first", "role": "admin"},
+		"id": 2,
+		"user": {"name": "second", "name": "third", "tags": {"t": 1, "t": [2]}},
+		"pre": 1, "prefix": 2, "pre": 3
+	}`)
+
+	var whole interface{}
+	if err := apexJSON.Unmarshal(doc, &whole); err != nil {
+		t.Fatal(err)
+	}
+	var std interface{}
+	if err := json.Unmarshal(doc, &std); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(whole, std) {
+		t.Fatalf("Unmarshal = %v, encoding/json %v", whole, std)
+	}
+
+	lookup := func(path []string) (interface{}, bool) {
+		v := whole
+		for _, seg := range path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[seg]; !ok {
+				return nil, false
+			}
+		}
+		return v, true
+	}
+
+	for _, path := range [][]string{
+		{"id"}, {"user"}, {"user", "name"}, {"user", "tags"}, {"user", "tags", "t"},
+		{"pre"}, {"prefix"}, {"user", "role"},
+	} {
+		want, found := lookup(path)
+		raw, err := apexJSON.ExtractErr(doc, path...)
+		if !found {
+			if !errors.Is(err, apexJSON.ErrPathNotFound) {
+				t.Errorf("Extract(%q) = %s, %v, want ErrPathNotFound", path, raw, err)
+			}
+			continue
+		}
+		var got interface{}
+		if err != nil || json.Unmarshal(raw, &got) != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Extract(%q) = %s, %v, want %v", path, raw, err, want)
+		}
+		if m, ok := want.(map[string]interface{}); ok {
+			if obj, err := apexJSON.GetObjectErr(doc, path...); err != nil || !reflect.DeepEqual(obj, m) {
+				t.Errorf("GetObject(%q) = %v, %v, want %v", path, obj, err, m)
+			}
+		}
+	}
+
+	var typed struct {
+		ID   int `json:"id"`
+		User struct {
+			Name string `json:"name"`
+		} `json:"user"`
+	}
+	if err := apexJSON.Unmarshal(doc, &typed); err != nil || typed.ID != 2 || typed.User.Name != "third" {
+		t.Errorf("Unmarshal struct = %+v, %v", typed, err)
+	}
+
+	// ExtractFirst stops at the first occurrence, without reading on
+	for path, want := range map[string]string{"id": "1", "user": `{"name": "first", "role": "admin"}`} {
+		if raw, ok := apexJSON.ExtractFirst(doc, path); !ok || string(raw) != want {
+			t.Errorf("ExtractFirst(%q) = %s, want %s", path, raw, want)
+		}
+	}
+	if raw, err := apexJSON.ExtractFirstErr([]byte(`{"a": 1, "a": tru`), "a"); err != nil || string(raw) != "1" {
+		t.Errorf("ExtractFirstErr = %s, %v", raw, err)
+	}
+	if _, err := apexJSON.ExtractErr([]byte(`{"a": 1, "a": tru`), "a"); err == nil {
+		t.Error("ExtractErr accepted a malformed later occurrence")
+	}
+}
+
+func TestExtractMatch(t *testing.T) {
+	doc := []byte(`{"meta": {"count": 3}, "readings": {
+		"sensor_a1": {"t": 21.5},
+		"label": "lab",
+		"sensor_\u0062\u0032": [1, 2],
+		"sensor_": null,
+		"xsensor_c3": 0,
+		"sensor_d4": "}{"
+	}}`)
+	re := regexp.MustCompile(`^sensor_[a-z][0-9]$`)
+
+	got, ok := apexJSON.ExtractMatch(doc, re, "readings")
+	want := []apexJSON.KV{
+		{Key: "sensor_a1", Value: []byte(`{"t": 21.5}`)},
+		{Key: "sensor_b2", Value: []byte(`[1, 2]`)},
+		{Key: "sensor_d4", Value: []byte(`"}{"`)},
+	}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Fatalf("ExtractMatch = %q, %v, want %q", got, ok, want)
+	}
+
+	// Values are copies: changing the input doesn't change them
+	for i := range doc {
+		doc[i] = ' '
+	}
+	if string(got[0].Value) != `{"t": 21.5}` {
+		t.Errorf("value aliases the input: %q", got[0].Value)
+	}
+
+	doc = []byte(`{"a": {"b": 1}, "list": [1], "bad": {"k": tru}}`)
+	if got, ok := apexJSON.ExtractMatch([]byte(`{"a": {"b": 1}}`), regexp.MustCompile(`x`), "a"); !ok || got == nil || len(got) != 0 {
+		t.Errorf("no match = %q, %v, want empty", got, ok)
+	}
+	for _, path := range [][]string{{"list"}, {"a", "b"}, {"missing"}, {"bad"}, nil} {
+		if got, ok := apexJSON.ExtractMatch(doc, re, path...); ok {
+			t.Errorf("ExtractMatch(%q) = %q, true, want false", path, got)
+		}
+	}
+	if got, ok := apexJSON.ExtractMatch([]byte(`{"sensor_a1":1}`), re); !ok || len(got) != 1 {
+		t.Errorf("root object = %q, %v", got, ok)
+	}
+}
+
+func TestShardArray(t *testing.T) {
+	type item struct {
+		ID   int      `json:"id"`
+		Blob string   `json:"blob,omitempty"`
+		Tags []string `json:"tags,omitempty"`
+	}
+
+	// Element sizes vary from a few bytes to tens of kilobytes
+	var items []item
+	for i := 0; i < 200; i++ {
+		it := item{ID: i}
+		switch {
+		case i%37 == 0:
+			it.Blob = strings.Repeat("x", 20000+i)
+		case i%5 == 0:
+			it.Tags = []string{"a,b", "]", strings.Repeat("t", i)}
+		}
+		items = append(items, it)
+	}
+	body, _ := json.MarshalIndent(items, "", "  ")
+	doc := []byte(`{"meta":{"n":200},"data":{"items":` + string(body) + `}}`)
+
+	var whole []item
+	if err := json.Unmarshal(body, &whole); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{1, 2, 3, 8, 64, 200, 1000} {
+		shards, err := apexJSON.ShardArray(doc, []string{"data", "items"}, n)
+		if err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if want := min(n, len(items)); len(shards) != want {
+			t.Errorf("n=%d: %d shards, want %d", n, len(shards), want)
+		}
+
+		var joined []item
+		largest, total := 0, 0
+		for i, shard := range shards {
+			var part []item
+			if err := apexJSON.Unmarshal(shard, &part); err != nil {
+				t.Fatalf("n=%d shard %d: %v\n%s", n, i, err, shard)
+			}
+			if len(part) == 0 {
+				t.Errorf("n=%d shard %d is empty", n, i)
+			}
+			joined = append(joined, part...)
+			largest, total = max(largest, len(shard)), total+len(shard)
+		}
+		if !reflect.DeepEqual(joined, whole) {
+			t.Errorf("n=%d: shards decode to %d items, want %d", n, len(joined), len(whole))
+		}
+
+		// No shard is larger than its share by more than one of the
+		// big elements
+		if n <= 8 && largest > total/len(shards)+21000 {
+			t.Errorf("n=%d: largest shard %d bytes of %d", n, largest, total)
+		}
+	}
+
+	// Fewer elements than shards, nothing to split and bad input
+	if shards, err := apexJSON.ShardArray([]byte(` [ 1 , "a" ] `), nil, 4); err != nil || len(shards) != 2 ||
+		string(shards[0]) != `[1]` || string(shards[1]) != `["a"]` {
+		t.Errorf("small array = %q, %v", shards, err)
+	}
+	if shards, err := apexJSON.ShardArray([]byte(`{"a":[]}`), []string{"a"}, 4); err != nil || len(shards) != 0 {
+		t.Errorf("empty array = %q, %v", shards, err)
+	}
+	for _, tt := range []struct {
+		doc  string
+		path []string
+		n    int
+	}{
+		{`{"a":{}}`, []string{"a"}, 2},
+		{`{"a":[1]}`, []string{"b"}, 2},
+		{`{"a":[1,]}`, []string{"a"}, 2},
+		{`{"a":[1 2]}`, []string{"a"}, 2},
+		{`[1]`, nil, 0},
+	} {
+		if shards, err := apexJSON.ShardArray([]byte(tt.doc), tt.path, tt.n); err == nil {
+			t.Errorf("ShardArray(%s, %q, %d) = %q", tt.doc, tt.path, tt.n, shards)
+		}
+	}
+}
+
 func TestProfileMarshalCPU(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping profile test in short mode")
@@ -509,6 +2195,58 @@ func TestProfileMarshalMemory(t *testing.T) {
 }
 
 // Helper function for comparing benchmark results
+func TestFixturesRoundTrip(t *testing.T) {
+	for _, v := range []interface{}{simple, complex, &complex, complexUser, []User{complexUser}} {
+		apexjsontest.RoundTrip(t, v)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		apexjsontest.RoundTrip(t, apexjsontest.Random[ComplexStruct](r))
+		apexjsontest.RoundTrip(t, apexjsontest.Random[User](r))
+	}
+}
+
+func FuzzRoundTripSimple(f *testing.F)  { apexjsontest.RoundTripFuzz[SimpleStruct](f) }
+func FuzzRoundTripComplex(f *testing.F) { apexjsontest.RoundTripFuzz[ComplexStruct](f) }
+func FuzzRoundTripUser(f *testing.F)    { apexjsontest.RoundTripFuzz[User](f) }
+
+// FuzzStringEscapes feeds strings cut off inside or right after an escape,
+// both whole and one byte per Read so escapes straddle the Decoder's
+// refills. Valid and Unmarshal must agree on what is malformed, errors must
+// point into the input, and the Decoder must decode what Unmarshal does.
+func FuzzStringEscapes(f *testing.F) {
+	for _, seed := range []string{
+		`"abc\`, `"abc\\`, `"abc\\\`, `"\`, `"\u`, `"\u12`, `"\u12"`, `"a\"`,
+		`["a\`, `["a\\"]`, `{"k\`, `{"k":"v\`, `{"k":"\u00e9\\"}`, `"\\\""`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v interface{}
+		err := apexJSON.Unmarshal(data, &v)
+		var se *apexJSON.SyntaxError
+		syntax := errors.As(err, &se)
+		if valid := apexJSON.Valid(data); err == nil && !valid || syntax && valid {
+			t.Fatalf("Valid(%q) = %v but Unmarshal: %v", data, valid, err)
+		}
+		if syntax && (se.Offset < 0 || se.Offset > int64(len(data))) {
+			t.Fatalf("Unmarshal(%q) offset %d outside the input", data, se.Offset)
+		}
+		if _, err := apexJSON.NewParser(data).ExtractStringErr(); errors.As(err, &se) && se.Offset > int64(len(data)) {
+			t.Fatalf("ExtractStringErr(%q) offset %d outside the input", data, se.Offset)
+		}
+
+		var got interface{}
+		derr := apexJSON.NewDecoder(iotest.OneByteReader(bytes.NewReader(data))).Decode(&got)
+		if errors.As(derr, &se) && (se.Offset < 0 || se.Offset > int64(len(data))) {
+			t.Fatalf("Decode(%q) offset %d outside the input", data, se.Offset)
+		}
+		if err == nil && (derr != nil || !reflect.DeepEqual(got, v)) {
+			t.Fatalf("Decode(%q) = %v, %v; Unmarshal gave %v", data, got, derr, v)
+		}
+	})
+}
+
 func TestCompareAllLibraries(t *testing.T) {
 	// This is a placeholder test that can be run to generate comprehensive benchmarks
 	// Run with: go test -bench=. -benchmem > benchmark_results.txt
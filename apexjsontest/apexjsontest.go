@@ -0,0 +1,387 @@
+// Package apexjsontest checks that values survive a round trip through
+// apexJSON, for use in the test suites of packages whose types are encoded
+// with it.
+package apexjsontest
+
+import (
+	"apexJSON"
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// maxDepth bounds how many pointers, slices, maps and interfaces Random
+// nests, so recursive types terminate
+const maxDepth = 4
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(apexJSON.RawMessage(nil))
+	emptyInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// RoundTrip marshals v, unmarshals the output into a new value of the same
+// type and fails t unless the result matches v. The comparison is
+// reflect.DeepEqual with the allowances JSON itself forces:
+//
+//   - nil and empty slices and maps are equal, since omitempty and null
+//     can turn one into the other
+//   - time.Time values are equal if they are the same instant to the
+//     second, since they are encoded as RFC 3339 without fractions
+//   - numbers held in an interface{} are compared by value, since they
+//     decode as float64 whatever type they had
+//   - struct fields apexJSON doesn't encode are ignored
+func RoundTrip(t testing.TB, v interface{}) {
+	t.Helper()
+
+	data, err := apexJSON.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal(%T): %v", v, err)
+	}
+
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		if string(data) != "null" {
+			t.Fatalf("Marshal(nil) = %s, want null", data)
+		}
+		return
+	}
+	out := reflect.New(rv.Type())
+	if err := apexJSON.Unmarshal(data, out.Interface()); err != nil {
+		t.Fatalf("Unmarshal(%s) into %T: %v", data, v, err)
+	}
+	if path, ok := diff(rv, out.Elem(), ""); !ok {
+		if path == "" {
+			path = "value"
+		}
+		t.Fatalf("%T does not round-trip: %s differs\nvalue:   %#v\nencoded: %s\ndecoded: %#v", v, path, v, data, out.Elem().Interface())
+	}
+}
+
+// RoundTripFuzz makes f a fuzz target that round-trips random values of T
+// built by Random, seeded from the fuzzer's input
+func RoundTripFuzz[T any](f *testing.F) {
+	for seed := int64(0); seed < 8; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		RoundTrip(t, Random[T](rand.New(rand.NewSource(seed))))
+	})
+}
+
+// Random returns a value of type T filled with random data drawn from r.
+// Struct fields are filled the way apexJSON encodes them: fields it skips,
+// such as unexported ones and those tagged "-", are left zero, as is any
+// Unknown. Pointers, slices, maps and interfaces stop nesting after a few
+// levels, so recursive types are fine. Values JSON cannot hold, like NaN,
+// invalid UTF-8 or channels, are never generated.
+func Random[T any](r *rand.Rand) T {
+	var v T
+	fill(reflect.ValueOf(&v).Elem(), r, 0)
+	return v
+}
+
+// fill sets v, which must be settable, to random data
+func fill(v reflect.Value, r *rand.Rand, depth int) {
+	t := v.Type()
+	switch t {
+	case timeType:
+		sec := r.Int63n(4102444800) // up to 2100
+		v.Set(reflect.ValueOf(time.Unix(sec, r.Int63n(1e9)).UTC()))
+		return
+	case rawMessageType:
+		v.SetBytes([]byte(strconv.Itoa(r.Intn(1000))))
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		v.SetBool(r.Intn(2) == 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(r.Int63() >> (64 - t.Bits()))
+		if r.Intn(2) == 0 {
+			v.SetInt(-v.Int() - 1)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(r.Uint64() >> (64 - t.Bits()))
+	case reflect.Float32:
+		v.SetFloat(float64(randomFloat32(r)))
+	case reflect.Float64:
+		v.SetFloat(randomFloat64(r))
+	case reflect.String:
+		v.SetString(randomString(r))
+
+	case reflect.Ptr:
+		if depth < maxDepth && r.Intn(4) != 0 {
+			p := reflect.New(t.Elem())
+			fill(p.Elem(), r, depth+1)
+			v.Set(p)
+		}
+	case reflect.Slice:
+		if depth < maxDepth && r.Intn(4) != 0 {
+			n := r.Intn(4)
+			s := reflect.MakeSlice(t, n, n)
+			for i := 0; i < n; i++ {
+				fill(s.Index(i), r, depth+1)
+			}
+			v.Set(s)
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			fill(v.Index(i), r, depth+1)
+		}
+	case reflect.Map:
+		if depth < maxDepth && r.Intn(4) != 0 {
+			n := r.Intn(4)
+			m := reflect.MakeMapWithSize(t, n)
+			for i := 0; i < n; i++ {
+				k := reflect.New(t.Key()).Elem()
+				fill(k, r, depth+1)
+				e := reflect.New(t.Elem()).Elem()
+				fill(e, r, depth+1)
+				m.SetMapIndex(k, e)
+			}
+			v.Set(m)
+		}
+	case reflect.Interface:
+		if t == emptyInterface {
+			if x := randomAny(r, depth); x != nil {
+				v.Set(reflect.ValueOf(x))
+			}
+		}
+	case reflect.Struct:
+		fillStruct(v, r, depth)
+	}
+}
+
+// fillStruct fills the fields of v that apexJSON encodes
+func fillStruct(v reflect.Value, r *rand.Rand, depth int) {
+	fields, err := apexJSON.TypeSchema(v.Type())
+	if err != nil {
+		return
+	}
+	for _, f := range fields {
+		if f.Options.Unknown {
+			continue
+		}
+		fv := v.FieldByName(f.GoField)
+		if !f.Options.Optional {
+			fill(fv, r, depth)
+			continue
+		}
+
+		// Optional values are only written when Present and not Null, so
+		// the others have to stay zero to survive the trip
+		switch r.Intn(3) {
+		case 0:
+		case 1:
+			fv.FieldByName("Present").SetBool(true)
+			fv.FieldByName("Null").SetBool(true)
+		default:
+			fv.FieldByName("Present").SetBool(true)
+			fill(fv.FieldByName("Value"), r, depth)
+		}
+	}
+}
+
+// randomAny returns a value of one of the types JSON decodes into an
+// interface{}
+func randomAny(r *rand.Rand, depth int) interface{} {
+	n := 4
+	if depth < maxDepth {
+		n = 6
+	}
+	switch r.Intn(n) {
+	case 0:
+		return nil
+	case 1:
+		return r.Intn(2) == 0
+	case 2:
+		return randomFloat64(r)
+	case 3:
+		return randomString(r)
+	case 4:
+		a := make([]interface{}, r.Intn(4))
+		for i := range a {
+			a[i] = randomAny(r, depth+1)
+		}
+		return a
+	default:
+		m := make(map[string]interface{})
+		for i := r.Intn(4); i > 0; i-- {
+			m[randomString(r)] = randomAny(r, depth+1)
+		}
+		return m
+	}
+}
+
+// randomFloat64 returns a finite float64, favoring small and whole numbers
+// but covering the whole exponent range
+func randomFloat64(r *rand.Rand) float64 {
+	switch r.Intn(3) {
+	case 0:
+		return float64(r.Intn(2001) - 1000)
+	case 1:
+		return r.NormFloat64() * 1000
+	}
+	for {
+		f := math.Float64frombits(r.Uint64())
+		if !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+	}
+}
+
+// randomFloat32 is randomFloat64 for float32
+func randomFloat32(r *rand.Rand) float32 {
+	if r.Intn(3) != 0 {
+		return float32(randomFloat64(r))
+	}
+	for {
+		f := math.Float32frombits(r.Uint32())
+		if !math.IsNaN(float64(f)) && !math.IsInf(float64(f), 0) {
+			return f
+		}
+	}
+}
+
+// stringRunes are mixed into random strings to exercise escaping
+var stringRunes = []rune{'"', '\\', '/', '<', '>', '&', '\n', '\t', 0, 0x1f, 0x7f, 'é', 0x2028, 0xfffd, 0x1f600}
+
+// randomString returns a valid UTF-8 string of up to 15 runes
+func randomString(r *rand.Rand) string {
+	b := make([]rune, r.Intn(16))
+	for i := range b {
+		switch r.Intn(4) {
+		case 0:
+			b[i] = stringRunes[r.Intn(len(stringRunes))]
+		case 1:
+			// Any scalar value, skipping the surrogate range
+			b[i] = rune(r.Intn(0x10ffff - 0x800))
+			if b[i] >= 0xd800 {
+				b[i] += 0x800
+			}
+		default:
+			b[i] = rune(' ' + r.Intn(95))
+		}
+	}
+	return string(b)
+}
+
+// diff compares want, a value before the round trip, with got, the value
+// decoded from it, under the allowances RoundTrip documents. It returns the
+// path of the first difference and false if they don't match.
+func diff(want, got reflect.Value, path string) (string, bool) {
+	if want.Type() != got.Type() {
+		return path, false
+	}
+
+	t := want.Type()
+	if t == timeType {
+		a := want.Interface().(time.Time).Truncate(time.Second)
+		b := got.Interface().(time.Time).Truncate(time.Second)
+		return path, a.Equal(b)
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if want.IsNil() || got.IsNil() {
+			return path, want.IsNil() == got.IsNil()
+		}
+		return diff(want.Elem(), got.Elem(), path)
+
+	case reflect.Interface:
+		if want.IsNil() || got.IsNil() {
+			return path, want.IsNil() == got.IsNil()
+		}
+		a, b := want.Elem(), got.Elem()
+		if fa, ok := number(a); ok {
+			fb, ok := number(b)
+			return path, ok && fa == fb
+		}
+		return diff(a, b, path)
+
+	case reflect.Slice, reflect.Array:
+		if want.Len() != got.Len() {
+			return path, false
+		}
+		for i := 0; i < want.Len(); i++ {
+			if p, ok := diff(want.Index(i), got.Index(i), path+"["+strconv.Itoa(i)+"]"); !ok {
+				return p, false
+			}
+		}
+		return path, true
+
+	case reflect.Map:
+		if want.Len() != got.Len() {
+			return path, false
+		}
+		for iter := want.MapRange(); iter.Next(); {
+			key := iter.Key()
+			p := path + "[" + strconv.Quote(fmtKey(key)) + "]"
+			g := got.MapIndex(key)
+			if !g.IsValid() {
+				return p, false
+			}
+			if p, ok := diff(iter.Value(), g, p); !ok {
+				return p, false
+			}
+		}
+		return path, true
+
+	case reflect.Struct:
+		fields, err := apexJSON.TypeSchema(t)
+		if err != nil {
+			return path, false
+		}
+		for _, f := range fields {
+			p := f.GoField
+			if path != "" {
+				p = path + "." + p
+			}
+			if p, ok := diff(want.FieldByName(f.GoField), got.FieldByName(f.GoField), p); !ok {
+				return p, false
+			}
+		}
+		return path, true
+
+	case reflect.Float32, reflect.Float64:
+		return path, want.Float() == got.Float()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return path, want.Int() == got.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return path, want.Uint() == got.Uint()
+	case reflect.String:
+		return path, want.String() == got.String()
+	case reflect.Bool:
+		return path, want.Bool() == got.Bool()
+	}
+	return path, reflect.DeepEqual(want.Interface(), got.Interface())
+}
+
+// number returns the value of v if it is of a numeric kind
+func number(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	}
+	return 0, false
+}
+
+// fmtKey formats a map key for a difference path
+func fmtKey(k reflect.Value) string {
+	if k.Kind() == reflect.String {
+		return k.String()
+	}
+	if f, ok := number(k); ok {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return k.Type().String()
+}
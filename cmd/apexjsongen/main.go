@@ -0,0 +1,748 @@
+// Apexjsongen writes MarshalApexJSON and UnmarshalApexJSON methods for
+// struct types, so apexJSON encodes and decodes them without reflection.
+// It is meant to be run by go generate:
+//
+//	//go:generate go run apexJSON/cmd/apexjsongen -type User,Post -output user_json.go
+//
+// The files named on the command line, or else the non-test Go files of the
+// current directory, are searched for the types. The methods follow the
+// json tags as the reflect path does, and fall back to it whenever the
+// encode or decode has options that change how fields are written or
+// matched. Fields of types apexjsongen doesn't know how to write, such as
+// maps, interfaces and pointers, are handed to the Buffer and Parser as
+// values, and still encoded by reflection.
+//
+// The fields of embedded structs are promoted, as by the reflect path, when
+// the struct is declared in the same files and embedded by value; other
+// untagged embedded structs are rejected. Of fields with the same JSON name,
+// the one the reflect path encodes is kept, or none if it drops them all.
+// Types with Optional or Unknown fields, and ,string on a field whose type
+// isn't a predeclared number or bool, are rejected. Fields are encoded as
+// copies, so MarshalJSON and MarshalText methods declared on a pointer to
+// the field's type are not called.
+package main
+
+import (
+	"apexJSON"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// libPath is the import path of the apexJSON package
+const libPath = "apexJSON"
+
+// fieldKind is how a field is encoded and decoded by generated code
+type fieldKind int
+
+const (
+	kindOther       fieldKind = iota // handed to Buffer.WriteValue and Parser.DecodeValue
+	kindString                       // predeclared string
+	kindBool                         // predeclared bool
+	kindInt                          // predeclared signed integer
+	kindUint                         // predeclared unsigned integer, except uintptr
+	kindFloat                        // predeclared float32 or float64
+	kindTime                         // time.Time
+	kindScalarSlice                  // slice of one of the predeclared kinds above, except bytes
+	kindStruct                       // a struct type being generated
+	kindStructSlice                  // slice of a struct type being generated, that can't contain itself
+)
+
+// field is one encoded struct field
+type field struct {
+	goName    string    // Go field name, with the embedded fields it is promoted through
+	depth     int       // number of embedded structs it is promoted through
+	name      string    // JSON name
+	key       string    // quoted and escaped JSON name, with the colon
+	kind      fieldKind // how the field is encoded
+	elem      fieldKind // element kind of a kindScalarSlice
+	bits      int       // float size for kindFloat, or the element's for a kindScalarSlice
+	typeName  string    // the generated type of a kindStruct or kindStructSlice
+	expr      ast.Expr  // declared type
+	tagged    bool      // the JSON name comes from the tag
+	omitEmpty bool
+	stringOpt bool
+}
+
+// structType is a type to generate methods for
+type structType struct {
+	name   string
+	file   *ast.File
+	st     *ast.StructType
+	fields []field
+}
+
+// generator collects the output for one package
+type generator struct {
+	pkg      string                 // package name
+	lib      string                 // qualifier for the apexJSON package, with its dot
+	types    map[string]*structType // types being generated, by name
+	all      map[string]*structType // every type declared in the files, by name
+	declared map[string]bool        // every type declared in the files
+	reflect  bool                   // the output uses package reflect
+	out      bytes.Buffer
+}
+
+func main() {
+	typeNames := flag.String("type", "", "comma-separated list of struct type names; required")
+	output := flag.String("output", "", "output file name; default <first type>_apexjson.go")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: apexjsongen -type T[,T...] [-output file] [file.go ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *typeNames == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	names := strings.Split(*typeNames, ",")
+	src, err := generate(names, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apexjsongen: %v\n", err)
+		os.Exit(1)
+	}
+
+	name := *output
+	if name == "" {
+		name = strings.ToLower(names[0]) + "_apexjson.go"
+	}
+	if err := os.WriteFile(name, src, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "apexjsongen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// generate returns the formatted source of the methods for the named types,
+// found in files or in the current directory when there are none
+func generate(names, files []string) ([]byte, error) {
+	if len(files) == 0 {
+		matches, err := filepath.Glob("*.go")
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if !strings.HasSuffix(m, "_test.go") {
+				files = append(files, m)
+			}
+		}
+	}
+
+	g := &generator{types: make(map[string]*structType), all: make(map[string]*structType), declared: make(map[string]bool)}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		f, err := parser.ParseFile(fset, name, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		if g.pkg == "" {
+			g.pkg = f.Name.Name
+		} else if g.pkg != f.Name.Name {
+			return nil, fmt.Errorf("%s is in package %s, not %s", name, f.Name.Name, g.pkg)
+		}
+		g.collect(f)
+	}
+
+	g.lib = "apexJSON."
+	if g.pkg == "apexJSON" {
+		g.lib = ""
+	}
+	for _, name := range names {
+		t, ok := g.types[name]
+		if !ok || t.st == nil {
+			return nil, fmt.Errorf("no struct type %s", name)
+		}
+	}
+	// Only the requested types are generated
+	for name := range g.types {
+		if !contains(names, name) {
+			delete(g.types, name)
+		}
+	}
+
+	for _, name := range names {
+		if err := g.resolve(g.types[name]); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	g.markRecursiveSlices()
+
+	var body bytes.Buffer
+	for _, name := range names {
+		g.out.Reset()
+		g.writeMethods(g.types[name])
+		body.Write(g.out.Bytes())
+	}
+
+	g.out.Reset()
+	g.printf("// Code generated by apexjsongen; DO NOT EDIT.\n\n")
+	g.printf("package %s\n\n", g.pkg)
+	g.printf("import (\n")
+	if g.lib != "" {
+		g.printf("%q\n", libPath)
+	}
+	if g.reflect {
+		g.printf("\"reflect\"\n")
+	}
+	g.printf(")\n")
+	g.out.Write(body.Bytes())
+
+	src, err := format.Source(g.out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting output: %v", err)
+	}
+	return src, nil
+}
+
+// collect records the type declarations of f
+func (g *generator) collect(f *ast.File) {
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			g.declared[ts.Name.Name] = true
+			t := &structType{name: ts.Name.Name, file: f}
+			if st, ok := ts.Type.(*ast.StructType); ok && ts.TypeParams == nil {
+				t.st = st
+			}
+			g.types[ts.Name.Name] = t
+			g.all[ts.Name.Name] = t
+		}
+	}
+}
+
+// resolve works out the JSON names and kinds of t's fields
+func (g *generator) resolve(t *structType) error {
+	fields, err := g.structFields(t, "", 0, map[string]bool{t.name: true})
+	if err != nil {
+		return err
+	}
+
+	// Of fields with the same name, the shallowest wins, then the only
+	// tagged one among them; otherwise the name is ambiguous and none is
+	// encoded
+	byName := make(map[string][]field, len(fields))
+	for _, f := range fields {
+		byName[f.name] = append(byName[f.name], f)
+	}
+	for _, f := range fields {
+		if dominant(f, byName[f.name]) {
+			t.fields = append(t.fields, f)
+		}
+	}
+	return nil
+}
+
+// dominant reports whether f is the field the reflect path keeps of group,
+// the fields sharing its name
+func dominant(f field, group []field) bool {
+	for _, o := range group {
+		if o.goName == f.goName {
+			continue
+		}
+		if o.depth < f.depth || o.depth == f.depth && (o.tagged || !f.tagged) {
+			return false
+		}
+	}
+	return true
+}
+
+// structFields returns the fields of t, reached through the embedded
+// fields in prefix, with those of its untagged embedded structs in their
+// place. visiting holds the types on the way down.
+func (g *generator) structFields(t *structType, prefix string, depth int, visiting map[string]bool) ([]field, error) {
+	var fields []field
+	for _, af := range t.st.Fields.List {
+		tag := ""
+		if af.Tag != nil {
+			s, err := strconv.Unquote(af.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag = reflect.StructTag(s).Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if !isValidTag(name) {
+			name = ""
+		}
+
+		names := af.Names
+		if len(names) == 0 {
+			// Embedded fields are named after their type
+			id := embeddedName(af.Type)
+			if id == nil {
+				return nil, fmt.Errorf("unsupported embedded field %s", exprString(af.Type))
+			}
+			if name == "" {
+				et, err := g.embeddedStruct(af.Type)
+				if err != nil {
+					return nil, err
+				}
+				if et != nil {
+					if !visiting[et.name] {
+						visiting[et.name] = true
+						promoted, err := g.structFields(et, prefix+id.Name+".", depth+1, visiting)
+						delete(visiting, et.name)
+						if err != nil {
+							return nil, err
+						}
+						fields = append(fields, promoted...)
+					}
+					continue
+				}
+			}
+			names = []*ast.Ident{id}
+		}
+
+		for _, id := range names {
+			if !id.IsExported() {
+				continue
+			}
+			f := field{goName: prefix + id.Name, name: id.Name, depth: depth, expr: af.Type}
+			if name != "" {
+				f.name, f.tagged = name, true
+			}
+			for _, opt := range strings.Split(opts, ",") {
+				switch opt {
+				case "omitempty":
+					f.omitEmpty = true
+				case "string":
+					f.stringOpt = true
+				case "jsonstring", "duration:string":
+					return nil, fmt.Errorf("field %s: %s fields are not supported", id.Name, opt)
+				}
+			}
+
+			key, err := apexJSON.Marshal(f.name)
+			if err != nil {
+				return nil, err
+			}
+			f.key = string(key) + ":"
+
+			if err := g.classify(t.file, &f); err != nil {
+				return nil, fmt.Errorf("field %s: %v", id.Name, err)
+			}
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// embeddedStruct returns the struct type whose fields the untagged
+// embedded field of type expr promotes, or nil if it is a field of its own.
+// Only structs declared in the files and embedded by value are supported;
+// for others, generated code would have to allocate nil pointers or know
+// types it can't see.
+func (g *generator) embeddedStruct(expr ast.Expr) (*structType, error) {
+	switch e := expr.(type) {
+	case *ast.StarExpr:
+		return nil, fmt.Errorf("embedded pointer %s is not supported", exprString(expr))
+	case *ast.SelectorExpr:
+		return nil, fmt.Errorf("embedded field %s from another package is not supported", exprString(expr))
+	case *ast.Ident:
+		if t, ok := g.all[e.Name]; ok && t.st != nil {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// classify sets the kind of f from its declared type
+func (g *generator) classify(file *ast.File, f *field) error {
+	switch e := f.expr.(type) {
+	case *ast.Ident:
+		f.kind, f.bits = g.predeclared(e.Name)
+		if t, ok := g.types[e.Name]; ok && f.kind == kindOther && t.st != nil {
+			f.kind, f.typeName = kindStruct, e.Name
+		}
+	case *ast.SelectorExpr:
+		switch importPath(file, e.X) {
+		case "time":
+			if e.Sel.Name == "Time" {
+				f.kind = kindTime
+			}
+		case libPath:
+			if e.Sel.Name == "Unknown" || e.Sel.Name == "Optional" {
+				return fmt.Errorf("%s fields are not supported", e.Sel.Name)
+			}
+		}
+	case *ast.IndexExpr:
+		if sel, ok := e.X.(*ast.SelectorExpr); ok && importPath(file, sel.X) == libPath && sel.Sel.Name == "Optional" {
+			return fmt.Errorf("Optional fields are not supported")
+		}
+	case *ast.ArrayType:
+		id, ok := e.Elt.(*ast.Ident)
+		if e.Len != nil || !ok {
+			break
+		}
+		if elem, bits := g.predeclared(id.Name); elem != kindOther && id.Name != "byte" && id.Name != "uint8" {
+			f.kind, f.elem, f.bits = kindScalarSlice, elem, bits
+		} else if t, ok := g.types[id.Name]; ok && elem == kindOther && t.st != nil {
+			f.kind, f.typeName = kindStructSlice, id.Name
+		}
+	}
+	if g.pkg == "apexJSON" {
+		if id, ok := f.expr.(*ast.Ident); ok && (id.Name == "Unknown" || id.Name == "Optional") {
+			return fmt.Errorf("%s fields are not supported", id.Name)
+		}
+	}
+
+	// Structs are never empty without DeepOmitEmpty, which sends the
+	// encode to WriteFields
+	if f.kind == kindTime || f.kind == kindStruct {
+		f.omitEmpty = false
+	}
+
+	if f.stringOpt {
+		switch f.kind {
+		case kindString, kindBool, kindInt, kindUint, kindFloat:
+		default:
+			switch f.expr.(type) {
+			case *ast.Ident, *ast.SelectorExpr, *ast.IndexExpr:
+				if f.kind != kindStruct && f.kind != kindTime {
+					return fmt.Errorf(",string on %s, which may or may not be a number", exprString(f.expr))
+				}
+			}
+			// The option does nothing for pointers, slices, maps and structs
+			f.stringOpt = false
+		}
+		if f.kind == kindString {
+			f.stringOpt = false
+		}
+	}
+	return nil
+}
+
+// predeclared returns the kind of the predeclared type name, with its size
+// for floats, or kindOther if it is none or the package redeclares it
+func (g *generator) predeclared(name string) (fieldKind, int) {
+	if g.declared[name] {
+		return kindOther, 0
+	}
+	switch name {
+	case "string":
+		return kindString, 0
+	case "bool":
+		return kindBool, 0
+	case "int", "int8", "int16", "int32", "int64", "rune":
+		return kindInt, 0
+	case "uint", "uint8", "uint16", "uint32", "uint64", "byte":
+		return kindUint, 0
+	case "float32":
+		return kindFloat, 32
+	case "float64":
+		return kindFloat, 64
+	}
+	return kindOther, 0
+}
+
+// markRecursiveSlices turns kindStructSlice fields whose element type can
+// hold a slice of itself back into kindOther, so the reflect path's cycle
+// check sees them
+func (g *generator) markRecursiveSlices() {
+	for _, t := range g.types {
+		for i := range t.fields {
+			f := &t.fields[i]
+			if f.kind == kindStructSlice && g.reaches(f.typeName, f.typeName, make(map[string]bool)) {
+				f.kind = kindOther
+			}
+		}
+	}
+}
+
+// reaches reports whether the generated type from holds, through fields
+// written by generated code, a slice of the type to
+func (g *generator) reaches(from, to string, visited map[string]bool) bool {
+	if visited[from] {
+		return false
+	}
+	visited[from] = true
+	for _, f := range g.types[from].fields {
+		switch f.kind {
+		case kindStructSlice:
+			if f.typeName == to || g.reaches(f.typeName, to, visited) {
+				return true
+			}
+		case kindStruct:
+			if g.reaches(f.typeName, to, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeMethods writes the methods of t
+func (g *generator) writeMethods(t *structType) {
+	g.printf("\n// ApexJSONGenerated implements %sGenerated\n", g.lib)
+	g.printf("func (%s) ApexJSONGenerated() {}\n", t.name)
+
+	g.printf("\n// MarshalApexJSON implements %sMarshalerTo\n", g.lib)
+	g.printf("func (x %s) MarshalApexJSON(buf *%sBuffer) error {\n", t.name, g.lib)
+	g.printf("if !buf.Plain() {\nreturn buf.WriteFields(x)\n}\n")
+	g.writeFields(t.fields)
+	g.printf("return nil\n}\n")
+
+	g.printf("\n// UnmarshalApexJSON implements %sUnmarshalerFrom\n", g.lib)
+	g.printf("func (x *%s) UnmarshalApexJSON(p *%sParser) error {\n", t.name, g.lib)
+	if len(t.fields) == 0 {
+		g.printf("return p.DecodeObject(x, func(string) (bool, error) { return false, nil })\n}\n")
+		return
+	}
+	g.printf("return p.DecodeObject(x, func(key string) (bool, error) {\nswitch key {\n")
+	for _, f := range t.fields {
+		g.printf("case %s:\nreturn true, %s\n", strconv.Quote(f.name), g.decode(f))
+	}
+	g.printf("}\nreturn false, nil\n})\n}\n")
+}
+
+// writeFields writes the body of MarshalApexJSON for fields. Members are
+// separated by literal commas while it is known whether one came before,
+// and through the variable more after an omitempty field leaves it open.
+func (g *generator) writeFields(fields []field) {
+	const (
+		none  = iota // no member written yet
+		some         // a member has been written
+		maybe        // more tells whether a member has been written
+	)
+	state := none
+	pending := "{" // literal output not yet written
+	flush := func() {
+		switch len(pending) {
+		case 0:
+			return
+		case 1:
+			g.printf("buf.WriteByte('%s')\n", pending)
+		default:
+			g.printf("buf.WriteString(%s)\n", literal(pending))
+		}
+		pending = ""
+	}
+
+	for i, f := range fields {
+		last := i == len(fields)-1
+		if !f.omitEmpty {
+			if state == maybe {
+				flush()
+				g.printf("if more {\nbuf.WriteByte(',')\n}\n")
+			} else if state == some {
+				pending += ","
+			}
+			pending += f.key
+			flush()
+			g.writeValue(f, "x."+f.goName)
+			state = some
+			continue
+		}
+
+		flush()
+		if state == none && !last {
+			g.printf("more := false\n")
+		}
+		g.printf("if %s {\n", g.nonEmpty(f, "x."+f.goName))
+		switch state {
+		case some:
+			g.printf("buf.WriteString(%s)\n", literal(","+f.key))
+		case maybe:
+			g.printf("if more {\nbuf.WriteByte(',')\n}\n")
+			g.printf("buf.WriteString(%s)\n", literal(f.key))
+		default:
+			g.printf("buf.WriteString(%s)\n", literal(f.key))
+		}
+		g.writeValue(f, "x."+f.goName)
+		if state != some && !last {
+			g.printf("more = true\n")
+		}
+		g.printf("}\n")
+		if state == none {
+			state = maybe
+		}
+	}
+	pending += "}"
+	flush()
+}
+
+// writeValue writes the code that encodes the field f held in v
+func (g *generator) writeValue(f field, v string) {
+	if f.stringOpt {
+		g.printf("buf.WriteByte('\"')\n")
+	}
+	switch f.kind {
+	case kindScalarSlice:
+		g.printf("if %s == nil {\nbuf.WriteString(\"null\")\n} else {\n", v)
+		g.printf("buf.WriteByte('[')\nfor i, e := range %s {\n", v)
+		g.printf("if i > 0 {\nbuf.WriteByte(',')\n}\n")
+		g.writeScalar(f.elem, f.bits, "e")
+		g.printf("}\nbuf.WriteByte(']')\n}\n")
+	case kindStructSlice:
+		g.printf("if %s == nil {\nbuf.WriteString(\"null\")\n} else {\n", v)
+		g.printf("buf.WriteByte('[')\nfor i := range %s {\n", v)
+		g.printf("if i > 0 {\nbuf.WriteByte(',')\n}\n")
+		g.printf("if err := %s[i].MarshalApexJSON(buf); err != nil {\nreturn err\n}\n", v)
+		g.printf("}\nbuf.WriteByte(']')\n}\n")
+	case kindStruct:
+		g.printf("if err := %s.MarshalApexJSON(buf); err != nil {\nreturn err\n}\n", v)
+	case kindTime:
+		g.printf("if err := buf.WriteTime(%s); err != nil {\nreturn err\n}\n", v)
+	case kindOther:
+		g.printf("if err := buf.WriteValue(%s); err != nil {\nreturn err\n}\n", v)
+	default:
+		g.writeScalar(f.kind, f.bits, v)
+	}
+	if f.stringOpt {
+		g.printf("buf.WriteByte('\"')\n")
+	}
+}
+
+// writeScalar writes the code that encodes v, of a predeclared kind
+func (g *generator) writeScalar(kind fieldKind, bits int, v string) {
+	switch kind {
+	case kindString:
+		g.printf("buf.WriteJSONString(%s)\n", v)
+	case kindBool:
+		g.printf("buf.WriteBool(%s)\n", v)
+	case kindInt:
+		g.printf("buf.WriteInt(int64(%s))\n", v)
+	case kindUint:
+		g.printf("buf.WriteUint(uint64(%s))\n", v)
+	case kindFloat:
+		g.printf("if err := buf.WriteFloat(float64(%s), %d); err != nil {\nreturn err\n}\n", v, bits)
+	}
+}
+
+// nonEmpty returns the condition under which the omitempty field f held in
+// v is written, matching DefaultIsEmpty
+func (g *generator) nonEmpty(f field, v string) string {
+	switch f.kind {
+	case kindString:
+		return v + ` != ""`
+	case kindBool:
+		return v
+	case kindInt, kindUint, kindFloat:
+		return v + " != 0"
+	case kindScalarSlice, kindStructSlice:
+		return "len(" + v + ") != 0"
+	}
+	switch f.expr.(type) {
+	case *ast.StarExpr, *ast.InterfaceType, *ast.FuncType, *ast.ChanType:
+		return v + " != nil"
+	case *ast.ArrayType, *ast.MapType:
+		return "len(" + v + ") != 0"
+	}
+	g.reflect = true
+	return "!" + g.lib + "DefaultIsEmpty(reflect.ValueOf(" + v + "))"
+}
+
+// decode returns the expression that decodes the field f
+func (g *generator) decode(f field) string {
+	v := "x." + f.goName
+	switch f.kind {
+	case kindString:
+		return "p.DecodeString(&" + v + ")"
+	case kindBool:
+		return "p.DecodeBool(&" + v + ")"
+	case kindInt:
+		return g.lib + "DecodeInt(p, &" + v + ")"
+	case kindUint:
+		return g.lib + "DecodeUint(p, &" + v + ")"
+	case kindFloat:
+		return g.lib + "DecodeFloat(p, &" + v + ")"
+	case kindStruct:
+		return v + ".UnmarshalApexJSON(p)"
+	}
+	return "p.DecodeValue(&" + v + ")"
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.out, format, args...)
+}
+
+// literal returns s as a Go string literal, raw when it can be
+func literal(s string) string {
+	if strings.ContainsAny(s, "`\r") || !strconv.CanBackquote(s) {
+		return strconv.Quote(s)
+	}
+	return "`" + s + "`"
+}
+
+// embeddedName returns the name an embedded field of type expr gets
+func embeddedName(expr ast.Expr) *ast.Ident {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return e
+	case *ast.SelectorExpr:
+		return e.Sel
+	}
+	return nil
+}
+
+// importPath returns the path of the package x names in file, if x is an
+// imported package name
+func importPath(file *ast.File, x ast.Expr) string {
+	id, ok := x.(*ast.Ident)
+	if !ok {
+		return ""
+	}
+	for _, imp := range file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		if name == id.Name {
+			return path
+		}
+	}
+	return ""
+}
+
+// exprString returns the source form of expr, for messages
+func exprString(expr ast.Expr) string {
+	var b bytes.Buffer
+	format.Node(&b, token.NewFileSet(), expr)
+	return b.String()
+}
+
+// isValidTag reports whether s can be used as a JSON name, as the reflect
+// path decides; other names fall back to the Go field name
+func isValidTag(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune("!#$%&()*+-./:;<=>?@[]^_{|}~ ", c):
+		case !unicode.IsLetter(c) && !unicode.IsDigit(c):
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package apexJSON_test
+
+import (
+	"apexJSON"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateCompat rewrites compatGoldenPath from the encoding/json the tests
+// are built with instead of checking against it. That must be Go 1.24's,
+// which StdlibCompat matches; later toolchains have it with
+// GOEXPERIMENT=nojsonv2.
+var updateCompat = flag.Bool("update-compat", false, "rewrite the StdlibCompat expected outputs from encoding/json")
+
+// compatGoldenPath holds the expected StdlibCompat outputs, keyed by case
+// and encode
+const compatGoldenPath = "testdata/compat/outputs.golden"
+
+var compatGolden map[string]string
+
+// compatOrder is the typed form of testdata/compat/order_request.json. Some
+// tags differ from the document in case, which encoding/json still matches.
+type compatOrder struct {
+	ID       string `json:"id"`
+	Customer struct {
+		Name  string   `json:"name"`
+		Email string   `json:"EMAIL"`
+		Tags  []string `json:"tags"`
+	} `json:"customer"`
+	Items []struct {
+		SKU      string  `json:"sku"`
+		Qty      int     `json:"qty"`
+		Price    float64 `json:"price"`
+		Discount float32 `json:"discount"`
+	} `json:"items"`
+	Total    json.Number             `json:"total"`
+	Currency string                  `json:"currency"`
+	Note     string                  `json:"note"`
+	PlacedAt time.Time               `json:"placed_at"`
+	Gift     bool                    `json:"gift"`
+	Coupon   string                  `json:"coupon"`
+	Metadata map[string]interface{}  `json:"metadata"`
+	Extra    map[string]compatMarker `json:"extra,omitempty"`
+}
+
+// compatMarker has MarshalJSON output that encoding/json compacts and
+// escapes
+type compatMarker struct{ Label string }
+
+func (m compatMarker) MarshalJSON() ([]byte, error) {
+	return []byte(`{ "label" : "<` + m.Label + `>",` + "\n" + ` "n": [1, 2] }`), nil
+}
+
+// TestStdlibCompatCorpus replays recorded request and response bodies
+// through encoding/json and through this package with StdlibCompat, and
+// requires the same values and byte-identical output
+func TestStdlibCompatCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "compat", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no corpus: %v", err)
+	}
+	compat := apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{StdlibCompat: true}}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			body, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got, want interface{}
+			if err := apexJSON.UnmarshalValue(body, reflect.ValueOf(&got), &compat); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(body, &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("decoded %v\nencoding/json %v", got, want)
+			}
+			compareCompatOutput(t, filepath.Base(file), want)
+		})
+	}
+
+	t.Run("typed", func(t *testing.T) {
+		body, err := os.ReadFile(filepath.Join("testdata", "compat", "order_request.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, want compatOrder
+		if err := apexJSON.UnmarshalValue(body, reflect.ValueOf(&got), &compat); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(body, &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("decoded %+v\nencoding/json %+v", got, want)
+		}
+		if got.Customer.Email == "" || got.Customer.Name == "" {
+			t.Errorf("case-insensitive fields not matched: %+v", got.Customer)
+		}
+
+		want.Extra = map[string]compatMarker{"b": {"x&y"}, "a": {" "}}
+		compareCompatOutput(t, "typed", want)
+		compareCompatOutput(t, "typed pointer", &want)
+	})
+}
+
+func TestStdlibCompatValues(t *testing.T) {
+	type bytes2 []byte
+	values := []interface{}{
+		1e6, 1e20, 1e21, 1e-6, 1e-7, 123456789.0, float32(1e6), float32(3.14), float32(1e-7), 5e-324,
+		"bad\xffutf8\xe2\x80", "<a&b>\u2028\u2029", json.Number("-3"),
+		map[int]string{10: "a", 2: "b", -1: "c"}, map[string]int{"b": 1, "a": 2, "B": 3},
+		time.Date(2024, 1, 2, 3, 4, 5, 600, time.FixedZone("", 3600)),
+		[2]byte{1, 2}, bytes2("hi"), []byte(nil), [0]int{},
+		map[string]interface{}{"n": nil, "m": compatMarker{"m"}, "r": json.RawMessage(` [1, "<"] `)},
+	}
+	for i, v := range values {
+		compareCompatOutput(t, fmt.Sprintf("values[%d]", i), v)
+	}
+
+	// Number stands in for encoding/json's Number
+	opts := apexJSON.MarshalOptions{StdlibCompat: true}
+	for n, lit := range map[string]string{"12.50": "12.50", "-3e-7": "-3e-7", "": "0"} {
+		got, err := apexJSON.MarshalWithOptions(struct {
+			N  apexJSON.Number
+			NS []apexJSON.Number
+			NM map[string]apexJSON.Number
+		}{apexJSON.Number(n), []apexJSON.Number{apexJSON.Number(n)}, map[string]apexJSON.Number{"n": apexJSON.Number(n)}}, opts)
+		want := `{"N":` + lit + `,"NS":[` + lit + `],"NM":{"n":` + lit + `}}`
+		if err != nil || string(got) != want {
+			t.Errorf("Number(%q): got %s, %v, want %s", n, got, err, want)
+		}
+	}
+	if _, err := apexJSON.MarshalWithOptions(apexJSON.Number("1x"), opts); err == nil {
+		t.Error("invalid Number accepted")
+	}
+}
+
+// compareCompatOutput encodes v, the case named name, with StdlibCompat
+// through Marshal, MarshalIndent and an Encoder with and without HTML
+// escaping, and reports any difference from encoding/json's output
+func compareCompatOutput(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	opts := apexJSON.MarshalOptions{StdlibCompat: true}
+
+	got, err := apexJSON.MarshalWithOptions(v, opts)
+	want := compatWant(t, name+" Marshal", func() string { data, _ := json.Marshal(v); return string(data) })
+	if err != nil || string(got) != want {
+		t.Errorf("Marshal: %v\n got %s\nwant %s", err, got, want)
+	}
+
+	apexJSON.SetStdlibCompat(true)
+	defer apexJSON.SetStdlibCompat(false)
+
+	got, err = apexJSON.MarshalIndent(v, "> ", "\t")
+	want = compatWant(t, name+" MarshalIndent", func() string { data, _ := json.MarshalIndent(v, "> ", "\t"); return string(data) })
+	if err != nil || string(got) != want {
+		t.Errorf("MarshalIndent: %v\n got %s\nwant %s", err, got, want)
+	}
+
+	for _, escape := range []bool{true, false} {
+		var gotBuf strings.Builder
+		enc := apexJSON.NewEncoder(&gotBuf)
+		enc.SetEscapeHTML(escape)
+		err := enc.Encode(v)
+		want := compatWant(t, fmt.Sprintf("%s Encode escapeHTML=%v", name, escape), func() string {
+			var wantBuf strings.Builder
+			std := json.NewEncoder(&wantBuf)
+			std.SetEscapeHTML(escape)
+			std.Encode(v)
+			return wantBuf.String()
+		})
+		if err != nil || gotBuf.String() != want {
+			t.Errorf("Encode with SetEscapeHTML(%v): %v\n got %s\nwant %s", escape, err, gotBuf.String(), want)
+		}
+	}
+}
+
+// compatWant returns the expected output for key from compatGoldenPath,
+// or with -update-compat records the output of std there
+func compatWant(t *testing.T, key string, std func() string) string {
+	t.Helper()
+	if compatGolden == nil {
+		compatGolden = make(map[string]string)
+		data, err := os.ReadFile(compatGoldenPath)
+		if err == nil {
+			err = json.Unmarshal(data, &compatGolden)
+		}
+		if err != nil && !*updateCompat {
+			t.Fatal(err)
+		}
+	}
+	if !*updateCompat {
+		want, ok := compatGolden[key]
+		if !ok {
+			t.Errorf("no expected output for %q; run go test -update-compat with Go 1.24", key)
+		}
+		return want
+	}
+
+	compatGolden[key] = std()
+	var data strings.Builder
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(compatGolden); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(compatGoldenPath, []byte(data.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return compatGolden[key]
+}
+
+func TestStdlibCompatDecode(t *testing.T) {
+	type record struct {
+		FooBar int
+		Count  int    `json:"count"`
+		Name   string `json:"name"`
+		Ptr    *int   `json:"ptr"`
+	}
+	compat := apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{StdlibCompat: true}}
+
+	for _, in := range []string{
+		`{"foobar":1,"COUNT":2,"Name":"x"}`,
+		`{"count":null,"name":null,"ptr":null}`,
+		`{"count":3,"name":"partial"} trailing`,
+		`{"count":4,"name":"partial","ptr":`,
+	} {
+		got := record{Count: 9, Name: "before"}
+		want := got
+		gotErr := apexJSON.UnmarshalValue([]byte(in), reflect.ValueOf(&got), &compat)
+		wantErr := json.Unmarshal([]byte(in), &want)
+		if !reflect.DeepEqual(got, want) || (gotErr == nil) != (wantErr == nil) {
+			t.Errorf("%s: got %+v, %v\nencoding/json %+v, %v", in, got, gotErr, want, wantErr)
+		}
+	}
+
+	// Without the flag null is an error for an int and names match exactly
+	var plain record
+	if err := apexJSON.Unmarshal([]byte(`{"count":null}`), &plain); err == nil {
+		t.Error("null into int accepted without StdlibCompat")
+	}
+	if apexJSON.Unmarshal([]byte(`{"foobar":1}`), &plain); plain.FooBar != 0 {
+		t.Error("case-insensitive match without StdlibCompat")
+	}
+
+	apexJSON.SetStdlibCompat(true)
+	defer apexJSON.SetStdlibCompat(false)
+	if err := apexJSON.Unmarshal([]byte(`{"foobar":1,"count":null}`), &plain); err != nil || plain.FooBar != 1 {
+		t.Errorf("SetStdlibCompat: got %+v, %v", plain, err)
+	}
+	plain = record{}
+	if err := apexJSON.NewDecoder(strings.NewReader(`{"FOOBAR":2}`)).Decode(&plain); err != nil || plain.FooBar != 2 {
+		t.Errorf("SetStdlibCompat Decoder: got %+v, %v", plain, err)
+	}
+}
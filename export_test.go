@@ -0,0 +1,19 @@
+package apexJSON
+
+// SetGrowHook installs f to be called whenever a Buffer reallocates and
+// returns a function that removes it again
+func SetGrowHook(f func(oldCap, newCap int)) func() {
+	growHook = f
+	return func() { growHook = nil }
+}
+
+// SetIgnoreGenerated has Generated types encoded and decoded by reflection,
+// as if cmd/apexjsongen had not run, until the returned function is called
+func SetIgnoreGenerated() func() {
+	ignoreGenerated = true
+	elemCache.Clear()
+	return func() {
+		ignoreGenerated = false
+		elemCache.Clear()
+	}
+}
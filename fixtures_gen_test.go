@@ -0,0 +1,361 @@
+// Code generated by apexjsongen; DO NOT EDIT.
+
+package apexJSON_test
+
+import (
+	"apexJSON"
+)
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (SimpleStruct) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x SimpleStruct) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteString(`{"name":`)
+	buf.WriteJSONString(x.Name)
+	buf.WriteString(`,"age":`)
+	buf.WriteInt(int64(x.Age))
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *SimpleStruct) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "name":
+			return true, p.DecodeString(&x.Name)
+		case "age":
+			return true, apexJSON.DecodeInt(p, &x.Age)
+		}
+		return false, nil
+	})
+}
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (Address) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x Address) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteString(`{"street":`)
+	buf.WriteJSONString(x.Street)
+	buf.WriteString(`,"city":`)
+	buf.WriteJSONString(x.City)
+	buf.WriteString(`,"country":`)
+	buf.WriteJSONString(x.Country)
+	buf.WriteString(`,"zip":`)
+	buf.WriteJSONString(x.Zip)
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *Address) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "street":
+			return true, p.DecodeString(&x.Street)
+		case "city":
+			return true, p.DecodeString(&x.City)
+		case "country":
+			return true, p.DecodeString(&x.Country)
+		case "zip":
+			return true, p.DecodeString(&x.Zip)
+		}
+		return false, nil
+	})
+}
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (User) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x User) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteString(`{"id":`)
+	buf.WriteInt(int64(x.ID))
+	buf.WriteString(`,"username":`)
+	buf.WriteJSONString(x.Username)
+	buf.WriteString(`,"email":`)
+	buf.WriteJSONString(x.Email)
+	buf.WriteString(`,"created_at":`)
+	if err := buf.WriteTime(x.CreatedAt); err != nil {
+		return err
+	}
+	buf.WriteString(`,"profile":`)
+	if err := x.Profile.MarshalApexJSON(buf); err != nil {
+		return err
+	}
+	buf.WriteString(`,"posts":`)
+	if x.Posts == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i := range x.Posts {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := x.Posts[i].MarshalApexJSON(buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString(`,"settings":`)
+	if err := x.Settings.MarshalApexJSON(buf); err != nil {
+		return err
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *User) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "id":
+			return true, apexJSON.DecodeInt(p, &x.ID)
+		case "username":
+			return true, p.DecodeString(&x.Username)
+		case "email":
+			return true, p.DecodeString(&x.Email)
+		case "created_at":
+			return true, p.DecodeValue(&x.CreatedAt)
+		case "profile":
+			return true, x.Profile.UnmarshalApexJSON(p)
+		case "posts":
+			return true, p.DecodeValue(&x.Posts)
+		case "settings":
+			return true, x.Settings.UnmarshalApexJSON(p)
+		}
+		return false, nil
+	})
+}
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (Profile) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x Profile) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteString(`{"full_name":`)
+	buf.WriteJSONString(x.FullName)
+	buf.WriteString(`,"age":`)
+	buf.WriteInt(int64(x.Age))
+	buf.WriteString(`,"bio":`)
+	buf.WriteJSONString(x.Bio)
+	buf.WriteString(`,"interests":`)
+	if x.Interests == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i, e := range x.Interests {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteJSONString(e)
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString(`,"avatar_url":`)
+	buf.WriteJSONString(x.AvatarURL)
+	buf.WriteString(`,"social_links":`)
+	if x.SocialLinks == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i, e := range x.SocialLinks {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteJSONString(e)
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *Profile) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "full_name":
+			return true, p.DecodeString(&x.FullName)
+		case "age":
+			return true, apexJSON.DecodeInt(p, &x.Age)
+		case "bio":
+			return true, p.DecodeString(&x.Bio)
+		case "interests":
+			return true, p.DecodeValue(&x.Interests)
+		case "avatar_url":
+			return true, p.DecodeString(&x.AvatarURL)
+		case "social_links":
+			return true, p.DecodeValue(&x.SocialLinks)
+		}
+		return false, nil
+	})
+}
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (Post) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x Post) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteString(`{"id":`)
+	buf.WriteInt(int64(x.ID))
+	buf.WriteString(`,"title":`)
+	buf.WriteJSONString(x.Title)
+	buf.WriteString(`,"content":`)
+	buf.WriteJSONString(x.Content)
+	buf.WriteString(`,"created_at":`)
+	if err := buf.WriteTime(x.CreatedAt); err != nil {
+		return err
+	}
+	buf.WriteString(`,"tags":`)
+	if x.Tags == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i, e := range x.Tags {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteJSONString(e)
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString(`,"likes":`)
+	buf.WriteInt(int64(x.Likes))
+	buf.WriteString(`,"comments":`)
+	if x.Comments == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i := range x.Comments {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := x.Comments[i].MarshalApexJSON(buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *Post) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "id":
+			return true, apexJSON.DecodeInt(p, &x.ID)
+		case "title":
+			return true, p.DecodeString(&x.Title)
+		case "content":
+			return true, p.DecodeString(&x.Content)
+		case "created_at":
+			return true, p.DecodeValue(&x.CreatedAt)
+		case "tags":
+			return true, p.DecodeValue(&x.Tags)
+		case "likes":
+			return true, apexJSON.DecodeInt(p, &x.Likes)
+		case "comments":
+			return true, p.DecodeValue(&x.Comments)
+		}
+		return false, nil
+	})
+}
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (Comment) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x Comment) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteString(`{"id":`)
+	buf.WriteInt(int64(x.ID))
+	buf.WriteString(`,"user_id":`)
+	buf.WriteInt(int64(x.UserID))
+	buf.WriteString(`,"content":`)
+	buf.WriteJSONString(x.Content)
+	buf.WriteString(`,"created_at":`)
+	if err := buf.WriteTime(x.CreatedAt); err != nil {
+		return err
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *Comment) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "id":
+			return true, apexJSON.DecodeInt(p, &x.ID)
+		case "user_id":
+			return true, apexJSON.DecodeInt(p, &x.UserID)
+		case "content":
+			return true, p.DecodeString(&x.Content)
+		case "created_at":
+			return true, p.DecodeValue(&x.CreatedAt)
+		}
+		return false, nil
+	})
+}
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (Settings) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x Settings) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteString(`{"notifications":`)
+	buf.WriteBool(x.Notifications)
+	buf.WriteString(`,"privacy":`)
+	buf.WriteJSONString(x.Privacy)
+	buf.WriteString(`,"theme":`)
+	buf.WriteJSONString(x.Theme)
+	buf.WriteString(`,"preferences":`)
+	if err := buf.WriteValue(x.Preferences); err != nil {
+		return err
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *Settings) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "notifications":
+			return true, p.DecodeBool(&x.Notifications)
+		case "privacy":
+			return true, p.DecodeString(&x.Privacy)
+		case "theme":
+			return true, p.DecodeString(&x.Theme)
+		case "preferences":
+			return true, p.DecodeValue(&x.Preferences)
+		}
+		return false, nil
+	})
+}
@@ -0,0 +1,225 @@
+package apexJSON
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// The methods and functions in this file are what cmd/apexjsongen writes
+// MarshalApexJSON and UnmarshalApexJSON methods with. Each one gives the
+// same output, result and errors as the reflect path for the same value.
+
+// Plain reports whether b encodes compact output with the default options,
+// the only case in which generated methods write fields themselves; any
+// other encode goes through WriteFields
+func (b *Buffer) Plain() bool {
+	return b.ind == nil && b.faults == nil && b.esc == nil && (b.opts == nil || b.opts.plain())
+}
+
+// plain reports whether o leaves the encoding of struct fields, strings,
+// numbers and times as it is by default
+func (o *MarshalOptions) plain() bool {
+	return o.IsEmpty == nil && o.FieldNamer == nil && o.DangerousKeyPolicy == KeysAllow && o.TimeFormat == "" && !o.NilSliceAsEmptyArray && !o.DeepOmitEmpty && !o.StdlibCompat
+}
+
+// WriteFields encodes v, a struct or pointer to one, field by field, as if
+// its type had no MarshalApexJSON method
+func (b *Buffer) WriteFields(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			b.Write(jsonNull)
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return marshalValue(rv, b)
+	}
+	if err := b.enter(rv); err != nil {
+		return err
+	}
+	err := marshalStruct(rv, b)
+	b.leave()
+	return err
+}
+
+// WriteInt writes n as a JSON number
+func (b *Buffer) WriteInt(n int64) {
+	writeInt(b, n)
+}
+
+// WriteUint writes n as a JSON number
+func (b *Buffer) WriteUint(n uint64) {
+	writeUint(b, n)
+}
+
+// WriteFloat writes f, a float of the given bit size, as a JSON number.
+// NaN and infinities have none and are an error.
+func (b *Buffer) WriteFloat(f float64, bits int) error {
+	return writeFloat(b, f, bits)
+}
+
+// WriteBool writes v as true or false
+func (b *Buffer) WriteBool(v bool) {
+	if v {
+		b.Write(jsonTrue)
+	} else {
+		b.Write(jsonFalse)
+	}
+}
+
+// WriteTime writes t as a JSON string in the layout of the encode in
+// progress. Under StdlibCompat a year outside [0,9999] is an error.
+func (b *Buffer) WriteTime(t time.Time) error {
+	return writeTime(b, t)
+}
+
+// DecodeObject decodes the object at the current position into v, a
+// pointer to a struct, calling field with each member's key and the Parser
+// at its value. field decodes the value and returns true, or returns false
+// to have it skipped. Anything but an object, and any decode with
+// StdlibCompat or other field names, goes to DecodeFields instead.
+func (p *Parser) DecodeObject(v interface{}, field func(key string) (bool, error)) error {
+	p.skipWhitespace()
+	if p.opts.StdlibCompat || p.opts.FieldNamer != nil || p.pos >= len(p.data) || p.data[p.pos] != '{' {
+		return p.DecodeFields(v)
+	}
+	if err := p.countElement(); err != nil {
+		return err
+	}
+	p.pos++
+
+	for first := true; ; first = false {
+		if done, err := p.nextMember('}', first); err != nil || done {
+			return err
+		}
+		tokenType, keyBytes := p.parseString()
+		if tokenType != TokenString {
+			return p.tokenError("expected string key in object")
+		}
+		unescaped, ok := p.unescape(keyBytes)
+		if !ok {
+			return &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in object key"}
+		}
+		key := GetString(unescaped)
+
+		p.skipWhitespace()
+		if p.pos >= len(p.data) || p.data[p.pos] != ':' {
+			return &SyntaxError{Offset: int64(p.pos), Msg: "expected colon after object key"}
+		}
+		p.pos++
+
+		found, err := field(key)
+		if err != nil {
+			if ute, ok := err.(*UnmarshalTypeError); ok && ute.Field == "" {
+				ute.Field = strings.Clone(key)
+			}
+			return err
+		}
+		if !found && !p.skipScalarOrValue() {
+			if p.err != nil {
+				return p.err
+			}
+			return &SyntaxError{Offset: int64(p.pos), Msg: "invalid JSON value"}
+		}
+	}
+}
+
+// DecodeFields decodes the next value into v, a non-nil pointer to a
+// struct, field by field, as if its type had no UnmarshalApexJSON method
+func (p *Parser) DecodeFields(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+	p.skipWhitespace()
+	if p.pos >= len(p.data) {
+		return &SyntaxError{Offset: int64(p.pos), Msg: "unexpected end of JSON input"}
+	}
+	return unmarshalKind(p, rv.Elem())
+}
+
+// DecodeString decodes the next value into s
+func (p *Parser) DecodeString(s *string) error {
+	p.skipWhitespace()
+	if start := p.pos; start < len(p.data) && p.data[start] == '"' {
+		if tokenType, value := p.parseString(); tokenType == TokenString {
+			if v, ok := p.valueString(value); ok {
+				*s = v
+				return nil
+			}
+		}
+		p.pos, p.err = start, nil
+	}
+	return unmarshalValue(p, reflect.ValueOf(s).Elem())
+}
+
+// DecodeBool decodes the next value into b
+func (p *Parser) DecodeBool(b *bool) error {
+	p.skipWhitespace()
+	if start := p.pos; start < len(p.data) && (p.data[start] == 't' || p.data[start] == 'f') {
+		if p.data[start] == 't' && p.matchLiteral("true") || p.data[start] == 'f' && p.matchLiteral("false") {
+			*b = p.data[start] == 't'
+			return nil
+		}
+		p.pos = start
+	}
+	return unmarshalValue(p, reflect.ValueOf(b).Elem())
+}
+
+// DecodeInt decodes the next value into n
+func DecodeInt[T int | int8 | int16 | int32 | int64](p *Parser, n *T) error {
+	if start, s, ok := p.plainNumber(); ok {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil && int64(T(i)) == i {
+			*n = T(i)
+			return nil
+		}
+		p.pos = start
+	}
+	return unmarshalValue(p, reflect.ValueOf(n).Elem())
+}
+
+// DecodeUint decodes the next value into n
+func DecodeUint[T uint | uint8 | uint16 | uint32 | uint64](p *Parser, n *T) error {
+	if start, s, ok := p.plainNumber(); ok {
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil && uint64(T(u)) == u {
+			*n = T(u)
+			return nil
+		}
+		p.pos = start
+	}
+	return unmarshalValue(p, reflect.ValueOf(n).Elem())
+}
+
+// DecodeFloat decodes the next value into f
+func DecodeFloat[T float32 | float64](p *Parser, f *T) error {
+	if start, s, ok := p.plainNumber(); ok {
+		if x, err := strconv.ParseFloat(s, int(unsafe.Sizeof(*f))*8); err == nil {
+			*f = T(x)
+			return nil
+		}
+		p.pos = start
+	}
+	return unmarshalValue(p, reflect.ValueOf(f).Elem())
+}
+
+// plainNumber reads the number token at the current position for the
+// Decode functions, as unmarshalFlatField does. It reports false with the
+// position unchanged when there is none or stored numbers are checked for
+// precision loss.
+func (p *Parser) plainNumber() (int, string, bool) {
+	p.skipWhitespace()
+	start := p.pos
+	if start >= len(p.data) || p.tracksPrecision() || p.data[start] != '-' && !isDigit(p.data[start]) {
+		return start, "", false
+	}
+	if tokenType, value := p.parseNumber(); tokenType == TokenNumber {
+		return start, GetString(value), true
+	}
+	p.pos, p.err = start, nil
+	return start, "", false
+}
@@ -0,0 +1,236 @@
+package apexJSON_test
+
+import (
+	"apexJSON"
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// genFields has a field of every kind apexjsongen writes itself, and
+// omitempty fields placed so each way of separating members is generated
+//
+//go:generate go run ./cmd/apexjsongen -type genFields,genInner,GenEmbedded -output genfields_gen_test.go generated_test.go
+type genFields struct {
+	Opt1   string  `json:"opt1,omitempty"`
+	Opt2   int8    `json:"opt2,omitempty"`
+	Req    bool    `json:"req"`
+	Opt3   float64 `json:"opt3,omitempty"`
+	Count  int64   `json:"count,string"`
+	Ratio  float32 `json:"ratio,string,omitempty"`
+	Flag   bool    `json:",string"`
+	Big    uint64
+	Floats []float64      `json:"floats"`
+	Bools  []bool         `json:"bools,omitempty"`
+	Bytes  []byte         `json:"bytes"`
+	When   time.Time      `json:"when,omitempty"`
+	Ptr    *genInner      `json:"ptr,omitempty"`
+	Inner  genInner       `json:"inner,omitempty"`
+	Kids   []genFields    `json:"kids,omitempty"`
+	Attrs  map[string]int `json:"attrs,omitempty"`
+	Any    interface{}    `json:"any"`
+	Dash   string         `json:"-,"`
+	Skip   string         `json:"-"`
+	Odd    string         `json:"x'y"`
+	hidden string
+	GenEmbedded
+	Tail uint16 `json:"tail,omitempty"`
+}
+
+type genInner struct {
+	N int `json:"n,omitempty"`
+}
+
+type GenEmbedded struct {
+	E string `json:"e"`
+}
+
+var genFull = genFields{
+	Opt1: "<one>", Opt2: -8, Req: true, Opt3: 2.5, Count: -12, Ratio: 0.25, Flag: true,
+	Big: math.MaxUint64, Floats: []float64{1, 1e21, -0.5}, Bools: []bool{true, false},
+	Bytes: []byte("hi"), When: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+	Ptr: &genInner{N: 1}, Inner: genInner{N: 2}, Kids: []genFields{{Req: true}, {Opt2: 1}},
+	Attrs: map[string]int{"a": 1}, Any: []interface{}{"x", 1.5, nil},
+	Dash: "dash", Skip: "skip", Odd: "odd", hidden: "hidden",
+	GenEmbedded: GenEmbedded{E: "e"}, Tail: 7,
+}
+
+// TestGeneratedConformance checks that the generated codecs of the
+// benchmark fixtures, and of genFields, encode to the same bytes and decode
+// to the same values and errors as reflection does without them, under
+// each way of encoding and a range of options
+func TestGeneratedConformance(t *testing.T) {
+	// Maps have one key at most, as their order is random without
+	// SortMapKeys
+	user := complexUser
+	user.Settings.Preferences = map[string]string{"language": "en"}
+	values := []interface{}{
+		simple, SimpleStruct{Name: "é\t\"\u2028\xff", Age: -1}, &simple,
+		*complex.Address, Address{}, &ComplexStruct{Address: complex.Address},
+		user, User{}, &user, []User{user, {}}, map[string]SimpleStruct{"a": simple},
+		genFull, genFields{}, genFields{Opt3: math.NaN()}, genFields{Ratio: float32(math.Inf(1))},
+		[]genFields{{Floats: []float64{math.NaN()}}},
+	}
+	encodes := []struct {
+		name string
+		fn   func(v interface{}) ([]byte, error)
+	}{
+		{"Marshal", apexJSON.Marshal},
+		{"MarshalIndent", func(v interface{}) ([]byte, error) { return apexJSON.MarshalIndent(v, "> ", "\t") }},
+		{"StdlibCompat", withOptions(apexJSON.MarshalOptions{StdlibCompat: true})},
+		{"TimeFormat", withOptions(apexJSON.MarshalOptions{TimeFormat: time.Kitchen, NilSliceAsEmptyArray: true})},
+		{"Escapes", withOptions(apexJSON.MarshalOptions{EscapeSolidus: true, ExtraEscapes: []byte("e"), SortMapKeys: true})},
+		{"IsEmpty", withOptions(apexJSON.MarshalOptions{IsEmpty: func(v reflect.Value) (bool, bool) {
+			return v.Kind() == reflect.Bool, v.Kind() == reflect.Bool
+		}})},
+		{"Encoder", func(v interface{}) ([]byte, error) {
+			var out bytes.Buffer
+			enc := apexJSON.NewEncoder(&out)
+			enc.SetEscapeHTML(false)
+			err := enc.Encode(v)
+			return out.Bytes(), err
+		}},
+		{"MarshalPartialValue", func(v interface{}) ([]byte, error) {
+			buf := &apexJSON.Buffer{}
+			faults := apexJSON.MarshalPartialValue(reflect.ValueOf(v), buf, nil)
+			return buf.Bytes(), fmt.Errorf("%v", faults)
+		}},
+	}
+
+	for _, enc := range encodes {
+		for _, v := range values {
+			got, gotErr := enc.fn(v)
+			restore := apexJSON.SetIgnoreGenerated()
+			want, wantErr := enc.fn(v)
+			restore()
+			if !bytes.Equal(got, want) || fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+				t.Errorf("%s(%T):\n got %s, %v\nwant %s, %v", enc.name, v, got, gotErr, want, wantErr)
+			}
+		}
+	}
+
+	userDocs := []string{
+		string(complexUserJSON), `null`, `[]`, ` {} `, `{"id":"7"}`, `{"id":1.5}`, `{"id":99999999999999999999}`,
+		`{"username":null,"id":null,"posts":null}`, `{"profile":{"age":"x"}}`, `{"profile":{"ag\u0065":3,"bio":"a\nb"}}`,
+		`{"posts":[{"id":1,"comments":[{"id":2,"content":"c"}]},{"tags":["t"]}]}`, `{"us\u0065rname":"esc","id":2,"id":3}`,
+		`{"id":1,}`, `{"id":1`, `{"ID":3,"UserName":"case"}`, `{"id" 1}`, `{"settings":{"notifications":1}}`,
+		`{"settings":{"notifications":tru}}`, `{"created_at":"bad"}`, `{"extra":{"a":[1,{"b":null}]},"email":"e@x"}`,
+		`{"email":"\ud800"}`, `{"profile":{"interests":["a",1]}}`, `{"id":1e400}`, `{"id":-0}`, `{"posts":[{"likes":"3"}]}`,
+	}
+	genDocs := []string{
+		mustMarshal(t, genFull), `{"ratio":"1.5","count":"3"}`, `{"Big":-1}`, `{"Big":18446744073709551616}`,
+		`{"opt2":300,"floats":[1,null]}`, `{"opt2":-128,"tail":65535,"opt3":1e-400}`, `{"bytes":"aGk="}`,
+		`{"Flag":"true"}`, `{"req":tru}`, `{"req":"1","opt1":5}`, `{"inner":{"n":2},"ptr":null,"GenEmbedded":{"e":"x"},"e":"y"}`,
+		`{"-":"d","x'y":"o","Odd":"O","hidden":"h","Skip":"s"}`, `{"kids":[{"kids":[{}]}],"attrs":{"z":1}}`,
+	}
+	options := []*apexJSON.Options{
+		nil,
+		{MarshalOptions: apexJSON.MarshalOptions{StdlibCompat: true}},
+		{UseNumber: true, FailOnPrecisionLoss: true},
+		{Stats: &apexJSON.DecodeStats{}},
+		{WeakTypeCoercion: apexJSON.CoerceAll},
+		{MaxDecodedElements: 3, MaxStringBytes: 8},
+		{StringTransform: func(field string, s []byte) []byte { return []byte(field + "=" + string(s)) }},
+		{ZeroBeforeDecode: true, AtomicDecode: true},
+	}
+
+	for _, opts := range options {
+		for _, doc := range userDocs {
+			compareDecode(t, doc, opts, func() interface{} { return &User{ID: 9, Username: "before"} })
+		}
+		for _, doc := range genDocs {
+			compareDecode(t, doc, opts, func() interface{} { return &genFields{Opt1: "before", Kids: make([]genFields, 3)} })
+		}
+		compareDecode(t, `[{"name":"a","age":1},{"age":"x"}]`, opts, func() interface{} { return new([]SimpleStruct) })
+		compareDecode(t, `{"k":{"street":"s"},"n":null}`, opts, func() interface{} { return new(map[string]*Address) })
+	}
+}
+
+// withOptions returns a MarshalWithOptions call with opts
+func withOptions(opts apexJSON.MarshalOptions) func(v interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) { return apexJSON.MarshalWithOptions(v, opts) }
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := apexJSON.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// compareDecode decodes doc into a value from fresh with and without the
+// generated codecs and reports any difference in the result or error
+func compareDecode(t *testing.T, doc string, opts *apexJSON.Options, fresh func() interface{}) {
+	t.Helper()
+	decode := func() (interface{}, error) {
+		v := fresh()
+		err := apexJSON.UnmarshalValue([]byte(doc), reflect.ValueOf(v), opts)
+		return v, err
+	}
+
+	got, gotErr := decode()
+	restore := apexJSON.SetIgnoreGenerated()
+	want, wantErr := decode()
+	restore()
+	if !reflect.DeepEqual(got, want) || fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+		t.Errorf("%s with %+v:\n got %+v, %v\nwant %+v, %v", doc, opts, got, gotErr, want, wantErr)
+	}
+}
+
+// TestGeneratedUpToDate reruns each go:generate line for apexjsongen and
+// requires the output to match the checked-in file, so the generated
+// codecs the conformance test covers are the generator's current output
+func TestGeneratedUpToDate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the generator")
+	}
+	const directive = "//go:generate go run ./cmd/apexjsongen "
+	files, _ := filepath.Glob("*_test.go")
+	runs := 0
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line, ok := strings.CutPrefix(sc.Text(), directive)
+			if !ok {
+				continue
+			}
+			args := strings.Fields(line)
+			output := ""
+			for i := range args {
+				if args[i] == "-output" && i+1 < len(args) {
+					output = args[i+1]
+					args[i+1] = filepath.Join(t.TempDir(), output)
+				}
+			}
+			cmd := exec.Command("go", append([]string{"run", "./cmd/apexjsongen"}, args...)...)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%s: %v\n%s", line, err, out)
+			}
+			got, err1 := os.ReadFile(args[slices.Index(args, "-output")+1])
+			want, err2 := os.ReadFile(output)
+			if err1 != nil || err2 != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s is out of date with apexjsongen; run go generate (%v, %v)", output, err1, err2)
+			}
+			runs++
+		}
+		f.Close()
+	}
+	if runs == 0 {
+		t.Fatal("no go:generate lines for apexjsongen")
+	}
+}
@@ -0,0 +1,241 @@
+// Code generated by apexjsongen; DO NOT EDIT.
+
+package apexJSON_test
+
+import (
+	"apexJSON"
+)
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (genFields) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x genFields) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteByte('{')
+	more := false
+	if x.Opt1 != "" {
+		buf.WriteString(`"opt1":`)
+		buf.WriteJSONString(x.Opt1)
+		more = true
+	}
+	if x.Opt2 != 0 {
+		if more {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"opt2":`)
+		buf.WriteInt(int64(x.Opt2))
+		more = true
+	}
+	if more {
+		buf.WriteByte(',')
+	}
+	buf.WriteString(`"req":`)
+	buf.WriteBool(x.Req)
+	if x.Opt3 != 0 {
+		buf.WriteString(`,"opt3":`)
+		if err := buf.WriteFloat(float64(x.Opt3), 64); err != nil {
+			return err
+		}
+	}
+	buf.WriteString(`,"count":`)
+	buf.WriteByte('"')
+	buf.WriteInt(int64(x.Count))
+	buf.WriteByte('"')
+	if x.Ratio != 0 {
+		buf.WriteString(`,"ratio":`)
+		buf.WriteByte('"')
+		if err := buf.WriteFloat(float64(x.Ratio), 32); err != nil {
+			return err
+		}
+		buf.WriteByte('"')
+	}
+	buf.WriteString(`,"Flag":`)
+	buf.WriteByte('"')
+	buf.WriteBool(x.Flag)
+	buf.WriteByte('"')
+	buf.WriteString(`,"Big":`)
+	buf.WriteUint(uint64(x.Big))
+	buf.WriteString(`,"floats":`)
+	if x.Floats == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i, e := range x.Floats {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := buf.WriteFloat(float64(e), 64); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	}
+	if len(x.Bools) != 0 {
+		buf.WriteString(`,"bools":`)
+		if x.Bools == nil {
+			buf.WriteString("null")
+		} else {
+			buf.WriteByte('[')
+			for i, e := range x.Bools {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteBool(e)
+			}
+			buf.WriteByte(']')
+		}
+	}
+	buf.WriteString(`,"bytes":`)
+	if err := buf.WriteValue(x.Bytes); err != nil {
+		return err
+	}
+	buf.WriteString(`,"when":`)
+	if err := buf.WriteTime(x.When); err != nil {
+		return err
+	}
+	if x.Ptr != nil {
+		buf.WriteString(`,"ptr":`)
+		if err := buf.WriteValue(x.Ptr); err != nil {
+			return err
+		}
+	}
+	buf.WriteString(`,"inner":`)
+	if err := x.Inner.MarshalApexJSON(buf); err != nil {
+		return err
+	}
+	if len(x.Kids) != 0 {
+		buf.WriteString(`,"kids":`)
+		if err := buf.WriteValue(x.Kids); err != nil {
+			return err
+		}
+	}
+	if len(x.Attrs) != 0 {
+		buf.WriteString(`,"attrs":`)
+		if err := buf.WriteValue(x.Attrs); err != nil {
+			return err
+		}
+	}
+	buf.WriteString(`,"any":`)
+	if err := buf.WriteValue(x.Any); err != nil {
+		return err
+	}
+	buf.WriteString(`,"-":`)
+	buf.WriteJSONString(x.Dash)
+	buf.WriteString(`,"Odd":`)
+	buf.WriteJSONString(x.Odd)
+	buf.WriteString(`,"e":`)
+	buf.WriteJSONString(x.GenEmbedded.E)
+	if x.Tail != 0 {
+		buf.WriteString(`,"tail":`)
+		buf.WriteUint(uint64(x.Tail))
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *genFields) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "opt1":
+			return true, p.DecodeString(&x.Opt1)
+		case "opt2":
+			return true, apexJSON.DecodeInt(p, &x.Opt2)
+		case "req":
+			return true, p.DecodeBool(&x.Req)
+		case "opt3":
+			return true, apexJSON.DecodeFloat(p, &x.Opt3)
+		case "count":
+			return true, apexJSON.DecodeInt(p, &x.Count)
+		case "ratio":
+			return true, apexJSON.DecodeFloat(p, &x.Ratio)
+		case "Flag":
+			return true, p.DecodeBool(&x.Flag)
+		case "Big":
+			return true, apexJSON.DecodeUint(p, &x.Big)
+		case "floats":
+			return true, p.DecodeValue(&x.Floats)
+		case "bools":
+			return true, p.DecodeValue(&x.Bools)
+		case "bytes":
+			return true, p.DecodeValue(&x.Bytes)
+		case "when":
+			return true, p.DecodeValue(&x.When)
+		case "ptr":
+			return true, p.DecodeValue(&x.Ptr)
+		case "inner":
+			return true, x.Inner.UnmarshalApexJSON(p)
+		case "kids":
+			return true, p.DecodeValue(&x.Kids)
+		case "attrs":
+			return true, p.DecodeValue(&x.Attrs)
+		case "any":
+			return true, p.DecodeValue(&x.Any)
+		case "-":
+			return true, p.DecodeString(&x.Dash)
+		case "Odd":
+			return true, p.DecodeString(&x.Odd)
+		case "e":
+			return true, p.DecodeString(&x.GenEmbedded.E)
+		case "tail":
+			return true, apexJSON.DecodeUint(p, &x.Tail)
+		}
+		return false, nil
+	})
+}
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (genInner) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x genInner) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteByte('{')
+	if x.N != 0 {
+		buf.WriteString(`"n":`)
+		buf.WriteInt(int64(x.N))
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *genInner) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "n":
+			return true, apexJSON.DecodeInt(p, &x.N)
+		}
+		return false, nil
+	})
+}
+
+// ApexJSONGenerated implements apexJSON.Generated
+func (GenEmbedded) ApexJSONGenerated() {}
+
+// MarshalApexJSON implements apexJSON.MarshalerTo
+func (x GenEmbedded) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if !buf.Plain() {
+		return buf.WriteFields(x)
+	}
+	buf.WriteString(`{"e":`)
+	buf.WriteJSONString(x.E)
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalApexJSON implements apexJSON.UnmarshalerFrom
+func (x *GenEmbedded) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeObject(x, func(key string) (bool, error) {
+		switch key {
+		case "e":
+			return true, p.DecodeString(&x.E)
+		}
+		return false, nil
+	})
+}
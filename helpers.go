@@ -1,6 +1,8 @@
 package apexJSON
 
 import (
+	"encoding"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -8,6 +10,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -232,6 +236,50 @@ func (n Number) Format(format string) string {
 	}
 }
 
+// MarshalJSON returns m, or null for a nil RawMessage
+func (m RawMessage) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return jsonNull, nil
+	}
+	return m, nil
+}
+
+// UnmarshalJSON sets *m to a copy of data
+func (m *RawMessage) UnmarshalJSON(data []byte) error {
+	if m == nil {
+		return fmt.Errorf("json: UnmarshalJSON on nil *RawMessage")
+	}
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// setOptional records presence, used by unmarshalToStruct
+func (o *Optional[T]) setOptional(present, null bool) {
+	o.Present = present
+	o.Null = null
+}
+
+// MarshalJSON encodes Value, or null when the Optional is absent or null.
+// Struct fields don't go through here; marshalStruct omits absent members.
+func (o Optional[T]) MarshalJSON() ([]byte, error) {
+	if !o.Present || o.Null {
+		return []byte("null"), nil
+	}
+	return marshal(o.Value)
+}
+
+// UnmarshalJSON marks the Optional present and decodes data into Value
+func (o *Optional[T]) UnmarshalJSON(data []byte) error {
+	var zero T
+	o.Value = zero
+	o.Present = true
+	o.Null = string(data) == "null"
+	if o.Null {
+		return nil
+	}
+	return unmarshal(NewParser(data), &o.Value)
+}
+
 // setNull sets a reflect.Value to its zero value
 func setNull(v reflect.Value) error {
 	switch v.Kind() {
@@ -275,24 +323,102 @@ func setString(v reflect.Value, s string) error {
 	return &UnmarshalTypeError{Value: "string", Type: v.Type()}
 }
 
+// setMapKey stores the object key s in v, an addressable map key. Like
+// encoding/json it calls UnmarshalText when *v has the method, whatever the
+// kind of v; otherwise integer kinds parse s in base 10, the way their keys
+// are marshaled, and other kinds go to setString.
+func setMapKey(v reflect.Value, s string) error {
+	if reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch k := v.Kind(); {
+	case k >= reflect.Int && k <= reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return &UnmarshalTypeError{Value: "number " + s, Type: v.Type()}
+		}
+		v.SetInt(n)
+		return nil
+	case k >= reflect.Uint && k <= reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			return &UnmarshalTypeError{Value: "number " + s, Type: v.Type()}
+		}
+		v.SetUint(n)
+		return nil
+	}
+	return setString(v, s)
+}
+
+// coerceString retries a string token that setString rejected with the weak
+// coercions enabled in opts. err is returned unchanged when none apply.
+func coerceString(v reflect.Value, s string, opts *Options, err error) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if opts.WeakTypeCoercion&CoerceStringToNumber == 0 {
+			return err
+		}
+		if len(s) > 0 && (s[0] == '-' || isDigit(s[0])) && isCompleteLiteral(s) {
+			if setNumber(v, s, opts) == nil {
+				return nil
+			}
+		}
+		return &UnmarshalTypeError{
+			Value: "string " + strconv.Quote(s) + " (weak coercion to number failed)",
+			Type:  v.Type(),
+		}
+	case reflect.Bool:
+		if opts.WeakTypeCoercion&CoerceStringToBool == 0 {
+			return err
+		}
+		switch s {
+		case "1":
+			v.SetBool(true)
+			return nil
+		case "0":
+			v.SetBool(false)
+			return nil
+		}
+		return &UnmarshalTypeError{
+			Value: "string " + strconv.Quote(s) + " (weak coercion to bool failed)",
+			Type:  v.Type(),
+		}
+	}
+	return err
+}
+
 func writeEscapedString(w io.Writer, s []byte) {
 	// Fast path for Buffer type - direct writing without interface calls
 	if buf, ok := w.(*Buffer); ok {
+		escapes := buf.escapes()
 		start := 0
 		// Pre-grow buffer to avoid multiple resizes
 		buf.grow(len(s) + 16) // Extra space for potential escapes
 
 		for i := 0; i < len(s); i++ {
-			if esc := escapeMap[s[i]]; esc != nil {
+			if esc := escapes[s[i]]; esc != nil {
+				n := 1
+				if len(esc) == 0 {
+					if esc, n = multiByteEscape(escapes, s[i:]); esc == nil {
+						i += n - 1
+						continue
+					}
+				}
+
 				// Write unescaped portion directly
 				if start < i {
 					copy(buf.buf[buf.off:], s[start:i])
 					buf.off += i - start
 				}
 
-				// Write escape sequence directly
+				// Write escape sequence directly, growing for the
+				// six-byte \u00XX forms
+				buf.grow(len(esc) + len(s) - i)
 				copy(buf.buf[buf.off:], esc)
 				buf.off += len(esc)
+				i += n - 1
 				start = i + 1
 			}
 		}
@@ -309,11 +435,19 @@ func writeEscapedString(w io.Writer, s []byte) {
 	// Fallback for non-Buffer writers
 	start := 0
 	for i := 0; i < len(s); i++ {
-		if esc := escapeMap[s[i]]; esc != nil {
+		if esc := defaultEscapes[s[i]]; esc != nil {
+			n := 1
+			if len(esc) == 0 {
+				if esc, n = multiByteEscape(&defaultEscapes, s[i:]); esc == nil {
+					i += n - 1
+					continue
+				}
+			}
 			if start < i {
 				w.Write(s[start:i])
 			}
 			w.Write(esc)
+			i += n - 1
 			start = i + 1
 		}
 	}
@@ -326,19 +460,31 @@ func writeEscapedString(w io.Writer, s []byte) {
 func writeEscapedStringString(w io.Writer, s string) {
 	// Fast path for Buffer type - direct string handling
 	if buf, ok := w.(*Buffer); ok {
+		escapes := buf.escapes()
 		start := 0
 		// Pre-grow buffer to avoid multiple resizes
 		buf.grow(len(s) + 16) // Extra space for potential escapes
 
 		for i := 0; i < len(s); i++ {
-			if esc := escapeMap[s[i]]; esc != nil {
+			if esc := escapes[s[i]]; esc != nil {
+				n := 1
+				if len(esc) == 0 {
+					if esc, n = multiByteEscape(escapes, s[i:]); esc == nil {
+						i += n - 1
+						continue
+					}
+				}
+
 				// Write unescaped portion directly
 				if start < i {
 					buf.off += copy(buf.buf[buf.off:], s[start:i])
 				}
 
-				// Write escape sequence directly
+				// Write escape sequence directly, growing for the
+				// six-byte \u00XX forms
+				buf.grow(len(esc) + len(s) - i)
 				buf.off += copy(buf.buf[buf.off:], esc)
+				i += n - 1
 				start = i + 1
 			}
 		}
@@ -355,18 +501,154 @@ func writeEscapedStringString(w io.Writer, s string) {
 	writeEscapedString(w, []byte(s))
 }
 
-// Helper function to check if a string needs JSON escaping
-func needsEscaping(s string) bool {
+// isValidTag reports whether s is a field name encoding/json accepts in a
+// struct tag
+func isValidTag(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune("!#$%&()*+-./:;<=>?@[]^_{|}~ ", c):
+			// Backslash and quote chars are reserved, but otherwise any
+			// punctuation chars are allowed in a tag name
+		case !unicode.IsLetter(c) && !unicode.IsDigit(c):
+			return false
+		}
+	}
+	return true
+}
+
+// appendEscapedName appends name to dst with the same escaping applied to
+// string values
+func appendEscapedName(dst []byte, name string) []byte {
+	for i := 0; i < len(name); i++ {
+		esc, n := defaultEscapes[name[i]], 1
+		if esc != nil && len(esc) == 0 {
+			esc, n = multiByteEscape(&defaultEscapes, name[i:])
+		}
+		if esc != nil {
+			dst = append(dst, esc...)
+		} else {
+			dst = append(dst, name[i:i+n]...)
+		}
+		i += n - 1
+	}
+	return dst
+}
+
+// needsEscaping reports whether s holds a byte or UTF-8 sequence escaped
+// by t
+func (t *escapeTable) needsEscaping(s string) bool {
 	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if c < 0x20 || c == '"' || c == '\\' {
-			return true
+		if esc := t[s[i]]; esc != nil {
+			if len(esc) != 0 {
+				return true
+			}
+			esc, n := multiByteEscape(t, s[i:])
+			if esc != nil {
+				return true
+			}
+			i += n - 1
 		}
 	}
 	return false
 }
 
-func setNumber(v reflect.Value, s string, decoder *Decoder) error {
+var (
+	escapedLineSep  = []byte(`\u2028`)
+	escapedParaSep  = []byte(`\u2029`)
+	replacementChar = []byte(`\ufffd`)
+)
+
+// multiByteEscape returns the escape for the UTF-8 sequence s begins with,
+// whose lead byte has an empty entry in t, and the sequence's length. A nil
+// escape leaves the sequence as is. U+2028 and U+2029 are escaped, and when
+// t checks every non-ASCII byte, as the StdlibCompat table does, each byte
+// of invalid UTF-8 is replaced by the escape \ufffd.
+func multiByteEscape[S string | []byte](t *escapeTable, s S) ([]byte, int) {
+	// At most utf8.UTFMax bytes are converted, so this doesn't allocate
+	r, n := utf8.DecodeRuneInString(string(s[:min(len(s), utf8.UTFMax)]))
+	switch {
+	case r == '\u2028':
+		return escapedLineSep, n
+	case r == '\u2029':
+		return escapedParaSep, n
+	case r == utf8.RuneError && n == 1 && t[0x80] != nil:
+		return replacementChar, 1
+	}
+	return nil, n
+}
+
+// escapeTableFor returns the escape table for the string options in o,
+// built once per distinct set of extra escaped bytes and then shared.
+// lineSeps reports whether U+2028 and U+2029 stay escaped, unless
+// o.RawLineSeparators is set.
+func escapeTableFor(o *MarshalOptions, lineSeps bool) (*escapeTable, error) {
+	lineSeps = lineSeps && !o.RawLineSeparators
+	if lineSeps && !o.EscapeSolidus && !o.StdlibCompat && len(o.ExtraEscapes) == 0 {
+		return nil, nil
+	}
+
+	var set [utf8.RuneSelf]bool
+	if o.EscapeSolidus {
+		set['/'] = true
+	}
+	if o.StdlibCompat && lineSeps {
+		// encoding/json's HTML escaping
+		set['<'], set['>'], set['&'] = true, true, true
+	}
+	for _, c := range o.ExtraEscapes {
+		// Escaping a byte of a multi-byte UTF-8 sequence would split the
+		// character, so only ASCII can be escaped on its own
+		if c >= utf8.RuneSelf {
+			return nil, fmt.Errorf("json: cannot escape byte %#x: only ASCII bytes can be escaped", c)
+		}
+		set[c] = true
+	}
+
+	// The key lists the escaped bytes in order, so equal sets share a table
+	key := make([]byte, 0, len(o.ExtraEscapes)+2)
+	for c, on := range set {
+		if on {
+			key = append(key, byte(c))
+		}
+	}
+	// Markers that aren't ASCII, so they can't collide with an escaped byte
+	if !lineSeps {
+		key = append(key, lineSepLead)
+	}
+	if o.StdlibCompat {
+		key = append(key, utf8.RuneSelf)
+	}
+	if cached, ok := escCache.Load(string(key)); ok {
+		return cached.(*escapeTable), nil
+	}
+
+	t := defaultEscapes
+	for _, c := range key {
+		switch {
+		case c == utf8.RuneSelf:
+			// Check every UTF-8 sequence, so invalid ones are replaced and
+			// line separators are always escaped, as in encoding/json
+			for b := utf8.RuneSelf; b < len(t); b++ {
+				t[b] = []byte{}
+			}
+		case c == lineSepLead:
+			t[c] = nil
+		case t[c] != nil:
+			// Already escaped by default, keep the short form
+		case c == '/':
+			t[c] = []byte(`\/`)
+		default:
+			t[c] = []byte{'\\', 'u', '0', '0', hex[c>>4], hex[c&0xF]}
+		}
+	}
+	actual, _ := escCache.LoadOrStore(string(key), &t)
+	return actual.(*escapeTable), nil
+}
+
+func setNumber(v reflect.Value, s string, opts *Options) error {
 	b := getBuilder()   // Get builder from pool
 	defer putBuilder(b) // Return to pool when done
 
@@ -385,128 +667,70 @@ func setNumber(v reflect.Value, s string, decoder *Decoder) error {
 		return &UnmarshalTypeError{Value: b.String(), Type: v.Type()}
 	}
 
-	if v.Type().Name() == "Number" {
+	if v.Kind() == reflect.String && v.Type().Name() == "Number" {
 		v.SetString(s)
 		return nil
 	} else if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
 		// Use Number type if useNumber is enabled, otherwise use float64
-		if decoder != nil && decoder.useNumber {
+		if opts.UseNumber {
 			v.Set(reflect.ValueOf(Number(s)))
 			return nil
 		} else {
 			// Try float64 first for all numbers (standard behavior)
-			if n, err := strconv.ParseFloat(s, 64); err == nil {
+			n, err := strconv.ParseFloat(s, 64)
+			if err == nil {
 				v.Set(reflect.ValueOf(n))
 				return nil
 			}
+			if errors.Is(err, strconv.ErrRange) {
+				return numberRangeError(s, reflect.TypeOf(n))
+			}
 		}
 	}
 
 	// Regular type handling
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		// Fast path for small integers (avoids allocation in strconv.ParseInt)
-		if len(s) < 10 && v.Kind() == reflect.Int64 || v.Kind() == reflect.Int {
-			var n int64
-			var neg bool
-
-			// Check for negative sign
-			i := 0
-			if len(s) > 0 && s[0] == '-' {
-				neg = true
-				i++
-			}
-
-			// Manual parsing of digits
-			for ; i < len(s); i++ {
-				if s[i] < '0' || s[i] > '9' {
-					// Not a simple integer, fall back to standard parsing
-					goto standardIntParse
-				}
-				digit := int64(s[i] - '0')
-
-				// Check for overflow: n*10 + digit > MaxInt64
-				if n > (math.MaxInt64-digit)/10 {
-					// Would overflow, fall back to standard parsing
-					goto standardIntParse
+		n, ok := parseSmallInt(s)
+		if !ok {
+			var err error
+			if n, err = strconv.ParseInt(s, 10, 64); err != nil {
+				if errors.Is(err, strconv.ErrRange) {
+					return numberRangeError(s, v.Type())
 				}
-
-				n = n*10 + digit
-			}
-
-			// Apply sign
-			if neg {
-				n = -n
-			}
-
-			// Check type overflow
-			if v.OverflowInt(n) {
 				return makeTypeError(s, v)
 			}
-
-			v.SetInt(n)
-			return nil
-		}
-
-	standardIntParse:
-		n, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return makeTypeError(s, v)
 		}
 		if v.OverflowInt(n) {
-			return makeTypeError(s, v)
+			return numberRangeError(s, v.Type())
 		}
 		v.SetInt(n)
 		return nil
 
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		// Fast path for small unsigned integers
-		if len(s) < 10 && v.Kind() == reflect.Uint64 || v.Kind() == reflect.Uint {
-			var n uint64
-
-			// Manual parsing of digits
-			for i := 0; i < len(s); i++ {
-				if s[i] < '0' || s[i] > '9' {
-					// Not a simple integer, fall back to standard parsing
-					goto standardUintParse
-				}
-				digit := uint64(s[i] - '0')
-
-				// Check for overflow: n*10 + digit > MaxUint64
-				if n > (math.MaxUint64-digit)/10 {
-					// Would overflow, fall back to standard parsing
-					goto standardUintParse
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := parseSmallUint(s)
+		if !ok {
+			var err error
+			if n, err = strconv.ParseUint(s, 10, 64); err != nil {
+				if errors.Is(err, strconv.ErrRange) {
+					return numberRangeError(s, v.Type())
 				}
-
-				n = n*10 + digit
-			}
-
-			// Check type overflow
-			if v.OverflowUint(n) {
 				return makeTypeError(s, v)
 			}
-
-			v.SetUint(n)
-			return nil
-		}
-
-	standardUintParse:
-		n, err := strconv.ParseUint(s, 10, 64)
-		if err != nil {
-			return makeTypeError(s, v)
 		}
 		if v.OverflowUint(n) {
-			return makeTypeError(s, v)
+			return numberRangeError(s, v.Type())
 		}
 		v.SetUint(n)
 		return nil
 
 	case reflect.Float32, reflect.Float64:
+		// Underflow rounds to zero without an error, as in encoding/json
 		n, err := strconv.ParseFloat(s, v.Type().Bits())
-		if err != nil {
-			return makeTypeError(s, v)
+		if errors.Is(err, strconv.ErrRange) || err == nil && v.OverflowFloat(n) {
+			return numberRangeError(s, v.Type())
 		}
-		if v.OverflowFloat(n) {
+		if err != nil {
 			return makeTypeError(s, v)
 		}
 		v.SetFloat(n)
@@ -525,10 +749,64 @@ func setNumber(v reflect.Value, s string, decoder *Decoder) error {
 		return makeTypeError(s, v)
 	}
 
-	// Unsupported type
+	// Unsupported type, including Chan, Func, Complex64, Complex128 and
+	// UnsafePointer
 	return makeTypeError(s, v, true)
 }
 
+// numberRangeError reports the number s as too large in magnitude for t.
+// Every decode path reports overflow with it, so a number fails the same
+// way whichever path decoded it; a number that isn't the right form for t
+// at all, such as a fraction for an integer, is a plain type error instead.
+func numberRangeError(s string, t reflect.Type) *UnmarshalTypeError {
+	return &UnmarshalTypeError{Value: "number " + s + " (out of range)", Type: t}
+}
+
+// parseSmallInt parses s without strconv when it is an optionally negative
+// run of at most 18 decimal digits, which cannot overflow an int64. It
+// reports false for anything else, including longer numbers, so the caller
+// can fall back to strconv.ParseInt.
+func parseSmallInt(s string) (int64, bool) {
+	digits := s
+	if len(s) > 0 && s[0] == '-' {
+		digits = s[1:]
+	}
+	if len(digits) == 0 || len(digits) > 18 {
+		return 0, false
+	}
+
+	var n int64
+	for i := 0; i < len(digits); i++ {
+		c := digits[i]
+		if !isDigit(c) {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if len(digits) < len(s) {
+		n = -n
+	}
+	return n, true
+}
+
+// parseSmallUint is the unsigned counterpart of parseSmallInt; 19 digits
+// always fit in a uint64
+func parseSmallUint(s string) (uint64, bool) {
+	if len(s) == 0 || len(s) > 19 {
+		return 0, false
+	}
+
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isDigit(c) {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	return n, true
+}
+
 // isDigit returns true if c is an ASCII digit
 func isDigit(c byte) bool {
 	return c >= '0' && c <= '9'
@@ -606,6 +884,23 @@ func estimateValueSize(v reflect.Value) int {
 	}
 }
 
+// DefaultIsEmpty reports whether v is empty under the built-in omitempty
+// rules, those of encoding/json: false, 0, a nil pointer or interface, or an
+// empty array, slice, map or string. Structs are never empty. Custom
+// MarshalOptions.IsEmpty hooks can delegate to it.
+func DefaultIsEmpty(v reflect.Value) bool {
+	return isEmptyValue(v)
+}
+
+// DeepIsEmpty reports whether v is empty under the omitempty rules of
+// MarshalOptions.DeepOmitEmpty: those of DefaultIsEmpty, and besides a
+// struct whose IsZero method returns true, such as a zero time.Time, a
+// struct without one whose fields are all empty, and a pointer to an empty
+// value.
+func DeepIsEmpty(v reflect.Value) bool {
+	return isDeepEmptyValue(v, 0)
+}
+
 // isEmptyValue reports whether v is considered empty for omitempty
 func isEmptyValue(v reflect.Value) bool {
 	switch v.Kind() {
@@ -621,22 +916,131 @@ func isEmptyValue(v reflect.Value) bool {
 		return v.Float() == 0
 	case reflect.Interface, reflect.Ptr:
 		return v.IsNil()
+	}
+	return false
+}
+
+// isDeepEmptyValue reports whether v is empty for omitempty under
+// DeepOmitEmpty, having followed depth pointers to reach it. Past
+// cycleDepth of them v is taken to be non-empty, which ends cycles.
+func isDeepEmptyValue(v reflect.Value, depth int) bool {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return true
+		}
+		return depth < cycleDepth && isDeepEmptyValue(v.Elem(), depth+1)
 	case reflect.Struct:
-		// Special case for time.Time
-		if v.Type().String() == "time.Time" && v.CanInterface() {
-			if t, ok := v.Interface().(time.Time); ok {
-				return t.IsZero()
+		if v.Type().Implements(isZeroerType) {
+			if zero, ok := isZeroValue(v); ok {
+				return zero
 			}
 		}
 		// Otherwise check all fields
 		for i := 0; i < v.NumField(); i++ {
-			if !isEmptyValue(v.Field(i)) {
+			if !isDeepEmptyValue(v.Field(i), depth) {
 				return false
 			}
 		}
 		return true
 	}
-	return false
+	return isEmptyValue(v)
+}
+
+// isZeroValue calls the IsZero method of v, whose type has one, reporting
+// false when v was reached through an unexported field and can't be used.
+// An addressable v is passed by pointer, which doesn't allocate.
+func isZeroValue(v reflect.Value) (zero, ok bool) {
+	if !v.CanInterface() {
+		return false, false
+	}
+	if v.CanAddr() {
+		return v.Addr().Interface().(isZeroer).IsZero(), true
+	}
+	return v.Interface().(isZeroer).IsZero(), true
+}
+
+// fieldValue returns the field at index in the struct v, reporting false
+// when a pointer to an embedded struct on the way is nil
+func fieldValue(v reflect.Value, index []int) (reflect.Value, bool) {
+	if len(index) == 1 {
+		return v.Field(index[0]), true
+	}
+	fv, err := v.FieldByIndexErr(index)
+	return fv, err == nil
+}
+
+// settableField returns the field at index in the struct v, allocating the
+// nil pointers to embedded structs on the way. A pointer to an unexported
+// struct can't be set, and is an error as in encoding/json.
+func settableField(v reflect.Value, index []int) (reflect.Value, error) {
+	if len(index) == 1 {
+		return v.Field(index[0]), nil
+	}
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("json: cannot set embedded pointer to unexported struct: %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// SnakeCase is a MarshalOptions.FieldNamer that writes Go names in
+// snake_case: UserID becomes user_id, HTTPServer http_server and Base64Data
+// base64_data
+func SnakeCase(name string) string {
+	var b strings.Builder
+	b.Grow(len(name) + 4)
+	forEachWord(name, func(i int, word string) {
+		if i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteString(strings.ToLower(word))
+	})
+	return b.String()
+}
+
+// CamelCase is a MarshalOptions.FieldNamer that writes Go names in
+// camelCase, lowering the first word: UserID becomes userID, HTTPServer
+// httpServer and ID id
+func CamelCase(name string) string {
+	var b strings.Builder
+	b.Grow(len(name))
+	forEachWord(name, func(i int, word string) {
+		if i == 0 {
+			word = strings.ToLower(word)
+		}
+		b.WriteString(word)
+	})
+	return b.String()
+}
+
+// forEachWord calls fn with each word of the Go name, in order. A word
+// starts at an upper-case letter after a lower-case letter or digit, and at
+// the last of a run of upper-case letters followed by a lower-case one, so
+// an initialism is one word.
+func forEachWord(name string, fn func(i int, word string)) {
+	runes := []rune(name)
+	start, n := 0, 0
+	for i := 1; i < len(runes); i++ {
+		if !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		prev := runes[i-1]
+		if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+			unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			fn(n, string(runes[start:i]))
+			start, n = i, n+1
+		}
+	}
+	fn(n, string(runes[start:]))
 }
 
 // getCachedFields retrieves field information from cache or computes it
@@ -649,7 +1053,7 @@ func getCachedFields(t reflect.Type) []Field {
 	}
 
 	// Not in cache - compute field information
-	fields := computeStructFields(t)
+	fields := computeStructFields(t, nil)
 
 	// Store in cache for future use
 	fieldCache.Store(key, fields)
@@ -657,6 +1061,167 @@ func getCachedFields(t reflect.Type) []Field {
 	return fields
 }
 
+// structFields returns the fields of struct type t as named under o. The
+// fields a FieldNamer names are cached apart from getCachedFields', keyed
+// by the namer, and resolved again since its names may collide.
+func structFields(t reflect.Type, o *MarshalOptions) []Field {
+	naming := o.naming()
+	if naming == (fieldNaming{}) {
+		return getCachedFields(t)
+	}
+	key := fieldCacheKey{rtype: t, naming: naming}
+	if cached, ok := fieldCache.Load(key); ok {
+		return cached.([]Field)
+	}
+
+	cached, _ := fieldCache.LoadOrStore(key, computeStructFields(t, o.FieldNamer))
+	return cached.([]Field)
+}
+
+// naming returns the fingerprint of the field naming options of o
+func (o *MarshalOptions) naming() fieldNaming {
+	if o == nil || o.FieldNamer == nil {
+		return fieldNaming{}
+	}
+	return fieldNaming{namer: *(*unsafe.Pointer)(unsafe.Pointer(&o.FieldNamer))}
+}
+
+// getDecodePlan retrieves the unmarshal plan for struct type t, with fields
+// named under o, from cache or builds it from the cached fields
+func getDecodePlan(t reflect.Type, o *MarshalOptions) *decodePlan {
+	key := fieldCacheKey{rtype: t, naming: o.naming()}
+	if cached, ok := planCache.Load(key); ok {
+		return cached.(*decodePlan)
+	}
+
+	fields := structFields(t, o)
+	plan := &decodePlan{
+		fields: fields,
+		byName: make(map[string]int, len(fields)),
+		flat:   true,
+	}
+	for i, f := range fields {
+		if f.unknown {
+			plan.unknown = f.index
+			plan.flat = false
+			continue
+		}
+		plan.byName[GetString(f.nameBytes)] = i
+		plan.names.add(f.nameBytes)
+		if !isFlatField(t, f) {
+			plan.flat = false
+		}
+	}
+	if plan.flat {
+		plan.kinds = make([]reflect.Kind, len(fields))
+		for i, f := range fields {
+			plan.kinds[i] = t.Field(f.index[0]).Type.Kind()
+		}
+	}
+
+	planCache.Store(key, plan)
+	return plan
+}
+
+// nameBit hashes name to its bit in a nameFilter
+func nameBit(name []byte) uint8 {
+	h := uint32(len(name)) * 0x9E3779B1
+	if len(name) > 0 {
+		h ^= uint32(name[0])<<8 | uint32(name[len(name)-1])
+		h *= 0x85EBCA6B
+	}
+	return uint8(h >> 24)
+}
+
+// add puts name in the set
+func (f *nameFilter) add(name []byte) {
+	b := nameBit(name)
+	f[b/64] |= 1 << (b % 64)
+}
+
+// has reports whether name may be in the set
+func (f *nameFilter) has(name []byte) bool {
+	b := nameBit(name)
+	return f[b/64]&(1<<(b%64)) != 0
+}
+
+// foldName finds the field whose name matches key ignoring case, as
+// encoding/json does when there is no exact match. The first such field
+// wins.
+func (plan *decodePlan) foldName(key string) (int, bool) {
+	for i := range plan.fields {
+		if f := &plan.fields[i]; !f.unknown && strings.EqualFold(GetString(f.nameBytes), key) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// getElemPlan retrieves the container plan for element type t from cache or
+// builds it. MarshalApexJSON takes precedence over MarshalJSON and, like
+// encoding/json, MarshalJSON over MarshalText, and any over the kind of t;
+// methods of *t count for addressable values only. Pointer and interface
+// types are left to marshalValue, which must check for nil first, and
+// time.Time keeps its RFC 3339 encoding.
+func getElemPlan(t reflect.Type) *elemPlan {
+	if cached, ok := elemCache.Load(t); ok {
+		return cached.(*elemPlan)
+	}
+
+	ptr := reflect.PointerTo(t)
+	plan := &elemPlan{}
+	if ignoreGenerated && ptr.Implements(generatedType) {
+		elemCache.Store(t, plan)
+		return plan
+	}
+	if haveFuncs.Load() {
+		if fn, ok := marshalFuncs.Load(t); ok {
+			plan.marshalFunc = fn.(marshalFunc)
+		}
+		if fn, ok := unmarshalFuncs.Load(t); ok {
+			plan.unmarshalFunc = fn.(unmarshalFunc)
+		}
+	}
+	plan.unmarshaler = plan.unmarshalFunc == nil && (ptr.Implements(unmarshalerFromType) || ptr.Implements(unmarshalerType))
+	if k := t.Kind(); k != reflect.Ptr && k != reflect.Interface && t != timeType && plan.marshalFunc == nil {
+		plan.marshaler = t.Implements(marshalerToType) || t.Implements(marshalerType)
+		plan.text = !plan.marshaler && t.Implements(textMarshalerType)
+		plan.addrMarshal = !plan.marshaler && (ptr.Implements(marshalerToType) || ptr.Implements(marshalerType))
+		plan.addrText = !plan.marshaler && !plan.text && ptr.Implements(textMarshalerType)
+	}
+
+	elemCache.Store(t, plan)
+	return plan
+}
+
+// hasAddrMethods reports whether t may have methods that only *t has, so
+// that an addressable t needs its elemPlan. Only declared types and structs,
+// which can promote methods of embedded fields, have any.
+func hasAddrMethods(t reflect.Type) bool {
+	return (t.PkgPath() != "" || t.Kind() == reflect.Struct) && reflect.PointerTo(t).NumMethod() > t.NumMethod()
+}
+
+// isFlatField reports whether f is a top-level field of a predeclared
+// string, number or bool type with no options that change how it decodes.
+// Named types are excluded since they may implement Unmarshaler.
+func isFlatField(t reflect.Type, f Field) bool {
+	if len(f.index) != 1 || f.optional || f.stringOpt || f.jsonString {
+		return false
+	}
+	ft := t.Field(f.index[0]).Type
+	if ft.PkgPath() != "" || ft.Name() == "" {
+		return false
+	}
+	switch ft.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
 // Helper to check if character is whitespace
 func isWhitespace(c byte) bool {
 	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
@@ -744,3 +1309,143 @@ func isCompleteLiteral(s string) bool {
 	// We should have consumed the entire string for a valid number
 	return i == len(s)
 }
+
+// isIntegerToken reports whether the number token s has no fraction or
+// exponent
+func isIntegerToken(s string) bool {
+	return strings.IndexAny(s, ".eE") < 0
+}
+
+func isIntegerKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// floatRoundTrips reports whether the shortest decimal form of f denotes the
+// same number as the token s. Spelling differences such as 1e2 for 100 or a
+// trailing 0 are not loss; 9007199254740993 read as ...992 is.
+func floatRoundTrips(s string, f float64, bits int) bool {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return false
+	}
+	neg, digits, exp, ok := normalizeDecimal(s)
+	fneg, fdigits, fexp, _ := normalizeDecimal(strconv.FormatFloat(f, 'e', -1, bits))
+	return ok && neg == fneg && digits == fdigits && exp == fexp
+}
+
+// normalizeDecimal splits the number s into sign, significant digits without
+// leading or trailing zeros and the exponent e such that s = 0.digits × 10^e.
+// Zero normalizes to no digits and a positive sign.
+func normalizeDecimal(s string) (neg bool, digits string, exp int, ok bool) {
+	if len(s) > 0 && s[0] == '-' {
+		neg = true
+		s = s[1:]
+	}
+	mant := s
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		mant = s[:i]
+		e, err := strconv.Atoi(strings.TrimPrefix(s[i+1:], "+"))
+		if err != nil {
+			// Exponents this large only survive parsing when the
+			// mantissa is zero
+			return false, "", 0, strings.Trim(mant, "0.") == ""
+		}
+		exp = e
+	}
+
+	intPart, frac := mant, ""
+	if i := strings.IndexByte(mant, '.'); i >= 0 {
+		intPart, frac = mant[:i], mant[i+1:]
+	}
+	digits = intPart + frac
+	exp += len(intPart)
+
+	trimmed := strings.TrimLeft(digits, "0")
+	exp -= len(digits) - len(trimmed)
+	digits = strings.TrimRight(trimmed, "0")
+	if digits == "" {
+		return false, "", 0, true
+	}
+	return neg, digits, exp, true
+}
+
+// pathAt describes where the value starting at offset sits in the document
+// data, as object keys joined by dots and array indexes in brackets
+func pathAt(data []byte, offset int) string {
+	var s pathScanner
+	s.advance(data, offset)
+	return s.String()
+}
+
+// advance moves the scanner to offset in data, resuming from its previous
+// position when data is the same document and offset hasn't gone back
+func (s *pathScanner) advance(data []byte, offset int) {
+	if unsafe.SliceData(data) != unsafe.SliceData(s.data) || offset < s.pos {
+		*s = pathScanner{data: data, stack: s.stack[:0]}
+	}
+
+	stack := s.stack
+	i := s.pos
+	for ; i < offset && i < len(data); i++ {
+		switch data[i] {
+		case '"':
+			j := i + 1
+			for j < len(data) && data[j] != '"' {
+				if data[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if s.expectKey && len(stack) > 0 && j < len(data) {
+				key, err := strconv.Unquote(string(data[i : j+1]))
+				if err != nil {
+					key = string(data[i+1 : j])
+				}
+				stack[len(stack)-1].key = key
+				s.expectKey = false
+			}
+			i = j
+		case '{':
+			stack = append(stack, pathFrame{object: true})
+			s.expectKey = true
+		case '[':
+			stack = append(stack, pathFrame{})
+		case '}', ']':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case ',':
+			if len(stack) > 0 {
+				if top := &stack[len(stack)-1]; top.object {
+					s.expectKey = true
+				} else {
+					top.index++
+				}
+			}
+		}
+	}
+	s.stack, s.pos = stack, i
+}
+
+// String formats the path of the value at the scanner's position
+func (s *pathScanner) String() string {
+	b := getBuilder()
+	defer putBuilder(b)
+	for i, f := range s.stack {
+		if !f.object {
+			b.WriteByte('[')
+			b.WriteString(strconv.Itoa(f.index))
+			b.WriteByte(']')
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(f.key)
+	}
+	return b.String()
+}
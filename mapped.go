@@ -0,0 +1,285 @@
+package apexJSON
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// NewMappedRegion returns a region for data, decoded from with
+// UnmarshalMapped. unmap, if not nil, is called by Close to release data
+// once no decoded string refers to it; policy decides how Close gets there.
+func NewMappedRegion(data []byte, policy ClosePolicy, unmap func() error) *MappedRegion {
+	r := &MappedRegion{
+		data:    data,
+		unmap:   unmap,
+		aliases: make(map[interface{}][]reflect.Value),
+		policy:  policy,
+	}
+	r.idle.L = &r.mu
+	return r
+}
+
+// UnmarshalMapped is Unmarshal for data inside region's memory. Decoded
+// strings without escapes share the input's memory, as they do for
+// Unmarshal; each one left in v counts against region until Release is
+// called with the same v, or until Close copies it out under CloseCopy.
+//
+// Only strings that can be updated in place later are left aliased: map
+// keys, and strings inside map values or inside a struct or array held in
+// an interface{}, are copied once the decode is done and never count.
+// Strings v already held that alias the region are counted again.
+func UnmarshalMapped(data []byte, v interface{}, region *MappedRegion) error {
+	if region == nil {
+		return fmt.Errorf("json: UnmarshalMapped with nil region")
+	}
+	if len(data) > 0 && !region.holds(data) {
+		return fmt.Errorf("json: UnmarshalMapped input is outside the region")
+	}
+
+	region.mu.Lock()
+	if region.closed {
+		region.mu.Unlock()
+		return ErrRegionClosed
+	}
+	region.decoding++
+	region.mu.Unlock()
+
+	err := Unmarshal(data, v)
+
+	// Strings from a decode that failed partway alias the region too
+	var refs []reflect.Value
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		t := aliasTracker{region: region}
+		t.walk(rv.Elem(), true)
+		refs = t.refs
+	}
+
+	region.mu.Lock()
+	region.decoding--
+	if len(refs) > 0 {
+		region.aliases[v] = append(region.aliases[v], refs...)
+		region.refs += len(refs)
+	}
+	region.idle.Broadcast()
+	region.mu.Unlock()
+	return err
+}
+
+// Refs returns the number of decoded strings that alias the region and
+// have not been released or copied out
+func (r *MappedRegion) Refs() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refs
+}
+
+// Release tells the region the strings decoded into v, the pointer passed
+// to UnmarshalMapped, are no longer used, so they stop counting against
+// it. Strings still held in v must not be used after Close.
+func (r *MappedRegion) Release(v interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if refs, ok := r.aliases[v]; ok {
+		r.refs -= len(refs)
+		delete(r.aliases, v)
+		r.idle.Broadcast()
+	}
+}
+
+// Close releases the region once no decoded string refers to it, calling
+// the unmap function it was created with. While strings are still counted
+// it waits for them to be released under CloseWait, returns ErrRegionInUse
+// under CloseError, leaving the region open, and under CloseCopy replaces
+// each one with a copy. CloseCopy writes to the destinations, so they must
+// not be in use while Close runs. Decodes in progress are always waited for.
+func (r *MappedRegion) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRegionClosed
+	}
+
+	switch r.policy {
+	case CloseError:
+		if r.refs > 0 || r.decoding > 0 {
+			return ErrRegionInUse
+		}
+		r.closed = true
+	case CloseCopy:
+		r.closed = true
+		for r.decoding > 0 {
+			r.idle.Wait()
+		}
+		for _, refs := range r.aliases {
+			for _, ref := range refs {
+				detachString(ref, r)
+			}
+		}
+		clear(r.aliases)
+		r.refs = 0
+	default:
+		r.closed = true
+		for r.refs > 0 || r.decoding > 0 {
+			r.idle.Wait()
+		}
+	}
+
+	if r.unmap != nil {
+		return r.unmap()
+	}
+	return nil
+}
+
+// holds reports whether all of b lies within the region's memory
+func (r *MappedRegion) holds(b []byte) bool {
+	if !within(b, r.data) {
+		return false
+	}
+	end := uintptr(unsafe.Pointer(unsafe.SliceData(r.data))) + uintptr(len(r.data))
+	return uintptr(unsafe.Pointer(unsafe.SliceData(b)))+uintptr(len(b)) <= end
+}
+
+// aliased reports whether s shares the region's memory
+func (r *MappedRegion) aliased(s string) bool {
+	return within(unsafe.Slice(unsafe.StringData(s), len(s)), r.data)
+}
+
+// detachString replaces the string held by ref, a settable string or
+// interface{} value, with a copy if it still aliases r
+func detachString(ref reflect.Value, r *MappedRegion) bool {
+	s := ref
+	if ref.Kind() == reflect.Interface {
+		s = ref.Elem()
+	}
+	if s.Kind() != reflect.String || !r.aliased(s.String()) {
+		return false
+	}
+	ref.Set(reflect.ValueOf(strings.Clone(s.String())).Convert(s.Type()))
+	return true
+}
+
+// walk visits every string reachable from v, which must be settable. When
+// track is set they are recorded for the region; otherwise v is a copy about
+// to be stored somewhere that can't be updated in place later, and they are
+// copied out at once. walk reports whether it changed v.
+func (t *aliasTracker) walk(v reflect.Value, track bool) bool {
+	switch v.Kind() {
+	case reflect.String:
+		if !t.region.aliased(v.String()) {
+			return false
+		}
+		if track {
+			t.refs = append(t.refs, v)
+			return false
+		}
+		return detachString(v, t.region)
+	case reflect.Interface:
+		if v.IsNil() {
+			return false
+		}
+		switch e := v.Elem(); e.Kind() {
+		case reflect.String:
+			if !t.region.aliased(e.String()) {
+				return false
+			}
+			if track {
+				t.refs = append(t.refs, v)
+				return false
+			}
+			return detachString(v, t.region)
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			t.walkShared(e)
+		case reflect.Struct, reflect.Array:
+			c := reflect.New(e.Type()).Elem()
+			c.Set(e)
+			if t.walk(c, false) {
+				v.Set(c)
+				return true
+			}
+		}
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		t.walkShared(v)
+	case reflect.Array:
+		if !mayHoldString(v.Type().Elem().Kind()) {
+			return false
+		}
+		changed := false
+		for i := 0; i < v.Len(); i++ {
+			changed = t.walk(v.Index(i), track) || changed
+		}
+		return changed
+	case reflect.Struct:
+		changed := false
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				changed = t.walk(f, track) || changed
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+// walkShared visits the memory a pointer, slice or map refers to, which
+// outlives whatever copy v was read from
+func (t *aliasTracker) walkShared(v reflect.Value) {
+	if v.IsNil() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if t.seen == nil {
+			t.seen = make(map[unsafe.Pointer]bool)
+		}
+		if p := v.UnsafePointer(); !t.seen[p] {
+			t.seen[p] = true
+			t.walk(v.Elem(), true)
+		}
+	case reflect.Slice:
+		if !mayHoldString(v.Type().Elem().Kind()) {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			t.walk(v.Index(i), true)
+		}
+	case reflect.Map:
+		t.walkMap(v)
+	}
+}
+
+// walkMap copies out the aliased strings in a map's keys and values, which
+// can't be updated in place once stored
+func (t *aliasTracker) walkMap(m reflect.Value) {
+	keyString := m.Type().Key().Kind() == reflect.String
+	if !keyString && !mayHoldString(m.Type().Elem().Kind()) {
+		return
+	}
+
+	elem := reflect.New(m.Type().Elem()).Elem()
+	for _, key := range m.MapKeys() {
+		elem.Set(m.MapIndex(key))
+		changed := t.walk(elem, false)
+		if keyString && t.region.aliased(key.String()) {
+			m.SetMapIndex(key, reflect.Value{})
+			key = reflect.ValueOf(strings.Clone(key.String())).Convert(key.Type())
+			changed = true
+		}
+		if changed {
+			m.SetMapIndex(key, elem)
+		}
+	}
+}
+
+// mayHoldString reports whether values of kind k can contain a string
+func mayHoldString(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128,
+		reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package apexJSON_test
+
+import (
+	"apexJSON"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const mappedDoc = `{
+	"id": "entry-1",
+	"title": "quoted \"title\"",
+	"tags": ["alpha", "beta"],
+	"attrs": {"color": "red", "size": "L"},
+	"any": ["x", {"k": "v"}, 1],
+	"label": "boxed",
+	"next": {"id": "entry-2", "tags": ["gamma"]}
+}`
+
+type mappedEntry struct {
+	ID    string            `json:"id"`
+	Title string            `json:"title"`
+	Tags  []string          `json:"tags"`
+	Attrs map[string]string `json:"attrs"`
+	Any   interface{}       `json:"any"`
+	Label interface{}       `json:"label"`
+	Next  *mappedEntry      `json:"next"`
+}
+
+// mappedFile stands in for a memory-mapped file: unmap overwrites the
+// bytes, as reading an unmapped page would fail, so any string still
+// aliasing them changes
+type mappedFile struct {
+	data     []byte
+	unmapped bool
+}
+
+func newMappedFile(doc string) *mappedFile {
+	return &mappedFile{data: []byte(doc)}
+}
+
+func (f *mappedFile) unmap() error {
+	f.unmapped = true
+	for i := range f.data {
+		f.data[i] = '#'
+	}
+	return nil
+}
+
+// decodeMapped decodes mappedDoc out of f and checks it against
+// encoding/json
+func decodeMapped(t *testing.T, f *mappedFile, region *apexJSON.MappedRegion) (*mappedEntry, mappedEntry) {
+	t.Helper()
+	var got, want mappedEntry
+	if err := json.Unmarshal([]byte(mappedDoc), &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := apexJSON.UnmarshalMapped(f.data, &got, region); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %+v\nwant %+v", got, want)
+	}
+	// id, both tags, label, "x" in any, and next's id and tag; title has
+	// escapes and map contents are copied
+	if n := region.Refs(); n != 7 {
+		t.Errorf("Refs() = %d, want 7", n)
+	}
+	return &got, want
+}
+
+func TestUnmarshalMappedCopy(t *testing.T) {
+	f := newMappedFile(mappedDoc)
+	region := apexJSON.NewMappedRegion(f.data, apexJSON.CloseCopy, f.unmap)
+	got, want := decodeMapped(t, f, region)
+
+	if err := region.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.unmapped || region.Refs() != 0 {
+		t.Fatalf("unmapped %v with %d refs", f.unmapped, region.Refs())
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("after unmap %+v\nwant %+v", *got, want)
+	}
+
+	if err := apexJSON.UnmarshalMapped(f.data, got, region); !errors.Is(err, apexJSON.ErrRegionClosed) {
+		t.Errorf("decode after Close: %v", err)
+	}
+	if err := region.Close(); !errors.Is(err, apexJSON.ErrRegionClosed) {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestUnmarshalMappedError(t *testing.T) {
+	f := newMappedFile(mappedDoc)
+	region := apexJSON.NewMappedRegion(f.data, apexJSON.CloseError, f.unmap)
+	got, want := decodeMapped(t, f, region)
+
+	if err := region.Close(); !errors.Is(err, apexJSON.ErrRegionInUse) || f.unmapped {
+		t.Fatalf("Close while referenced: %v, unmapped %v", err, f.unmapped)
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Fatalf("after refused Close %+v", *got)
+	}
+
+	// The region stays usable until it closes
+	var more mappedEntry
+	if err := apexJSON.UnmarshalMapped(f.data, &more, region); err != nil {
+		t.Fatal(err)
+	}
+	region.Release(got)
+	if err := region.Close(); !errors.Is(err, apexJSON.ErrRegionInUse) {
+		t.Fatalf("Close with one destination left: %v", err)
+	}
+	region.Release(&more)
+	if err := region.Close(); err != nil || !f.unmapped {
+		t.Fatalf("Close after Release: %v, unmapped %v", err, f.unmapped)
+	}
+	if got.ID == want.ID {
+		t.Error("released string still reads the unmapped bytes as before")
+	}
+}
+
+func TestUnmarshalMappedWait(t *testing.T) {
+	f := newMappedFile(mappedDoc)
+	region := apexJSON.NewMappedRegion(f.data, apexJSON.CloseWait, f.unmap)
+	got, want := decodeMapped(t, f, region)
+
+	closed := make(chan error)
+	go func() { closed <- region.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned while referenced: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Still mapped while Close waits
+	if !reflect.DeepEqual(*got, want) {
+		t.Fatalf("while waiting %+v", *got)
+	}
+	region.Release(got)
+	if err := <-closed; err != nil || !f.unmapped {
+		t.Fatalf("Close after Release: %v, unmapped %v", err, f.unmapped)
+	}
+}
+
+func TestUnmarshalMappedInput(t *testing.T) {
+	f := newMappedFile(`["a", "b"]`)
+	region := apexJSON.NewMappedRegion(f.data[:6], apexJSON.CloseError, nil)
+
+	var v []string
+	if err := apexJSON.UnmarshalMapped(f.data, &v, region); err == nil {
+		t.Error("input running past the region accepted")
+	}
+	if err := apexJSON.UnmarshalMapped(bytes.Clone(f.data), &v, region); err == nil {
+		t.Error("input outside the region accepted")
+	}
+	if err := apexJSON.UnmarshalMapped(f.data, &v, nil); err == nil {
+		t.Error("nil region accepted")
+	}
+
+	// Strings from a failed decode are counted too
+	var arr []string
+	if err := apexJSON.UnmarshalMapped(f.data[:6], &arr, region); err == nil {
+		t.Fatal("truncated input accepted")
+	}
+	if n := region.Refs(); n != len(arr) {
+		t.Errorf("Refs() = %d for %q", n, arr)
+	}
+	region.Release(&arr)
+	if err := region.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,451 @@
+package apexJSON
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// MapStructs copies the fields of the struct src into the fields of the same
+// JSON name in the struct dst points to, converting values the way Marshal
+// followed by Unmarshal would but without encoding them. Values of
+// assignable types are copied directly, sharing maps, slices and pointers
+// with src; numbers convert between kinds with the same overflow checks as
+// Unmarshal, and Number to and from any numeric kind; nested structs, slices
+// and string-keyed maps are mapped member by member, allocating pointers on
+// the dst side as needed. time.Time converts to and from strings in RFC 3339
+// form. Other types with their own MarshalJSON or UnmarshalJSON go through
+// their JSON encoding.
+//
+// The fields of embedded structs are promoted, as in Marshal, so they map
+// onto members of the same name whichever struct declares them. Optional,
+// omitempty and Unknown fields behave as they would in the round trip.
+// Fields that cannot be converted are left as they were and reported
+// together in a MultiError of *FieldErrors; every other field is still
+// copied.
+func MapStructs(dst, src interface{}) error {
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() || dv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("json: MapStructs destination must be a non-nil pointer to a struct, not %T", dst)
+	}
+	sv := reflect.ValueOf(src)
+	for sv.Kind() == reflect.Ptr && !sv.IsNil() {
+		sv = sv.Elem()
+	}
+	if sv.Kind() != reflect.Struct {
+		return fmt.Errorf("json: MapStructs source must be a struct or a pointer to one, not %T", src)
+	}
+
+	var errs MultiError
+	mapStruct(dv.Elem(), sv, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// getStructMapping retrieves the field pairing of src onto dst from cache or
+// builds it from both types' cached fields
+func getStructMapping(dst, src reflect.Type) *structMapping {
+	key := [2]reflect.Type{dst, src}
+	if cached, ok := mappingCache.Load(key); ok {
+		return cached.(*structMapping)
+	}
+
+	m := &structMapping{dst: getDecodePlan(dst, nil)}
+	fields := getCachedFields(src)
+	for i := range fields {
+		f := &fields[i]
+		if f.unknown {
+			m.srcUnknown = f
+			continue
+		}
+		if j, ok := m.dst.byName[GetString(f.nameBytes)]; ok {
+			m.pairs = append(m.pairs, fieldPair{src: f, dst: &m.dst.fields[j]})
+		} else {
+			m.unmatched = append(m.unmatched, f)
+		}
+	}
+
+	mappingCache.Store(key, m)
+	return m
+}
+
+// mapStruct copies the fields of src into dst, two structs
+func mapStruct(dst, src reflect.Value, errs *MultiError) {
+	m := getStructMapping(dst.Type(), src.Type())
+	for _, pair := range m.pairs {
+		sf, ok := encodedField(src, pair.src)
+		if !ok {
+			continue
+		}
+		df, err := settableField(dst, pair.dst.index)
+		if err != nil {
+			*errs = append(*errs, &FieldError{Path: string(pair.src.nameBytes), Err: err})
+			continue
+		}
+		if pair.dst.optional {
+			null := encodesNull(sf)
+			df.Addr().Interface().(optionalValue).setOptional(true, null)
+			if null {
+				continue
+			}
+			df = df.Field(0)
+		}
+		before := len(*errs)
+		mapValue(df, sf, errs)
+		if len(*errs) > before {
+			prefixPaths((*errs)[before:], string(pair.src.nameBytes))
+		}
+	}
+
+	// What the round trip would carry in dst's Unknown: fields dst lacks,
+	// and src's own unknown members unless dst has a field of their name
+	if m.dst.unknown != nil {
+		for _, f := range m.unmatched {
+			sf, ok := encodedField(src, f)
+			if !ok {
+				continue
+			}
+			raw, err := marshal(sf.Interface())
+			if err != nil {
+				*errs = append(*errs, &FieldError{Path: string(f.nameBytes), Err: err})
+				continue
+			}
+			if err := keepMember(dst, m, GetString(f.nameBytes), raw); err != nil {
+				*errs = append(*errs, &FieldError{Path: string(f.nameBytes), Err: err})
+			}
+		}
+	}
+	if m.srcUnknown != nil {
+		if u, ok := fieldValue(src, m.srcUnknown.index); ok {
+			mapUnknown(dst, m, u.Interface().(Unknown), errs)
+		}
+	}
+}
+
+// mapUnknown decodes the members of u, src's Unknown, into the dst fields
+// of their names, keeping the rest in dst's own Unknown
+func mapUnknown(dst reflect.Value, m *structMapping, u Unknown, errs *MultiError) {
+	for name, raw := range u {
+		if m.shadows(name) {
+			continue
+		}
+		if i, ok := m.dst.byName[name]; ok {
+			f := &m.dst.fields[i]
+			p := NewParser(append([]byte(nil), raw...))
+			if err := p.endOfInput(unmarshalField(p, dst, f)); err != nil {
+				*errs = append(*errs, &FieldError{Path: string(f.nameBytes), Err: err})
+			}
+			continue
+		}
+		if m.dst.unknown != nil {
+			if err := keepMember(dst, m, name, append(RawMessage(nil), raw...)); err != nil {
+				*errs = append(*errs, &FieldError{Path: name, Err: err})
+			}
+		}
+	}
+}
+
+// keepMember stores raw under name in dst's Unknown
+func keepMember(dst reflect.Value, m *structMapping, name string, raw RawMessage) error {
+	u, err := settableField(dst, m.dst.unknown)
+	if err != nil {
+		return err
+	}
+	if u.IsNil() {
+		u.Set(reflect.MakeMap(unknownType))
+	}
+	u.SetMapIndex(reflect.ValueOf(name), reflect.ValueOf(raw))
+	return nil
+}
+
+// shadows reports whether src has a field named name, which Marshal writes
+// in place of the Unknown member of the same name
+func (m *structMapping) shadows(name string) bool {
+	for _, pair := range m.pairs {
+		if GetString(pair.src.nameBytes) == name {
+			return true
+		}
+	}
+	for _, f := range m.unmatched {
+		if GetString(f.nameBytes) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// encodedField returns the value Marshal would write for the field f of
+// src, reporting false when it would leave the field out. An Optional
+// that is Null yields the invalid Value, for null.
+func encodedField(src reflect.Value, f *Field) (reflect.Value, bool) {
+	v, ok := fieldValue(src, f.index)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	if f.optional {
+		if !v.Field(1).Bool() {
+			return reflect.Value{}, false
+		}
+		if v.Field(2).Bool() {
+			return reflect.Value{}, true
+		}
+		v = v.Field(0)
+	}
+	if f.omitEmpty && isEmptyValue(v) {
+		return reflect.Value{}, false
+	}
+	return v, true
+}
+
+// encodesNull reports whether Marshal writes v as null
+func encodesNull(v reflect.Value) bool {
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
+
+// prefixPaths puts seg, a member name or a bracketed index, in front of the
+// paths of errs, all *FieldErrors. Paths are built this way, on the way
+// out, so values that map cleanly cost no strings.
+func prefixPaths(errs MultiError, seg string) {
+	for _, err := range errs {
+		fe := err.(*FieldError)
+		switch {
+		case fe.Path == "":
+			fe.Path = seg
+		case fe.Path[0] == '[':
+			fe.Path = seg + fe.Path
+		default:
+			fe.Path = seg + "." + fe.Path
+		}
+	}
+}
+
+// mapValue stores src in dst, converting it as its JSON encoding would be
+// decoded. Failures are added to errs with paths relative to dst and leave
+// dst as it was.
+func mapValue(dst, src reflect.Value, errs *MultiError) {
+	if err := mapConvert(dst, src, errs); err != nil {
+		*errs = append(*errs, &FieldError{Err: err})
+	}
+}
+
+// mapConvert is mapValue for a single value. Errors in members of src are
+// added to errs directly; the error returned is for src as a whole.
+func mapConvert(dst, src reflect.Value, errs *MultiError) error {
+	if src.IsValid() && src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	for src.IsValid() && (src.Kind() == reflect.Ptr || src.Kind() == reflect.Interface) {
+		if src.IsNil() {
+			src = reflect.Value{}
+			break
+		}
+		src = src.Elem()
+	}
+	if encodesNull(src) {
+		return setNull(dst)
+	}
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	if dst.Kind() == reflect.Ptr {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return mapConvert(dst.Elem(), src, errs)
+	}
+
+	// time.Time to and from its RFC 3339 text, as Marshal writes it
+	if dst.Type() == timeType && src.Kind() == reflect.String {
+		return dst.Addr().Interface().(*time.Time).UnmarshalText([]byte(src.String()))
+	}
+	if src.Type() == timeType && dst.Kind() == reflect.String {
+		dst.SetString(src.Interface().(time.Time).Format(time.RFC3339))
+		return nil
+	}
+
+	// Values that encode or decode themselves see their real JSON, apart
+	// from Number whose encoding as a string would lose its meaning. Only
+	// types with methods are looked up, unless functions are registered.
+	if src.Type() != numberType && dst.Type() != numberType &&
+		(src.NumMethod() > 0 || dst.Addr().NumMethod() > 0 || mayBeRegistered(src.Type()) || mayBeRegistered(dst.Type())) {
+		if plan := getElemPlan(src.Type()); plan.marshaler || plan.text || plan.marshalFunc != nil || src.Type() == timeType ||
+			getElemPlan(dst.Type()).unmarshaler || getElemPlan(dst.Type()).unmarshalFunc != nil {
+			return mapEncoded(dst, src)
+		}
+	}
+
+	switch sk, dk := src.Kind(), dst.Kind(); {
+	case sk == reflect.String && dk == reflect.String:
+		dst.SetString(src.String())
+		return nil
+
+	case isNumberKind(sk) || src.Type() == numberType:
+		return mapNumber(dst, src)
+
+	case sk == reflect.Bool && dk == reflect.Bool:
+		dst.SetBool(src.Bool())
+		return nil
+
+	case sk == reflect.Struct && dk == reflect.Struct:
+		mapStruct(dst, src, errs)
+		return nil
+
+	case (sk == reflect.Slice || sk == reflect.Array) && src.Type().Elem().Kind() != reflect.Uint8:
+		return mapArray(dst, src, errs)
+
+	case sk == reflect.Map && src.Type().Key().Kind() == reflect.String &&
+		dk == reflect.Map && dst.Type().Key().Kind() == reflect.String:
+		n := reflect.MakeMapWithSize(dst.Type(), src.Len())
+		elem := reflect.New(dst.Type().Elem()).Elem()
+		for iter := src.MapRange(); iter.Next(); {
+			elem.SetZero()
+			before := len(*errs)
+			mapValue(elem, iter.Value(), errs)
+			k := iter.Key()
+			if len(*errs) > before {
+				prefixPaths((*errs)[before:], k.String())
+				continue
+			}
+			if k.Type() != dst.Type().Key() {
+				k = k.Convert(dst.Type().Key())
+			}
+			n.SetMapIndex(k, elem)
+		}
+		dst.Set(n)
+		return nil
+	}
+	return mapEncoded(dst, src)
+}
+
+// mapArray maps the elements of the slice or array src into dst. Like
+// Unmarshal, a slice is resized to fit and an array keeps as many elements
+// as it has room for, zeroing the rest.
+func mapArray(dst, src reflect.Value, errs *MultiError) error {
+	n := src.Len()
+	switch dst.Kind() {
+	case reflect.Slice:
+		dst.Set(reflect.MakeSlice(dst.Type(), n, n))
+	case reflect.Array:
+		for i := n; i < dst.Len(); i++ {
+			dst.Index(i).SetZero()
+		}
+		n = min(n, dst.Len())
+	default:
+		return &UnmarshalTypeError{Value: "array", Type: dst.Type()}
+	}
+	for i := 0; i < n; i++ {
+		before := len(*errs)
+		mapValue(dst.Index(i), src.Index(i), errs)
+		if len(*errs) > before {
+			prefixPaths((*errs)[before:], "["+strconv.Itoa(i)+"]")
+		}
+	}
+	return nil
+}
+
+// mapNumber stores src, a number or Number, in dst
+func mapNumber(dst, src reflect.Value) error {
+	if dst.Type() == numberType {
+		if src.Type() == numberType {
+			dst.SetString(src.String())
+			return nil
+		}
+		buf := getBufferSize(32)
+		err := marshalValue(src, buf)
+		if err == nil {
+			dst.SetString(string(buf.Bytes()))
+		}
+		putBuffer(buf)
+		return err
+	}
+
+	// Integers convert directly; floats and Numbers are formatted and parsed
+	// so fractions and exponents are judged exactly as Unmarshal judges them
+	switch sk, dk := src.Kind(), dst.Kind(); {
+	case isSignedKind(sk) && isSignedKind(dk):
+		if dst.OverflowInt(src.Int()) {
+			return numberRangeError(strconv.FormatInt(src.Int(), 10), dst.Type())
+		}
+		dst.SetInt(src.Int())
+		return nil
+	case isUnsignedKind(sk) && isUnsignedKind(dk):
+		if dst.OverflowUint(src.Uint()) {
+			return numberRangeError(strconv.FormatUint(src.Uint(), 10), dst.Type())
+		}
+		dst.SetUint(src.Uint())
+		return nil
+	case isSignedKind(sk) && isUnsignedKind(dk):
+		if src.Int() < 0 || dst.OverflowUint(uint64(src.Int())) {
+			return numberRangeError(strconv.FormatInt(src.Int(), 10), dst.Type())
+		}
+		dst.SetUint(uint64(src.Int()))
+		return nil
+	case isUnsignedKind(sk) && isSignedKind(dk):
+		if src.Uint() > math.MaxInt64 || dst.OverflowInt(int64(src.Uint())) {
+			return numberRangeError(strconv.FormatUint(src.Uint(), 10), dst.Type())
+		}
+		dst.SetInt(int64(src.Uint()))
+		return nil
+	case (isSignedKind(sk) || isUnsignedKind(sk)) && (dk == reflect.Float32 || dk == reflect.Float64):
+		if isSignedKind(sk) {
+			dst.SetFloat(float64(src.Int()))
+		} else {
+			dst.SetFloat(float64(src.Uint()))
+		}
+		return nil
+	}
+
+	var s string
+	if src.Type() == numberType {
+		// An unset Number has no value to convert
+		if s = src.String(); s == "" {
+			return nil
+		}
+	} else {
+		buf := getBufferSize(32)
+		err := marshalValue(src, buf)
+		s = string(buf.Bytes())
+		putBuffer(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return setNumber(dst, s, &defaultOptions)
+}
+
+// mapEncoded stores src in dst by encoding src and decoding the result, for
+// the values MapStructs has no direct conversion for. The encoding isn't
+// pooled since decoded strings may point into it.
+func mapEncoded(dst, src reflect.Value) error {
+	data, err := marshal(src.Interface())
+	if err != nil {
+		return err
+	}
+	p := NewParser(data)
+	return p.endOfInput(unmarshalValue(p, dst))
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return isSignedKind(k) || isUnsignedKind(k) || k == reflect.Float32 || k == reflect.Float64
+}
+
+func isSignedKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUnsignedKind(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
@@ -0,0 +1,169 @@
+package apexJSON_test
+
+import (
+	"apexJSON"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type WireBase struct {
+	ID int64 `json:"id"`
+}
+
+type wireAccount struct {
+	WireBase
+	Name     string                    `json:"name"`
+	Balance  float64                   `json:"balance"`
+	Visits   int64                     `json:"visits"`
+	Joined   string                    `json:"joined"`
+	Rank     apexJSON.Number           `json:"rank"`
+	Owner    *wireOwner                `json:"owner"`
+	Labels   []string                  `json:"labels"`
+	Limits   map[string]int64          `json:"limits"`
+	Note     string                    `json:"note,omitempty"`
+	Extra    string                    `json:"extra"`
+	Nickname apexJSON.Optional[string] `json:"nickname"`
+}
+
+type wireOwner struct {
+	Email string `json:"email"`
+}
+
+type DomainBase struct {
+	ID uint32 `json:"id"`
+}
+
+type domainAccount struct {
+	DomainBase
+	Name     string                     `json:"name"`
+	Balance  apexJSON.Number            `json:"balance"`
+	Visits   int32                      `json:"visits"`
+	Joined   time.Time                  `json:"joined"`
+	Rank     int                        `json:"rank"`
+	Owner    *domainOwner               `json:"owner"`
+	Labels   []string                   `json:"labels"`
+	Limits   map[string]uint8           `json:"limits"`
+	Note     *string                    `json:"note"`
+	Nickname apexJSON.Optional[*string] `json:"nickname"`
+	apexJSON.Unknown
+}
+
+type domainOwner struct {
+	Email string `json:"email"`
+}
+
+func TestMapStructs(t *testing.T) {
+	src := wireAccount{
+		WireBase: WireBase{ID: 7},
+		Name:     "ada",
+		Balance:  12.5,
+		Visits:   300,
+		Joined:   "2024-03-01T10:00:00Z",
+		Rank:     "42",
+		Owner:    &wireOwner{Email: "ada@example.com"},
+		Labels:   []string{"a", "b"},
+		Limits:   map[string]int64{"daily": 10},
+		Extra:    "kept",
+		Nickname: apexJSON.Optional[string]{Value: "A", Present: true},
+	}
+
+	var dst domainAccount
+	if err := apexJSON.MapStructs(&dst, &src); err != nil {
+		t.Fatalf("MapStructs: %v", err)
+	}
+
+	if dst.ID != 7 || dst.Balance != "12.5" || dst.Visits != 300 || dst.Rank != 42 {
+		t.Errorf("scalars = %d %q %d %d", dst.ID, dst.Balance, dst.Visits, dst.Rank)
+	}
+	if !dst.Joined.Equal(time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Joined = %v", dst.Joined)
+	}
+	if !reflect.DeepEqual(dst.Labels, src.Labels) || !reflect.DeepEqual(dst.Limits, map[string]uint8{"daily": 10}) {
+		t.Errorf("Labels = %v, Limits = %v", dst.Labels, dst.Limits)
+	}
+	if dst.Owner == nil || dst.Owner.Email != "ada@example.com" {
+		t.Errorf("Owner = %+v", dst.Owner)
+	}
+	if dst.Note != nil {
+		t.Errorf("Note = %q, want nil for an omitted empty field", *dst.Note)
+	}
+	if !dst.Nickname.Present || dst.Nickname.Value == nil || *dst.Nickname.Value != "A" {
+		t.Errorf("Nickname = %+v", dst.Nickname)
+	}
+	if string(dst.Unknown["extra"]) != `"kept"` {
+		t.Errorf("Unknown = %q", dst.Unknown)
+	}
+}
+
+func TestMapStructsErrors(t *testing.T) {
+	src := wireAccount{
+		Name:   "bob",
+		Visits: 1 << 40,
+		Joined: "yesterday",
+		Limits: map[string]int64{"daily": 10, "monthly": 1000},
+	}
+
+	var dst domainAccount
+	err := apexJSON.MapStructs(&dst, src)
+
+	var multi apexJSON.MultiError
+	if !errors.As(err, &multi) {
+		t.Fatalf("MapStructs = %v, want a MultiError", err)
+	}
+	paths := map[string]bool{}
+	for _, e := range multi {
+		var fe *apexJSON.FieldError
+		if !errors.As(e, &fe) {
+			t.Fatalf("error %v is not a *FieldError", e)
+		}
+		paths[fe.Path] = true
+	}
+	want := map[string]bool{"visits": true, "joined": true, "limits.monthly": true}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("failed paths = %v, want %v (%v)", paths, want, err)
+	}
+
+	// Every other field is still copied, and failed ones are left alone
+	if dst.Name != "bob" || dst.Visits != 0 || dst.Limits["daily"] != 10 {
+		t.Errorf("dst = %+v", dst)
+	}
+	if _, ok := dst.Limits["monthly"]; ok {
+		t.Errorf("Limits kept the overflowing entry: %v", dst.Limits)
+	}
+
+	if err := apexJSON.MapStructs(dst, src); err == nil {
+		t.Error("MapStructs into a non-pointer succeeded")
+	}
+}
+
+func BenchmarkMapStructs(b *testing.B) {
+	src := wireAccount{
+		WireBase: WireBase{ID: 7},
+		Name:     "ada",
+		Balance:  12.5,
+		Visits:   300,
+		Joined:   "2024-03-01T10:00:00Z",
+		Rank:     "42",
+		Owner:    &wireOwner{Email: "ada@example.com"},
+		Labels:   []string{"a", "b"},
+		Limits:   map[string]int64{"daily": 10},
+	}
+
+	b.Run("MapStructs", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var dst domainAccount
+			_ = apexJSON.MapStructs(&dst, &src)
+		}
+	})
+	b.Run("RoundTrip", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var dst domainAccount
+			data, _ := apexJSON.Marshal(&src)
+			_ = apexJSON.Unmarshal(data, &dst)
+		}
+	})
+}
@@ -1,12 +1,18 @@
 package apexJSON
 
 import (
+	"bytes"
+	"encoding"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"math"
 	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,19 +25,51 @@ func marshalValue(v reflect.Value, buf *Buffer) error {
 		return nil
 	}
 
-	// 2. Handle pointer indirection with a loop to avoid recursion
-	// This ensures proper handling of pointers to all types including primitives
-	for v.Kind() == reflect.Ptr {
+	// 2. Handle pointer and interface indirection with a loop to avoid recursion
+	// This ensures proper handling of pointers to all types including primitives,
+	// and that nil pointers and interfaces encode as null without ever calling
+	// methods on a nil receiver. Only a pointer or interface holding itself
+	// goes on for cycleDepth steps.
+	for n := 0; v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface; n++ {
 		if v.IsNil() {
 			buf.Write(jsonNull)
 			return nil
 		}
+		if n == cycleDepth {
+			return &UnsupportedValueError{Value: v, Str: "encountered a cycle via " + v.Type().String()}
+		}
 		v = v.Elem()
 	}
 
-	// 3. Direct kind handling for most common types - avoids Interface() calls
+	// 3. A registered function, then a type's own MarshalApexJSON,
+	// MarshalJSON, then MarshalText wins over its kind,
+	// with pointer receivers used when v is addressable as in encoding/json.
+	// Only types with methods need the lookup, unless functions are
+	// registered, and RawMessage none at all.
+	if v.Type() == rawMessageType {
+		return writeRawMessage(buf, v.Bytes())
+	}
+	if v.CanInterface() && (v.Type().NumMethod() > 0 || mayBeRegistered(v.Type()) || v.CanAddr() && hasAddrMethods(v.Type())) {
+		switch plan := getElemPlan(v.Type()); {
+		case plan.marshalFunc != nil:
+			return marshalRegistered(plan.marshalFunc, v, buf)
+		case plan.marshaler:
+			return marshalElem(v, buf, true)
+		case plan.addrMarshal && v.CanAddr():
+			return callMarshaler(v.Addr().Interface(), v.Type(), buf)
+		case plan.text:
+			return marshalText(v.Interface().(encoding.TextMarshaler), v.Type(), buf)
+		case plan.addrText && v.CanAddr():
+			return marshalText(v.Addr().Interface().(encoding.TextMarshaler), v.Type(), buf)
+		}
+	}
+
+	// 4. Direct kind handling for most common types - avoids Interface() calls
 	switch v.Kind() {
 	case reflect.String:
+		if isNumberType(v.Type()) {
+			return writeNumberLiteral(buf, v.String())
+		}
 		buf.WriteByte(jsonQuote)
 		writeEscapedStringString(buf, v.String()) // Use string-direct version
 		buf.WriteByte(jsonQuote)
@@ -44,21 +82,10 @@ func marshalValue(v reflect.Value, buf *Buffer) error {
 		}
 		return nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		numBuf := getNumberBuf()
-		*numBuf = strconv.AppendInt((*numBuf)[:0], v.Int(), 10)
-		buf.Write(*numBuf)
-		putNumberBuf(numBuf)
+		writeInt(buf, v.Int())
 		return nil
 	case reflect.Float32, reflect.Float64:
-		f := v.Float()
-		if math.IsInf(f, 0) || math.IsNaN(f) {
-			return fmt.Errorf("json: unsupported float value: %v", f)
-		}
-		numBuf := getNumberBuf()
-		*numBuf = strconv.AppendFloat((*numBuf)[:0], f, 'g', -1, 64)
-		buf.Write(*numBuf)
-		putNumberBuf(numBuf)
-		return nil
+		return writeFloat(buf, v.Float(), v.Type().Bits())
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		numBuf := getNumberBuf()
 		*numBuf = strconv.AppendUint((*numBuf)[:0], v.Uint(), 10)
@@ -67,27 +94,22 @@ func marshalValue(v reflect.Value, buf *Buffer) error {
 		return nil
 	}
 
-	// 4. Only use Interface() for special types that need it
-	if v.CanInterface() {
+	// 5. Only use Interface() for special types that need it; boxing
+	// anything else, such as a struct, would allocate
+	if t := v.Type(); (t == timeType || t == bytesType) && v.CanInterface() {
 		switch x := v.Interface().(type) {
 		case time.Time:
-			buf.WriteByte(jsonQuote)
-			// Use direct buffer writing for time
-			if cap(buf.buf)-buf.off < len(time.RFC3339) {
-				buf.grow(len(time.RFC3339))
-			}
-			b := x.AppendFormat(buf.buf[buf.off:buf.off], time.RFC3339)
-			buf.off += len(b)
-			buf.WriteByte(jsonQuote)
-			return nil
-		case Marshaler:
-			data, err := x.MarshalJSON()
-			if err != nil {
-				return err
-			}
-			buf.Write(data)
-			return nil
+			return writeTime(buf, x)
 		case []byte:
+			if x == nil {
+				if buf.opts != nil && buf.opts.NilSliceAsEmptyArray {
+					buf.WriteByte(jsonQuote)
+					buf.WriteByte(jsonQuote)
+				} else {
+					buf.Write(jsonNull)
+				}
+				return nil
+			}
 			buf.WriteByte(jsonQuote)
 			encodedLen := base64.StdEncoding.EncodedLen(len(x))
 			if encodedLen > 0 {
@@ -109,25 +131,15 @@ func marshalValue(v reflect.Value, buf *Buffer) error {
 		}
 	}
 
-	// 5. Handle interface indirection
-	if v.Kind() == reflect.Interface && !v.IsNil() {
-		v = v.Elem()
-
-		// If the interface contains a string, handle it directly
-		if v.Kind() == reflect.String {
-			buf.WriteByte(jsonQuote)
-			writeEscapedStringString(buf, v.String())
-			buf.WriteByte(jsonQuote)
-			return nil
-		}
-
-		// For all other types, process the concrete value recursively
-		return marshalValue(v, buf)
-	}
-
 	// 6. Type-specific encoding for remaining types
 	switch v.Kind() {
 	case reflect.Array, reflect.Slice:
+		// Nil slices encode as null, matching encoding/json
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.writeNilSlice()
+			return nil
+		}
+
 		// Special case for empty arrays
 		if v.Len() == 0 {
 			buf.WriteByte(jsonOpenBracket)
@@ -135,13 +147,28 @@ func marshalValue(v reflect.Value, buf *Buffer) error {
 			return nil
 		}
 
-		// Special case for []byte
-		if v.Type().Elem().Kind() == reflect.Uint8 && v.CanInterface() {
-			return marshalBytes(v.Interface().([]byte), buf)
+		// Special case for byte slices, unless the elements encode
+		// themselves. Byte arrays are arrays of numbers, as in encoding/json.
+		if elem := v.Type().Elem(); elem.Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			if plan := getElemPlan(elem); !plan.marshaler && !plan.text && !plan.addrMarshal && !plan.addrText && plan.marshalFunc == nil {
+				return marshalBytes(v.Bytes(), buf)
+			}
 		}
 
-		return marshalArray(v, buf)
+		if err := buf.enter(v); err != nil {
+			return err
+		}
+		err := marshalArray(v, buf)
+		buf.leave()
+		return err
 	case reflect.Map:
+		// Nil maps encode as null, matching encoding/json, unless the
+		// options ask for {}
+		if v.IsNil() {
+			buf.writeNilMap()
+			return nil
+		}
+
 		// Special case for empty maps
 		if v.Len() == 0 {
 			buf.WriteByte(jsonOpenBrace)
@@ -149,12 +176,43 @@ func marshalValue(v reflect.Value, buf *Buffer) error {
 			return nil
 		}
 
-		return marshalMap(v, buf)
+		if err := buf.enter(v); err != nil {
+			return err
+		}
+		err := marshalMap(v, buf)
+		buf.leave()
+		return err
 	case reflect.Struct:
-		return marshalStruct(v, buf)
+		if err := buf.enter(v); err != nil {
+			return err
+		}
+		err := marshalStruct(v, buf)
+		buf.leave()
+		return err
+	default:
+		// Chan, Func, Complex64, Complex128 and UnsafePointer
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+}
+
+// unsupportedIn puts seg, a member name or a bracketed index, in front of
+// the path of err when it is an *UnsupportedTypeError, so the value is
+// named as it propagates out and a successful encode builds no strings. An
+// index alone is not a path: the error names a field, or the root value.
+func unsupportedIn(err error, seg string) error {
+	ute, ok := err.(*UnsupportedTypeError)
+	switch {
+	case !ok:
+	case ute.Path == "":
+		if !strings.HasPrefix(seg, "[") {
+			ute.Path = seg
+		}
+	case ute.Path[0] == '[':
+		ute.Path = seg + ute.Path
 	default:
-		return fmt.Errorf("json: unsupported type: %s", v.Type().String())
+		ute.Path = seg + "." + ute.Path
 	}
+	return err
 }
 
 // Helper function for byte array marshaling
@@ -173,6 +231,80 @@ func marshalBytes(data []byte, buf *Buffer) error {
 	return nil
 }
 
+// MarshalValue encodes v into buf with the defaults of Marshal. It is
+// MarshalValueWithOptions with nil opts.
+func MarshalValue(v reflect.Value, buf *Buffer) error {
+	return MarshalValueWithOptions(v, buf, nil)
+}
+
+// MarshalValueWithOptions encodes v into buf. It is the reflect.Value
+// counterpart of Marshal for callers that already hold values; an invalid v
+// encodes as null. A nil opts uses the same defaults as Marshal.
+func MarshalValueWithOptions(v reflect.Value, buf *Buffer, opts *Options) error {
+	if buf == nil {
+		return fmt.Errorf("json: MarshalValue called with nil Buffer")
+	}
+	if opts != nil {
+		esc, err := escapeTableFor(&opts.MarshalOptions, true)
+		if err != nil {
+			return err
+		}
+		prevOpts, prevEsc := buf.opts, buf.esc
+		buf.opts, buf.esc = &opts.MarshalOptions, esc
+		defer func() { buf.opts, buf.esc = prevOpts, prevEsc }()
+	}
+	if v.IsValid() {
+		if n := sizeHint(v.Type(), buf.opts); n > 0 {
+			buf.grow(n)
+		}
+	}
+	return marshalValue(v, buf)
+}
+
+// MarshalPartial encodes v like Marshal, but a value that fails to encode,
+// such as a NaN or a MarshalJSON that returns an error, is written as null
+// instead of failing the whole document. The output is always valid JSON;
+// each substituted value is reported in the returned FieldErrors.
+func MarshalPartial(v interface{}) ([]byte, []FieldError) {
+	buf := getBufferSize(max(sizeHint(reflect.TypeOf(v), nil), 256))
+	defer putBuffer(buf)
+
+	faults := MarshalPartialValue(reflect.ValueOf(v), buf, nil)
+	result := make([]byte, buf.off)
+	copy(result, buf.buf[:buf.off])
+	return result, faults
+}
+
+// MarshalPartialValue is the reflect.Value counterpart of MarshalPartial.
+// The value is appended to buf; opts.PartialPlaceholder, when set, is
+// written in place of each failed value instead of null.
+func MarshalPartialValue(v reflect.Value, buf *Buffer, opts *Options) []FieldError {
+	if buf == nil {
+		return []FieldError{{Err: fmt.Errorf("json: MarshalPartialValue called with nil Buffer")}}
+	}
+	if opts != nil && opts.PartialPlaceholder != nil && !Valid(opts.PartialPlaceholder) {
+		buf.Write(jsonNull)
+		return []FieldError{{Err: fmt.Errorf("json: PartialPlaceholder is not a valid JSON value")}}
+	}
+
+	var faults []FieldError
+	prevFaults := buf.faults
+	buf.faults = &faults
+	defer func() { buf.faults = prevFaults }()
+
+	// Every error is absorbed by substitute, at worst for the root value
+	start := buf.off
+	if err := MarshalValueWithOptions(v, buf, opts); err != nil {
+		buf.substitute(start, err)
+	}
+
+	out := buf.buf[start:buf.off]
+	for i := range faults {
+		faults[i].Path = pathAt(out, faults[i].offset-start)
+	}
+	return faults
+}
+
 // MarshalToWriter allows compatibility with io.Writer
 func MarshalToWriter(v interface{}, w io.Writer) error {
 	// For Buffer type, use direct path
@@ -181,7 +313,7 @@ func MarshalToWriter(v interface{}, w io.Writer) error {
 	}
 
 	// Otherwise, use buffer pool
-	buf := getBuffer()
+	buf := getBufferSize(max(sizeHint(reflect.TypeOf(v), nil), 256))
 	defer putBuffer(buf)
 
 	if err := marshalValue(reflect.ValueOf(v), buf); err != nil {
@@ -202,24 +334,18 @@ func marshalArray(v reflect.Value, buf *Buffer) error {
 		return nil
 	}
 
-	// Special case for []byte - optimize base64 encoding
-	if v.Type().Elem().Kind() == reflect.Uint8 && v.CanInterface() {
-		byteSlice := v.Interface().([]byte)
-		buf.WriteByte(jsonQuote)
-
-		// Calculate encoded length and pre-grow buffer
-		encodedLen := base64.StdEncoding.EncodedLen(len(byteSlice))
-		if buf.off+encodedLen > cap(buf.buf) {
-			buf.grow(encodedLen)
-		}
-
-		// Encode directly into buffer's backing array
-		dst := buf.buf[buf.off : buf.off+encodedLen]
-		base64.StdEncoding.Encode(dst, byteSlice)
-		buf.off += encodedLen
+	// Elements with their own encoding skip the per-kind fast paths below.
+	// Slice elements are always addressable, array elements when v is.
+	elemKind := v.Type().Elem().Kind()
+	addressable := v.Kind() == reflect.Slice || v.CanAddr()
+	if plan := getElemPlan(v.Type().Elem()); plan.marshaler || plan.text || plan.marshalFunc != nil ||
+		addressable && (plan.addrMarshal || plan.addrText) || isNumberType(v.Type().Elem()) {
+		elemKind = reflect.Invalid
+	}
 
-		buf.WriteByte(jsonQuote)
-		return nil
+	// Special case for byte slices - optimize base64 encoding
+	if elemKind == reflect.Uint8 && v.Kind() == reflect.Slice {
+		return marshalBytes(v.Bytes(), buf)
 	}
 
 	// Estimate buffer size needed for array
@@ -227,7 +353,6 @@ func marshalArray(v reflect.Value, buf *Buffer) error {
 	if length > 0 {
 		estimatedSize += length - 1 // commas between elements
 
-		elemKind := v.Type().Elem().Kind()
 		switch elemKind {
 		case reflect.Int, reflect.Int64:
 			estimatedSize += length * 20 // Conservative estimate for int64
@@ -255,42 +380,46 @@ func marshalArray(v reflect.Value, buf *Buffer) error {
 		buf.grow(estimatedSize)
 	}
 
-	buf.WriteByte(jsonOpenBracket)
+	buf.beginContainer(jsonOpenBracket)
 
 	// Fast paths for common array types
-	elemKind := v.Type().Elem().Kind()
 	switch elemKind {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		for i := 0; i < length; i++ {
+			if err := buf.yieldPoint(); err != nil {
+				return err
+			}
 			if i > 0 {
 				buf.WriteByte(jsonComma)
 			}
-			numBuf := getNumberBuf()
-			*numBuf = strconv.AppendInt((*numBuf)[:0], v.Index(i).Int(), 10)
-			buf.Write(*numBuf)
-			putNumberBuf(numBuf)
+			buf.breakLine()
+			writeInt(buf, v.Index(i).Int())
 		}
 
 	case reflect.Float32, reflect.Float64:
+		bits := v.Type().Elem().Bits()
 		for i := 0; i < length; i++ {
+			if err := buf.yieldPoint(); err != nil {
+				return err
+			}
 			if i > 0 {
 				buf.WriteByte(jsonComma)
 			}
-			f := v.Index(i).Float()
-			if math.IsInf(f, 0) || math.IsNaN(f) {
-				return fmt.Errorf("json: unsupported float value: %v", f)
+			buf.breakLine()
+			if err := writeFloat(buf, v.Index(i).Float(), bits); err != nil && !buf.substitute(buf.off, err) {
+				return err
 			}
-			numBuf := getNumberBuf()
-			*numBuf = strconv.AppendFloat((*numBuf)[:0], f, 'g', -1, 64)
-			buf.Write(*numBuf)
-			putNumberBuf(numBuf)
 		}
 
 	case reflect.Bool:
 		for i := 0; i < length; i++ {
+			if err := buf.yieldPoint(); err != nil {
+				return err
+			}
 			if i > 0 {
 				buf.WriteByte(jsonComma)
 			}
+			buf.breakLine()
 			if v.Index(i).Bool() {
 				buf.Write(jsonTrue)
 			} else {
@@ -300,12 +429,16 @@ func marshalArray(v reflect.Value, buf *Buffer) error {
 
 	case reflect.String:
 		for i := 0; i < length; i++ {
+			if err := buf.yieldPoint(); err != nil {
+				return err
+			}
 			if i > 0 {
 				buf.WriteByte(jsonComma)
 			}
+			buf.breakLine()
 			str := v.Index(i).String()
 			buf.WriteByte(jsonQuote)
-			if !needsEscaping(str) {
+			if !buf.escapes().needsEscaping(str) {
 				buf.WriteString(str)
 			} else {
 				writeEscapedStringString(buf, str)
@@ -314,17 +447,207 @@ func marshalArray(v reflect.Value, buf *Buffer) error {
 		}
 
 	default:
+		direct := v.CanInterface() && getElemPlan(v.Type().Elem()).marshaler
 		for i := 0; i < length; i++ {
+			if err := buf.yieldPoint(); err != nil {
+				return err
+			}
 			if i > 0 {
 				buf.WriteByte(jsonComma)
 			}
-			if err := marshalValue(v.Index(i), buf); err != nil {
-				return err
+			buf.breakLine()
+			start := buf.off
+			if err := marshalElem(v.Index(i), buf, direct); err != nil && !buf.substitute(start, err) {
+				return unsupportedIn(err, "["+strconv.Itoa(i)+"]")
 			}
 		}
 	}
 
-	buf.WriteByte(jsonCloseBracket)
+	buf.endContainer(jsonCloseBracket, length == 0)
+	return nil
+}
+
+// hasOwnEncoding reports whether v is encoded by one of its methods rather
+// than by its kind
+func hasOwnEncoding(v reflect.Value) bool {
+	plan := getElemPlan(v.Type())
+	return plan.marshaler || plan.text || plan.marshalFunc != nil || v.CanAddr() && (plan.addrMarshal || plan.addrText)
+}
+
+// marshalElem encodes one element of a slice, array or map. direct is set
+// when the container's elemPlan found the element type to be a MarshalerTo
+// or Marshaler, so its method is called without going through
+// marshalValue's type checks. An addressable element is passed by pointer,
+// which doesn't copy it to the heap as boxing the value would.
+func marshalElem(v reflect.Value, buf *Buffer, direct bool) error {
+	if !direct {
+		return marshalValue(v, buf)
+	}
+	if v.Type() == rawMessageType {
+		return writeRawMessage(buf, v.Bytes())
+	}
+	if v.CanAddr() {
+		return callMarshaler(v.Addr().Interface(), v.Type(), buf)
+	}
+	return callMarshaler(v.Interface(), v.Type(), buf)
+}
+
+// callMarshaler has m, a MarshalerTo or Marshaler, encode itself into buf.
+// Its errors are reported as a *MarshalerError for type t.
+func callMarshaler(m interface{}, t reflect.Type, buf *Buffer) error {
+	if to, ok := m.(MarshalerTo); ok {
+		return marshalTo(to, t, buf)
+	}
+	return marshalJSON(m.(Marshaler), t, buf)
+}
+
+// marshalJSON writes the MarshalJSON output of m, a value of type t or a
+// pointer to one. The output is checked and compacted first, so a bad
+// method fails with its type named instead of corrupting the document,
+// unless MarshalOptions.TrustMarshalers says it needn't be.
+func marshalJSON(m Marshaler, t reflect.Type, buf *Buffer) error {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return &MarshalerError{Type: t, Err: err}
+	}
+	if buf.opts != nil && buf.opts.TrustMarshalers && !buf.opts.StdlibCompat {
+		buf.writeRaw(data)
+		return nil
+	}
+	return writeMarshaled(buf, data, t)
+}
+
+// marshalTo has m write itself into buf. Output that is indented or made
+// to match encoding/json goes through a scratch buffer first.
+func marshalTo(m MarshalerTo, t reflect.Type, buf *Buffer) error {
+	if buf.ind == nil && !buf.compat() {
+		if err := m.MarshalApexJSON(buf); err != nil {
+			return marshalToError(m, t, err)
+		}
+		return nil
+	}
+	scratch := getBuffer()
+	defer putBuffer(scratch)
+	scratch.opts, scratch.esc = buf.opts, buf.esc
+	if err := m.MarshalApexJSON(scratch); err != nil {
+		return marshalToError(m, t, err)
+	}
+	if buf.compat() {
+		return writeMarshaled(buf, scratch.Bytes(), t)
+	}
+	buf.writeRaw(scratch.Bytes())
+	return nil
+}
+
+// marshalRegistered has fn, the function registered for the type of v,
+// write v into buf, as marshalTo does a MarshalApexJSON method
+func marshalRegistered(fn marshalFunc, v reflect.Value, buf *Buffer) error {
+	out := buf
+	if buf.ind != nil || buf.compat() {
+		out = getBuffer()
+		defer putBuffer(out)
+		out.opts, out.esc = buf.opts, buf.esc
+	}
+	if err := fn(v, out); err != nil {
+		return &MarshalerError{Type: v.Type(), Err: err, sourceFunc: "registered marshaler"}
+	}
+	if out == buf {
+		return nil
+	}
+	if buf.compat() {
+		return writeMarshaled(buf, out.Bytes(), v.Type())
+	}
+	buf.writeRaw(out.Bytes())
+	return nil
+}
+
+// marshalToError reports err from the MarshalApexJSON method of m as a
+// *MarshalerError, unless the method was generated and err is what
+// reflection would have returned
+func marshalToError(m MarshalerTo, t reflect.Type, err error) error {
+	if _, ok := m.(Generated); ok {
+		return err
+	}
+	return &MarshalerError{Type: t, Err: err, sourceFunc: "MarshalApexJSON"}
+}
+
+// writeRawMessage writes m, the bytes of a RawMessage, as is once they are
+// checked to be a single JSON value. A nil m is written as null.
+func writeRawMessage(buf *Buffer, m []byte) error {
+	if m == nil {
+		buf.Write(jsonNull)
+		return nil
+	}
+	if buf.compat() {
+		return writeMarshaled(buf, m, rawMessageType)
+	}
+	p := Parser{data: m, opts: &defaultOptions}
+	if _, _, err := p.document(); err != nil {
+		return &MarshalerError{Type: rawMessageType, Err: err}
+	}
+	buf.writeRaw(m)
+	return nil
+}
+
+// writeMarshaled writes MarshalJSON output of a value of type t as
+// encoding/json does: checked, compacted, and with <, >, & and line
+// separators escaped when buf escapes them in strings. Under StdlibCompat
+// line separators are only escaped along with <, > and &, as encoding/json
+// leaves them alone in this output after SetEscapeHTML(false).
+func writeMarshaled(buf *Buffer, data []byte, t reflect.Type) error {
+	compact := getBufferSize(len(data))
+	defer putBuffer(compact)
+	if err := Compact(compact, data); err != nil {
+		return &MarshalerError{Type: t, Err: err}
+	}
+
+	// Outside strings valid JSON is ASCII without any of these, so every
+	// one found is in a string
+	esc := buf.escapes()
+	lineSeps := esc[lineSepLead] != nil && (esc['<'] != nil || !buf.compat())
+	data = compact.Bytes()
+	var escaped *Buffer
+	start := 0
+	for i := 0; i < len(data); i++ {
+		var e []byte
+		n := 1
+		switch c := data[i]; {
+		case c == '<' || c == '>' || c == '&':
+			e = esc[c]
+		case c == lineSepLead && lineSeps:
+			e, n = multiByteEscape(esc, data[i:])
+		}
+		if e == nil {
+			i += n - 1
+			continue
+		}
+		if escaped == nil {
+			escaped = getBufferSize(len(data) + 16)
+			defer putBuffer(escaped)
+		}
+		escaped.Write(data[start:i])
+		escaped.Write(e)
+		i += n - 1
+		start = i + 1
+	}
+	if escaped != nil {
+		escaped.Write(data[start:])
+		data = escaped.Bytes()
+	}
+	buf.writeRaw(data)
+	return nil
+}
+
+// marshalText writes the MarshalText output of m, a value of type t or a
+// pointer to one, as a JSON string
+func marshalText(m encoding.TextMarshaler, t reflect.Type, buf *Buffer) error {
+	text, err := m.MarshalText()
+	if err != nil {
+		return &MarshalerError{Type: t, Err: err, sourceFunc: "MarshalText"}
+	}
+	buf.WriteByte(jsonQuote)
+	writeEscapedString(buf, text)
+	buf.WriteByte(jsonQuote)
 	return nil
 }
 
@@ -332,14 +655,15 @@ func marshalArray(v reflect.Value, buf *Buffer) error {
 func marshalMap(v reflect.Value, buf *Buffer) error {
 	// Handle nil maps
 	if v.IsNil() {
-		buf.Write(jsonNull)
+		buf.writeNilMap()
 		return nil
 	}
+	if buf.checksKeys() {
+		return marshalResolvedMap(v, buf, v.CanInterface() && getElemPlan(v.Type().Elem()).marshaler)
+	}
 
 	// Fast path for map[string]interface{} - extremely common case
 	if v.Type().Key().Kind() == reflect.String {
-		stringKeyMap := true
-
 		// Check if this is a common map type we can handle directly
 		if v.CanInterface() {
 			switch v.Interface().(type) {
@@ -353,293 +677,634 @@ func marshalMap(v reflect.Value, buf *Buffer) error {
 		}
 
 		// Handle generic string key maps more efficiently
-		if stringKeyMap {
-			keys := getKeysSlice()
-			*keys = append(*keys, v.MapKeys()...)
-			defer putKeysSlice(keys)
-
-			// Pre-size buffer based on map size
-			mapLen := v.Len()
-			estimatedSize := 2 + (mapLen * 8) // {} plus average key/value size
-			if buf.off+estimatedSize > cap(buf.buf) {
-				buf.grow(estimatedSize)
-			}
-
-			buf.WriteByte(jsonOpenBrace)
-
-			// Process keys with optimized string key handling
-			for i, key := range *keys {
-				if i > 0 {
-					buf.WriteByte(jsonComma)
-				}
+		direct := v.CanInterface() && getElemPlan(v.Type().Elem()).marshaler
+		keys := getKeysSlice()
+		*keys = append(*keys, v.MapKeys()...)
+		defer putKeysSlice(keys)
+
+		// Pre-size buffer based on map size
+		mapLen := v.Len()
+		estimatedSize := 2 + (mapLen * 8) // {} plus average key/value size
+		if buf.off+estimatedSize > cap(buf.buf) {
+			buf.grow(estimatedSize)
+		}
 
-				// Write key (we know it's a string)
-				buf.WriteByte(jsonQuote)
-				var s string
-				if key.Kind() == reflect.String {
-					s = key.String() // Use String() for reflect.String kind
-				} else if key.CanInterface() {
-					// Try to extract string via interface
-					switch k := key.Interface().(type) {
-					case string:
-						s = k
-					default:
-						// Last resort - use fmt to convert to string
-						s = fmt.Sprintf("%v", k)
-					}
-				} else {
-					// Fallback
-					s = fmt.Sprintf("%v", key)
-				}
+		if buf.marshalOptions().sortKeys() {
+			slices.SortFunc(*keys, func(a, b reflect.Value) int {
+				return strings.Compare(a.String(), b.String())
+			})
+		}
 
-				if !needsEscaping(s) {
-					_, err := buf.WriteString(s)
-					if err != nil {
-						return err
-					}
-				} else {
-					writeEscapedStringString(buf, s)
-				}
+		buf.beginContainer(jsonOpenBrace)
 
-				buf.Write(jsonQuoteColon)
+		// Process keys with optimized string key handling
+		for i, key := range *keys {
+			if err := buf.yieldPoint(); err != nil {
+				return err
+			}
+			if i > 0 {
+				buf.WriteByte(jsonComma)
+			}
+			buf.breakLine()
 
-				// Marshal value with original key
-				if err := marshalValue(v.MapIndex(key), buf); err != nil {
-					return err
-				}
+			// Write key (we know it's a string)
+			buf.WriteByte(jsonQuote)
+			s := key.String()
+			if !buf.escapes().needsEscaping(s) {
+				buf.WriteString(s)
+			} else {
+				writeEscapedStringString(buf, s)
 			}
+			buf.writeColon()
 
-			buf.WriteByte(jsonCloseBrace)
-			return nil
+			// Marshal value with original key
+			start := buf.off
+			if err := marshalElem(v.MapIndex(key), buf, direct); err != nil && !buf.substitute(start, err) {
+				return unsupportedIn(err, s)
+			}
 		}
+
+		buf.endContainer(jsonCloseBrace, len(*keys) == 0)
+		return nil
 	}
 
 	// General case for non-string key maps
+	direct := v.CanInterface() && getElemPlan(v.Type().Elem()).marshaler
+	if buf.marshalOptions().sortKeys() {
+		return marshalResolvedMap(v, buf, direct)
+	}
 	keys := getKeysSlice()
 	*keys = append(*keys, v.MapKeys()...)
 	defer putKeysSlice(keys)
 
-	buf.WriteByte(jsonOpenBrace)
+	buf.beginContainer(jsonOpenBrace)
 
 	for i, key := range *keys {
+		if err := buf.yieldPoint(); err != nil {
+			return err
+		}
 		if i > 0 {
 			buf.WriteByte(jsonComma)
 		}
+		buf.breakLine()
 
-		// Write key with opening quote
-		buf.WriteByte(jsonQuote)
-
-		// Handle interface/pointer indirection for keys
-		originalKey := key
-		if key.Kind() == reflect.Interface && !key.IsNil() {
-			key = key.Elem()
-		}
-		if key.Kind() == reflect.Ptr && !key.IsNil() {
-			key = key.Elem()
+		// Write the quoted key
+		if err := writeMapKey(key, buf); err != nil {
+			return err
 		}
+		buf.writeColon()
 
-		// First check kind for common cases without interface conversion
-		switch key.Kind() {
-		case reflect.String:
-			s := key.String()
-			if !needsEscaping(s) {
-				buf.WriteString(s)
-			} else {
-				writeEscapedStringString(buf, s)
-			}
-
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			numBuf := getNumberBuf()
-			*numBuf = strconv.AppendInt((*numBuf)[:0], key.Int(), 10)
-			buf.Write(*numBuf)
-			putNumberBuf(numBuf)
+		// Marshal the value
+		start := buf.off
+		if err := marshalElem(v.MapIndex(key), buf, direct); err != nil && !buf.substitute(start, err) {
+			s, _ := mapKeyText(key, buf.marshalOptions())
+			return unsupportedIn(err, s)
+		}
+	}
 
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-			numBuf := getNumberBuf()
-			*numBuf = strconv.AppendUint((*numBuf)[:0], key.Uint(), 10)
-			buf.Write(*numBuf)
-			putNumberBuf(numBuf)
+	buf.endContainer(jsonCloseBrace, len(*keys) == 0)
+	return nil
+}
 
-		case reflect.Float32, reflect.Float64:
-			numBuf := getNumberBuf()
-			*numBuf = strconv.AppendFloat((*numBuf)[:0], key.Float(), 'g', -1, key.Type().Bits())
-			buf.Write(*numBuf)
-			putNumberBuf(numBuf)
+// writeUnknown writes the members of the Unknown u of a struct of type t,
+// in key order, after the fields already written. Members named like one
+// of fields are left out, or are an *UnknownCollisionError under
+// MarshalOptions.StrictUnknown. Values are checked as RawMessage values
+// are. comma reports whether a member was written before; the result
+// reports whether one has been written now.
+func writeUnknown(u Unknown, t reflect.Type, fields []Field, comma bool, buf *Buffer) (bool, error) {
+	keys := getNamesSlice()
+	defer putNamesSlice(keys)
+	for k := range u {
+		*keys = append(*keys, k)
+	}
+	slices.Sort(*keys)
 
-		case reflect.Bool:
-			if key.Bool() {
-				buf.Write(jsonTrue)
-			} else {
-				buf.Write(jsonFalse)
+	for _, k := range *keys {
+		if slices.ContainsFunc(fields, func(f Field) bool { return GetString(f.nameBytes) == k }) {
+			if buf.opts != nil && buf.opts.StrictUnknown {
+				return comma, &UnknownCollisionError{Type: t, Key: strings.Clone(k)}
 			}
-
-		default:
-			// Use interface only for complex cases
-			if key.CanInterface() {
-				switch k := key.Interface().(type) {
-				case []byte:
-					if len(k) == 0 {
-						buf.Write(jsonEmpty)
-					} else {
-						buf.Write(jsonHexPrefix)
-						// Direct hex writing
-						hexLen := len(k) * 2
-						if buf.off+hexLen <= cap(buf.buf) {
-							buf.grow(hexLen)
-							for _, b := range k {
-								buf.buf[buf.off] = hex[b>>4]
-								buf.off++
-								buf.buf[buf.off] = hex[b&0xF]
-								buf.off++
-							}
-						} else {
-							// Fallback for large byte arrays
-							hexBuf := getBufferSize(hexLen)
-							for _, b := range k {
-								hexBuf.WriteByte(hex[b>>4])
-								hexBuf.WriteByte(hex[b&0xF])
-							}
-							buf.Write(hexBuf.buf[:hexBuf.off])
-							putBuffer(hexBuf)
-						}
-					}
-
-				case time.Time:
-					buf.WriteByte(jsonQuote)
-					timeLen := len(time.RFC3339)
-					if buf.off+timeLen <= cap(buf.buf) {
-						buf.grow(timeLen)
-						n := copy(buf.buf[buf.off:], k.AppendFormat(buf.buf[buf.off:buf.off], time.RFC3339))
-						buf.off += n
-					} else {
-						// Fallback
-						timeBuf := getNumberBuf()
-						*timeBuf = k.AppendFormat((*timeBuf)[:0], time.RFC3339)
-						buf.Write(*timeBuf)
-						putNumberBuf(timeBuf)
-					}
-					buf.WriteByte(jsonQuote)
-
-				default:
-					switch key.Kind() {
-					case reflect.Array, reflect.Slice:
-						if key.Len() == 0 {
-							buf.Write(jsonEmpty)
-						} else {
-							buf.WriteString("array")
-						}
-
-					case reflect.Map:
-						buf.Write(jsonMapOpen)
-						numBuf := getNumberBuf()
-						*numBuf = strconv.AppendInt((*numBuf)[:0], int64(key.Len()), 10)
-						buf.Write(*numBuf)
-						putNumberBuf(numBuf)
-						buf.Write(jsonMapClose)
-
-					case reflect.Struct:
-						if stringer, ok := key.Interface().(fmt.Stringer); ok {
-							writeEscapedStringString(buf, stringer.String())
-						} else {
-							b := getBuilder()
-							fmt.Fprint(b, key.Interface())
-							keyStr := b.String()
-							writeEscapedStringString(buf, keyStr)
-							putBuilder(b)
-						}
-
-					default:
-						b := getBuilder()
-						fmt.Fprint(b, key.Interface())
-						keyStr := b.String()
-						writeEscapedStringString(buf, keyStr)
-						putBuilder(b)
-					}
-				}
-			} else {
-				// Fallback for non-interfaceable types
-				typeStr := key.Type().String()
-				buf.WriteString(typeStr)
+			continue
+		}
+		if keep, err := buf.opts.keepKey(k); !keep {
+			if err != nil {
+				return comma, err
 			}
+			continue
 		}
-
-		// Complete key-value pair
-		buf.Write(jsonQuoteColon)
-
-		// Marshal the value
-		if err := marshalValue(v.MapIndex(originalKey), buf); err != nil {
-			return err
+		if comma {
+			buf.WriteByte(jsonComma)
+		}
+		buf.breakLine()
+		comma = true
+		writeObjectKey(buf, k)
+		if err := writeRawMessage(buf, u[k]); err != nil {
+			if me, ok := err.(*MarshalerError); ok {
+				me.Err = fmt.Errorf("Unknown member %q: %w", k, me.Err)
+			}
+			return comma, err
 		}
 	}
-
-	buf.WriteByte(jsonCloseBrace)
-	return nil
+	return comma, nil
 }
 
-// Specialized implementations for common map types
-func marshalStringInterfaceMap(m map[string]interface{}, buf *Buffer) error {
-	buf.WriteByte(jsonOpenBrace)
-	first := true
+// marshalResolvedMap writes a map by the resolved key strings, in their
+// order for MarshalOptions.SortMapKeys, and leaving out the keys its
+// DangerousKeyPolicy refuses
+func marshalResolvedMap(v reflect.Value, buf *Buffer, direct bool) error {
+	type entry struct {
+		text string
+		key  reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	for iter := v.MapRange(); iter.Next(); {
+		text, err := mapKeyText(iter.Key(), buf.marshalOptions())
+		if err != nil {
+			return err
+		}
+		if keep, err := buf.opts.keepKey(text); !keep {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		entries = append(entries, entry{text, iter.Key()})
+	}
+	if buf.marshalOptions().sortKeys() {
+		slices.SortFunc(entries, func(a, b entry) int { return strings.Compare(a.text, b.text) })
+	}
+
+	buf.beginContainer(jsonOpenBrace)
+	for i, e := range entries {
+		if err := buf.yieldPoint(); err != nil {
+			return err
+		}
+		if i > 0 {
+			buf.WriteByte(jsonComma)
+		}
+		buf.breakLine()
+		writeObjectKey(buf, e.text)
+		start := buf.off
+		if err := marshalElem(v.MapIndex(e.key), buf, direct); err != nil && !buf.substitute(start, err) {
+			return unsupportedIn(err, e.text)
+		}
+	}
+	buf.endContainer(jsonCloseBrace, len(entries) == 0)
+	return nil
+}
+
+// writeMapKey writes an opening quote and the escaped object key for key,
+// as resolved by mapKeyText. Integer keys are formatted straight into buf.
+func writeMapKey(key reflect.Value, buf *Buffer) error {
+	if key.Kind() == reflect.Interface && !key.IsNil() {
+		key = key.Elem()
+	}
+
+	switch k := key.Kind(); {
+	case k >= reflect.Int && k <= reflect.Int64 && !key.Type().Implements(textMarshalerType):
+		buf.WriteByte(jsonQuote)
+		writeInt(buf, key.Int())
+		return nil
+	case k >= reflect.Uint && k <= reflect.Uintptr && !key.Type().Implements(textMarshalerType):
+		buf.WriteByte(jsonQuote)
+		writeUint(buf, key.Uint())
+		return nil
+	}
+
+	s, err := mapKeyText(key, buf.marshalOptions())
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(jsonQuote)
+	if !buf.escapes().needsEscaping(s) {
+		buf.WriteString(s)
+	} else {
+		writeEscapedStringString(buf, s)
+	}
+	return nil
+}
+
+// mapKeyText resolves a map key to its object key string. Keys resolve in
+// the same order as encoding/json: string kinds use the string itself, then
+// encoding.TextMarshaler, then integer kinds in base 10. With
+// MarshalOptions.AllowMarshalerKeys a Marshaler whose output is a JSON string
+// is accepted as well; every other key is a *MapKeyError wrapping an
+// *UnsupportedTypeError.
+//
+// Keys of interface-typed maps, such as the map[interface{}]interface{}
+// produced by YAML decoders, resolve by their dynamic value under the same
+// rules, so "1" and 1 both become "1"; a nil key is an error.
+func mapKeyText(key reflect.Value, opts *MarshalOptions) (string, error) {
+	if key.Kind() == reflect.Interface {
+		if key.IsNil() {
+			return "", &MapKeyError{Type: key.Type(), reason: "nil interface key"}
+		}
+		key = key.Elem()
+	}
+
+	var s string
+	switch {
+	case key.Kind() == reflect.String:
+		s = key.String()
+
+	case key.Type().Implements(textMarshalerType):
+		if key.Kind() == reflect.Ptr && key.IsNil() {
+			break
+		}
+		text, err := key.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return "", &MapKeyError{Type: key.Type(), Err: err, reason: "MarshalText failed"}
+		}
+		s = string(text)
+
+	case key.Kind() >= reflect.Int && key.Kind() <= reflect.Int64:
+		s = strconv.FormatInt(key.Int(), 10)
+
+	case key.Kind() >= reflect.Uint && key.Kind() <= reflect.Uintptr:
+		s = strconv.FormatUint(key.Uint(), 10)
+
+	case opts.AllowMarshalerKeys && key.Type().Implements(marshalerType):
+		if key.Kind() == reflect.Ptr && key.IsNil() {
+			return "", &MapKeyError{Type: key.Type(), reason: "nil Marshaler key"}
+		}
+		data, err := key.Interface().(Marshaler).MarshalJSON()
+		if err != nil {
+			return "", &MapKeyError{Type: key.Type(), Err: err, reason: "MarshalJSON failed"}
+		}
+		var ok bool
+		if s, ok = marshaledKeyString(data); !ok {
+			return "", &MapKeyError{Type: key.Type(), reason: "MarshalJSON did not return a JSON string"}
+		}
+
+	default:
+		return "", &MapKeyError{Type: key.Type(), Err: &UnsupportedTypeError{Type: key.Type()}}
+	}
+	return s, nil
+}
+
+// writeObjectKey writes s as a quoted, escaped object key followed by a colon
+func writeObjectKey(buf *Buffer, s string) {
+	buf.WriteByte(jsonQuote)
+	if !buf.escapes().needsEscaping(s) {
+		buf.WriteString(s)
+	} else {
+		writeEscapedStringString(buf, s)
+	}
+	buf.writeColon()
+}
+
+// marshaledKeyString decodes MarshalJSON output that must be exactly one
+// JSON string, optionally surrounded by whitespace
+func marshaledKeyString(data []byte) (string, bool) {
+	p := NewParser(data)
+	p.skipWhitespace()
+	tokenType, raw := p.parseString()
+	if tokenType != TokenString {
+		return "", false
+	}
+	p.skipWhitespace()
+	if p.pos != len(p.data) {
+		return "", false
+	}
+	unescaped, ok := p.unescape(raw)
+	if !ok {
+		return "", false
+	}
+	return string(unescaped), true
+}
+
+// marshalInterfaceSlice writes s, which is not nil, as a JSON array
+func marshalInterfaceSlice(s []interface{}, buf *Buffer) error {
+	buf.beginContainer(jsonOpenBracket)
+	for i, elem := range s {
+		if err := buf.yieldPoint(); err != nil {
+			return err
+		}
+		if i > 0 {
+			buf.WriteByte(jsonComma)
+		}
+		buf.breakLine()
+		start := buf.off
+		if err := marshalInterface(elem, buf); err != nil && !buf.substitute(start, err) {
+			return unsupportedIn(err, "["+strconv.Itoa(i)+"]")
+		}
+	}
+	buf.endContainer(jsonCloseBracket, len(s) == 0)
+	return nil
+}
+
+// Specialized implementations for common map types
+func marshalStringInterfaceMap(m map[string]interface{}, buf *Buffer) error {
+	if buf.checksKeys() {
+		return marshalResolvedMap(reflect.ValueOf(m), buf, false)
+	}
+	if buf.marshalOptions().sortKeys() {
+		return marshalSortedStringMap(m, buf, marshalInterface)
+	}
+
+	buf.beginContainer(jsonOpenBrace)
+	first := true
 
 	// Pre-grow buffer
 	buf.grow(len(m) * 16)
 
 	for k, v := range m {
+		if err := buf.yieldPoint(); err != nil {
+			return err
+		}
 		if !first {
 			buf.WriteByte(jsonComma)
 		}
+		buf.breakLine()
 		first = false
 
 		// Write key
 		buf.WriteByte(jsonQuote)
-		if !needsEscaping(k) {
+		if !buf.escapes().needsEscaping(k) {
 			buf.WriteString(k)
 		} else {
 			writeEscapedStringString(buf, k)
 		}
-		buf.Write(jsonQuoteColon)
+		buf.writeColon()
 
 		// Write value directly without reflection where possible
-		switch val := v.(type) {
-		case string:
-			buf.WriteByte(jsonQuote)
-			if !needsEscaping(val) {
-				buf.WriteString(val)
-			} else {
-				writeEscapedStringString(buf, val)
+		start := buf.off
+		if err := marshalInterface(v, buf); err != nil && !buf.substitute(start, err) {
+			return unsupportedIn(err, k)
+		}
+	}
+
+	buf.endContainer(jsonCloseBrace, len(m) == 0)
+	return nil
+}
+
+// marshalSortedStringMap writes m with its keys in sorted order, for
+// MarshalOptions.SortMapKeys, using write for each value
+func marshalSortedStringMap[V any](m map[string]V, buf *Buffer, write func(V, *Buffer) error) error {
+	buf.beginContainer(jsonOpenBrace)
+	for i, k := range slices.Sorted(maps.Keys(m)) {
+		if err := buf.yieldPoint(); err != nil {
+			return err
+		}
+		if i > 0 {
+			buf.WriteByte(jsonComma)
+		}
+		buf.breakLine()
+		writeObjectKey(buf, k)
+		start := buf.off
+		if err := write(m[k], buf); err != nil && !buf.substitute(start, err) {
+			return unsupportedIn(err, k)
+		}
+	}
+	buf.endContainer(jsonCloseBrace, len(m) == 0)
+	return nil
+}
+
+// marshalInterface writes the dynamic value held in an interface{} using
+// concrete type switches for the types that dominate decoded and telemetry
+// data, falling back to reflection for everything else
+func marshalInterface(v interface{}, buf *Buffer) error {
+	if t := reflect.TypeOf(v); t != nil && mayBeRegistered(t) {
+		if getElemPlan(t).marshalFunc != nil {
+			return marshalValue(reflect.ValueOf(v), buf)
+		}
+	}
+	switch val := v.(type) {
+	case string:
+		buf.WriteByte(jsonQuote)
+		if !buf.escapes().needsEscaping(val) {
+			buf.WriteString(val)
+		} else {
+			writeEscapedStringString(buf, val)
+		}
+		buf.WriteByte(jsonQuote)
+	case Number:
+		return writeNumberLiteral(buf, string(val))
+	case int:
+		writeInt(buf, int64(val))
+	case int64:
+		writeInt(buf, val)
+	case int32:
+		writeInt(buf, int64(val))
+	case uint64:
+		writeUint(buf, val)
+	case float64:
+		return writeFloat(buf, val, 64)
+	case float32:
+		return writeFloat(buf, float64(val), 32)
+	case bool:
+		if val {
+			buf.Write(jsonTrue)
+		} else {
+			buf.Write(jsonFalse)
+		}
+	case nil:
+		buf.Write(jsonNull)
+	case time.Time:
+		return writeTime(buf, val)
+	case map[string]interface{}:
+		if val == nil {
+			buf.writeNilMap()
+			return nil
+		}
+		if len(val) == 0 {
+			buf.WriteByte(jsonOpenBrace)
+			buf.WriteByte(jsonCloseBrace)
+			return nil
+		}
+		// Deep enough to look for cycles, the reflection path tracks it
+		if buf.level >= cycleDepth {
+			return marshalValue(reflect.ValueOf(val), buf)
+		}
+		buf.level++
+		err := marshalStringInterfaceMap(val, buf)
+		buf.level--
+		return err
+	case []interface{}:
+		if val == nil {
+			buf.writeNilSlice()
+			return nil
+		}
+		if buf.level >= cycleDepth {
+			return marshalValue(reflect.ValueOf(val), buf)
+		}
+		buf.level++
+		err := marshalInterfaceSlice(val, buf)
+		buf.level--
+		return err
+	case []string:
+		if val == nil {
+			buf.writeNilSlice()
+			return nil
+		}
+		buf.beginContainer(jsonOpenBracket)
+		for i, str := range val {
+			if err := buf.yieldPoint(); err != nil {
+				return err
+			}
+			if i > 0 {
+				buf.WriteByte(jsonComma)
 			}
+			buf.breakLine()
 			buf.WriteByte(jsonQuote)
-		case int:
-			numBuf := getNumberBuf()
-			*numBuf = strconv.AppendInt((*numBuf)[:0], int64(val), 10)
-			buf.Write(*numBuf)
-			putNumberBuf(numBuf)
-		case float64:
-			numBuf := getNumberBuf()
-			*numBuf = strconv.AppendFloat((*numBuf)[:0], val, 'g', -1, 64)
-			buf.Write(*numBuf)
-			putNumberBuf(numBuf)
-		case bool:
-			if val {
-				buf.Write(jsonTrue)
+			if !buf.escapes().needsEscaping(str) {
+				buf.WriteString(str)
 			} else {
-				buf.Write(jsonFalse)
+				writeEscapedStringString(buf, str)
 			}
-		case nil:
-			buf.Write(jsonNull)
-		default:
-			if err := marshalValue(reflect.ValueOf(v), buf); err != nil {
+			buf.WriteByte(jsonQuote)
+		}
+		buf.endContainer(jsonCloseBracket, len(val) == 0)
+	case []int:
+		if val == nil {
+			buf.writeNilSlice()
+			return nil
+		}
+		buf.beginContainer(jsonOpenBracket)
+		for i, n := range val {
+			if err := buf.yieldPoint(); err != nil {
 				return err
 			}
+			if i > 0 {
+				buf.WriteByte(jsonComma)
+			}
+			buf.breakLine()
+			writeInt(buf, int64(n))
+		}
+		buf.endContainer(jsonCloseBracket, len(val) == 0)
+	default:
+		return marshalValue(reflect.ValueOf(v), buf)
+	}
+	return nil
+}
+
+// AppendNumber appends f to dst formatted exactly as Marshal encodes a float
+// of the given bit size, 32 or 64, which is as encoding/json does: like
+// JavaScript, without an exponent from 1e-6 up to 1e21. f must be finite:
+// NaN and infinities have no JSON form, and Marshal reports them as errors
+// instead of encoding them.
+func AppendNumber(dst []byte, f float64, bits int) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) ||
+			bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, bits)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		if n := len(dst); n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst
+}
+
+// AppendIntNumber appends i to dst formatted exactly as Marshal encodes
+// signed integers
+func AppendIntNumber(dst []byte, i int64) []byte {
+	return strconv.AppendInt(dst, i, 10)
+}
+
+// writeInt appends the decimal form of n using a pooled scratch buffer
+func writeInt(buf *Buffer, n int64) {
+	numBuf := getNumberBuf()
+	*numBuf = AppendIntNumber((*numBuf)[:0], n)
+	buf.Write(*numBuf)
+	putNumberBuf(numBuf)
+}
+
+// writeUint appends the decimal form of n using a pooled scratch buffer
+func writeUint(buf *Buffer, n uint64) {
+	numBuf := getNumberBuf()
+	*numBuf = strconv.AppendUint((*numBuf)[:0], n, 10)
+	buf.Write(*numBuf)
+	putNumberBuf(numBuf)
+}
+
+// writeFloat appends f, a float of the given bit size, with AppendNumber,
+// rejecting NaN and infinities which have no JSON representation
+func writeFloat(buf *Buffer, f float64, bits int) error {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		v := reflect.ValueOf(f)
+		if bits == 32 {
+			v = reflect.ValueOf(float32(f))
+		}
+		return &UnsupportedValueError{Value: v, Str: strconv.FormatFloat(f, 'g', -1, bits)}
+	}
+	numBuf := getNumberBuf()
+	*numBuf = AppendNumber((*numBuf)[:0], f, bits)
+	buf.Write(*numBuf)
+	putNumberBuf(numBuf)
+	return nil
+}
+
+// writeTime appends t as a quoted string in the MarshalOptions.TimeFormat
+// layout, RFC3339 by default and RFC3339Nano, as encoding/json writes
+// times, under StdlibCompat. StdlibCompat also fails, as time.Time's
+// MarshalJSON does, for a year outside [0,9999].
+func writeTime(buf *Buffer, t time.Time) error {
+	if buf.opts != nil && (buf.opts.TimeFormat != "" || buf.opts.StdlibCompat) {
+		if y := t.Year(); buf.opts.StdlibCompat && (y < 0 || y > 9999) {
+			_, err := t.MarshalJSON()
+			return &MarshalerError{Type: timeType, Err: err}
 		}
+		layout := buf.opts.TimeFormat
+		if layout == "" {
+			layout = time.RFC3339Nano
+		}
+		buf.WriteByte(jsonQuote)
+		writeEscapedStringString(buf, t.Format(layout))
+		buf.WriteByte(jsonQuote)
+		return nil
 	}
 
-	buf.WriteByte(jsonCloseBrace)
+	// Years past 9999 or before 0 run longer than the layout, so the
+	// time is formatted aside rather than in place
+	var scratch [64]byte
+	buf.WriteByte(jsonQuote)
+	buf.Write(t.AppendFormat(scratch[:0], time.RFC3339))
+	buf.WriteByte(jsonQuote)
+	return nil
+}
+
+// isNumberType reports whether t is Number or encoding/json's Number, which
+// are written as numbers rather than strings
+func isNumberType(t reflect.Type) bool {
+	return t == numberType || t.Name() == "Number" && t.PkgPath() == "encoding/json"
+}
+
+// writeNumberLiteral writes the Number s as a bare number, as
+// encoding/json writes its Number, with "" written as 0
+func writeNumberLiteral(buf *Buffer, s string) error {
+	if s == "" {
+		s = "0"
+	}
+	if !isCompleteLiteral(s) || !(s[0] == '-' || isDigit(s[0])) {
+		return fmt.Errorf("json: invalid number literal %q", s)
+	}
+	buf.WriteString(s)
 	return nil
 }
 
 func marshalStringStringMap(m map[string]string, buf *Buffer) error {
-	buf.WriteByte(jsonOpenBrace)
+	if buf.marshalOptions().sortKeys() {
+		return marshalSortedStringMap(m, buf, func(v string, buf *Buffer) error {
+			buf.WriteByte(jsonQuote)
+			if !buf.escapes().needsEscaping(v) {
+				buf.WriteString(v)
+			} else {
+				writeEscapedStringString(buf, v)
+			}
+			buf.WriteByte(jsonQuote)
+			return nil
+		})
+	}
+
+	buf.beginContainer(jsonOpenBrace)
 	first := true
 
 	// Pre-grow buffer based on map content
@@ -658,21 +1323,25 @@ func marshalStringStringMap(m map[string]string, buf *Buffer) error {
 
 	first = true
 	for k, v := range m {
+		if err := buf.yieldPoint(); err != nil {
+			return err
+		}
 		if !first {
 			buf.WriteByte(jsonComma)
 		}
+		buf.breakLine()
 		first = false
 
 		buf.WriteByte(jsonQuote)
-		if !needsEscaping(k) {
+		if !buf.escapes().needsEscaping(k) {
 			buf.WriteString(k)
 		} else {
 			writeEscapedStringString(buf, k)
 		}
-		buf.Write(jsonQuoteColon)
+		buf.writeColon()
 
 		buf.WriteByte(jsonQuote)
-		if !needsEscaping(v) {
+		if !buf.escapes().needsEscaping(v) {
 			buf.WriteString(v)
 		} else {
 			writeEscapedStringString(buf, v)
@@ -680,57 +1349,110 @@ func marshalStringStringMap(m map[string]string, buf *Buffer) error {
 		buf.WriteByte(jsonQuote)
 	}
 
-	buf.WriteByte(jsonCloseBrace)
+	buf.endContainer(jsonCloseBrace, len(m) == 0)
 	return nil
 }
 
 func marshalStringIntMap(m map[string]int, buf *Buffer) error {
-	buf.WriteByte(jsonOpenBrace)
+	if buf.marshalOptions().sortKeys() {
+		return marshalSortedStringMap(m, buf, func(v int, buf *Buffer) error {
+			writeInt(buf, int64(v))
+			return nil
+		})
+	}
+
+	buf.beginContainer(jsonOpenBrace)
 	first := true
 
 	// Pre-estimate size
 	buf.grow(len(m) * 16)
 
 	for k, v := range m {
+		if err := buf.yieldPoint(); err != nil {
+			return err
+		}
 		if !first {
 			buf.WriteByte(jsonComma)
 		}
+		buf.breakLine()
 		first = false
 
 		buf.WriteByte(jsonQuote)
-		if !needsEscaping(k) {
+		if !buf.escapes().needsEscaping(k) {
 			buf.WriteString(k)
 		} else {
 			writeEscapedStringString(buf, k)
 		}
-		buf.Write(jsonQuoteColon)
+		buf.writeColon()
 
-		numBuf := getNumberBuf()
-		*numBuf = strconv.AppendInt((*numBuf)[:0], int64(v), 10)
-		buf.Write(*numBuf)
-		putNumberBuf(numBuf)
+		writeInt(buf, int64(v))
 	}
 
-	buf.WriteByte(jsonCloseBrace)
+	buf.endContainer(jsonCloseBrace, len(m) == 0)
 	return nil
 }
 
 // marshalStruct serializes a struct to JSON with optimized memory usage
 func marshalStruct(v reflect.Value, buf *Buffer) error {
 	t := v.Type()
-	fields := structFields(t)
+	fields := structFields(t, buf.opts)
 
 	// Write opening brace
-	buf.WriteByte(jsonOpenBrace)
+	buf.beginContainer(jsonOpenBrace)
 
 	fieldCount := 0
 	// Process all fields with direct writing to buffer
 	for i := 0; i < len(fields); i++ {
+		if err := buf.yieldPoint(); err != nil {
+			return err
+		}
 		f := &fields[i]
-		fv := v.FieldByIndex(f.index)
+		fv, ok := fieldValue(v, f.index)
+		if !ok {
+			continue
+		}
+
+		// Unknown is always last; its members follow the declared fields
+		if f.unknown {
+			wrote, err := writeUnknown(fv.Interface().(Unknown), t, fields[:i], fieldCount > 0, buf)
+			if err != nil {
+				return err
+			}
+			if wrote {
+				fieldCount++
+			}
+			break
+		}
+
+		if f.dangerous && buf.checksKeys() {
+			if keep, err := buf.opts.keepKey(GetString(f.nameBytes)); !keep {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		// Optional fields are emitted only when Present, as null when Null
+		if f.optional {
+			if !fv.Field(1).Bool() {
+				continue
+			}
+			if fv.Field(2).Bool() {
+				if fieldCount > 0 {
+					buf.WriteByte(jsonComma)
+				}
+				buf.breakLine()
+				fieldCount++
+				buf.writeFieldName(f)
+				buf.Write(jsonNull)
+				continue
+			}
+			fv = fv.Field(0)
+		}
 
 		// Skip empty fields with omitempty tag
-		if f.omitEmpty && isEmptyValue(fv) {
+		if f.omitEmpty && buf.isEmpty(f, fv) {
 			continue
 		}
 
@@ -738,22 +1460,43 @@ func marshalStruct(v reflect.Value, buf *Buffer) error {
 		if fieldCount > 0 {
 			buf.WriteByte(jsonComma)
 		}
+		buf.breakLine()
 		fieldCount++
 
 		// Write field name
-		buf.Write(f.nameWithQuotesBytes)
+		buf.writeFieldName(f)
+		start := buf.off
+
+		if f.jsonString {
+			if err := marshalJSONString(fv, buf); err != nil && !buf.substitute(start, err) {
+				return unsupportedIn(err, GetString(f.nameBytes))
+			}
+			continue
+		}
+		if f.duration {
+			buf.WriteByte(jsonQuote)
+			writeEscapedStringString(buf, time.Duration(fv.Int()).String())
+			buf.WriteByte(jsonQuote)
+			continue
+		}
 
-		// Special handling for string tag option
-		// This is strange if why have a switch case with only one case that matches basically everything?
-		if f.stringOpt {
+		// Special handling for string tag option, which like encoding/json
+		// leaves values with their own encoding alone
+		if f.stringOpt && !hasOwnEncoding(fv) {
 			switch fv.Kind() {
 			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
 				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
-				reflect.Float32, reflect.Float64, reflect.Bool:
+				reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+				if fv.Kind() == reflect.String && !isNumberType(fv.Type()) {
+					break
+				}
 				// For numeric types with string tag, wrap in quotes
 				buf.WriteByte(jsonQuote)
 				if err := marshalValue(fv, buf); err != nil {
-					return err
+					if !buf.substitute(start, err) {
+						return unsupportedIn(err, GetString(f.nameBytes))
+					}
+					continue
 				}
 				buf.WriteByte(jsonQuote)
 				continue
@@ -761,13 +1504,13 @@ func marshalStruct(v reflect.Value, buf *Buffer) error {
 		}
 
 		// Regular marshaling for all other cases
-		if err := marshalValue(fv, buf); err != nil {
-			return err
+		if err := marshalValue(fv, buf); err != nil && !buf.substitute(start, err) {
+			return unsupportedIn(err, GetString(f.nameBytes))
 		}
 	}
 
 	// Write closing brace
-	buf.WriteByte(jsonCloseBrace)
+	buf.endContainer(jsonCloseBrace, fieldCount == 0)
 	return nil
 }
 
@@ -777,51 +1520,239 @@ func unmarshalValue(p *Parser, v reflect.Value) error {
 		return &SyntaxError{Offset: int64(p.pos), Msg: "unexpected end of JSON input"}
 	}
 
-	if v.CanAddr() && v.Addr().Type().Implements(reflect.TypeOf((*Unmarshaler)(nil)).Elem()) {
-		start := p.pos
-		if !skipValue(p) {
-			return &SyntaxError{Offset: int64(p.pos), Msg: "invalid JSON value"}
+	if v.CanAddr() && mayBeRegistered(v.Type()) {
+		if fn := getElemPlan(v.Type()).unmarshalFunc; fn != nil {
+			return unmarshalRegistered(p, fn, v)
 		}
-		return v.Addr().Interface().(Unmarshaler).UnmarshalJSON(p.data[start:p.pos])
+	}
+	if v.Type() == rawMessageType {
+		return unmarshalRawMessage(p, v)
+	}
+	if v.CanAddr() && getElemPlan(v.Type()).unmarshaler {
+		return callUnmarshaler(p, v.Addr().Interface())
+	}
+	return unmarshalKind(p, v)
+}
+
+// unmarshalKind is unmarshalValue past the Unmarshaler check: it decodes the
+// next value by the kind of v, which need not be addressable
+func unmarshalKind(p *Parser, v reflect.Value) error {
+	// Decode through pointers, allocating as needed; null resets the pointer
+	if v.Kind() == reflect.Ptr {
+		if p.data[p.pos] == 'n' {
+			if !p.matchLiteral("null") {
+				return p.tokenError("invalid literal")
+			}
+			return setNull(v)
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalValue(p, v.Elem())
 	}
 
 	switch p.data[p.pos] {
 	case 'n':
-		p.pos += 4 // Skip "null"
-		return setNull(v)
+		if !p.matchLiteral("null") {
+			return p.tokenError("invalid literal")
+		}
+		if err := setNull(v); err != nil && !p.opts.StdlibCompat {
+			return err
+		}
+		return nil
 	case 't':
-		p.pos += 4 // Skip "true"
+		if !p.matchLiteral("true") {
+			return p.tokenError("invalid literal")
+		}
 		return setBool(v, true)
 	case 'f':
-		p.pos += 5 // Skip "false"
+		if !p.matchLiteral("false") {
+			return p.tokenError("invalid literal")
+		}
 		return setBool(v, false)
 	case '"':
 		tokenType, value := p.parseString()
 		if tokenType != TokenString {
-			return &SyntaxError{Offset: int64(p.pos), Msg: "invalid string"}
+			return p.tokenError("invalid string")
 		}
-		return setString(v, GetString(value))
+		s, ok := p.valueString(value)
+		if !ok {
+			return &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in string"}
+		}
+		err := setString(v, s)
+		if err != nil && p.opts.WeakTypeCoercion != 0 {
+			return coerceString(v, s, p.opts, err)
+		}
+		return err
 	case '{':
 		if v.Kind() == reflect.Struct {
 			return unmarshalToStruct(p, v)
 		} else if v.Kind() == reflect.Map {
 			return unmarshalToMap(p, v)
+		} else if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+			return unmarshalToInterface(p, v)
 		}
 	case '[':
 		if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
 			return unmarshalToSlice(p, v)
+		} else if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+			return unmarshalToInterface(p, v)
 		}
 	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		start := p.pos
 		tokenType, value := p.parseNumber()
 		if tokenType != TokenNumber {
-			return &SyntaxError{Offset: int64(p.pos), Msg: "invalid number"}
+			return p.tokenError("invalid number")
+		}
+		err := setNumber(v, GetString(value), p.opts)
+		if err != nil && p.opts.WeakTypeCoercion&CoerceNumberToString != 0 && v.Kind() == reflect.String {
+			v.SetString(string(value))
+			return nil
+		}
+		if p.tracksPrecision() {
+			err = p.checkPrecision(v, GetString(value), start, err)
 		}
-		return setNumber(v, GetString(value), nil)
+		return err
 	}
 
+	switch p.data[p.pos] {
+	case '{':
+		return &UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(p.pos)}
+	case '[':
+		return &UnmarshalTypeError{Value: "array", Type: v.Type(), Offset: int64(p.pos)}
+	}
 	return &SyntaxError{Offset: int64(p.pos), Msg: "invalid JSON value"}
 }
 
+// callUnmarshaler has u, an UnmarshalerFrom or Unmarshaler, decode the
+// next value: from p itself, or from the raw bytes of the value
+func callUnmarshaler(p *Parser, u interface{}) error {
+	p.skipWhitespace()
+	start := p.pos
+	if from, ok := u.(UnmarshalerFrom); ok {
+		if err := from.UnmarshalApexJSON(p); err != nil {
+			return err
+		}
+		if p.pos == start {
+			return fmt.Errorf("json: UnmarshalApexJSON for type %T read no value", u)
+		}
+		return nil
+	}
+	data, err := p.rawValue()
+	if err != nil {
+		return err
+	}
+	if err := u.(Unmarshaler).UnmarshalJSON(data); err != nil {
+		return &UnmarshalerError{Type: reflect.TypeOf(u), Err: err, Field: pathAt(p.data, start), Offset: int64(start)}
+	}
+	return nil
+}
+
+// unmarshalRegistered has fn, the function registered for the type of v,
+// decode the next value from its raw bytes, as callUnmarshaler does an
+// UnmarshalJSON method
+func unmarshalRegistered(p *Parser, fn unmarshalFunc, v reflect.Value) error {
+	start := p.pos
+	data, err := p.rawValue()
+	if err != nil {
+		return err
+	}
+	if err := fn(data, v); err != nil {
+		return &UnmarshalerError{Type: v.Addr().Type(), Err: err, Field: pathAt(p.data, start), Offset: int64(start)}
+	}
+	return nil
+}
+
+// rawValue skips the next value and returns its bytes, for a method or
+// function that decodes it from them
+func (p *Parser) rawValue() ([]byte, error) {
+	start := p.pos
+	if !skipValue(p) {
+		return nil, p.tokenError("invalid JSON value")
+	}
+	// A value inside an array or object that runs to the end of the input
+	// is cut short, however complete it looks, so the method isn't called
+	if p.pos == len(p.data) && inContainer(p.data, start) {
+		return nil, unexpectedEnd(int64(p.pos))
+	}
+	return p.data[start:p.pos], nil
+}
+
+// inContainer reports whether the value at start in data is an array
+// element or member value, from the token before it
+func inContainer(data []byte, start int) bool {
+	i := start - 1
+	for i >= 0 && isWhitespace(data[i]) {
+		i--
+	}
+	return i >= 0 && (data[i] == ':' || data[i] == ',' || data[i] == '[')
+}
+
+// AsMarshalerTo returns m as a MarshalerTo, so a MarshalApexJSON method can
+// hand part of its value to a type that only has MarshalJSON
+func AsMarshalerTo(m Marshaler) MarshalerTo {
+	return marshalerAdapter{m}
+}
+
+// MarshalApexJSON writes the output of MarshalJSON
+func (a marshalerAdapter) MarshalApexJSON(buf *Buffer) error {
+	return marshalJSON(a.m, reflect.TypeOf(a.m), buf)
+}
+
+// AsUnmarshalerFrom returns u as an UnmarshalerFrom, so an
+// UnmarshalApexJSON method can hand part of its input to a type that only
+// has UnmarshalJSON
+func AsUnmarshalerFrom(u Unmarshaler) UnmarshalerFrom {
+	return unmarshalerAdapter{u}
+}
+
+// UnmarshalApexJSON passes the raw bytes of the next value to UnmarshalJSON
+func (a unmarshalerAdapter) UnmarshalApexJSON(p *Parser) error {
+	return callUnmarshaler(p, a.u)
+}
+
+// unmarshalRawMessage stores a copy of the next value's bytes in v, a
+// RawMessage, as its UnmarshalJSON would without the interface conversion
+func unmarshalRawMessage(p *Parser, v reflect.Value) error {
+	start := p.pos
+	if !skipValue(p) {
+		return p.tokenError("invalid JSON value")
+	}
+	v.SetBytes(append(v.Bytes()[:0], p.data[start:p.pos]...))
+	return nil
+}
+
+// unmarshalElem decodes the next value into elem, an addressable element of
+// a slice, array or map. direct is set when the container's elemPlan found
+// *T to be an UnmarshalerFrom or Unmarshaler, so it is called without
+// unmarshalValue's checks.
+func unmarshalElem(p *Parser, elem reflect.Value, direct bool) error {
+	if direct {
+		if elem.Type() == rawMessageType {
+			p.skipWhitespace()
+			return unmarshalRawMessage(p, elem)
+		}
+		return callUnmarshaler(p, elem.Addr().Interface())
+	}
+	return unmarshalValue(p, elem)
+}
+
+// unmarshalToInterface decodes an object or array into an empty interface
+// as map[string]interface{} or []interface{}, like encoding/json
+func unmarshalToInterface(p *Parser, v reflect.Value) error {
+	val, err := p.extractElement()
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(val))
+	return nil
+}
+
+// unmarshalToMap decodes an object into a map. Key types with
+// UnmarshalText decode their keys with it, and integer key types parse them
+// as numbers; any other key is decoded as a string, so a
+// map[interface{}]T receives string keys whatever type they had before they
+// were marshaled.
 func unmarshalToMap(p *Parser, v reflect.Value) error {
 	// Skip opening brace
 	p.pos++
@@ -832,124 +1763,183 @@ func unmarshalToMap(p *Parser, v reflect.Value) error {
 		v.Set(reflect.MakeMap(t))
 	}
 
+	// The two most common targets are filled without reflection. Named map
+	// types don't match here and take the generic path.
+	if v.CanInterface() {
+		switch m := v.Interface().(type) {
+		case map[string]string:
+			return unmarshalStringStringMap(p, m)
+		case map[string]interface{}:
+			return unmarshalStringInterfaceMap(p, m)
+		}
+	}
+
 	// Get key and element types
 	keyType := t.Key()
 	elemType := t.Elem()
+	direct := getElemPlan(elemType).unmarshaler
 
 	// Process key-value pairs
-	for p.pos < len(p.data) {
-		p.skipWhitespace()
-
-		if p.pos >= len(p.data) {
-			err := getSyntaxError()
-			err.Offset = int64(p.pos)
-			err.Msg = "unexpected end of JSON input"
+	for first := true; ; first = false {
+		if done, err := p.nextMember('}', first); err != nil || done {
 			return err
 		}
 
-		// Check for end of object
-		if p.data[p.pos] == '}' {
-			p.pos++ // Skip closing brace
-			return nil
-		}
-
-		// Expect a comma between elements (but not before the first element)
-		if p.data[p.pos] == ',' {
-			p.pos++ // Skip comma
-			p.skipWhitespace()
-		}
-
-		// Parse key
-		tokenType, keyBytes := p.parseString()
-		if tokenType != TokenString {
-			err := getSyntaxError()
-			err.Offset = int64(p.pos)
-			err.Msg = "expected string key in object"
+		keyStr, err := p.objectKey()
+		if err != nil {
 			return err
 		}
-		keyStr := GetString(keyBytes)
-
-		// Expect colon
-		p.skipWhitespace()
-		if p.pos >= len(p.data) || p.data[p.pos] != ':' {
-			err := getSyntaxError()
-			err.Offset = int64(p.pos)
-			err.Msg = "expected colon after object key"
-			return err
-		}
-		p.pos++ // Skip colon
 
 		// Create map key
 		mapKey := reflect.New(keyType).Elem()
-		if err := setString(mapKey, keyStr); err != nil {
-			return &UnmarshalTypeError{Value: "string", Type: keyType, Offset: int64(p.pos)}
+		if err := setMapKey(mapKey, keyStr); err != nil {
+			if ute, ok := err.(*UnmarshalTypeError); ok {
+				ute.Offset = int64(p.pos)
+			}
+			return err
 		}
 
 		// Create map value
+		if err := p.countElement(); err != nil {
+			return err
+		}
 		mapElem := reflect.New(elemType).Elem()
 
 		// Unmarshal value
-		if err := unmarshalValue(p, mapElem); err != nil {
+		if err := unmarshalElem(p, mapElem, direct); err != nil {
 			return err
 		}
 
 		// Set map entry
 		v.SetMapIndex(mapKey, mapElem)
 	}
-
-	err := getSyntaxError()
-	err.Offset = int64(p.pos)
-	err.Msg = "unexpected end of JSON input"
-	return err
 }
 
-func unmarshalToStruct(p *Parser, v reflect.Value) error {
-	// Skip opening brace
-	p.pos++
+// unmarshalStringStringMap is unmarshalToMap for map[string]string. String
+// values are assigned directly; anything else goes through unmarshalValue
+// so null, coercion and type errors behave as on the generic path.
+func unmarshalStringStringMap(p *Parser, m map[string]string) error {
+	for first := true; ; first = false {
+		if done, err := p.nextMember('}', first); err != nil || done {
+			return err
+		}
+		key, err := p.objectKey()
+		if err != nil {
+			return err
+		}
+		if err := p.countElement(); err != nil {
+			return err
+		}
 
-	// Get field information
-	fields := structFields(v.Type())
-	fieldMap := getFieldMap()
-	defer putFieldMap(fieldMap)
+		p.skipWhitespace()
+		if p.pos < len(p.data) && p.data[p.pos] == '"' {
+			tokenType, raw := p.parseString()
+			if tokenType != TokenString {
+				return p.tokenError("invalid string")
+			}
+			s, ok := p.valueString(raw)
+			if !ok {
+				return &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in string"}
+			}
+			m[key] = s
+			continue
+		}
 
-	// Convert Field to field and populate the map
-	for _, f := range fields {
-		// Use GetString to convert nameBytes to string for map key
-		fieldName := GetString(f.nameBytes)
-		fieldMap[fieldName] = Field{
-			nameBytes:           f.nameBytes,
-			nameWithQuotesBytes: f.nameWithQuotesBytes,
-			index:               f.index,
-			omitEmpty:           f.omitEmpty,
+		var s string
+		if err := unmarshalValue(p, reflect.ValueOf(&s).Elem()); err != nil {
+			return err
 		}
+		m[key] = s
 	}
+}
+
+// unmarshalStringInterfaceMap is unmarshalToMap for map[string]interface{},
+// building each value with extractElement
+func unmarshalStringInterfaceMap(p *Parser, m map[string]interface{}) error {
+	for first := true; ; first = false {
+		if done, err := p.nextMember('}', first); err != nil || done {
+			return err
+		}
+		key, err := p.objectKey()
+		if err != nil {
+			return err
+		}
+		if err := p.countElement(); err != nil {
+			return err
+		}
 
-	// Process key-value pairs
-	for p.pos < len(p.data) {
 		p.skipWhitespace()
-		if p.pos >= len(p.data) {
-			return &SyntaxError{Offset: int64(p.pos), Msg: "unexpected end of JSON input"}
+		val, err := p.extractElement()
+		if err != nil {
+			return err
 		}
+		m[key] = val
+	}
+}
 
-		// Check for end of object
-		if p.data[p.pos] == '}' {
-			p.pos++ // Skip closing brace
-			return nil
+// objectKey parses an object member's key and the colon after it
+func (p *Parser) objectKey() (string, error) {
+	tokenType, keyBytes := p.parseString()
+	if tokenType != TokenString {
+		if p.err != nil {
+			return "", p.err
 		}
+		err := getSyntaxError()
+		err.Offset = int64(p.pos)
+		err.Msg = "expected string key in object"
+		return "", err
+	}
+	key, ok := p.stringValue(keyBytes)
+	if !ok {
+		err := getSyntaxError()
+		err.Offset = int64(p.pos)
+		err.Msg = "invalid escape sequence in object key"
+		return "", err
+	}
 
-		// Expect a comma between elements (but not before the first element)
-		if p.data[p.pos] == ',' {
-			p.pos++ // Skip comma
-			p.skipWhitespace()
+	// Expect colon
+	p.skipWhitespace()
+	if p.pos >= len(p.data) || p.data[p.pos] != ':' {
+		err := getSyntaxError()
+		err.Offset = int64(p.pos)
+		err.Msg = "expected colon after object key"
+		return "", err
+	}
+	p.pos++ // Skip colon
+	return key, nil
+}
+
+func unmarshalToStruct(p *Parser, v reflect.Value) error {
+	if err := p.countElement(); err != nil {
+		return err
+	}
+
+	// Skip opening brace
+	p.pos++
+
+	// Get the cached field lookup for the type
+	plan := getDecodePlan(v.Type(), &p.opts.MarshalOptions)
+
+	// Process key-value pairs
+	for first := true; ; first = false {
+		if done, err := p.nextMember('}', first); err != nil || done {
+			return err
 		}
 
 		// Parse field name
 		tokenType, keyBytes := p.parseString()
 		if tokenType != TokenString {
-			return &SyntaxError{Offset: int64(p.pos), Msg: "expected string key in object"}
+			return p.tokenError("expected string key in object")
 		}
 
-		key := GetString(keyBytes)
+		// Escaped keys are decoded into the parser's scratch buffer, which
+		// is only needed for the field lookup below
+		unescaped, ok := p.unescape(keyBytes)
+		if !ok {
+			return &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in object key"}
+		}
+		key := GetString(unescaped)
+
 		// Expect colon
 		p.skipWhitespace()
 		if p.pos >= len(p.data) || p.data[p.pos] != ':' {
@@ -960,11 +1950,31 @@ func unmarshalToStruct(p *Parser, v reflect.Value) error {
 		}
 
 		p.pos++ // Skip colon
-		// Find matching field
-		f, ok := fieldMap[key]
+		// Find matching field. In a wide document most keys name none, and
+		// the filter turns them away without hashing the whole key.
+		i, ok := 0, false
+		if plan.names.has(unescaped) {
+			i, ok = plan.byName[key]
+		}
+		if !ok && p.opts.StdlibCompat {
+			i, ok = plan.foldName(key)
+		}
+		if !ok && plan.unknown != nil {
+			u, err := settableField(v, plan.unknown)
+			if err == nil {
+				err = keepUnknown(p, u, key)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		if !ok {
 			// Skip value if field doesn't exist in struct
-			if !skipValue(p) {
+			if !p.skipScalarOrValue() {
+				if p.err != nil {
+					return p.err
+				}
 				err := getSyntaxError()
 				err.Offset = int64(p.pos)
 				err.Msg = "invalid JSON value"
@@ -975,22 +1985,250 @@ func unmarshalToStruct(p *Parser, v reflect.Value) error {
 		}
 
 		// Unmarshal value into field
-		field := v.FieldByIndex(f.index)
-		if err := unmarshalValue(p, field); err != nil {
+		f := &plan.fields[i]
+		var err error
+		if plan.flat {
+			err = unmarshalFlatField(p, v.Field(f.index[0]), plan.kinds[i])
+		} else {
+			err = unmarshalField(p, v, f)
+		}
+		if err != nil {
+			// Keep a field path set further down, such as the one on
+			// precision loss errors. Errors from setters that don't know
+			// the position are given the one the value was read up to.
 			if ute, ok := err.(*UnmarshalTypeError); ok {
-				ute.Field = key
+				if ute.Field == "" {
+					ute.Field = GetString(f.nameBytes)
+				}
+				if ute.Offset == 0 {
+					ute.Offset = int64(p.pos)
+				}
 			}
 
 			return err
 		}
 	}
+}
 
-	err := getSyntaxError()
-	err.Offset = int64(p.pos)
-	err.Msg = "unexpected end of JSON input"
-	return err
+// keepUnknown stores a copy of the raw value at the current position in
+// the struct's Unknown field u under key
+func keepUnknown(p *Parser, u reflect.Value, key string) error {
+	p.skipWhitespace()
+	start := p.pos
+	if !skipValue(p) {
+		if p.err != nil {
+			return p.err
+		}
+		return p.tokenError("invalid JSON value")
+	}
+	if u.IsNil() {
+		u.Set(reflect.MakeMap(unknownType))
+	}
+	raw := make(RawMessage, p.pos-start)
+	copy(raw, p.data[start:p.pos])
+	u.SetMapIndex(reflect.ValueOf(strings.Clone(key)), reflect.ValueOf(raw))
+	return nil
+}
+
+// unmarshalField decodes the next value into the struct field f of v
+func unmarshalField(p *Parser, v reflect.Value, f *Field) error {
+	field, err := settableField(v, f.index)
+	if err != nil {
+		return err
+	}
+	if f.optional {
+		// Record presence; an explicit null leaves Value zeroed
+		if field = unmarshalOptional(p, field); !field.IsValid() {
+			return nil
+		}
+	}
+	if f.jsonString {
+		return unmarshalJSONString(p, field)
+	}
+	if f.duration {
+		return unmarshalDuration(p, field)
+	}
+	return unmarshalValue(p, field)
+}
+
+// unmarshalDuration decodes the next value into v, a time.Duration field
+// with the duration:string option. A string is parsed by
+// time.ParseDuration; anything else decodes as it would without the
+// option, so numbers are still nanoseconds.
+func unmarshalDuration(p *Parser, v reflect.Value) error {
+	p.skipWhitespace()
+	if p.pos >= len(p.data) || p.data[p.pos] != '"' {
+		return unmarshalValue(p, v)
+	}
+	tokenType, raw := p.parseString()
+	if tokenType != TokenString {
+		return p.tokenError("invalid string")
+	}
+	s, ok := p.stringValue(raw)
+	if !ok {
+		return &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in string"}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return &UnmarshalTypeError{Value: "string " + strconv.Quote(s), Type: v.Type(), Offset: int64(p.pos)}
+	}
+	v.SetInt(int64(d))
+	return nil
+}
+
+// marshalJSONString writes v encoded as a JSON document and then escaped
+// into a JSON string, for fields with the jsonstring option. The document
+// is compact whatever the layout of the output around it.
+func marshalJSONString(v reflect.Value, buf *Buffer) error {
+	start := buf.off
+	ind, yield := buf.ind, buf.yield
+	buf.ind, buf.yield = nil, nil
+	err := marshalValue(v, buf)
+	buf.ind, buf.yield = ind, yield
+	if err != nil {
+		return err
+	}
+
+	doc := getBufferSize(buf.off - start)
+	doc.Write(buf.buf[start:buf.off])
+	buf.off = start
+	buf.WriteByte(jsonQuote)
+	writeEscapedString(buf, doc.Bytes())
+	buf.WriteByte(jsonQuote)
+	putBuffer(doc)
+	return nil
+}
+
+// unmarshalJSONString decodes the next value, a JSON string holding a JSON
+// document, into v, for fields with the jsonstring option. null leaves v
+// unchanged. Errors in the document are an *EmbeddedError.
+func unmarshalJSONString(p *Parser, v reflect.Value) error {
+	p.skipWhitespace()
+	start := p.pos
+	if p.pos < len(p.data) && p.data[p.pos] == 'n' {
+		if !p.matchLiteral("null") {
+			return p.tokenError("invalid literal")
+		}
+		return nil
+	}
+	if p.pos >= len(p.data) || p.data[p.pos] != '"' {
+		return p.notContainer(v.Type())
+	}
+	tokenType, raw := p.parseString()
+	if tokenType != TokenString {
+		return p.tokenError("invalid string")
+	}
+	doc, ok := p.unescape(raw)
+	if !ok {
+		return &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in string"}
+	}
+	// The embedded document outlives the parser's scratch buffer
+	doc = bytes.Clone(doc)
+	if err := UnmarshalValue(doc, v, p.opts); err != nil {
+		return embeddedError(pathAt(p.data, start), err)
+	}
+	return nil
+}
+
+// embeddedError wraps err, from decoding the document in the string at path
+func embeddedError(path string, err error) *EmbeddedError {
+	e := &EmbeddedError{Path: path, Err: err, Offset: -1}
+	var syntaxErr *SyntaxError
+	var typeErr *UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		e.Offset = syntaxErr.Offset
+	} else if errors.As(err, &typeErr) && typeErr.Offset > 0 {
+		e.Offset = typeErr.Offset
+	}
+	return e
+}
+
+// unmarshalFlatField decodes the next value into a field of a flat struct
+// (see decodePlan) without the Unmarshaler and pointer checks of
+// unmarshalValue. Any other token, and numbers that need per-value option
+// handling, are rewound and decoded by unmarshalValue so results and errors
+// are the same on both paths.
+func unmarshalFlatField(p *Parser, field reflect.Value, kind reflect.Kind) error {
+	p.skipWhitespace()
+	if p.pos < len(p.data) {
+		start := p.pos
+		c := p.data[p.pos]
+		switch {
+		case kind == reflect.String && c == '"':
+			if tokenType, value := p.parseString(); tokenType == TokenString {
+				if s, ok := p.valueString(value); ok {
+					field.SetString(s)
+					return nil
+				}
+			}
+		case kind == reflect.Bool && (c == 't' || c == 'f'):
+			literal := "false"
+			if c == 't' {
+				literal = "true"
+			}
+			if p.matchLiteral(literal) {
+				field.SetBool(c == 't')
+				return nil
+			}
+		case (c == '-' || isDigit(c)) && !p.tracksPrecision():
+			if tokenType, value := p.parseNumber(); tokenType == TokenNumber && setFlatNumber(field, kind, GetString(value)) {
+				return nil
+			}
+		}
+		p.pos = start
+		p.err = nil
+	}
+	return unmarshalValue(p, field)
+}
+
+// setFlatNumber stores the number token s in a predeclared numeric field of
+// the given kind, reporting false when it does not parse or fit
+func setFlatNumber(field reflect.Value, kind reflect.Kind, s string) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || field.OverflowInt(n) {
+			return false
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || field.OverflowUint(n) {
+			return false
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, field.Type().Bits())
+		if err != nil || field.OverflowFloat(n) {
+			return false
+		}
+		field.SetFloat(n)
+	default:
+		return false
+	}
+	return true
+}
+
+// unmarshalOptional marks an Optional field present and returns its Value
+// field for decoding, or an invalid Value when the member was null
+func unmarshalOptional(p *Parser, field reflect.Value) reflect.Value {
+	p.skipWhitespace()
+	isNull := p.matchLiteral("null")
+	field.Addr().Interface().(optionalValue).setOptional(true, isNull)
+
+	value := field.Field(0)
+	if isNull {
+		value.Set(reflect.Zero(value.Type()))
+		return reflect.Value{}
+	}
+	return value
 }
 
+// unmarshalToSlice decodes an array into a slice or array the way
+// encoding/json does. A slice is truncated and refilled, reusing its backing
+// array and decoding into the elements already there, and an empty array
+// gives an empty, non-nil slice. Array elements past the end of the input
+// are zeroed.
 func unmarshalToSlice(p *Parser, v reflect.Value) error {
 	// Skip opening bracket
 	p.pos++
@@ -999,66 +2237,54 @@ func unmarshalToSlice(p *Parser, v reflect.Value) error {
 	t := v.Type()
 	elemType := t.Elem()
 
-	// For slices, create a new one; for arrays, use existing
 	isSlice := v.Kind() == reflect.Slice
-	if isSlice {
-		// Start with empty slice
-		v.Set(reflect.MakeSlice(t, 0, 4))
-	}
+	direct := getElemPlan(elemType).unmarshaler && (isSlice || v.CanAddr())
 
 	// Track array index
 	index := 0
 
 	// Process array elements
-	for p.pos < len(p.data) {
-		p.skipWhitespace()
-
-		if p.pos >= len(p.data) {
-			return &SyntaxError{Offset: int64(p.pos), Msg: "unexpected end of JSON input"}
+	for first := true; ; first = false {
+		done, err := p.nextMember(']', first)
+		if err != nil {
+			return err
 		}
-
-		// Check for end of array
-		if p.data[p.pos] == ']' {
-			p.pos++ // Skip closing bracket
-			return nil
+		if done {
+			break
 		}
 
-		// Expect a comma between elements (but not before the first element)
-		if index > 0 {
-			if p.data[p.pos] != ',' {
-				return &SyntaxError{Offset: int64(p.pos), Msg: "expected comma after array element"}
+		// Slices grow to fit; arrays must already be long enough
+		if isSlice {
+			if index >= v.Cap() {
+				v.Grow(1)
 			}
-			p.pos++ // Skip comma
-			p.skipWhitespace()
-		}
-
-		// For arrays, check if we've exceeded the length
-		if !isSlice && index >= v.Len() {
+			if index >= v.Len() {
+				v.SetLen(index + 1)
+			}
+		} else if index >= v.Len() {
 			return &UnmarshalTypeError{Value: "array", Type: t, Offset: int64(p.pos)}
 		}
 
-		// Create element value
-		var elem reflect.Value
-		if isSlice {
-			// Grow slice
-			elem = reflect.New(elemType).Elem()
-		} else {
-			// Use array element
-			elem = v.Index(index)
-		}
-
 		// Unmarshal element
-		if err := unmarshalValue(p, elem); err != nil {
+		if err := p.countElement(); err != nil {
 			return err
 		}
-
-		// For slices, append the new element
-		if isSlice {
-			v.Set(reflect.Append(v, elem))
+		if err := unmarshalElem(p, v.Index(index), direct); err != nil {
+			return err
 		}
 
 		index++
 	}
 
-	return &SyntaxError{Offset: int64(p.pos), Msg: "unexpected end of JSON input"}
+	switch {
+	case !isSlice:
+		for i := index; i < v.Len(); i++ {
+			v.Index(i).SetZero()
+		}
+	case index == 0:
+		v.Set(reflect.MakeSlice(t, 0, 0))
+	default:
+		v.SetLen(index)
+	}
+	return nil
 }
@@ -0,0 +1,4580 @@
+package apexJSON_test
+
+import (
+	"apexJSON"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unsafe"
+)
+
+func TestUnmarshalEscapedStrings(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`"plain"`, "plain"},
+		{`"line\nbreak"`, "line\nbreak"},
+		{`"quote \" and \\ slash \/"`, `quote " and \ slash /`},
+		{`"\b\f\r\t"`, "\b\f\r\t"},
+		{`"café"`, "café"},
+		{`"😀"`, "😀"},
+		{`"lone \ud83d surrogate"`, "lone � surrogate"},
+	}
+
+	for _, tt := range tests {
+		var got string
+		if err := apexJSON.Unmarshal([]byte(tt.input), &got); err != nil {
+			t.Errorf("Unmarshal(%s) error: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+
+	var s string
+	if err := apexJSON.Unmarshal([]byte(`"bad \x escape"`), &s); err == nil {
+		t.Error("expected error for invalid escape sequence")
+	}
+}
+
+func TestUnmarshalEscapedKeys(t *testing.T) {
+	type tagged struct {
+		Name string `json:"name"`
+	}
+
+	var v tagged
+	if err := apexJSON.Unmarshal([]byte(`{"name":"x"}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "x" {
+		t.Errorf("escaped struct key not matched, got %+v", v)
+	}
+
+	var m map[string]string
+	if err := apexJSON.Unmarshal([]byte(`{"a\tb":"1","cd":"2"}`), &m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"a\tb": "1", "cd": "2"}; !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+}
+
+func TestCodecReuse(t *testing.T) {
+	c := apexJSON.NewCodec()
+
+	for i := 0; i < 3; i++ {
+		var s SimpleStruct
+		if err := c.Unmarshal(simpleJSON, &s); err != nil {
+			t.Fatal(err)
+		}
+		if s != simple {
+			t.Fatalf("iteration %d: got %+v, want %+v", i, s, simple)
+		}
+
+		var esc SimpleStruct
+		if err := c.Unmarshal([]byte(`{"name":"Jörg","age":1}`), &esc); err != nil {
+			t.Fatal(err)
+		}
+		if esc.Name != "Jörg" {
+			t.Fatalf("iteration %d: got name %q", i, esc.Name)
+		}
+
+		data, err := c.Marshal(complex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded ComplexStruct
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("iteration %d: invalid output %s: %v", i, data, err)
+		}
+		if decoded.Name != complex.Name || decoded.Address.City != complex.Address.City {
+			t.Fatalf("iteration %d: round trip mismatch: %+v", i, decoded)
+		}
+	}
+}
+
+// TestCodecMatchesPackage checks that a Codec encodes and decodes as the
+// package-level functions do, with SetStdlibCompat and trace hooks
+func TestCodecMatchesPackage(t *testing.T) {
+	c := apexJSON.NewCodec()
+	values := []interface{}{
+		simple, &Address{Street: "1 <Main>", City: "Town"}, "<a&b>\u2028 bad\xff", map[string]int{"b": 1}, map[int]bool{10: true},
+		time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC), 1e21, []interface{}{nil, 1.5, "x"},
+	}
+	docs := []string{`{"NAME":"upper","age":3}`, `{"name":null,"age":null}`, string(simpleJSON)}
+
+	for _, compat := range []bool{true, false} {
+		apexJSON.SetStdlibCompat(compat)
+		for _, v := range values {
+			got, gotErr := c.Marshal(v)
+			want, wantErr := apexJSON.Marshal(v)
+			if string(got) != string(want) || fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+				t.Errorf("compat %v: Codec.Marshal(%T) = %s, %v; Marshal %s, %v", compat, v, got, gotErr, want, wantErr)
+			}
+		}
+		for _, doc := range docs {
+			got, want := SimpleStruct{Name: "before", Age: 9}, SimpleStruct{Name: "before", Age: 9}
+			gotErr := c.Unmarshal([]byte(doc), &got)
+			wantErr := apexJSON.Unmarshal([]byte(doc), &want)
+			if got != want || fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+				t.Errorf("compat %v: Codec.Unmarshal(%s) = %+v, %v; Unmarshal %+v, %v", compat, doc, got, gotErr, want, wantErr)
+			}
+		}
+	}
+
+	var encodes, decodes int
+	apexJSON.SetTraceHooks(apexJSON.Hooks{
+		OnEncodeStart: func(reflect.Type) func(int, error) { encodes++; return func(int, error) {} },
+		OnDecodeStart: func(int) func(error) { decodes++; return func(error) {} },
+	})
+	defer apexJSON.SetTraceHooks(apexJSON.Hooks{})
+	c.Marshal(simple)
+	c.Unmarshal(simpleJSON, new(SimpleStruct))
+	if encodes != 1 || decodes != 1 {
+		t.Errorf("trace hooks saw %d encodes and %d decodes, want 1 each", encodes, decodes)
+	}
+}
+
+func BenchmarkApexUnmarshalSimpleCodec(b *testing.B) {
+	c := apexJSON.NewCodec()
+	for i := 0; i < b.N; i++ {
+		var s SimpleStruct
+		_ = c.Unmarshal(simpleJSON, &s)
+	}
+}
+
+func BenchmarkApexUnmarshalComplexUserCodec(b *testing.B) {
+	c := apexJSON.NewCodec()
+	for i := 0; i < b.N; i++ {
+		var u User
+		_ = c.Unmarshal(complexUserJSON, &u)
+	}
+}
+
+func BenchmarkApexMarshalComplexCodec(b *testing.B) {
+	c := apexJSON.NewCodec()
+	for i := 0; i < b.N; i++ {
+		_, _ = c.Marshal(complex)
+	}
+}
+
+func TestMarshalAppend(t *testing.T) {
+	prefix := []byte("data: ")
+	for _, v := range []interface{}{simple, &simple, *complex.Address, []int{1, 2}, map[string]int{"a": 1}, nil} {
+		want, err := apexJSON.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Into a slice with room, which is extended in place, and into one
+		// that has to grow
+		roomy := append(make([]byte, 0, 1024), prefix...)
+		got, err := apexJSON.MarshalAppend(roomy, v)
+		if err != nil || string(got) != string(prefix)+string(want) {
+			t.Errorf("MarshalAppend(%T) = %s, %v, want %s%s", v, got, err, prefix, want)
+		}
+		if &got[0] != &roomy[0] {
+			t.Errorf("MarshalAppend(%T) reallocated a slice with enough capacity", v)
+		}
+		got, err = apexJSON.MarshalAppend(prefix[:len(prefix):len(prefix)], v)
+		if err != nil || string(got) != string(prefix)+string(want) {
+			t.Errorf("MarshalAppend(%T) growing = %s, %v", v, got, err)
+		}
+	}
+
+	if got, err := apexJSON.MarshalAppend(nil, simple); err != nil || string(got) != `{"name":"John Doe","age":30}` {
+		t.Errorf("MarshalAppend(nil) = %s, %v", got, err)
+	}
+	if got, err := apexJSON.MarshalAppend(prefix, make(chan int)); err == nil || string(got) != string(prefix) {
+		t.Errorf("MarshalAppend(chan) = %q, %v", got, err)
+	}
+
+	s, dst := &simple, make([]byte, 0, 256)
+	if n := testing.AllocsPerRun(100, func() { dst, _ = apexJSON.MarshalAppend(dst[:0], s) }); n != 0 && !raceEnabled {
+		t.Errorf("MarshalAppend allocated %v times with enough capacity", n)
+	}
+}
+
+func BenchmarkApexMarshalAppendSimple(b *testing.B) {
+	s, dst := &simple, make([]byte, 0, 256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst, _ = apexJSON.MarshalAppend(dst[:0], s)
+	}
+}
+
+type valueMarshaler struct{}
+
+func (valueMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`"value"`), nil
+}
+
+type ptrMarshaler struct{ n int }
+
+func (p *ptrMarshaler) MarshalJSON() ([]byte, error) {
+	// Dereferences the receiver, so calling it on nil would panic
+	return []byte{'"', byte('0' + p.n), '"'}, nil
+}
+
+type nilFields struct {
+	Iface     interface{}            `json:"iface"`
+	Marshaler json.Marshaler         `json:"marshaler"`
+	PtrM      *ptrMarshaler          `json:"ptr_m"`
+	Map       map[string]int         `json:"map"`
+	Slice     []string               `json:"slice"`
+	Bytes     []byte                 `json:"bytes"`
+	Nested    map[string]interface{} `json:"nested"`
+}
+
+func TestMarshalNilMatchesStdlib(t *testing.T) {
+	var nilPtrM *ptrMarshaler
+	var nilValM *valueMarshaler
+
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"untyped nil", nil},
+		{"nil pointer with value-receiver MarshalJSON", nilValM},
+		{"nil pointer with pointer-receiver MarshalJSON", nilPtrM},
+		{"nil map", map[string]int(nil)},
+		{"nil slice", []int(nil)},
+		{"nil byte slice", []byte(nil)},
+		{"empty map", map[string]int{}},
+		{"empty slice", []int{}},
+		{"empty byte slice", []byte{}},
+		{"struct of nil fields", nilFields{}},
+		{"struct with typed nil in interface", nilFields{Iface: nilPtrM}},
+		{"slice of nil interfaces", []interface{}{nil, nilPtrM, map[string]int(nil)}},
+		{"nil map in map value", map[string]interface{}{"v": map[string]interface{}(nil)}},
+		{"nil []interface{} in map value", map[string]interface{}{"v": []interface{}(nil)}},
+		{"nil []string in map value", map[string]interface{}{"v": []string(nil)}},
+		{"nil []int in map value", map[string]interface{}{"v": []int(nil)}},
+		{"nil pointer marshaler in map value", map[string]interface{}{"v": nilPtrM}},
+		{"marshaler in map value", map[string]interface{}{"v": valueMarshaler{}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, wantErr := json.Marshal(tt.value)
+			got, gotErr := apexJSON.Marshal(tt.value)
+			if (wantErr != nil) != (gotErr != nil) {
+				t.Fatalf("error mismatch: stdlib %v, apexJSON %v", wantErr, gotErr)
+			}
+			if string(got) != string(want) {
+				t.Errorf("Marshal = %s, stdlib = %s", got, want)
+			}
+		})
+	}
+
+	var nilFunc func()
+	if _, err := apexJSON.Marshal(nilFunc); err == nil {
+		t.Error("expected error marshaling a typed nil func, like encoding/json")
+	}
+}
+
+func TestUnmarshalValue(t *testing.T) {
+	// Settable value from reflect.New
+	v := reflect.New(reflect.TypeOf(SimpleStruct{})).Elem()
+	if err := apexJSON.UnmarshalValue(simpleJSON, v, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := v.Interface().(SimpleStruct); got != simple {
+		t.Errorf("got %+v, want %+v", got, simple)
+	}
+
+	// Settable field of an addressable struct
+	var holder struct{ Inner SimpleStruct }
+	field := reflect.ValueOf(&holder).Elem().Field(0)
+	if err := apexJSON.UnmarshalValue(simpleJSON, field, nil); err != nil {
+		t.Fatal(err)
+	}
+	if holder.Inner != simple {
+		t.Errorf("got %+v, want %+v", holder.Inner, simple)
+	}
+
+	// Non-nil pointer decodes into the pointee
+	var s SimpleStruct
+	if err := apexJSON.UnmarshalValue(simpleJSON, reflect.ValueOf(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s != simple {
+		t.Errorf("got %+v, want %+v", s, simple)
+	}
+
+	// Options are honored
+	iface := reflect.New(reflect.TypeOf((*interface{})(nil)).Elem()).Elem()
+	if err := apexJSON.UnmarshalValue([]byte(`12345678901234567890`), iface, &apexJSON.Options{UseNumber: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := iface.Interface().(apexJSON.Number); !ok || got != "12345678901234567890" {
+		t.Errorf("UseNumber: got %#v", iface.Interface())
+	}
+}
+
+func TestUnmarshalValueInvalidDestination(t *testing.T) {
+	var nilPtr *SimpleStruct
+	tests := []struct {
+		name string
+		v    reflect.Value
+		msg  string
+	}{
+		{"invalid value", reflect.Value{}, "json: Unmarshal(nil)"},
+		{"unaddressable value", reflect.ValueOf(SimpleStruct{}), "json: Unmarshal(unsettable apexJSON_test.SimpleStruct)"},
+		{"nil pointer", reflect.ValueOf(nilPtr), "json: Unmarshal(unsettable *apexJSON_test.SimpleStruct)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := apexJSON.UnmarshalValue(simpleJSON, tt.v, nil)
+			var invalid *apexJSON.InvalidUnmarshalError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("expected InvalidUnmarshalError, got %v", err)
+			}
+			if err.Error() != tt.msg {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.msg)
+			}
+		})
+	}
+
+	for _, dst := range []interface{}{nil, SimpleStruct{}, nilPtr} {
+		want := json.Unmarshal(simpleJSON, dst)
+		got := apexJSON.Unmarshal(simpleJSON, dst)
+		if got == nil || got.Error() != want.Error() {
+			t.Errorf("Unmarshal(%T) error = %v, want %v", dst, got, want)
+		}
+	}
+}
+
+func TestUnmarshalPointerFields(t *testing.T) {
+	var c ComplexStruct
+	if err := apexJSON.Unmarshal(complexJSON, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Address == nil || *c.Address != *complex.Address {
+		t.Errorf("Address = %+v, want %+v", c.Address, complex.Address)
+	}
+
+	if err := apexJSON.Unmarshal([]byte(`{"address":null}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != nil {
+		t.Errorf("null should reset pointer, got %+v", c.Address)
+	}
+}
+
+func TestMarshalValue(t *testing.T) {
+	buf := &apexJSON.Buffer{}
+	if err := apexJSON.MarshalValue(reflect.ValueOf(simple), buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf.Bytes()) != string(simpleJSON) {
+		t.Errorf("got %s, want %s", buf.Bytes(), simpleJSON)
+	}
+
+	buf.Reset()
+	if err := apexJSON.MarshalValue(reflect.Value{}, buf); err != nil || string(buf.Bytes()) != "null" {
+		t.Errorf("invalid value: got %s, %v", buf.Bytes(), err)
+	}
+
+	if err := apexJSON.MarshalValue(reflect.ValueOf(simple), nil); err == nil {
+		t.Error("expected error for nil Buffer")
+	}
+}
+
+func TestMarshalIndent(t *testing.T) {
+	type doc struct {
+		Name    string                 `json:"name"`
+		Empty   []int                  `json:"empty"`
+		NoKeys  map[string]int         `json:"no_keys"`
+		Ints    []int                  `json:"ints"`
+		Matrix  [][]float64            `json:"matrix"`
+		Attrs   map[string]interface{} `json:"attrs"`
+		Labels  map[string]string      `json:"labels"`
+		ByCode  map[int]string         `json:"by_code"`
+		Items   []interface{}          `json:"items"`
+		Address Address                `json:"address"`
+		Raw     apexJSON.RawMessage    `json:"raw"`
+		Skipped struct{}               `json:"skipped"`
+	}
+	value := doc{
+		Name:   "a\"b",
+		Empty:  []int{},
+		NoKeys: map[string]int{},
+		Ints:   []int{1, 2},
+		Matrix: [][]float64{{1.5}, {}},
+		Attrs:  map[string]interface{}{"inner": []interface{}{map[string]interface{}{}, []string{"x"}}},
+		Labels: map[string]string{"env": "prod"},
+		ByCode: map[int]string{200: "ok"},
+		Items:  []interface{}{valueMarshaler{}, nil},
+		Raw:    apexJSON.RawMessage(`{ "k" : [ 1 , {} , "a b,:" ] , "e" : [ ] }`),
+	}
+
+	for _, tt := range []struct{ prefix, indent string }{{"", "  "}, {"> ", "\t"}, {"", ""}} {
+		got, err := apexJSON.MarshalIndent(value, tt.prefix, tt.indent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.MarshalIndent(value, tt.prefix, tt.indent)
+		if string(got) != string(want) {
+			t.Errorf("prefix %q indent %q:\n%s\nwant\n%s", tt.prefix, tt.indent, got, want)
+		}
+	}
+
+	// Scalars and empty containers have a single line, and compact
+	// encoding is unaffected by an earlier indented one on a pooled buffer
+	for _, v := range []interface{}{42, "s", []int{}, map[string]int{}, nil} {
+		got, _ := apexJSON.MarshalIndent(v, "> ", "  ")
+		want, _ := json.MarshalIndent(v, "> ", "  ")
+		if string(got) != string(want) {
+			t.Errorf("MarshalIndent(%v) = %s, want %s", v, got, want)
+		}
+	}
+	if got, _ := apexJSON.Marshal(value.Ints); string(got) != "[1,2]" {
+		t.Errorf("Marshal after MarshalIndent = %s", got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	valid := []string{
+		"  {\n\t\"a b\" : [ 1 , 2.5e3 , true , null ] ,\r\n \"s\\\" \\\\\" : \" x\\t y \" }\n",
+		`[ ]`,
+		` "  spaced  " `,
+		`-0.5`,
+		`{"nested":{ "k" : [ { } , [ [ ] ] ] }}`,
+	}
+	for _, in := range valid {
+		var got apexJSON.Buffer
+		got.Write([]byte("prefix:"))
+		if err := apexJSON.Compact(&got, []byte(in)); err != nil {
+			t.Errorf("Compact(%q): %v", in, err)
+			continue
+		}
+		var want bytes.Buffer
+		want.WriteString("prefix:")
+		json.Compact(&want, []byte(in))
+		if string(got.Bytes()) != want.String() {
+			t.Errorf("Compact(%q) = %q, want %q", in, got.Bytes(), want.String())
+		}
+	}
+
+	invalid := []struct {
+		in     string
+		offset int64
+	}{
+		{`{"a": 1,}`, 8},
+		{`[1 2]`, 3},
+		{`{"a" 1}`, 5},
+		{"[\"a\nb\"]", 3},
+		{`{"a": [1, 2`, 11},
+		{`{} x`, 3},
+	}
+	for _, tt := range invalid {
+		var got apexJSON.Buffer
+		err := apexJSON.Compact(&got, []byte(tt.in))
+		var se *apexJSON.SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("Compact(%q) = %v, want a SyntaxError", tt.in, err)
+			continue
+		}
+		if se.Offset != tt.offset {
+			t.Errorf("Compact(%q) offset = %d, want %d (%v)", tt.in, se.Offset, tt.offset, err)
+		}
+		if len(got.Bytes()) != 0 {
+			t.Errorf("Compact(%q) wrote %q on error", tt.in, got.Bytes())
+		}
+	}
+}
+
+func TestIndent(t *testing.T) {
+	valid := []string{
+		`{"z":1,"a":[12345678901234567890,1.50e+3,-0],"m":{ },"s":"{[\"x\",: ]}\\"}`,
+		"  [ [ ] , { \"k\" : null } , true ]\n",
+		`"plain"`,
+		`0`,
+	}
+	for _, in := range valid {
+		for _, tt := range []struct{ prefix, indent string }{{"", "  "}, {"> ", "\t"}} {
+			var got apexJSON.Buffer
+			got.Write([]byte("prefix:"))
+			if err := apexJSON.Indent(&got, []byte(in), tt.prefix, tt.indent); err != nil {
+				t.Errorf("Indent(%q): %v", in, err)
+				continue
+			}
+			var want bytes.Buffer
+			want.WriteString("prefix:")
+			json.Indent(&want, bytes.TrimSpace([]byte(in)), tt.prefix, tt.indent)
+			if string(got.Bytes()) != want.String() {
+				t.Errorf("Indent(%q, %q, %q):\n%s\nwant\n%s", in, tt.prefix, tt.indent, got.Bytes(), want.String())
+			}
+		}
+	}
+
+	var got apexJSON.Buffer
+	err := apexJSON.Indent(&got, []byte(`{"a":[1,2}`), "", "  ")
+	var se *apexJSON.SyntaxError
+	if !errors.As(err, &se) || se.Offset != 9 {
+		t.Errorf("Indent of malformed input = %v, want a SyntaxError at offset 9", err)
+	}
+	if len(got.Bytes()) != 0 {
+		t.Errorf("Indent wrote %q on error", got.Bytes())
+	}
+
+	// Indenting leaves later compact encodes on the same buffer alone
+	if err := apexJSON.Compact(&got, []byte(`[ 1 ]`)); err != nil || string(got.Bytes()) != "[1]" {
+		t.Errorf("Compact after a failed Indent = %q, %v", got.Bytes(), err)
+	}
+}
+
+// protoKeys has a struct field, map entries and Unknown members keyed so
+// DangerousKeyPolicy applies to them
+type protoKeys struct {
+	Proto   string                 `json:"__proto__"`
+	Name    string                 `json:"name"`
+	Ctor    map[string]int         `json:"constructor,omitempty"`
+	Nested  map[string]interface{} `json:"nested"`
+	ByID    map[protoID]string     `json:"by_id,omitempty"`
+	Unknown apexJSON.Unknown
+}
+
+type protoID int
+
+func (id protoID) MarshalText() ([]byte, error) {
+	if id == 0 {
+		return []byte("prototype"), nil
+	}
+	return []byte(strconv.Itoa(int(id))), nil
+}
+
+func TestDangerousKeyPolicy(t *testing.T) {
+	v := protoKeys{
+		Proto: "p", Name: "n",
+		Nested: map[string]interface{}{
+			"__proto__": map[string]bool{"admin": true},
+			"safe":      []interface{}{map[string]interface{}{"constructor": 1, "ok": 2}},
+		},
+		ByID:    map[protoID]string{0: "x", 1: "y"},
+		Unknown: apexJSON.Unknown{"prototype": apexJSON.RawMessage(`1`), "extra": apexJSON.RawMessage(`{"__proto__":{}}`)},
+	}
+	allowed := `{"__proto__":"p","name":"n","nested":{"__proto__":{"admin":true},"safe":[{"constructor":1,"ok":2}]},` +
+		`"by_id":{"1":"y","prototype":"x"},"extra":{"__proto__":{}},"prototype":1}`
+	stripped := `{"name":"n","nested":{"safe":[{"ok":2}]},"by_id":{"1":"y"},"extra":{"__proto__":{}}}`
+
+	for _, tt := range []struct {
+		policy apexJSON.KeyPolicy
+		want   string
+	}{{apexJSON.KeysAllow, allowed}, {apexJSON.KeysStrip, stripped}} {
+		opts := apexJSON.MarshalOptions{DangerousKeyPolicy: tt.policy, SortMapKeys: true}
+		if got, err := apexJSON.MarshalWithOptions(v, opts); err != nil || string(got) != tt.want {
+			t.Errorf("policy %d: Marshal = %s, %v, want %s", tt.policy, got, err, tt.want)
+		}
+	}
+
+	// Without SortMapKeys the members left are the same
+	got, err := apexJSON.MarshalWithOptions(v, apexJSON.MarshalOptions{DangerousKeyPolicy: apexJSON.KeysStrip})
+	var back, want interface{}
+	json.Unmarshal(got, &back)
+	json.Unmarshal([]byte(stripped), &want)
+	if err != nil || !reflect.DeepEqual(back, want) {
+		t.Errorf("unsorted Marshal = %s, %v, want %s", got, err, stripped)
+	}
+
+	// Under KeysError the first dangerous key anywhere fails the encode
+	errorOpts := apexJSON.MarshalOptions{DangerousKeyPolicy: apexJSON.KeysError}
+	for _, v := range []interface{}{
+		v, protoKeys{Ctor: map[string]int{}}, map[string]string{"constructor": "c"},
+		[]map[string]interface{}{{"a": map[string]int{"__proto__": 1}}}, map[protoID]int{0: 1},
+		protoKeys{Unknown: apexJSON.Unknown{"prototype": nil}},
+	} {
+		_, err := apexJSON.MarshalWithOptions(v, errorOpts)
+		var keyErr *apexJSON.DangerousKeyError
+		if !errors.As(err, &keyErr) || !strings.Contains(err.Error(), keyErr.Key) {
+			t.Errorf("Marshal(%T) under KeysError = %v", v, err)
+		}
+	}
+	if got, err := apexJSON.MarshalWithOptions(map[string]int{"proto": 1, "Constructor": 2}, errorOpts); err != nil {
+		t.Errorf("Marshal of safe keys under KeysError = %s, %v", got, err)
+	}
+}
+
+func TestTranscodeBytes(t *testing.T) {
+	strip := apexJSON.MarshalOptions{DangerousKeyPolicy: apexJSON.KeysStrip}
+	tests := []struct{ in, want string }{
+		{` { "a" : 1 , "__proto__" : { "x" : [1, {"y":2}] } } `, `{"a":1}`},
+		{`{"__proto__":1}`, `{}`},
+		{`{"__proto__":1,"a":[{"constructor":{},"b":"\u005f"}],"prototype":null}`, `{"a":[{"b":"\u005f"}]}`},
+		// Escaped spellings are matched as decoded
+		{`{"\u005f_proto__":{"polluted":true},"k":"v"}`, `{"k":"v"}`},
+		{`{"\u005F\u005Fproto\u005f\u005f":1,"cons\u0074ructor":2,"proto\/type":3}`, `{"proto\/type":3}`},
+		{`[{"a":{"b":{"__proto__":1,"c":2}}},"__proto__",{"__proto__":[]}]`, `[{"a":{"b":{"c":2}}},"__proto__",{}]`},
+		{` "x" `, `"x"`},
+		{`[ ]`, `[]`},
+	}
+	for _, tt := range tests {
+		got, err := apexJSON.TranscodeBytes([]byte(tt.in), strip)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("TranscodeBytes(%s) = %s, %v, want %s", tt.in, got, err, tt.want)
+		}
+
+		// Allow only compacts
+		var compact bytes.Buffer
+		json.Compact(&compact, []byte(tt.in))
+		if got, err := apexJSON.TranscodeBytes([]byte(tt.in), apexJSON.MarshalOptions{}); err != nil || string(got) != compact.String() {
+			t.Errorf("TranscodeBytes(%s) allowing = %s, %v, want %s", tt.in, got, err, compact.String())
+		}
+	}
+
+	var keyErr *apexJSON.DangerousKeyError
+	_, err := apexJSON.TranscodeBytes([]byte(`[{"a":{"\u005f_proto__":1}}]`), apexJSON.MarshalOptions{DangerousKeyPolicy: apexJSON.KeysError})
+	if !errors.As(err, &keyErr) || keyErr.Key != "__proto__" {
+		t.Errorf("TranscodeBytes under KeysError = %v", err)
+	}
+	var syntaxErr *apexJSON.SyntaxError
+	if _, err := apexJSON.TranscodeBytes([]byte(`{"__proto__":1,}`), strip); !errors.As(err, &syntaxErr) {
+		t.Errorf("TranscodeBytes of invalid JSON = %v, want SyntaxError", err)
+	}
+}
+
+func TestUnmarshalNumberRange(t *testing.T) {
+	tokens := []string{
+		"1e400", "-1e400", "1e-400", "3.5e38", "-3.5e38",
+		"9223372036854775807", "9223372036854775808", "-9223372036854775808", "-9223372036854775809",
+		"18446744073709551615", "18446744073709551616",
+	}
+	kinds := []interface{}{
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), new(interface{}),
+	}
+
+	for _, tok := range tokens {
+		for _, k := range kinds {
+			typ := reflect.TypeOf(k)
+			if typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+			// A flat struct takes the fast path, a slice the general one
+			flat := reflect.StructOf([]reflect.StructField{{Name: "V", Type: typ}})
+			for _, dst := range []reflect.Type{flat, reflect.SliceOf(typ)} {
+				in := `{"V":` + tok + `}`
+				if dst.Kind() == reflect.Slice {
+					in = "[" + tok + "]"
+				}
+				got := reflect.New(dst)
+				err := apexJSON.Unmarshal([]byte(in), got.Interface())
+				want := reflect.New(dst)
+				stdErr := json.Unmarshal([]byte(in), want.Interface())
+
+				// Overflow is reported as such; numbers of the wrong form
+				// for an integer are plain type errors
+				rangeErr := !strings.ContainsAny(tok, ".eE") && (typ.Kind() < reflect.Uint || typ.Kind() > reflect.Uint64 || tok[0] != '-')
+				if typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64 || typ.Kind() == reflect.Interface {
+					rangeErr = true
+				}
+
+				switch {
+				case (err == nil) != (stdErr == nil):
+					t.Errorf("%s into %v: error %v, encoding/json %v", tok, dst, err, stdErr)
+				case err == nil && !reflect.DeepEqual(got.Elem().Interface(), want.Elem().Interface()):
+					t.Errorf("%s into %v = %v, want %v", tok, dst, got.Elem(), want.Elem())
+				case err != nil && strings.Contains(err.Error(), "out of range") != rangeErr:
+					t.Errorf("%s into %v: %v, want range error %v", tok, dst, err, rangeErr)
+				}
+			}
+		}
+	}
+
+	// interface{} values never hold an infinity, however they are built
+	for _, in := range []string{`1e400`, `[-1e400]`, `{"a":{"b":1e400}}`} {
+		var v interface{}
+		if err := apexJSON.Unmarshal([]byte(in), &v); err == nil || !strings.Contains(err.Error(), "number 1e400 (out of range)") && !strings.Contains(err.Error(), "number -1e400 (out of range)") {
+			t.Errorf("Unmarshal(%s) = %v, %v", in, v, err)
+		}
+	}
+	var m map[string]interface{}
+	if err := apexJSON.Unmarshal([]byte(`{"a":1e400}`), &m); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("map value: %v, %v", m, err)
+	}
+	var f float64
+	if err := apexJSON.Unmarshal([]byte(`1e-400`), &f); err != nil || f != 0 {
+		t.Errorf("underflow: %v, %v", f, err)
+	}
+}
+
+type patchRequest struct {
+	Age     apexJSON.Optional[int]     `json:"age"`
+	Name    apexJSON.Optional[string]  `json:"name"`
+	Address apexJSON.Optional[Address] `json:"address"`
+}
+
+func TestOptionalPresence(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		present [3]bool
+		null    [3]bool
+	}{
+		{"absent", `{}`, [3]bool{}, [3]bool{}},
+		{"null", `{"age":null,"name":null,"address":null}`, [3]bool{true, true, true}, [3]bool{true, true, true}},
+		{"zero", `{"age":0,"name":"","address":{}}`, [3]bool{true, true, true}, [3]bool{}},
+		{"non-zero", `{"age":42,"name":"Ann","address":{"city":"Oslo"}}`, [3]bool{true, true, true}, [3]bool{}},
+		{"mixed", `{"name": null , "age":7}`, [3]bool{true, true, false}, [3]bool{false, true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req patchRequest
+			if err := apexJSON.Unmarshal([]byte(tt.input), &req); err != nil {
+				t.Fatal(err)
+			}
+			present := [3]bool{req.Age.Present, req.Name.Present, req.Address.Present}
+			null := [3]bool{req.Age.Null, req.Name.Null, req.Address.Null}
+			if present != tt.present || null != tt.null {
+				t.Errorf("present = %v, null = %v; want %v, %v", present, null, tt.present, tt.null)
+			}
+
+			if tt.name == "non-zero" {
+				if req.Age.Value != 42 || req.Name.Value != "Ann" || req.Address.Value.City != "Oslo" {
+					t.Errorf("values not decoded: %+v", req)
+				}
+			}
+			if tt.name == "mixed" && req.Age.Value != 7 {
+				t.Errorf("age = %d, want 7", req.Age.Value)
+			}
+
+			// Marshaling writes back exactly the members that were present
+			out, err := apexJSON.Marshal(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var roundTrip patchRequest
+			if err := apexJSON.Unmarshal(out, &roundTrip); err != nil {
+				t.Fatalf("invalid output %s: %v", out, err)
+			}
+			if roundTrip != req {
+				t.Errorf("round trip through %s: got %+v, want %+v", out, roundTrip, req)
+			}
+		})
+	}
+}
+
+func TestOptionalMarshal(t *testing.T) {
+	req := patchRequest{
+		Age:  apexJSON.Optional[int]{Value: 0, Present: true},
+		Name: apexJSON.Optional[string]{Present: true, Null: true},
+	}
+	out, err := apexJSON.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"age":0,"name":null}`; string(out) != want {
+		t.Errorf("Marshal = %s, want %s", out, want)
+	}
+
+	// Outside of a struct an Optional marshals through its own methods
+	out, err = apexJSON.Marshal([]apexJSON.Optional[int]{{Value: 3, Present: true}, {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[3,null]`; string(out) != want {
+		t.Errorf("Marshal = %s, want %s", out, want)
+	}
+}
+
+func TestUnmarshalTokenLimits(t *testing.T) {
+	opts := &apexJSON.Options{MaxStringBytes: 8, MaxNumberBytes: 4}
+	tests := []struct {
+		name   string
+		input  string
+		into   interface{}
+		offset int64
+		limit  string
+	}{
+		{"string", `{"name":"0123456789"}`, &SimpleStruct{}, 17, "MaxStringBytes"},
+		{"key", `{"0123456789":1}`, &map[string]int{}, 10, "MaxStringBytes"},
+		{"skipped", `{"other":"0123456789","age":1}`, &SimpleStruct{}, 18, "MaxStringBytes"},
+		{"number", `{"age":123456}`, &SimpleStruct{}, 11, "MaxNumberBytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := reflect.ValueOf(tt.into)
+			err := apexJSON.UnmarshalValue([]byte(tt.input), v, opts)
+			var syntaxErr *apexJSON.SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("got %v, want *SyntaxError", err)
+			}
+			if syntaxErr.Offset != tt.offset || !strings.Contains(syntaxErr.Msg, tt.limit) {
+				t.Errorf("got offset %d %q, want offset %d naming %s", syntaxErr.Offset, syntaxErr.Msg, tt.offset, tt.limit)
+			}
+		})
+	}
+
+	// Tokens exactly at the limit are accepted
+	var s SimpleStruct
+	if err := apexJSON.UnmarshalValue([]byte(`{"name":"01234567","age":1234}`), reflect.ValueOf(&s), opts); err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "01234567" || s.Age != 1234 {
+		t.Errorf("got %+v", s)
+	}
+
+	// Limits are off by default
+	long := `{"name":"` + strings.Repeat("x", 1<<16) + `"}`
+	if err := apexJSON.Unmarshal([]byte(long), &s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecoderStringLimit(t *testing.T) {
+	d := apexJSON.NewDecoder(strings.NewReader(`{"name":"ok"} {"name":"` + strings.Repeat("x", 4096) + `"}`))
+	d.SetOptions(apexJSON.Options{MaxStringBytes: 16})
+
+	var s SimpleStruct
+	if err := d.Decode(&s); err != nil || s.Name != "ok" {
+		t.Fatalf("first value: %+v, %v", s, err)
+	}
+	err := d.Decode(&s)
+	var syntaxErr *apexJSON.SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != 39 {
+		t.Fatalf("got %v, want SyntaxError at offset 39", err)
+	}
+}
+
+// splitReader delivers its data in chunks ending at the given offsets,
+// one chunk per Read, however much room the caller has
+type splitReader struct {
+	data []byte
+	cuts []int
+	pos  int
+}
+
+func (r *splitReader) Read(b []byte) (int, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.EOF
+	}
+	end := len(r.data)
+	for len(r.cuts) > 0 {
+		if cut := r.cuts[0]; cut > r.pos {
+			end = cut
+			break
+		}
+		r.cuts = r.cuts[1:]
+	}
+	n := copy(b, r.data[r.pos:end])
+	r.pos += n
+	return n, nil
+}
+
+// decodeAll decodes every value in the stream r into interface{} values
+func decodeAll(r io.Reader) ([]interface{}, error) {
+	d := apexJSON.NewDecoder(r)
+	defer d.Close()
+	var values []interface{}
+	for {
+		var v interface{}
+		if err := d.Decode(&v); err == io.EOF {
+			return values, nil
+		} else if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+}
+
+// chunkStreams are streams of values whose tokens land on every kind of
+// read boundary when split at each byte
+var chunkStreams = []string{
+	`{"a":"x\u00e9\"y\\","n":-12.5e+3,"t":true,"f":false,"z":null,"arr":[1,"\\",{},[]]}`,
+	`1 -2.5E-3 0 true false null "s\u0041\ud83d\ude00" [1,2] {"k":[]}`,
+	`12345`,
+	`-0.5e10`,
+	`true`,
+	`null`,
+	`"\u00e9"`,
+	`[ 1 , 2 ]` + "\n" + `"a""b"{}[]3`,
+	"\t{\"k\": \"\\/\\b\\f\\n\\r\\t\"}\r\n 7 ",
+	`{"a":1}{"b":2}`,
+	`[10,"x",[-1e2]]`,
+
+	// Scalars end by grammar, without a delimiter after them
+	`1[2]1"a"1{}`,
+	`true"x"null[]"a"1`,
+	`1-2 01 -0.0e-0`,
+	`truefalsenull`,
+	`[` + strings.Repeat(`"`+strings.Repeat("s", 1100)+`\"",`, 4) + `1]`,
+}
+
+// badStreams hold a malformed or truncated value somewhere
+var badStreams = []string{
+	`{"a":1`,
+	`[1,2`,
+	`"abc`,
+	`"ab\u00`,
+	`tru`,
+	`nul`,
+	`-`,
+	`1.`,
+	`1e`,
+	`1 2 x`,
+	`"a" "b\`,
+	`{"a":"\u12"}`,
+	`[1]]`,
+	`1.5e3e`,
+	`nulll`,
+	`1.e5`,
+	`-x`,
+	`[` + strings.Repeat(`"abc",`, 1000),
+}
+
+// TestDecoderChunkBoundaries feeds each stream to a Decoder split into two
+// reads at every offset, and one byte at a time, and requires the same
+// values and errors as reading it whole
+func TestDecoderChunkBoundaries(t *testing.T) {
+	for _, doc := range chunkStreams {
+		want, err := decodeAll(strings.NewReader(doc))
+		if err != nil {
+			t.Fatalf("%s: %v", doc, err)
+		}
+
+		// The values must be what encoding/json sees in the stream
+		var std []interface{}
+		sd := json.NewDecoder(strings.NewReader(doc))
+		for sd.More() {
+			var v interface{}
+			if err := sd.Decode(&v); err != nil {
+				t.Fatalf("%s: encoding/json: %v", doc, err)
+			}
+			std = append(std, v)
+		}
+		if !reflect.DeepEqual(want, std) {
+			t.Fatalf("%s: got %v, encoding/json %v", doc, want, std)
+		}
+
+		for cut := 1; cut < len(doc); cut++ {
+			for _, r := range []io.Reader{
+				&splitReader{data: []byte(doc), cuts: []int{cut}},
+				iotest.DataErrReader(&splitReader{data: []byte(doc), cuts: []int{cut}}),
+			} {
+				got, err := decodeAll(r)
+				if err != nil || !reflect.DeepEqual(got, want) {
+					t.Errorf("%q | %q: got %v, %v", doc[:cut], doc[cut:], got, err)
+				}
+			}
+		}
+		got, err := decodeAll(iotest.OneByteReader(strings.NewReader(doc)))
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s one byte at a time: got %v, %v", doc, got, err)
+		}
+	}
+
+	for _, doc := range badStreams {
+		want, wantErr := decodeAll(strings.NewReader(doc))
+		if wantErr == nil {
+			t.Fatalf("%s: no error", doc)
+		}
+		for cut := 1; cut < len(doc); cut++ {
+			got, err := decodeAll(&splitReader{data: []byte(doc), cuts: []int{cut}})
+			if !reflect.DeepEqual(got, want) || err == nil || err.Error() != wantErr.Error() {
+				t.Errorf("%q | %q: got %v, %v, want %v, %v", doc[:cut], doc[cut:], got, err, want, wantErr)
+			}
+		}
+	}
+}
+
+func TestDecoderErrorOffsets(t *testing.T) {
+	stream := "{\"id\":1}\n{\"id\":2}\n  {\"id\":3,\"name\":x}"
+	d := apexJSON.NewDecoder(strings.NewReader(stream))
+	var v ComplexStruct
+	for i := 0; i < 2; i++ {
+		if err := d.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fmt.Errorf("third value: %w", d.Decode(&v))
+	var syntaxErr *apexJSON.SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != int64(strings.IndexByte(stream, 'x')) {
+		t.Errorf("Decode = %v, want a SyntaxError at offset %d", err, strings.IndexByte(stream, 'x'))
+	}
+
+	// Type errors are moved into the stream the same way, to just past
+	// the value that didn't fit
+	stream = `{"id":1} {"id":"two"}`
+	d = apexJSON.NewDecoder(strings.NewReader(stream))
+	_ = d.Decode(&v)
+	err = d.Decode(&v)
+	want := int64(strings.Index(stream, `"two"`) + len(`"two"`))
+	var typeErr *apexJSON.UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Offset != want {
+		t.Errorf("Decode = %v, want an UnmarshalTypeError at offset %d", err, want)
+	}
+}
+
+func TestAtomicDecode(t *testing.T) {
+	before := ComplexStruct{
+		ID:       1,
+		Name:     "before",
+		Tags:     []string{"a"},
+		Metadata: map[string]interface{}{"k": "v"},
+		Address:  &Address{City: "Old"},
+	}
+	// Each input is broken only after fields that would otherwise be stored
+	inputs := []string{
+		`{"id":2,"name":"after","tags":["b","c"],"metadata":{"k":"w"},"address":{"city":"New"},"score":}`,
+		`{"id":2,"name":"after","tags":["b",`,
+		`{"id":2,"address":{"city":"New"}} trailing`,
+	}
+
+	for _, in := range inputs {
+		dst := before
+		dst.Tags = append([]string(nil), before.Tags...)
+		dst.Metadata = map[string]interface{}{"k": "v"}
+		dst.Address = &Address{City: "Old"}
+
+		opts := apexJSON.Options{AtomicDecode: true}
+		err := apexJSON.UnmarshalValue([]byte(in), reflect.ValueOf(&dst), &opts)
+		var syntaxErr *apexJSON.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("%s: got %v, want a SyntaxError", in, err)
+		}
+		if !reflect.DeepEqual(dst, before) {
+			t.Errorf("%s: destination changed to %+v (address %+v)", in, dst, dst.Address)
+		}
+
+		// Without the option the same input is partly applied
+		partial := ComplexStruct{Name: "before"}
+		if apexJSON.Unmarshal([]byte(in), &partial) == nil || partial.Name == "before" && partial.ID == 0 {
+			t.Errorf("%s: plain Unmarshal = %+v, expected a partial decode", in, partial)
+		}
+	}
+
+	// The Decoder checks each value on its own
+	d := apexJSON.NewDecoder(strings.NewReader(`{"id":3,"name":"ok"} {"id":4,"name":"bad","score":tru}`))
+	d.SetAtomicDecode(true)
+	var s ComplexStruct
+	if err := d.Decode(&s); err != nil || s.ID != 3 {
+		t.Fatalf("first value: %+v, %v", s, err)
+	}
+	if err := d.Decode(&s); err == nil {
+		t.Fatal("second value decoded")
+	}
+	if s.ID != 3 || s.Name != "ok" {
+		t.Errorf("Decode changed the destination to %+v", s)
+	}
+}
+
+type pollState struct {
+	Seq     int               `json:"seq"`
+	Status  string            `json:"status"`
+	Samples []int             `json:"samples"`
+	Points  []Address         `json:"points"`
+	Labels  map[string]string `json:"labels"`
+	Window  [3]int            `json:"window"`
+	Next    *Address          `json:"next"`
+}
+
+func TestZeroBeforeDecode(t *testing.T) {
+	first := `{"seq":1,"status":"up","samples":[1,2,3],"points":[{"city":"A","zip":"1"},{"city":"B"}],` +
+		`"labels":{"a":"1"},"window":[1,2,3],"next":{"city":"N"}}`
+	second := `{"seq":2,"samples":[9],"points":[{"city":"C"}],"labels":{"b":"2"},"window":[7]}`
+
+	// By default members absent from the second document keep their values,
+	// and slices, maps and structs are decoded into, as with encoding/json
+	var s pollState
+	if err := apexJSON.Unmarshal([]byte(first), &s); err != nil {
+		t.Fatal(err)
+	}
+	samples := s.Samples
+	if err := apexJSON.Unmarshal([]byte(second), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Seq != 2 || s.Status != "up" || s.Next == nil || s.Next.City != "N" {
+		t.Errorf("scalar fields = %+v", s)
+	}
+	if !reflect.DeepEqual(s.Samples, []int{9}) || &s.Samples[0] != &samples[0] {
+		t.Errorf("samples = %v, want [9] reusing the backing array", s.Samples)
+	}
+	if len(s.Points) != 1 || s.Points[0].City != "C" || s.Points[0].Zip != "1" {
+		t.Errorf("points = %+v, want the first element decoded into", s.Points)
+	}
+	if !reflect.DeepEqual(s.Labels, map[string]string{"a": "1", "b": "2"}) {
+		t.Errorf("labels = %v, want merged", s.Labels)
+	}
+	if s.Window != [3]int{7, 0, 0} {
+		t.Errorf("window = %v, want the rest zeroed", s.Window)
+	}
+
+	var std pollState
+	json.Unmarshal([]byte(first), &std)
+	json.Unmarshal([]byte(second), &std)
+	if !reflect.DeepEqual(s, std) {
+		t.Errorf("got %+v\nencoding/json %+v", s, std)
+	}
+
+	// With ZeroBeforeDecode only the second document shows
+	opts := apexJSON.Options{ZeroBeforeDecode: true}
+	if err := apexJSON.UnmarshalValue([]byte(second), reflect.ValueOf(&s), &opts); err != nil {
+		t.Fatal(err)
+	}
+	var want pollState
+	json.Unmarshal([]byte(second), &want)
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("ZeroBeforeDecode: got %+v, want %+v", s, want)
+	}
+	if s.Status != "" || s.Next != nil || s.Points[0].Zip != "" || len(s.Labels) != 1 {
+		t.Errorf("ZeroBeforeDecode kept stale values: %+v", s)
+	}
+
+	// An empty array still gives an empty, non-nil slice, and with
+	// AtomicDecode malformed input doesn't zero the destination
+	d := apexJSON.NewDecoder(strings.NewReader(`{"samples":[]} {"seq":`))
+	d.SetOptions(apexJSON.Options{ZeroBeforeDecode: true, AtomicDecode: true})
+	if err := d.Decode(&s); err != nil || s.Samples == nil || len(s.Samples) != 0 || s.Seq != 0 {
+		t.Fatalf("first value: %+v, %v", s, err)
+	}
+	s.Seq = 5
+	if err := d.Decode(&s); err == nil || s.Seq != 5 {
+		t.Errorf("malformed value: %+v, %v", s, err)
+	}
+}
+
+type coercedRecord struct {
+	Zip    string  `json:"zip"`
+	Count  int     `json:"count"`
+	Small  uint8   `json:"small"`
+	Ratio  float64 `json:"ratio"`
+	Active bool    `json:"active"`
+}
+
+func TestWeakTypeCoercion(t *testing.T) {
+	tests := []struct {
+		input string
+		mode  apexJSON.Coercion
+		want  coercedRecord
+		err   string // substring of the expected error, "" for success
+	}{
+		// Numbers into strings keep the literal text
+		{`{"zip":12345}`, apexJSON.CoerceNumberToString, coercedRecord{Zip: "12345"}, ""},
+		{`{"zip":-42}`, apexJSON.CoerceNumberToString, coercedRecord{Zip: "-42"}, ""},
+		{`{"zip":1.5e-3}`, apexJSON.CoerceNumberToString, coercedRecord{Zip: "1.5e-3"}, ""},
+		{`{"zip":-2E+10}`, apexJSON.CoerceNumberToString, coercedRecord{Zip: "-2E+10"}, ""},
+		{`{"zip":12345}`, apexJSON.CoerceAll &^ apexJSON.CoerceNumberToString, coercedRecord{}, "cannot unmarshal"},
+
+		// Strings into numbers
+		{`{"count":"-17"}`, apexJSON.CoerceStringToNumber, coercedRecord{Count: -17}, ""},
+		{`{"ratio":"2.5e2"}`, apexJSON.CoerceStringToNumber, coercedRecord{Ratio: 250}, ""},
+		{`{"small":"200"}`, apexJSON.CoerceStringToNumber, coercedRecord{Small: 200}, ""},
+		{`{"small":"300"}`, apexJSON.CoerceStringToNumber, coercedRecord{}, "weak coercion to number failed"},
+		{`{"count":"12abc"}`, apexJSON.CoerceStringToNumber, coercedRecord{}, "weak coercion to number failed"},
+		{`{"count":" 12"}`, apexJSON.CoerceStringToNumber, coercedRecord{}, "weak coercion to number failed"},
+		{`{"count":"1.5"}`, apexJSON.CoerceStringToNumber, coercedRecord{}, "weak coercion to number failed"},
+		{`{"count":"12"}`, apexJSON.CoerceStringToBool, coercedRecord{}, "cannot unmarshal string"},
+
+		// "1" and "0" into bool
+		{`{"active":"1"}`, apexJSON.CoerceStringToBool, coercedRecord{Active: true}, ""},
+		{`{"active":"0"}`, apexJSON.CoerceStringToBool, coercedRecord{}, ""},
+		{`{"active":"true"}`, apexJSON.CoerceStringToBool, coercedRecord{}, "weak coercion to bool failed"},
+		{`{"active":"1"}`, apexJSON.CoerceStringToNumber, coercedRecord{}, "cannot unmarshal string"},
+
+		// Off by default
+		{`{"zip":12345}`, 0, coercedRecord{}, "cannot unmarshal"},
+		{`{"count":"12"}`, 0, coercedRecord{}, "cannot unmarshal"},
+		{`{"active":"1"}`, 0, coercedRecord{}, "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		var got coercedRecord
+		opts := &apexJSON.Options{WeakTypeCoercion: tt.mode}
+		err := apexJSON.UnmarshalValue([]byte(tt.input), reflect.ValueOf(&got), opts)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s (mode %b): unexpected error %v", tt.input, tt.mode, err)
+			} else if got != tt.want {
+				t.Errorf("%s (mode %b): got %+v, want %+v", tt.input, tt.mode, got, tt.want)
+			}
+			continue
+		}
+
+		var typeErr *apexJSON.UnmarshalTypeError
+		if !errors.As(err, &typeErr) || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s (mode %b): got error %v, want UnmarshalTypeError containing %q", tt.input, tt.mode, err, tt.err)
+		}
+	}
+}
+
+func TestDecodeBudget(t *testing.T) {
+	data := []byte("[" + strings.Repeat(`{"id":1},`, 999) + `{"id":1}]`)
+
+	type item struct {
+		ID int `json:"id"`
+	}
+	targets := map[string]interface{}{
+		"structs":   &[]item{},
+		"maps":      &[]map[string]int{},
+		"interface": new(interface{}),
+	}
+	for name, target := range targets {
+		var stats apexJSON.DecodeStats
+		opts := &apexJSON.Options{MaxDecodedElements: 100, Stats: &stats}
+		err := apexJSON.UnmarshalValue(data, reflect.ValueOf(target), opts)
+		if !errors.Is(err, apexJSON.ErrDecodeBudgetExceeded) {
+			t.Fatalf("%s: got %v, want ErrDecodeBudgetExceeded", name, err)
+		}
+		var budgetErr *apexJSON.DecodeBudgetError
+		if !errors.As(err, &budgetErr) || budgetErr.Elements != 101 || budgetErr.Limit != 100 {
+			t.Errorf("%s: got %#v, want 101 elements against limit 100", name, err)
+		}
+		if stats.Elements != 101 {
+			t.Errorf("%s: stats.Elements = %d, want 101", name, stats.Elements)
+		}
+	}
+
+	// Unlimited by default, with the count still reported
+	var stats apexJSON.DecodeStats
+	var items []item
+	if err := apexJSON.UnmarshalValue(data, reflect.ValueOf(&items), &apexJSON.Options{Stats: &stats}); err != nil {
+		t.Fatal(err)
+	}
+	if want := 2000; stats.Elements != want { // 1000 elements + 1000 struct values
+		t.Errorf("stats.Elements = %d, want %d", stats.Elements, want)
+	}
+}
+
+func TestUnmarshalInterface(t *testing.T) {
+	data := []byte(`{"a":[1,"two",{"three":3.5}],"b":{"c":null,"d":[true,false]},"e":[]}`)
+
+	var got, want interface{}
+	if err := apexJSON.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal into interface{} = %#v, want %#v", got, want)
+	}
+
+	var nums []interface{}
+	opts := &apexJSON.Options{UseNumber: true}
+	if err := apexJSON.UnmarshalValue([]byte(`[[1.50]]`), reflect.ValueOf(&nums), opts); err != nil {
+		t.Fatal(err)
+	}
+	if inner, ok := nums[0].([]interface{}); !ok || inner[0] != apexJSON.Number("1.50") {
+		t.Errorf("UseNumber nested = %#v", nums)
+	}
+}
+
+func TestMarshalNumber(t *testing.T) {
+	// Documents decoded with UseNumber encode to the same bytes; keys are
+	// in order so the map encodes them the same way
+	for _, doc := range []string{
+		`{"a":123,"b":-1.50e+10,"c":[1,2.0,{"d":0}],"e":"123","f":12345678901234567890123}`,
+		`[0.1,-0,1E-7,null,true]`,
+		`7.250`,
+	} {
+		d := apexJSON.NewDecoder(strings.NewReader(doc))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		got, err := apexJSON.MarshalWithOptions(v, apexJSON.MarshalOptions{SortMapKeys: true})
+		if err != nil || string(got) != doc {
+			t.Errorf("round trip of %s = %s, %v", doc, got, err)
+		}
+		if got, err := apexJSON.Marshal(v); err != nil || !apexJSON.Valid(got) {
+			t.Errorf("unsorted round trip of %s = %s, %v", doc, got, err)
+		}
+	}
+
+	type totals struct {
+		Sum    apexJSON.Number            `json:"sum"`
+		Quoted apexJSON.Number            `json:"quoted,string"`
+		List   []apexJSON.Number          `json:"list"`
+		ByKey  map[string]apexJSON.Number `json:"by_key"`
+		Ptr    *apexJSON.Number           `json:"ptr"`
+		Empty  apexJSON.Number            `json:"empty"`
+	}
+	n := apexJSON.Number("-3.5e2")
+	got, err := apexJSON.Marshal(totals{"10.00", "7", []apexJSON.Number{"1", "2.5"}, map[string]apexJSON.Number{"k": "0"}, &n, ""})
+	want := `{"sum":10.00,"quoted":"7","list":[1,2.5],"by_key":{"k":0},"ptr":-3.5e2,"empty":0}`
+	if err != nil || string(got) != want {
+		t.Errorf("Marshal = %s, %v\nwant %s", got, err, want)
+	}
+
+	// Anything that isn't a JSON number is an error, wherever it is
+	for _, v := range []interface{}{
+		apexJSON.Number("12abc"),
+		[]apexJSON.Number{"1", "0x10"},
+		map[string]interface{}{"n": apexJSON.Number("NaN")},
+		totals{Sum: "+1"},
+	} {
+		if out, err := apexJSON.Marshal(v); err == nil {
+			t.Errorf("Marshal(%#v) = %s, want an error", v, out)
+		}
+	}
+}
+
+type unusualNames struct {
+	Cafe  string `json:"café"`
+	Space int    `json:"first name"`
+	Quote bool   `json:"bad\"name"`
+	Punct string `json:"a-b.c@d"`
+}
+
+type sanitizedItem struct {
+	Name string            `json:"name"`
+	Tags map[string]string `json:"tags"`
+}
+
+type sanitizedDoc struct {
+	Title string                 `json:"title"`
+	Items []sanitizedItem        `json:"items"`
+	Extra map[string]interface{} `json:"extra"`
+}
+
+func TestStringTransform(t *testing.T) {
+	data := []byte(`{"title":"  hi  ","items":[{"name":" a\t","tags":{" k ":"  v "}}],"extra":{"x":[" y\n",1]}}`)
+	input := string(data)
+
+	var fields []string
+	opts := &apexJSON.Options{StringTransform: func(field string, s []byte) []byte {
+		fields = append(fields, field)
+		return bytes.TrimSpace(s)
+	}}
+	var got sanitizedDoc
+	if err := apexJSON.UnmarshalValue(data, reflect.ValueOf(&got), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are left alone, and the escaped values, trimmed in the scratch
+	// buffer, don't overwrite each other
+	want := sanitizedDoc{
+		Title: "hi",
+		Items: []sanitizedItem{{Name: "a", Tags: map[string]string{" k ": "v"}}},
+		Extra: map[string]interface{}{"x": []interface{}{"y", 1.0}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if wantFields := []string{"title", "items[0].name", "items[0].tags. k ", "extra.x[0]"}; !reflect.DeepEqual(fields, wantFields) {
+		t.Errorf("fields = %q, want %q", fields, wantFields)
+	}
+	if string(data) != input {
+		t.Errorf("input modified: %s", data)
+	}
+
+	// Returned memory is copied, so a transform may reuse its own buffer
+	var out []byte
+	opts.StringTransform = func(_ string, s []byte) []byte {
+		out = append(out[:0], s...)
+		return out
+	}
+	var m map[string]string
+	if err := apexJSON.UnmarshalValue([]byte(`{"a":"x","b":"y"}`), reflect.ValueOf(&m), opts); err != nil {
+		t.Fatal(err)
+	}
+	if m["a"] != "x" || m["b"] != "y" {
+		t.Errorf("map = %v, want a:x b:y", m)
+	}
+}
+
+func TestUnmarshalInterfaceDepth(t *testing.T) {
+	// Nesting is tracked without recursion, so very deep input is fine
+	const depth = 100000
+	deep := strings.Repeat(`[{"k":`, depth) + "1" + strings.Repeat("}]", depth)
+	var v interface{}
+	if err := apexJSON.Unmarshal([]byte(deep), &v); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < depth; i++ {
+		v = v.([]interface{})[0].(map[string]interface{})["k"]
+	}
+	if v != 1.0 {
+		t.Errorf("innermost value = %#v, want 1", v)
+	}
+
+	data := []byte(`{"a":[{"b":[1]}],"c":2}`)
+	for _, tt := range []struct {
+		max int
+		ok  bool
+	}{{0, true}, {4, true}, {3, false}, {1, false}} {
+		var got interface{}
+		err := apexJSON.UnmarshalValue(data, reflect.ValueOf(&got), &apexJSON.Options{MaxDepth: tt.max})
+		var syntaxErr *apexJSON.SyntaxError
+		if tt.ok && err != nil || !tt.ok && !errors.As(err, &syntaxErr) {
+			t.Errorf("MaxDepth %d: err = %v", tt.max, err)
+		}
+	}
+
+	// Errors part way through leave the pooled scratch usable
+	for _, bad := range []string{`{"a":[1,2`, `[{"a":1},{"a":}]`, `{"a":{"b":[tru]}}`} {
+		var got interface{}
+		if err := apexJSON.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", bad)
+		}
+	}
+	var got, want interface{}
+	if err := apexJSON.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	_ = json.Unmarshal(data, &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal after errors = %#v, want %#v", got, want)
+	}
+}
+
+// namedFields is encoded with the field namers of TestFieldNamingCache
+type namedFields struct {
+	UserID  int    `json:",omitempty"`
+	Tagged  string `json:"tag"`
+	Nested  *namedFields
+	Unknown apexJSON.Unknown
+}
+
+func upperNamer(name string) string { return strings.ToUpper(name) }
+
+func prefixNamer(prefix string) func(string) string {
+	return func(name string) string { return prefix + name }
+}
+
+// TestFieldNamingCache interleaves encodes and decodes of one type under
+// different field namers, and none, and checks each gets its own names
+// from the shared field cache
+func TestFieldNamingCache(t *testing.T) {
+	v := namedFields{UserID: 1, Tagged: "t", Nested: &namedFields{}}
+	cases := []struct {
+		opts apexJSON.MarshalOptions
+		want string
+	}{
+		{apexJSON.MarshalOptions{}, `{"UserID":1,"tag":"t","Nested":{"tag":"","Nested":null}}`},
+		{apexJSON.MarshalOptions{FieldNamer: upperNamer}, `{"USERID":1,"tag":"t","NESTED":{"tag":"","NESTED":null}}`},
+		{apexJSON.MarshalOptions{FieldNamer: prefixNamer("a_")}, `{"a_UserID":1,"tag":"t","a_Nested":{"tag":"","a_Nested":null}}`},
+		{apexJSON.MarshalOptions{FieldNamer: prefixNamer("b_")}, `{"b_UserID":1,"tag":"t","b_Nested":{"tag":"","b_Nested":null}}`},
+		{apexJSON.MarshalOptions{FieldNamer: prefixNamer("")}, `{"UserID":1,"tag":"t","Nested":{"tag":"","Nested":null}}`},
+		// Invalid names keep the Go name
+		{apexJSON.MarshalOptions{FieldNamer: func(string) string { return "" }}, `{"UserID":1,"tag":"t","Nested":{"tag":"","Nested":null}}`},
+	}
+
+	var wg sync.WaitGroup
+	for round := 0; round < 8; round++ {
+		for _, tc := range cases {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := apexJSON.MarshalWithOptions(v, tc.opts)
+				if err != nil || string(got) != tc.want {
+					t.Errorf("Marshal = %s, %v, want %s", got, err, tc.want)
+				}
+
+				// Decoding matches keys to the same names, and leaves the
+				// names of the other namers to Unknown
+				var back namedFields
+				in := strings.TrimSuffix(tc.want, "}") + `,"UserID":2,"USERID":3}`
+				err = apexJSON.UnmarshalValue([]byte(in), reflect.ValueOf(&back), &apexJSON.Options{MarshalOptions: tc.opts})
+				if err != nil || back.Tagged != "t" || back.Nested == nil {
+					t.Errorf("Unmarshal(%s) = %+v, %v", in, back, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	var back namedFields
+	opts := &apexJSON.Options{MarshalOptions: cases[1].opts}
+	if err := apexJSON.UnmarshalValue([]byte(`{"UserID":2,"USERID":3}`), reflect.ValueOf(&back), opts); err != nil || back.UserID != 3 || len(back.Unknown) != 1 {
+		t.Errorf("Unmarshal with upperNamer = %+v, %v", back, err)
+	}
+	back = namedFields{}
+	if err := apexJSON.Unmarshal([]byte(`{"UserID":2,"USERID":3}`), &back); err != nil || back.UserID != 2 || len(back.Unknown) != 1 {
+		t.Errorf("Unmarshal = %+v, %v", back, err)
+	}
+}
+
+func TestFieldNamerHelpers(t *testing.T) {
+	for _, tc := range []struct{ in, snake, camel string }{
+		{"Name", "name", "name"},
+		{"UserID", "user_id", "userID"},
+		{"ID", "id", "id"},
+		{"HTTPServer", "http_server", "httpServer"},
+		{"Base64Data", "base64_data", "base64Data"},
+		{"CreatedAtUTC", "created_at_utc", "createdAtUTC"},
+		{"ÉtéTemps", "été_temps", "étéTemps"},
+	} {
+		if got := apexJSON.SnakeCase(tc.in); got != tc.snake {
+			t.Errorf("SnakeCase(%q) = %q, want %q", tc.in, got, tc.snake)
+		}
+		if got := apexJSON.CamelCase(tc.in); got != tc.camel {
+			t.Errorf("CamelCase(%q) = %q, want %q", tc.in, got, tc.camel)
+		}
+	}
+
+	type account struct {
+		UserID    int
+		HTTPProxy string
+		Legacy    string `json:"user_id"` // the tag wins the name SnakeCase gives UserID
+		Kept      string `json:"KeptAsIs"`
+	}
+	v := account{UserID: 1, HTTPProxy: "p", Legacy: "l", Kept: "k"}
+	opts := apexJSON.MarshalOptions{FieldNamer: apexJSON.SnakeCase}
+	const want = `{"http_proxy":"p","user_id":"l","KeptAsIs":"k"}`
+	got, err := apexJSON.MarshalWithOptions(v, opts)
+	if err != nil || string(got) != want {
+		t.Errorf("SnakeCase: %s, %v, want %s", got, err, want)
+	}
+	var back account
+	err = apexJSON.UnmarshalValue([]byte(`{"http_proxy":"q","HTTPProxy":"x","user_id":"m"}`), reflect.ValueOf(&back), &apexJSON.Options{MarshalOptions: opts})
+	if err != nil || back.HTTPProxy != "q" || back.Legacy != "m" || back.UserID != 0 {
+		t.Errorf("Unmarshal with SnakeCase = %+v, %v", back, err)
+	}
+
+	const camel = `{"userID":1,"httpProxy":"p","user_id":"l","KeptAsIs":"k"}`
+	if got, err := apexJSON.MarshalWithOptions(v, apexJSON.MarshalOptions{FieldNamer: apexJSON.CamelCase}); err != nil || string(got) != camel {
+		t.Errorf("CamelCase: %s, %v, want %s", got, err, camel)
+	}
+}
+
+func TestUnusualTagNames(t *testing.T) {
+	in := unusualNames{Cafe: "crème", Space: 7, Quote: true, Punct: "x"}
+
+	// As in Go 1.24's encoding/json, a name with a quote is not a valid
+	// tag name, so the field keeps its own
+	out, err := apexJSON.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"café":"crème","first name":7,"Quote":true,"a-b.c@d":"x"}`
+	if string(out) != want {
+		t.Errorf("Marshal = %s, want %s", out, want)
+	}
+
+	var back unusualNames
+	if err := apexJSON.Unmarshal(out, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back != in {
+		t.Errorf("round trip = %+v, want %+v", back, in)
+	}
+
+	// Escaped forms of a non-ASCII key match the field too
+	back = unusualNames{}
+	if err := apexJSON.Unmarshal([]byte(`{"caf\u00e9":"ok"}`), &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Cafe != "ok" {
+		t.Errorf("escaped key decoded to %+v", back)
+	}
+}
+
+func TestErrorContextSnippet(t *testing.T) {
+	syntaxSnippet := func(data string, n int) (*apexJSON.SyntaxError, bool) {
+		var v interface{}
+		err := apexJSON.UnmarshalValue([]byte(data), reflect.ValueOf(&v), &apexJSON.Options{ErrorContextBytes: n})
+		var syntaxErr *apexJSON.SyntaxError
+		ok := errors.As(err, &syntaxErr)
+		return syntaxErr, ok
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		n     int
+		want  string
+	}{
+		{"centered", `{"alpha":1,"beta":x,"gamma":3}`, 6, `a":x,"`},
+		{"clipped at start", `x{"alpha":1}`, 6, `x{"`},
+		{"clipped at end", `{"alpha":[1,2`, 6, `1,2`},
+		{"control characters", "{\"a\":\n\t@}", 4, `\n\t@}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syntaxErr, ok := syntaxSnippet(tt.input, tt.n)
+			if !ok {
+				t.Fatal("expected SyntaxError")
+			}
+			if syntaxErr.ContextSnippet != tt.want {
+				t.Errorf("offset %d: snippet %q, want %q", syntaxErr.Offset, syntaxErr.ContextSnippet, tt.want)
+			}
+		})
+	}
+
+	// Off by default, leaving the message untouched
+	syntaxErr, _ := syntaxSnippet(`{"alpha":x}`, 0)
+	if syntaxErr.ContextSnippet != "" || strings.Contains(syntaxErr.Error(), "near") {
+		t.Errorf("default error carries context: %v", syntaxErr)
+	}
+
+	// Type errors get the context too, copied out of the input. Their
+	// offset is just past the offending token.
+	data := []byte(`{"name":"ok","age":"seven"}`)
+	var s SimpleStruct
+	err := apexJSON.UnmarshalValue(data, reflect.ValueOf(&s), &apexJSON.Options{ErrorContextBytes: 8})
+	var typeErr *apexJSON.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("got %v, want UnmarshalTypeError", err)
+	}
+	copy(data, strings.Repeat("#", len(data)))
+	if typeErr.ContextSnippet != `ven"}` || !strings.Contains(err.Error(), "near `ven\"}`") {
+		t.Errorf("type error snippet %q (offset %d): %v", typeErr.ContextSnippet, typeErr.Offset, err)
+	}
+}
+
+type keyPoint struct{ X, Y int }
+
+type textKey keyPoint
+
+func (k textKey) MarshalText() ([]byte, error) { return []byte(fmt.Sprintf("%d:%d", k.X, k.Y)), nil }
+
+type stringerKey keyPoint
+
+func (k stringerKey) String() string { return "stringer" }
+
+type jsonKey keyPoint
+
+func (k jsonKey) MarshalJSON() ([]byte, error) { return []byte(fmt.Sprintf(` "j\"%d" `, k.X)), nil }
+
+type stringerJSONKey keyPoint
+
+func (k stringerJSONKey) String() string               { return "stringer" }
+func (k stringerJSONKey) MarshalJSON() ([]byte, error) { return []byte(`"json"`), nil }
+
+type textJSONKey keyPoint
+
+func (k textJSONKey) MarshalText() ([]byte, error) { return []byte("text"), nil }
+func (k textJSONKey) MarshalJSON() ([]byte, error) { return []byte(`"json"`), nil }
+
+type numberJSONKey keyPoint
+
+func (k numberJSONKey) MarshalJSON() ([]byte, error) { return []byte(`123`), nil }
+
+type textStringKey string
+
+func (k textStringKey) MarshalText() ([]byte, error) { return []byte("ignored"), nil }
+
+func TestMarshalMapKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string // "" means an error is expected; Go 1.24's encoding/json agrees but for interface keys
+		allow string // expected output with AllowMarshalerKeys, "" for an error
+	}{
+		{"text", map[textKey]int{{1, 2}: 3}, `{"1:2":3}`, `{"1:2":3}`},
+		{"text and json", map[textJSONKey]int{{}: 1}, `{"text":1}`, `{"text":1}`},
+		{"string kind with text", map[textStringKey]int{"k": 1}, `{"k":1}`, `{"k":1}`},
+		{"int", map[int8]string{-3: "a"}, `{"-3":"a"}`, `{"-3":"a"}`},
+		{"uint", map[uint16]bool{7: true}, `{"7":true}`, `{"7":true}`},
+		{"stringer", map[stringerKey]int{{}: 1}, "", ""},
+		{"json", map[jsonKey]int{{X: 4}: 1}, "", `{"j\"4":1}`},
+		{"stringer and json", map[stringerJSONKey]int{{}: 1}, "", `{"json":1}`},
+		{"json not a string", map[numberJSONKey]int{{}: 1}, "", ""},
+		{"float", map[float64]int{1.5: 1}, "", ""},
+		{"struct", map[keyPoint]int{{}: 1}, "", ""},
+		{"interface", map[interface{}]int{"s": 1}, `{"s":1}`, `{"s":1}`},
+		{"interface int", map[interface{}]int{5: 1}, `{"5":1}`, `{"5":1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, allow := range []bool{false, true} {
+				want := tt.want
+				if allow {
+					want = tt.allow
+				}
+
+				buf := &apexJSON.Buffer{}
+				opts := &apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{AllowMarshalerKeys: allow}}
+				err := apexJSON.MarshalValueWithOptions(reflect.ValueOf(tt.value), buf, opts)
+				if want == "" {
+					var keyErr *apexJSON.MapKeyError
+					if !errors.As(err, &keyErr) {
+						t.Errorf("allow=%v: got %s, %v, want MapKeyError", allow, buf.Bytes(), err)
+					}
+					continue
+				}
+				if err != nil || string(buf.Bytes()) != want {
+					t.Errorf("allow=%v: got %s, %v, want %s", allow, buf.Bytes(), err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIntMapKeys(t *testing.T) {
+	values := []interface{}{
+		map[int]string{-1: "a", 2: "b"},
+		map[int8]bool{math.MinInt8: true},
+		map[uint64]int{math.MaxUint64: 1},
+		map[uintptr]int{0: 0},
+	}
+	for _, v := range values {
+		data, err := apexJSON.MarshalWithOptions(v, apexJSON.MarshalOptions{SortMapKeys: true})
+		std, _ := json.Marshal(v)
+		if err != nil || string(data) != string(std) {
+			t.Errorf("Marshal(%v) = %s, %v, want %s", v, data, err, std)
+		}
+		got := reflect.New(reflect.TypeOf(v))
+		if err := apexJSON.Unmarshal(data, got.Interface()); err != nil || !reflect.DeepEqual(got.Elem().Interface(), v) {
+			t.Errorf("Unmarshal(%s) = %v, %v, want %v", data, got.Elem(), err, v)
+		}
+	}
+
+	for _, doc := range []string{`{"128":true}`, `{"x":true}`, `{"1.0":true}`, `{" 1":true}`} {
+		var m map[int8]bool
+		err := apexJSON.Unmarshal([]byte(doc), &m)
+		var typeErr *apexJSON.UnmarshalTypeError
+		if !errors.As(err, &typeErr) || typeErr.Type != reflect.TypeOf(int8(0)) {
+			t.Errorf("Unmarshal(%s) = %v, want UnmarshalTypeError for int8", doc, err)
+		}
+	}
+
+	_, err := apexJSON.Marshal(map[float64]int{1.5: 1})
+	var typeErr *apexJSON.UnsupportedTypeError
+	if !errors.As(err, &typeErr) || typeErr.Type != reflect.TypeOf(0.0) {
+		t.Errorf("Marshal(map[float64]int) = %v, want UnsupportedTypeError", err)
+	}
+}
+
+// regionKey is a struct map key written as "region/zone"
+type regionKey struct{ Region, Zone string }
+
+func (k regionKey) MarshalText() ([]byte, error) { return []byte(k.Region + "/" + k.Zone), nil }
+func (k *regionKey) UnmarshalText(b []byte) error {
+	region, zone, ok := strings.Cut(string(b), "/")
+	if !ok {
+		return fmt.Errorf("region key %q has no zone", b)
+	}
+	*k = regionKey{region, zone}
+	return nil
+}
+
+// textID is an integer map key written in hex rather than as a number
+type textID int
+
+func (id textID) MarshalText() ([]byte, error) {
+	if id < 0 {
+		return nil, errNegativeID
+	}
+	return []byte("id-" + strconv.FormatInt(int64(id), 16)), nil
+}
+func (id *textID) UnmarshalText(b []byte) error {
+	n, err := strconv.ParseInt(strings.TrimPrefix(string(b), "id-"), 16, 64)
+	*id = textID(n)
+	return err
+}
+
+var errNegativeID = errors.New("negative id")
+
+func TestTextMapKeys(t *testing.T) {
+	values := []interface{}{
+		map[regionKey]int{{"eu", "west-1"}: 1, {"us", "a\"b"}: 2},
+		map[textID]string{255: "ff", 0: "zero"},
+	}
+	for _, v := range values {
+		data, err := apexJSON.MarshalWithOptions(v, apexJSON.MarshalOptions{SortMapKeys: true})
+		std, _ := json.Marshal(v)
+		if err != nil || string(data) != string(std) {
+			t.Errorf("Marshal(%v) = %s, %v, want %s", v, data, err, std)
+		}
+		got := reflect.New(reflect.TypeOf(v))
+		if err := apexJSON.Unmarshal(data, got.Interface()); err != nil || !reflect.DeepEqual(got.Elem().Interface(), v) {
+			t.Errorf("Unmarshal(%s) = %v, %v, want %v", data, got.Elem(), err, v)
+		}
+	}
+
+	_, err := apexJSON.Marshal(map[textID]int{-1: 1})
+	if !errors.Is(err, errNegativeID) {
+		t.Errorf("Marshal with failing MarshalText: got %v, want %v", err, errNegativeID)
+	}
+	var m map[regionKey]int
+	if err := apexJSON.Unmarshal([]byte(`{"nozone":1}`), &m); err == nil || !strings.Contains(err.Error(), "has no zone") {
+		t.Errorf("Unmarshal with failing UnmarshalText: got %v", err)
+	}
+}
+
+// Identifier types implementing every combination of MarshalJSON,
+// MarshalText and String over the same int
+type idJSONText int
+
+func (i idJSONText) MarshalJSON() ([]byte, error) {
+	return strconv.AppendInt(nil, int64(i)*10, 10), nil
+}
+func (i idJSONText) MarshalText() ([]byte, error) { return []byte(fmt.Sprintf("id-%d", i)), nil }
+
+type idJSON int
+
+func (i idJSON) MarshalJSON() ([]byte, error) { return strconv.AppendInt(nil, int64(i)*10, 10), nil }
+
+type idText int
+
+func (i idText) MarshalText() ([]byte, error) { return []byte(fmt.Sprintf("id-%d", i)), nil }
+
+type idStringer int
+
+func (i idStringer) String() string { return fmt.Sprintf("s-%d", int(i)) }
+
+// Named primitive types whose MarshalJSON writes an object
+type (
+	statusJSON string
+	countJSON  int
+	ratioJSON  float64
+	flagJSON   bool
+)
+
+func (s statusJSON) MarshalJSON() ([]byte, error) {
+	return []byte(`{"status":"` + string(s) + `"}`), nil
+}
+func (c countJSON) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"count":%d}`, int(c))), nil
+}
+func (r ratioJSON) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"ratio":%g}`, float64(r))), nil
+}
+func (f flagJSON) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"flag":%t}`, bool(f))), nil
+}
+
+// TestPrimitiveMarshalers checks MarshalJSON on types of primitive kinds is
+// used wherever their values appear, as encoding/json uses it. Map keys
+// are the exception there too and are written from the kind.
+func TestPrimitiveMarshalers(t *testing.T) {
+	s, c, r, f := statusJSON("ok"), countJSON(3), ratioJSON(0.5), flagJSON(true)
+	values := []interface{}{
+		s, c, r, f, &s, &c,
+		struct {
+			S statusJSON
+			C countJSON  `json:"c,omitempty"`
+			R *ratioJSON `json:"r"`
+			F flagJSON   `json:",string"`
+		}{s, c, &r, f},
+		[]statusJSON{s, ""}, []countJSON{c}, [2]ratioJSON{r}, []flagJSON{f, false}, []*countJSON{&c, nil},
+		[]interface{}{s, c, r, f},
+		map[string]statusJSON{"k": s}, map[string]countJSON{"k": c}, map[string]ratioJSON{"k": r}, map[string]flagJSON{"k": f},
+		map[string]interface{}{"s": s}, map[string]interface{}{"c": c},
+		map[statusJSON]int{s: 1}, map[countJSON]statusJSON{c: s},
+	}
+	for _, v := range values {
+		got, err := apexJSON.Marshal(v)
+		want, stdErr := json.Marshal(v)
+		if err != nil || stdErr != nil || string(got) != string(want) {
+			t.Errorf("Marshal(%T) = %s, %v, want %s, %v", v, got, err, want, stdErr)
+		}
+	}
+}
+
+func TestMarshalerPrecedence(t *testing.T) {
+	// MarshalJSON wins for values and MarshalText for map keys, wherever
+	// the value appears
+	positions := []string{"field", "element", "array element", "interface element", "map key", "map value"}
+	tests := []struct {
+		name   string
+		values []interface{}
+		want   []string
+	}{
+		{
+			"json and text",
+			[]interface{}{struct{ ID idJSONText }{7}, []idJSONText{7}, [1]idJSONText{7}, []interface{}{idJSONText(7)}, map[idJSONText]int{7: 1}, map[int]idJSONText{1: 7}},
+			[]string{`{"ID":70}`, `[70]`, `[70]`, `[70]`, `{"id-7":1}`, `{"1":70}`},
+		},
+		{
+			"json",
+			[]interface{}{struct{ ID idJSON }{7}, []idJSON{7}, [1]idJSON{7}, []interface{}{idJSON(7)}, map[idJSON]int{7: 1}, map[int]idJSON{1: 7}},
+			[]string{`{"ID":70}`, `[70]`, `[70]`, `[70]`, `{"7":1}`, `{"1":70}`},
+		},
+		{
+			"text",
+			[]interface{}{struct{ ID idText }{7}, []idText{7}, [1]idText{7}, []interface{}{idText(7)}, map[idText]int{7: 1}, map[string]idText{"1": 7}},
+			[]string{`{"ID":"id-7"}`, `["id-7"]`, `["id-7"]`, `["id-7"]`, `{"id-7":1}`, `{"1":"id-7"}`},
+		},
+		{
+			"stringer",
+			[]interface{}{struct{ ID idStringer }{7}, []idStringer{7}, [1]idStringer{7}, []interface{}{idStringer(7)}, map[idStringer]int{7: 1}, map[string]idStringer{"1": 7}},
+			[]string{`{"ID":7}`, `[7]`, `[7]`, `[7]`, `{"7":1}`, `{"1":7}`},
+		},
+		{
+			"pointer",
+			[]interface{}{struct{ ID *idJSONText }{new(idJSONText)}, []*idText{new(idText)}, [1]*idJSON{new(idJSON)}, []interface{}{new(idText)}, map[*idText]int{new(idText): 1}, map[string]*idJSONText{"1": new(idJSONText)}},
+			[]string{`{"ID":0}`, `["id-0"]`, `[0]`, `["id-0"]`, `{"id-0":1}`, `{"1":0}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, v := range tt.values {
+				got, err := apexJSON.Marshal(v)
+				if err != nil || string(got) != tt.want[i] {
+					t.Errorf("%s: got %s, %v, want %s", positions[i], got, err, tt.want[i])
+				}
+				if std, _ := json.Marshal(v); string(std) != tt.want[i] {
+					t.Errorf("%s: encoding/json gives %s, want %s", positions[i], std, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// Types whose MarshalJSON or MarshalText has a pointer receiver
+type ptrJSON struct{ n int }
+
+func (p *ptrJSON) MarshalJSON() ([]byte, error) { return []byte(fmt.Sprintf(`"json-%d"`, p.n)), nil }
+
+type ptrText int
+
+func (p *ptrText) MarshalText() ([]byte, error) { return []byte(fmt.Sprintf("text-%d", *p)), nil }
+
+type ptrByte byte
+
+func (p *ptrByte) MarshalText() ([]byte, error) { return []byte(fmt.Sprintf("b%d", *p)), nil }
+
+type ptrHolder struct {
+	J  ptrJSON
+	T  ptrText
+	JS []ptrJSON
+	TA [1]ptrText
+	JM map[string]ptrJSON
+}
+
+func TestPointerReceiverMarshalers(t *testing.T) {
+	// Only addressable values have their pointer methods called, as in
+	// encoding/json: fields reached through a pointer, slice elements and
+	// array elements of an addressable array, but not map values
+	h := ptrHolder{J: ptrJSON{1}, T: 2, JS: []ptrJSON{{3}}, TA: [1]ptrText{4}, JM: map[string]ptrJSON{"m": {5}}}
+	values := []interface{}{
+		&h,
+		h,
+		[]ptrHolder{h},
+		[]ptrText{6, 7},
+		[2]ptrJSON{{8}, {9}},
+		&[2]ptrJSON{{8}, {9}},
+		map[string]ptrText{"k": 10},
+		map[string]*ptrText{"k": new(ptrText)},
+		[]interface{}{ptrJSON{11}, &ptrJSON{12}},
+		[]struct{ B ptrText }{{13}},
+		[]ptrText{},
+	}
+	wants := []string{
+		`{"J":"json-1","T":"text-2","JS":["json-3"],"TA":["text-4"],"JM":{"m":{}}}`,
+		`{"J":{},"T":2,"JS":["json-3"],"TA":[4],"JM":{"m":{}}}`,
+	}
+	for i, v := range values {
+		got, err := apexJSON.Marshal(v)
+		want, _ := json.Marshal(v)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("Marshal(%T) = %s, %v, want %s", v, got, err, want)
+		}
+		if i < len(wants) && string(want) != wants[i] {
+			t.Errorf("encoding/json gives %s for %T, want %s", want, v, wants[i])
+		}
+	}
+
+	// Nor is a slice of bytes with a pointer MarshalText base64 encoded
+	if got, err := apexJSON.Marshal([]ptrByte{1, 2}); err != nil || string(got) != `["b1","b2"]` {
+		t.Errorf("Marshal([]ptrByte) = %s, %v", got, err)
+	}
+}
+
+func TestInterfaceKeyRoundTrip(t *testing.T) {
+	// The shape a YAML decoder produces: interface keys of mixed dynamic
+	// types, nested maps of the same kind
+	doc := map[interface{}]interface{}{
+		"name":   "svc",
+		8080:     "http",
+		uint(22): "ssh",
+		"limits": map[interface{}]interface{}{"cpu": 2, -1: true},
+		"hosts":  []interface{}{map[interface{}]interface{}{"ip": "10.0.0.1"}},
+	}
+
+	data, err := apexJSON.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[interface{}]interface{}
+	if err := apexJSON.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every key comes back as its string form; nested objects decode the
+	// way any object decodes into an interface{}
+	want := map[interface{}]interface{}{
+		"name":   "svc",
+		"8080":   "http",
+		"22":     "ssh",
+		"limits": map[string]interface{}{"cpu": 2.0, "-1": true},
+		"hosts":  []interface{}{map[string]interface{}{"ip": "10.0.0.1"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %#v, want %#v", got, want)
+	}
+
+	// Marshaling the decoded map again gives the same object
+	again, err := apexJSON.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first, second map[string]interface{}
+	if err := json.Unmarshal(data, &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(again, &second); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("re-marshaled %s, want %s", again, data)
+	}
+
+	for _, bad := range []map[interface{}]interface{}{{1.5: "x"}, {true: "x"}, {nil: "x"}, {"ok": map[interface{}]int{[2]int{}: 1}}} {
+		var keyErr *apexJSON.MapKeyError
+		if _, err := apexJSON.Marshal(bad); !errors.As(err, &keyErr) {
+			t.Errorf("Marshal(%v) error = %v, want MapKeyError", bad, err)
+		}
+	}
+}
+
+func TestPrecisionLoss(t *testing.T) {
+	type record struct {
+		Items []struct {
+			ID float64 `json:"id"`
+		} `json:"items"`
+		Small int8    `json:"small"`
+		Ratio float32 `json:"ratio"`
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		target interface{}
+		losses int
+		offset int64
+		path   string
+		fails  bool // errors even without FailOnPrecisionLoss
+	}{
+		{"exact", `{"items":[{"id":0.1},{"id":1e2},{"id":-0},{"id":9007199254740992}],"ratio":0.5}`, new(record), 0, -1, "", false},
+		{"float64 rounding", `{"items":[{"id":1},{"id":9007199254740993}]}`, new(record), 1, 25, "items[1].id", false},
+		{"underflow", `{"items":[{"id":1e-400}]}`, new(record), 1, 16, "items[0].id", false},
+		{"float32 rounding", `{"ratio":16777217}`, new(record), 1, 9, "ratio", false},
+		{"overflow", `[1e400]`, new([]float64), 1, 1, "[0]", true},
+		{"int overflow", `{"small":300}`, new(record), 1, 9, "small", true},
+		{"interface", `{"a":{"b c":[0.1,12345678901234567890]}}`, new(interface{}), 1, 17, "a.b c[1]", false},
+		{"interface scalar", `9007199254740993`, new(interface{}), 1, 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stats apexJSON.DecodeStats
+			err := apexJSON.UnmarshalValue([]byte(tt.input), reflect.ValueOf(tt.target), &apexJSON.Options{Stats: &stats})
+			if (err != nil) != tt.fails {
+				t.Fatalf("got error %v, want failure %v", err, tt.fails)
+			}
+			if stats.PrecisionLoss != tt.losses || stats.FirstLossOffset != tt.offset || stats.FirstLossPath != tt.path {
+				t.Errorf("got %d losses, first at %d %q; want %d at %d %q",
+					stats.PrecisionLoss, stats.FirstLossOffset, stats.FirstLossPath, tt.losses, tt.offset, tt.path)
+			}
+
+			err = apexJSON.UnmarshalValue([]byte(tt.input), reflect.ValueOf(tt.target), &apexJSON.Options{FailOnPrecisionLoss: true})
+			if (err != nil) != (tt.losses > 0) {
+				t.Fatalf("FailOnPrecisionLoss: got %v, want error %v", err, tt.losses > 0)
+			}
+			var typeErr *apexJSON.UnmarshalTypeError
+			if tt.losses > 0 && !tt.fails && (!errors.As(err, &typeErr) || typeErr.Offset != tt.offset || typeErr.Field != tt.path) {
+				t.Errorf("FailOnPrecisionLoss: got %#v, want type error at %d %q", err, tt.offset, tt.path)
+			}
+		})
+	}
+}
+
+type flatRecord struct {
+	Name   string  `json:"name"`
+	Count  int     `json:"count"`
+	Small  int8    `json:"small"`
+	Size   uint32  `json:"size"`
+	Ratio  float32 `json:"ratio"`
+	Score  float64 `json:"score"`
+	Active bool    `json:"active"`
+}
+
+func TestUnmarshalFlatStruct(t *testing.T) {
+	inputs := []string{
+		`{"name":"a\nb","count":-12,"small":7,"size":4000000000,"ratio":0.25,"score":1e3,"active":true}`,
+		`{ "active" : false , "unknown" : [1,{"x":2}], "name" : "x" }`,
+		`{"count":1.5}`,
+		`{"small":300}`,
+		`{"size":-1}`,
+		`{"name":5}`,
+		`{"count":"5"}`,
+		`{"active":"true"}`,
+		`{"active":tru}`,
+		`{"name":"unterminated`,
+		`{"score":1e400}`,
+	}
+
+	for _, input := range inputs {
+		var std flatRecord
+		stdErr := json.Unmarshal([]byte(input), &std)
+
+		// Stats routes numbers through the general path; both must agree
+		// with encoding/json
+		for _, opts := range []*apexJSON.Options{nil, {Stats: &apexJSON.DecodeStats{}}} {
+			var got flatRecord
+			err := apexJSON.UnmarshalValue([]byte(input), reflect.ValueOf(&got), opts)
+			if (err != nil) != (stdErr != nil) {
+				t.Errorf("%s: got error %v, encoding/json %v", input, err, stdErr)
+				continue
+			}
+			if err == nil && got != std {
+				t.Errorf("%s: got %+v, want %+v", input, got, std)
+			}
+		}
+	}
+
+	data := []byte(`{"name":"John Doe","count":30,"active":true}`)
+	allocs := testing.AllocsPerRun(100, func() {
+		var r flatRecord
+		_ = apexJSON.Unmarshal(data, &r)
+	})
+	if allocs > 2 && !raceEnabled {
+		t.Errorf("flat struct decode allocated %v times, want at most 2", allocs)
+	}
+}
+
+func TestMarshalEscapeOptions(t *testing.T) {
+	type paths struct {
+		Route string            `json:"a/b"`
+		List  []string          `json:"list"`
+		Map   map[string]string `json:"map"`
+		Any   interface{}       `json:"any"`
+	}
+	value := paths{
+		Route: "</script>",
+		List:  []string{"x/y", "it's"},
+		Map:   map[string]string{"k/1": "v/1"},
+		Any:   map[string]interface{}{"i/j": "'/'"},
+	}
+
+	tests := []struct {
+		name string
+		opts apexJSON.MarshalOptions
+		want string
+	}{
+		{"default", apexJSON.MarshalOptions{},
+			`{"a/b":"</script>","list":["x/y","it's"],"map":{"k/1":"v/1"},"any":{"i/j":"'/'"}}`},
+		{"solidus", apexJSON.MarshalOptions{EscapeSolidus: true},
+			`{"a\/b":"<\/script>","list":["x\/y","it's"],"map":{"k\/1":"v\/1"},"any":{"i\/j":"'\/'"}}`},
+		{"extra", apexJSON.MarshalOptions{ExtraEscapes: []byte("'<")},
+			`{"a/b":"\u003c/script>","list":["x/y","it\u0027s"],"map":{"k/1":"v/1"},"any":{"i/j":"\u0027/\u0027"}}`},
+		{"extra already escaped", apexJSON.MarshalOptions{ExtraEscapes: []byte("\"/"), EscapeSolidus: true},
+			`{"a\/b":"<\/script>","list":["x\/y","it's"],"map":{"k\/1":"v\/1"},"any":{"i\/j":"'\/'"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &apexJSON.Buffer{}
+			err := apexJSON.MarshalValueWithOptions(reflect.ValueOf(value), buf, &apexJSON.Options{MarshalOptions: tt.opts})
+			if err != nil || string(buf.Bytes()) != tt.want {
+				t.Fatalf("got %s, %v\nwant %s", buf.Bytes(), err, tt.want)
+			}
+
+			var back paths
+			if err := json.Unmarshal(buf.Bytes(), &back); err != nil || !reflect.DeepEqual(back, value) {
+				t.Errorf("round trip: got %+v, %v", back, err)
+			}
+		})
+	}
+
+	// Custom tables must not leak into the package-level default
+	if got, _ := apexJSON.Marshal("a/b'"); string(got) != `"a/b'"` {
+		t.Errorf("Marshal after custom escapes = %s", got)
+	}
+
+	buf := &apexJSON.Buffer{}
+	opts := &apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{ExtraEscapes: []byte{0xC3}}}
+	if err := apexJSON.MarshalValueWithOptions(reflect.ValueOf("é"), buf, opts); err == nil {
+		t.Error("escaping a non-ASCII byte succeeded")
+	}
+}
+
+func TestMarshalManyEscapes(t *testing.T) {
+	s := strings.Repeat(`"\`, 40) + "/"
+	for _, v := range []interface{}{s, []string{s}, map[string]string{s: s}} {
+		got, err := apexJSON.Marshal(v)
+		want, _ := json.Marshal(v)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("got %s, %v\nwant %s", got, err, want)
+		}
+	}
+
+	buf := &apexJSON.Buffer{}
+	opts := &apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{EscapeSolidus: true}}
+	if err := apexJSON.MarshalValueWithOptions(reflect.ValueOf(strings.Repeat("/", 100)), buf, opts); err != nil || string(buf.Bytes()) != `"`+strings.Repeat(`\/`, 100)+`"` {
+		t.Errorf("got %s, %v", buf.Bytes(), err)
+	}
+}
+
+func TestMarshalWithOptions(t *testing.T) {
+	type event struct {
+		Name  string            `json:"name"`
+		At    time.Time         `json:"at"`
+		Tags  []string          `json:"tags"`
+		IDs   []int             `json:"ids"`
+		Raw   []byte            `json:"raw"`
+		Any   interface{}       `json:"any"`
+		Attrs map[string]string `json:"attrs"`
+	}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	value := event{Name: "a/b\u2028", At: at, Any: []interface{}(nil), Attrs: map[string]string{"a": "2"}}
+
+	// The zero options are Marshal
+	for _, v := range []interface{}{value, &value, nil, []interface{}{at, []string(nil)}, map[string]interface{}{"k": value}} {
+		got, err := apexJSON.MarshalWithOptions(v, apexJSON.MarshalOptions{})
+		want, _ := apexJSON.Marshal(v)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("zero options: got %s, %v\nwant %s", got, err, want)
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts apexJSON.MarshalOptions
+		want string
+	}{
+		{"nil slices", apexJSON.MarshalOptions{NilSliceAsEmptyArray: true},
+			`{"name":"a/b\u2028","at":"2024-05-06T07:08:09Z","tags":[],"ids":[],"raw":"","any":[],"attrs":{"a":"2"}}`},
+		{"time format", apexJSON.MarshalOptions{TimeFormat: `2006-01-02 "15h"`},
+			`{"name":"a/b\u2028","at":"2024-05-06 \"07h\"","tags":null,"ids":null,"raw":null,"any":null,"attrs":{"a":"2"}}`},
+		{"raw line separators", apexJSON.MarshalOptions{RawLineSeparators: true, EscapeSolidus: true},
+			"{\"name\":\"a\\/b\u2028\",\"at\":\"2024-05-06T07:08:09Z\",\"tags\":null,\"ids\":null,\"raw\":null,\"any\":null,\"attrs\":{\"a\":\"2\"}}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := apexJSON.MarshalWithOptions(value, tt.opts)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("got %s, %v\nwant %s", got, err, tt.want)
+			}
+		})
+	}
+
+	// Options don't leak into later encodes through pooled buffers
+	got, _ := apexJSON.Marshal([]string(nil))
+	if string(got) != "null" {
+		t.Errorf("Marshal after NilSliceAsEmptyArray = %s", got)
+	}
+
+	if _, err := apexJSON.MarshalWithOptions(value, apexJSON.MarshalOptions{ExtraEscapes: []byte{0xC3}}); err == nil {
+		t.Error("invalid ExtraEscapes accepted")
+	}
+}
+
+// TestMarshalTimeYears checks that times whose year takes more than four
+// digits are written whole wherever they end in the buffer
+func TestMarshalTimeYears(t *testing.T) {
+	for _, year := range []int{12345, -1, -123456, 2024} {
+		at := time.Date(year, 1, 2, 3, 4, 5, 0, time.FixedZone("", -7*3600))
+		want := `"` + at.Format(time.RFC3339) + `"`
+		for pad := 200; pad < 260; pad++ {
+			v := struct {
+				P string
+				T time.Time
+			}{strings.Repeat("x", pad), at}
+			got, err := apexJSON.Marshal(v)
+			if err != nil || !strings.HasSuffix(string(got), `"T":`+want+`}`) {
+				t.Fatalf("year %d after %d bytes: got %s, %v", year, pad, got, err)
+			}
+		}
+		if got, err := apexJSON.Marshal(map[string]interface{}{"t": at}); err != nil || string(got) != `{"t":`+want+`}` {
+			t.Errorf("year %d in map: got %s, %v", year, got, err)
+		}
+
+		// StdlibCompat fails for the years time.Time's MarshalJSON does
+		compat := apexJSON.MarshalOptions{StdlibCompat: true}
+		for _, v := range []interface{}{at, []interface{}{at}, struct{ T time.Time }{at}} {
+			got, err := apexJSON.MarshalWithOptions(v, compat)
+			if year == 2024 {
+				if err != nil {
+					t.Errorf("StdlibCompat %T: %v", v, err)
+				}
+				continue
+			}
+			const msg = "json: error calling MarshalJSON for type time.Time: Time.MarshalJSON: year outside of range [0,9999]"
+			var merr *apexJSON.MarshalerError
+			if !errors.As(err, &merr) || err.Error() != msg {
+				t.Errorf("StdlibCompat %T with year %d: got %s, %v", v, year, got, err)
+			}
+		}
+	}
+}
+
+func TestNilMapAsEmptyObject(t *testing.T) {
+	type payload struct {
+		Attrs  map[string]string      `json:"attrs"`
+		Meta   map[string]interface{} `json:"meta"`
+		Counts map[int]int            `json:"counts"`
+		Nested map[string]map[int]int `json:"nested"`
+		Any    interface{}            `json:"any"`
+		Ptr    *map[string]int        `json:"ptr"`
+		Tags   []string               `json:"tags"`
+	}
+	value := payload{Nested: map[string]map[int]int{"n": nil}, Any: map[string]interface{}(nil)}
+
+	// The default is unchanged, as in encoding/json
+	got, err := apexJSON.Marshal(value)
+	want, _ := json.Marshal(value)
+	if err != nil || string(got) != string(want) {
+		t.Errorf("Marshal = %s, %v, want %s", got, err, want)
+	}
+
+	opts := apexJSON.MarshalOptions{NilMapAsEmptyObject: true}
+	const wantEmpty = `{"attrs":{},"meta":{},"counts":{},"nested":{"n":{}},"any":{},"ptr":null,"tags":null}`
+	if got, err := apexJSON.MarshalWithOptions(value, opts); err != nil || string(got) != wantEmpty {
+		t.Errorf("NilMapAsEmptyObject: %s, %v, want %s", got, err, wantEmpty)
+	}
+	opts.NilSliceAsEmptyArray = true
+	const wantBoth = `{"attrs":{},"meta":{},"counts":{},"nested":{"n":{}},"any":{},"ptr":null,"tags":[]}`
+	if got, err := apexJSON.MarshalWithOptions(value, opts); err != nil || string(got) != wantBoth {
+		t.Errorf("with NilSliceAsEmptyArray: %s, %v, want %s", got, err, wantBoth)
+	}
+}
+
+func TestMarshalLineSeparators(t *testing.T) {
+	inputs := []string{
+		"\u2028start",
+		"mid\u2029dle",
+		"end\u2028",
+		"\u2028\u2029",
+		"\"\u2028\\",
+		"\n\u2029\t\u2028\x01",
+		"\u2027\u202a\u20ac\u00e2",
+	}
+	for _, s := range inputs {
+		for _, v := range []interface{}{s, []string{s}, map[string]string{s: s}, map[string]interface{}{s: s}} {
+			got, err := apexJSON.Marshal(v)
+			want, _ := json.Marshal(v)
+			if err != nil || string(got) != string(want) {
+				t.Errorf("Marshal(%q) = %s, %v\nwant %s", v, got, err, want)
+			}
+		}
+	}
+
+	// SetEscapeHTML(false) writes them as is, also with other escapes set
+	value := []string{"a/\u2028", "\u2029\""}
+	for _, tt := range []struct {
+		escape bool
+		want   string
+	}{
+		{true, `["a/\u2028","\u2029\""]` + "\n"},
+		{false, "[\"a/\u2028\",\"\u2029\\\"\"]\n"},
+	} {
+		var got bytes.Buffer
+		enc := apexJSON.NewEncoder(&got)
+		enc.SetEscapeHTML(tt.escape)
+		if err := enc.Encode(value); err != nil || got.String() != tt.want {
+			t.Errorf("SetEscapeHTML(%v): got %s, %v\nwant %s", tt.escape, got.String(), err, tt.want)
+		}
+
+		got.Reset()
+		if err := enc.SetMarshalOptions(apexJSON.MarshalOptions{EscapeSolidus: true}); err != nil {
+			t.Fatal(err)
+		}
+		want := strings.Replace(tt.want, "/", `\/`, 1)
+		if err := enc.Encode(value); err != nil || got.String() != want {
+			t.Errorf("SetEscapeHTML(%v) with EscapeSolidus: got %s, %v\nwant %s", tt.escape, got.String(), err, want)
+		}
+	}
+}
+
+func TestMarshalControlCharacters(t *testing.T) {
+	var all []byte
+	for c := byte(0); c < 0x20; c++ {
+		all = append(all, c)
+	}
+	inputs := []string{string(all), "a\x01b\x0bc", "\x7f\x00\"\x1f\\"}
+	for c := byte(0); c < 0x20; c++ {
+		inputs = append(inputs, string([]byte{c}), "x"+string([]byte{c, c})+"y")
+	}
+
+	type record struct {
+		Name string            `json:"name"`
+		Tags []string          `json:"tags"`
+		Meta map[string]string `json:"meta"`
+		Any  interface{}       `json:"any"`
+	}
+	for _, s := range inputs {
+		values := []interface{}{
+			s,
+			[]string{s},
+			map[string]string{s: s},
+			map[string]interface{}{s: []interface{}{s}},
+			record{Name: s, Tags: []string{s}, Meta: map[string]string{s: s}, Any: s},
+		}
+		for _, v := range values {
+			got, err := apexJSON.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.IndexFunc(got, func(r rune) bool { return r < 0x20 }) >= 0 {
+				t.Errorf("Marshal(%q) wrote a raw control character: %q", v, got)
+			}
+			back := reflect.New(reflect.TypeOf(v))
+			if err := json.Unmarshal(got, back.Interface()); err != nil || !reflect.DeepEqual(back.Elem().Interface(), v) {
+				t.Errorf("encoding/json read %q back as %q, %v", got, back.Elem().Interface(), err)
+			}
+			if want, _ := json.Marshal(v); string(got) != string(want) {
+				t.Errorf("Marshal(%q) = %s, want %s", v, got, want)
+			}
+		}
+
+		// Non-default escape tables and the indenter start from the same
+		// control character escapes
+		var out bytes.Buffer
+		enc := apexJSON.NewEncoder(&out)
+		enc.SetEscapeHTML(false)
+		if err := enc.SetMarshalOptions(apexJSON.MarshalOptions{EscapeSolidus: true}); err != nil {
+			t.Fatal(err)
+		}
+		enc.Encode(values[4])
+		indented, _ := apexJSON.MarshalIndent(values[4], "", "  ")
+		for _, got := range [][]byte{out.Bytes(), indented} {
+			var back record
+			if err := json.Unmarshal(got, &back); err != nil || !reflect.DeepEqual(back, values[4]) {
+				t.Errorf("encoding/json read %q back as %q, %v", got, back, err)
+			}
+		}
+	}
+}
+
+type kitchenSink struct {
+	Func    func()         `json:"func,omitempty"`
+	Chan    chan int       `json:"chan,omitempty"`
+	Pointer unsafe.Pointer `json:"pointer,omitempty"`
+	Complex complex128     `json:"complex,omitempty"`
+}
+
+// cycleNode is a tree node pointing back at its parent
+type cycleNode struct {
+	Name     string       `json:"name"`
+	Parent   *cycleNode   `json:"parent,omitempty"`
+	Children []*cycleNode `json:"children,omitempty"`
+}
+
+func TestMarshalCycles(t *testing.T) {
+	root := &cycleNode{Name: "root"}
+	root.Children = []*cycleNode{{Name: "child", Parent: root}}
+
+	selfMap := map[string]interface{}{}
+	selfMap["self"] = selfMap
+	selfSlice := []interface{}{nil}
+	selfSlice[0] = selfSlice
+	var selfIface interface{}
+	selfIface = &selfIface
+	typedMap := map[string]interface{}{"k": map[string]int{}}
+	typedMap["again"] = []interface{}{typedMap}
+
+	cycles := map[string]interface{}{
+		"back pointer": root,
+		"map":          selfMap,
+		"slice":        selfSlice,
+		"interface":    selfIface,
+		"mixed":        typedMap,
+		"in struct":    struct{ M map[string]interface{} }{selfMap},
+	}
+	for name, v := range cycles {
+		_, err := apexJSON.Marshal(v)
+		var valueErr *apexJSON.UnsupportedValueError
+		if !errors.As(err, &valueErr) || !strings.Contains(err.Error(), "encountered a cycle via") {
+			t.Errorf("Marshal %s: got %v, want a cycle error", name, err)
+		}
+	}
+	loop := &cycleNode{Name: "loop"}
+	loop.Parent = loop
+	_, err := apexJSON.Marshal(loop)
+	if want := "json: unsupported value: encountered a cycle via *apexJSON_test.cycleNode"; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %s", err, want)
+	}
+
+	// Deep but acyclic data, with the same subtree in two places, still
+	// encodes as encoding/json has it
+	deep := &cycleNode{Name: "leaf"}
+	shared := []*cycleNode{deep}
+	for i := 0; i < 3*1000; i++ {
+		deep = &cycleNode{Name: strconv.Itoa(i), Children: []*cycleNode{deep}}
+	}
+	deep.Children = append(deep.Children, shared...)
+	nested := interface{}("end")
+	for i := 0; i < 1500; i++ {
+		nested = map[string]interface{}{"n": []interface{}{nested, shared}}
+	}
+	for _, v := range []interface{}{deep, nested} {
+		got, err := apexJSON.Marshal(v)
+		want, stdErr := json.Marshal(v)
+		if err != nil || stdErr != nil || !bytes.Equal(got, want) {
+			t.Errorf("deep %T: %v, encoding/json %v, equal %v", v, err, stdErr, bytes.Equal(got, want))
+		}
+	}
+}
+
+func TestUnsupportedKinds(t *testing.T) {
+	n := 1
+	values := map[string]interface{}{
+		"func":              kitchenSink{Func: func() {}},
+		"chan":              kitchenSink{Chan: make(chan int)},
+		"pointer":           kitchenSink{Pointer: unsafe.Pointer(&n)},
+		"complex":           kitchenSink{Complex: 1i},
+		"func in map":       map[string]interface{}{"f": func() {}},
+		"chan in interface": []interface{}{make(chan int)},
+		"complex in slice":  []complex64{1},
+		"pointer in map":    map[string]unsafe.Pointer{"p": nil},
+	}
+	for name, v := range values {
+		var typeErr *apexJSON.UnsupportedTypeError
+		if _, err := apexJSON.Marshal(v); !errors.As(err, &typeErr) {
+			t.Errorf("Marshal %s: got %v, want UnsupportedTypeError", name, err)
+		}
+	}
+
+	// The errors read as encoding/json's do, for values JSON has no
+	// encoding for as well as types
+	inf := math.Inf(1)
+	stdValues := map[string]interface{}{
+		"chan":             make(chan int),
+		"func":             func() {},
+		"complex64":        complex64(1),
+		"complex128":       []complex128{1},
+		"NaN":              math.NaN(),
+		"+Inf":             inf,
+		"-Inf float32":     float32(-inf),
+		"NaN in interface": map[string]interface{}{"f": math.NaN()},
+		"Inf in slice":     []float32{1, float32(inf)},
+		"Inf in struct":    struct{ F float64 }{-inf},
+	}
+	for name, v := range stdValues {
+		_, err := apexJSON.Marshal(v)
+		_, stdErr := json.Marshal(v)
+		if err == nil || stdErr == nil || err.Error() != stdErr.Error() {
+			t.Errorf("Marshal %s: got %v, encoding/json %v", name, err, stdErr)
+		}
+	}
+	for _, f := range []float64{math.NaN(), inf, -inf} {
+		var valueErr *apexJSON.UnsupportedValueError
+		if _, err := apexJSON.Marshal(f); !errors.As(err, &valueErr) || valueErr.Value.Kind() != reflect.Float64 {
+			t.Errorf("Marshal %v: got %v, want UnsupportedValueError", f, err)
+		}
+	}
+
+	for _, input := range []string{
+		`{"func":1}`, `{"func":"f"}`, `{"func":{}}`, `{"func":[]}`, `{"func":true}`,
+		`{"chan":1}`, `{"chan":"c"}`, `{"chan":{}}`, `{"chan":[1]}`,
+		`{"pointer":1}`, `{"pointer":"p"}`, `{"pointer":{}}`, `{"pointer":[]}`,
+		`{"complex":1}`, `{"complex":"1i"}`, `{"complex":{"re":1}}`, `{"complex":[1,0]}`,
+	} {
+		var sink kitchenSink
+		var typeErr *apexJSON.UnmarshalTypeError
+		if err := apexJSON.Unmarshal([]byte(input), &sink); !errors.As(err, &typeErr) {
+			t.Errorf("Unmarshal %s: got %v, want UnmarshalTypeError", input, err)
+		}
+	}
+
+	// A user type that happens to be named Number is not a string
+	type Number struct{ V int }
+	var num Number
+	var typeErr *apexJSON.UnmarshalTypeError
+	if err := apexJSON.Unmarshal([]byte(`7`), &num); !errors.As(err, &typeErr) {
+		t.Errorf("Unmarshal into struct Number: got %v, want UnmarshalTypeError", err)
+	}
+
+	var ptr uintptr
+	if err := apexJSON.Unmarshal([]byte(`42`), &ptr); err != nil || ptr != 42 {
+		t.Errorf("Unmarshal uintptr: got %d, %v", ptr, err)
+	}
+}
+
+// unsupportedSettings nests unsupported values below fields, slices and
+// maps. Like encoding/json, omitempty leaves a nil func or chan in, so
+// those sit behind pointers.
+type unsupportedSettings struct {
+	Name     string                 `json:"name"`
+	Callback *func()                `json:"callback,omitempty"`
+	Hooks    []unsupportedHook      `json:"hooks,omitempty"`
+	Extra    map[string]interface{} `json:"extra,omitempty"`
+	ByID     map[int][]complex64    `json:"by_id,omitempty"`
+}
+
+type unsupportedHook struct {
+	Amount *complex128 `json:"amount,omitempty"`
+}
+
+func TestUnsupportedTypePaths(t *testing.T) {
+	type config struct {
+		Settings unsupportedSettings
+	}
+	callback, amount := func() {}, complex128(1i)
+	tests := []struct {
+		name string
+		v    interface{}
+		path string
+	}{
+		{"root", make(chan int), ""},
+		{"root slice", []complex128{1}, ""},
+		{"field", struct{ C chan int }{make(chan int)}, "C"},
+		{"nested field", config{unsupportedSettings{Callback: &callback}}, "Settings.callback"},
+		{"slice element", config{unsupportedSettings{Hooks: []unsupportedHook{{}, {&amount}}}}, "Settings.hooks[1].amount"},
+		{"slice of kind", unsupportedSettings{ByID: map[int][]complex64{7: {1}}}, "by_id.7"},
+		{"func in map", unsupportedSettings{Extra: map[string]interface{}{"f": func() {}}}, "extra.f"},
+		{"deep in interface", map[string]interface{}{"a": []interface{}{1, map[string]interface{}{"b": make(chan int)}}}, "a[1].b"},
+		{"indented", unsupportedSettings{Extra: map[string]interface{}{"c": 1i}}, "extra.c"},
+	}
+	for _, tt := range tests {
+		marshal := apexJSON.Marshal
+		if tt.name == "indented" {
+			marshal = func(v interface{}) ([]byte, error) { return apexJSON.MarshalIndent(v, "", "  ") }
+		}
+		_, err := marshal(tt.v)
+		var typeErr *apexJSON.UnsupportedTypeError
+		if !errors.As(err, &typeErr) || typeErr.Path != tt.path {
+			t.Errorf("%s: got %v, want UnsupportedTypeError at %q", tt.name, err, tt.path)
+			continue
+		}
+		if tt.path != "" && !strings.HasSuffix(err.Error(), " in field "+tt.path) {
+			t.Errorf("%s: message %q does not name the field", tt.name, err)
+		}
+	}
+
+	// Sorted keys take another route through maps
+	v := unsupportedSettings{Extra: map[string]interface{}{"a": 1, "z": complex64(1)}}
+	_, err := apexJSON.MarshalWithOptions(v, apexJSON.MarshalOptions{SortMapKeys: true})
+	if err == nil || err.Error() != "json: unsupported type: complex64 in field extra.z" {
+		t.Errorf("SortMapKeys: got %v", err)
+	}
+}
+
+type decimalValue struct{ Digits string }
+
+func TestMarshalIsEmptyHook(t *testing.T) {
+	type order struct {
+		Total    decimalValue `json:"total,omitempty"`
+		Discount decimalValue `json:"discount,omitempty"`
+		Fee      decimalValue `json:"fee"`
+		Note     string       `json:"note,omitempty"`
+		Count    int          `json:"count,omitempty"`
+	}
+	value := order{Total: decimalValue{"12.5"}, Discount: decimalValue{"0"}, Fee: decimalValue{"0"}}
+
+	calls := 0
+	decimalType := reflect.TypeOf(decimalValue{})
+	opts := &apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{
+		IsEmpty: func(v reflect.Value) (bool, bool) {
+			calls++
+			if v.Type() != decimalType {
+				return false, false
+			}
+			return v.Interface().(decimalValue).Digits == "0", true
+		},
+	}}
+
+	buf := &apexJSON.Buffer{}
+	if err := apexJSON.MarshalValueWithOptions(reflect.ValueOf(value), buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"total":{"Digits":"12.5"},"fee":{"Digits":"0"}}`; string(buf.Bytes()) != want {
+		t.Errorf("got %s, want %s", buf.Bytes(), want)
+	}
+	if calls != 4 {
+		t.Errorf("IsEmpty called %d times, want once per omitempty field (4)", calls)
+	}
+
+	// Without the hook the non-empty decimal string is kept
+	buf = &apexJSON.Buffer{}
+	if err := apexJSON.MarshalValue(reflect.ValueOf(value), buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"total":{"Digits":"12.5"},"discount":{"Digits":"0"},"fee":{"Digits":"0"}}`; string(buf.Bytes()) != want {
+		t.Errorf("default: got %s, want %s", buf.Bytes(), want)
+	}
+
+	if apexJSON.DefaultIsEmpty(reflect.ValueOf(decimalValue{})) || !apexJSON.DeepIsEmpty(reflect.ValueOf(decimalValue{})) ||
+		apexJSON.DeepIsEmpty(reflect.ValueOf(decimalValue{"0"})) {
+		t.Error("DefaultIsEmpty or DeepIsEmpty disagrees with the built-in omitempty rules")
+	}
+}
+
+// span is zero when it covers nothing, whatever its bounds
+type span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func (s span) IsZero() bool { return s.End <= s.Start }
+
+// ptrSpan has IsZero on the pointer only, so omitempty looks at its fields
+type ptrSpan span
+
+func (s *ptrSpan) IsZero() bool { return true }
+
+// TestOmitEmptyIsZero checks that DeepOmitEmpty asks types with IsZero
+// whether they are empty
+func TestOmitEmptyIsZero(t *testing.T) {
+	type window struct {
+		Active  span                    `json:"active,omitempty"`
+		Paused  span                    `json:"paused,omitempty"`
+		Pending ptrSpan                 `json:"pending,omitempty"`
+		Since   time.Time               `json:"since,omitempty"`
+		Next    apexJSON.Optional[span] `json:"next,omitempty"`
+		Nested  struct{ S span }        `json:"nested,omitempty"`
+	}
+	w := window{
+		Active:  span{Start: 1, End: 5},
+		Paused:  span{Start: 5, End: 5},
+		Pending: ptrSpan{Start: 2},
+		Next:    apexJSON.Optional[span]{Value: span{Start: 3, End: 1}, Present: true},
+		Nested:  struct{ S span }{span{Start: 9}},
+	}
+	deep := apexJSON.MarshalOptions{DeepOmitEmpty: true}
+	const want = `{"active":{"start":1,"end":5},"pending":{"start":2,"end":0}}`
+	for _, v := range []interface{}{w, &w} {
+		got, err := apexJSON.MarshalWithOptions(v, deep)
+		if err != nil || string(got) != want {
+			t.Errorf("Marshal(%T) = %s, %v, want %s", v, got, err, want)
+		}
+	}
+
+	w.Since = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got, _ := apexJSON.MarshalWithOptions(w, deep); !strings.Contains(string(got), `"since":"2024-01-01T00:00:00Z"`) {
+		t.Errorf("non-zero time left out: %s", got)
+	}
+	if apexJSON.DeepIsEmpty(reflect.ValueOf(span{End: 1})) || !apexJSON.DeepIsEmpty(reflect.ValueOf(span{Start: 1})) {
+		t.Error("DeepIsEmpty ignores IsZero")
+	}
+}
+
+type omitContact struct {
+	Email string `json:"email,omitempty"`
+	Phone string `json:"phone,omitempty"`
+}
+
+type omitPerson struct {
+	Name    string        `json:"name"`
+	Home    omitContact   `json:"home,omitempty"`
+	Work    *omitContact  `json:"work,omitempty"`
+	Backup  **omitContact `json:"backup,omitempty"`
+	Born    time.Time     `json:"born,omitempty"`
+	Friends []omitPerson  `json:"friends,omitempty"`
+	Boss    *omitPerson   `json:"boss,omitempty"`
+}
+
+func TestDeepOmitEmpty(t *testing.T) {
+	empty := &omitContact{}
+	p := omitPerson{
+		Name:    "ada",
+		Work:    &omitContact{},
+		Backup:  &empty,
+		Friends: []omitPerson{{Name: "bob", Home: omitContact{Phone: "1"}}},
+		Boss:    &omitPerson{Work: &omitContact{}},
+	}
+
+	// By default structs are never empty, as in encoding/json
+	got, err := apexJSON.Marshal(p)
+	want, _ := json.Marshal(p)
+	if err != nil || string(got) != string(want) {
+		t.Errorf("Marshal = %s, %v, want %s", got, err, want)
+	}
+
+	// DeepOmitEmpty looks through structs and pointers, at any depth
+	const deepWant = `{"name":"ada","friends":[{"name":"bob","home":{"phone":"1"}}]}`
+	got, err = apexJSON.MarshalWithOptions(p, apexJSON.MarshalOptions{DeepOmitEmpty: true})
+	if err != nil || string(got) != deepWant {
+		t.Errorf("DeepOmitEmpty: %s, %v, want %s", got, err, deepWant)
+	}
+
+	// A pointer cycle is not empty, and is reported by the encode
+	cyclic := &omitPerson{}
+	cyclic.Boss = cyclic
+	_, err = apexJSON.MarshalWithOptions(omitPerson{Boss: cyclic}, apexJSON.MarshalOptions{DeepOmitEmpty: true})
+	var unsupported *apexJSON.UnsupportedValueError
+	if !errors.As(err, &unsupported) {
+		t.Errorf("cycle: got %v, want UnsupportedValueError", err)
+	}
+}
+
+func TestAppendNumberMatchesMarshal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	floats := []float64{0, math.Copysign(0, -1), 1, -1.5, 1e20, 1e21, 1e-6, 1e-7, math.MaxFloat64, math.SmallestNonzeroFloat64}
+	for len(floats) < 2000 {
+		f := math.Float64frombits(rng.Uint64())
+		if !math.IsNaN(f) && !math.IsInf(f, 0) {
+			floats = append(floats, f)
+		}
+	}
+
+	check := func(v interface{}, want string) {
+		t.Helper()
+		got, err := apexJSON.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("Marshal(%T %v) = %s, want %s", v, v, got, want)
+		}
+	}
+	for _, f := range floats {
+		num := string(apexJSON.AppendNumber(nil, f, 64))
+		check(f, num)
+		check([]float64{f, f}, "["+num+","+num+"]")
+		check(map[string]interface{}{"f": f}, `{"f":`+num+`}`)
+
+		f32 := float32(f)
+		if math.IsInf(float64(f32), 0) {
+			continue
+		}
+		num32 := string(apexJSON.AppendNumber(nil, float64(f32), 32))
+		check(f32, num32)
+		check([]float32{f32}, "["+num32+"]")
+		check(map[string]interface{}{"f": f32}, `{"f":`+num32+`}`)
+
+		i := int64(rng.Uint64())
+		check(i, string(apexJSON.AppendIntNumber(nil, i)))
+		check([]int64{i}, "["+string(apexJSON.AppendIntNumber(nil, i))+"]")
+	}
+
+	if got := apexJSON.AppendNumber([]byte("x="), 0.1, 32); string(got) != "x=0.1" {
+		t.Errorf("AppendNumber does not append to dst: %s", got)
+	}
+}
+
+// TestFloatFormatMatchesStdlib checks floats are spelled as encoding/json
+// spells them, choosing between plain and exponent form at the same bounds
+func TestFloatFormatMatchesStdlib(t *testing.T) {
+	tests := []struct {
+		f    float64
+		want string
+	}{
+		{0, "0"},
+		{math.Copysign(0, -1), "-0"},
+		{100000, "100000"},
+		{1e7, "10000000"},
+		{1e20, "100000000000000000000"},
+		{1e21, "1e+21"},
+		{123456789e12, "123456789000000000000"},
+		{1e-6, "0.000001"},
+		{1e-7, "1e-7"},
+		{1.5e-9, "1.5e-9"},
+		{2.5e-10, "2.5e-10"},
+		{1e100, "1e+100"},
+		{-1e-100, "-1e-100"},
+		{math.MaxFloat64, "1.7976931348623157e+308"},
+		{math.SmallestNonzeroFloat64, "5e-324"},
+		{0.1, "0.1"},
+		{-123.456, "-123.456"},
+		{9007199254740993, "9007199254740992"},
+	}
+	for _, tt := range tests {
+		if got, err := apexJSON.Marshal(tt.f); err != nil || string(got) != tt.want {
+			t.Errorf("Marshal(%g) = %s, %v, want %s", tt.f, got, err, tt.want)
+		}
+	}
+
+	// Powers of ten across the whole range, the floats either side of the
+	// bounds where the form changes, and their float32 counterparts
+	var floats []float64
+	for exp := -325; exp <= 308; exp++ {
+		f, _ := strconv.ParseFloat("1e"+strconv.Itoa(exp), 64)
+		floats = append(floats, f, -f, 3*f, f*1.2345678901234567)
+	}
+	for _, bound := range []float64{1e-6, 1e21} {
+		floats = append(floats, bound, math.Nextafter(bound, 0), math.Nextafter(bound, math.Inf(1)))
+		b32 := float64(float32(bound))
+		floats = append(floats, b32, float64(math.Nextafter32(float32(bound), 0)), float64(math.Nextafter32(float32(bound), float32(math.Inf(1)))))
+	}
+	for _, f := range floats {
+		if math.IsInf(f, 0) {
+			continue
+		}
+		for _, v := range []interface{}{f, float32(f), []float64{f}, map[string]float32{"f": float32(f)}, struct{ F float64 }{f}} {
+			if math.IsInf(float64(float32(f)), 0) {
+				if _, ok := v.(float64); !ok {
+					continue
+				}
+			}
+			got, err := apexJSON.Marshal(v)
+			want, _ := json.Marshal(v)
+			if err != nil || string(got) != string(want) {
+				t.Errorf("Marshal(%T %v) = %s, %v, want %s", v, v, got, err, want)
+			}
+		}
+	}
+}
+
+// TestFloat32RoundTrip checks float32 values encode with their own bit
+// size, as encoding/json does, and decode back to the same value
+func TestFloat32RoundTrip(t *testing.T) {
+	type point struct {
+		X  float32   `json:"x"`
+		Y  *float32  `json:"y"`
+		Zs []float32 `json:"zs"`
+	}
+	y := float32(0.3)
+	values := []interface{}{
+		float32(0.1),
+		[]float32{0.1, 1.1, 3.4e38, 1e-45, -2.5e-8, 16777217},
+		[3]float32{0.7, 1e21, 1e20},
+		point{X: 0.1, Y: &y, Zs: []float32{0.2, 1.0 / 3}},
+		map[string]float32{"f": 0.1},
+	}
+	if got, err := apexJSON.Marshal(values[3]); err != nil || string(got) != `{"x":0.1,"y":0.3,"zs":[0.2,0.33333334]}` {
+		t.Errorf("Marshal(%v) = %s, %v", values[3], got, err)
+	}
+	for _, v := range values {
+		got, err := apexJSON.Marshal(v)
+		want, _ := json.Marshal(v)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("Marshal(%v) = %s, %v, want %s", v, got, err, want)
+		}
+
+		back := reflect.New(reflect.TypeOf(v))
+		if err := apexJSON.Unmarshal(got, back.Interface()); err != nil || !reflect.DeepEqual(back.Elem().Interface(), v) {
+			t.Errorf("Unmarshal(%s) = %v, %v, want %v", got, back.Elem(), err, v)
+		}
+	}
+}
+
+// customID encodes as a prefixed JSON string through its own methods
+type customID struct{ n int }
+
+func (id customID) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"id-%d"`, id.n)), nil
+}
+
+func (id *customID) UnmarshalJSON(data []byte) error {
+	_, err := fmt.Sscanf(string(data), `"id-%d"`, &id.n)
+	return err
+}
+
+func TestMarshalerElements(t *testing.T) {
+	ids := []customID{{1}, {2}, {3}}
+	values := []interface{}{
+		ids,
+		[2]customID{{4}, {5}},
+		map[string]customID{"a": {1}},
+		map[int]customID{7: {7}},
+		[]*customID{{8}, nil},
+	}
+	for _, v := range values {
+		got, err := apexJSON.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.Marshal(v)
+		if string(got) != string(want) {
+			t.Errorf("Marshal(%T) = %s, want %s", v, got, want)
+		}
+	}
+
+	var slice []customID
+	if err := apexJSON.Unmarshal([]byte(` [ "id-1", "id-2","id-3" ] `), &slice); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(slice, ids) {
+		t.Errorf("Unmarshal slice = %v, want %v", slice, ids)
+	}
+
+	var arr [2]customID
+	if err := apexJSON.Unmarshal([]byte(`["id-4","id-5"]`), &arr); err != nil || arr != [2]customID{{4}, {5}} {
+		t.Errorf("Unmarshal array = %v, %v", arr, err)
+	}
+
+	var m map[string]customID
+	if err := apexJSON.Unmarshal([]byte(`{"a":"id-1","b": "id-2"}`), &m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]customID{"a": {1}, "b": {2}}; !reflect.DeepEqual(m, want) {
+		t.Errorf("Unmarshal map = %v, want %v", m, want)
+	}
+
+	// Errors from UnmarshalJSON and malformed elements still stop the decode
+	if err := apexJSON.Unmarshal([]byte(`["id-1",3]`), &slice); err == nil {
+		t.Error("Unmarshal accepted an element UnmarshalJSON rejected")
+	}
+	var syntaxErr *apexJSON.SyntaxError
+	if err := apexJSON.Unmarshal([]byte(`["id-1",tru]`), &slice); !errors.As(err, &syntaxErr) {
+		t.Errorf("malformed element error = %v, want SyntaxError", err)
+	}
+}
+
+// seenJSON records the bytes its UnmarshalJSON is given and rejects
+// anything but a JSON number
+type seenJSON struct{ got []string }
+
+func (s *seenJSON) UnmarshalJSON(data []byte) error {
+	s.got = append(s.got, string(data))
+	if _, err := strconv.ParseFloat(string(data), 64); err != nil {
+		return errors.New("not a number")
+	}
+	return nil
+}
+
+func TestUnmarshalerErrorPosition(t *testing.T) {
+	// A number cut off at the end of a truncated document scans as a whole
+	// value, but the method must not see it
+	var v struct {
+		A *seenJSON `json:"a"`
+		B []seenJSON
+	}
+	for _, in := range []string{`{"a": 12`, `{"B":[1, 2`, `{"B":[1,true`, `{"a":[`} {
+		v.A, v.B = &seenJSON{}, nil
+		err := apexJSON.Unmarshal([]byte(in), &v)
+		var syntaxErr *apexJSON.SyntaxError
+		if !errors.As(err, &syntaxErr) || !errors.Is(err, io.ErrUnexpectedEOF) || syntaxErr.Offset != int64(len(in)) {
+			t.Errorf("%s: error = %v, want unexpected end at %d", in, err, len(in))
+		}
+		for _, s := range append(v.B, *v.A) {
+			for _, got := range s.got {
+				if got != "1" {
+					t.Errorf("%s: UnmarshalJSON called with %q", in, got)
+				}
+			}
+		}
+	}
+
+	// The top-level value may end the input
+	var top seenJSON
+	if err := apexJSON.Unmarshal([]byte(` 12`), &top); err != nil || !reflect.DeepEqual(top.got, []string{"12"}) {
+		t.Errorf("Unmarshal top level = %q, %v", top.got, err)
+	}
+
+	// Errors from the method carry where the value is
+	in := `{"a": 1, "B": [2, "x"]}`
+	err := apexJSON.Unmarshal([]byte(in), &v)
+	var methodErr *apexJSON.UnmarshalerError
+	if !errors.As(err, &methodErr) {
+		t.Fatalf("error = %v, want UnmarshalerError", err)
+	}
+	if methodErr.Offset != int64(strings.Index(in, `"x"`)) || methodErr.Field != "B[1]" ||
+		methodErr.Type != reflect.TypeOf(&seenJSON{}) || methodErr.Err.Error() != "not a number" {
+		t.Errorf("UnmarshalerError = %+v", methodErr)
+	}
+	if want := `json: error calling UnmarshalJSON for type *apexJSON_test.seenJSON field B[1] at offset 18: not a number`; err.Error() != want {
+		t.Errorf("Error() = %s, want %s", err, want)
+	}
+}
+
+func BenchmarkApexMarshalMarshalerSlice(b *testing.B) {
+	ids := make([]customID, 100000)
+	for i := range ids {
+		ids[i].n = i
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = apexJSON.Marshal(ids)
+	}
+}
+
+func BenchmarkApexUnmarshalUnmarshalerSlice(b *testing.B) {
+	ids := make([]customID, 100000)
+	for i := range ids {
+		ids[i].n = i
+	}
+	data, _ := apexJSON.Marshal(ids)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out []customID
+		_ = apexJSON.Unmarshal(data, &out)
+	}
+}
+
+// blobJSON carries a large payload through MarshalJSON and UnmarshalJSON
+type blobJSON struct {
+	Name string
+	Data string
+}
+
+type blobFields struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+func (b blobJSON) MarshalJSON() ([]byte, error) {
+	return apexJSON.Marshal(blobFields(b))
+}
+
+func (b *blobJSON) UnmarshalJSON(data []byte) error {
+	return apexJSON.Unmarshal(data, (*blobFields)(b))
+}
+
+// blobTo is blobJSON writing to the Buffer and reading from the Parser
+type blobTo struct {
+	Name string
+	Data string
+}
+
+func (b blobTo) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	buf.WriteString(`{"name":`)
+	buf.WriteJSONString(b.Name)
+	buf.WriteString(`,"data":`)
+	buf.WriteJSONString(b.Data)
+	buf.WriteByte('}')
+	return nil
+}
+
+func (b *blobTo) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	return p.DecodeValue((*blobFields)(b))
+}
+
+// bothID has both kinds of methods; the Apex ones win
+type bothID struct{ customID }
+
+func (id bothID) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	buf.WriteString(`{"id":`)
+	if err := apexJSON.AsMarshalerTo(id.customID).MarshalApexJSON(buf); err != nil {
+		return err
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func (id *bothID) UnmarshalApexJSON(p *apexJSON.Parser) error {
+	var wrapper struct {
+		ID apexJSON.RawMessage `json:"id"`
+	}
+	if err := p.DecodeValue(&wrapper); err != nil {
+		return err
+	}
+	inner := apexJSON.NewParser(wrapper.ID)
+	return apexJSON.AsUnmarshalerFrom(&id.customID).UnmarshalApexJSON(inner)
+}
+
+// lazyText has a pointer-receiver MarshalApexJSON and an UnmarshalApexJSON
+// that reads nothing
+type lazyText string
+
+func (l *lazyText) MarshalApexJSON(buf *apexJSON.Buffer) error {
+	if *l == "" {
+		return errors.New("empty lazyText")
+	}
+	return buf.WriteValue([]string{string(*l)})
+}
+
+func (l *lazyText) UnmarshalApexJSON(p *apexJSON.Parser) error { return nil }
+
+func TestMarshalerTo(t *testing.T) {
+	blob := blobTo{"b", "<data>"}
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{blob, `{"name":"b","data":"<data>"}`},
+		{[]blobTo{blob}, `[{"name":"b","data":"<data>"}]`},
+		{map[string]blobTo{"k": blob}, `{"k":{"name":"b","data":"<data>"}}`},
+		{struct{ B *blobTo }{&blob}, `{"B":{"name":"b","data":"<data>"}}`},
+		{[]bothID{{customID{3}}}, `[{"id":"id-3"}]`},
+		{&struct{ L lazyText }{"x"}, `{"L":["x"]}`},
+		{struct{ L lazyText }{"x"}, `{"L":"x"}`},
+		{[]lazyText{"y"}, `[["y"]]`},
+	}
+	for _, tt := range tests {
+		got, err := apexJSON.Marshal(tt.value)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("Marshal(%T) = %s, %v, want %s", tt.value, got, err, tt.want)
+		}
+	}
+
+	// Indented and encoding/json compatible output still apply
+	got, err := apexJSON.MarshalIndent([]blobTo{blob}, "", " ")
+	if want := "[\n {\n  \"name\": \"b\",\n  \"data\": \"<data>\"\n }\n]"; err != nil || string(got) != want {
+		t.Errorf("MarshalIndent = %s, %v", got, err)
+	}
+	got, err = apexJSON.MarshalWithOptions(blob, apexJSON.MarshalOptions{StdlibCompat: true})
+	if want := `{"name":"b","data":"\u003cdata\u003e"}`; err != nil || string(got) != want {
+		t.Errorf("StdlibCompat = %s, %v", got, err)
+	}
+
+	if _, err := apexJSON.Marshal([]lazyText{""}); err == nil || !strings.Contains(err.Error(), "empty lazyText") {
+		t.Errorf("MarshalApexJSON error = %v", err)
+	}
+}
+
+func TestUnmarshalerFrom(t *testing.T) {
+	var blob blobTo
+	if err := apexJSON.Unmarshal([]byte(` {"name":"b","data":"d"} `), &blob); err != nil || blob != (blobTo{"b", "d"}) {
+		t.Errorf("Unmarshal = %+v, %v", blob, err)
+	}
+
+	var nested struct {
+		List []blobTo          `json:"list"`
+		Map  map[string]blobTo `json:"map"`
+		Arr  [1]bothID         `json:"arr"`
+	}
+	in := `{"list":[{"name":"l"}],"map":{"k":{"data":"m"}},"arr":[{"id":"id-9"}]}`
+	if err := apexJSON.Unmarshal([]byte(in), &nested); err != nil {
+		t.Fatal(err)
+	}
+	if nested.List[0].Name != "l" || nested.Map["k"].Data != "m" || nested.Arr[0].n != 9 {
+		t.Errorf("Unmarshal nested = %+v", nested)
+	}
+
+	// Errors from the method and from the input are returned
+	if err := apexJSON.Unmarshal([]byte(`{"name":1}`), &blob); err == nil {
+		t.Error("type error inside UnmarshalApexJSON ignored")
+	}
+	if err := apexJSON.Unmarshal([]byte(`[{"id":"id-1"},{"id":"x"}]`), &[]bothID{}); err == nil {
+		t.Error("UnmarshalJSON error through AsUnmarshalerFrom ignored")
+	}
+	var lazy lazyText
+	if err := apexJSON.Unmarshal([]byte(`"x"`), &lazy); err == nil {
+		t.Error("UnmarshalApexJSON that read nothing accepted")
+	}
+
+	p := apexJSON.NewParser([]byte(` [1, {"a":2}] x`))
+	if raw, err := p.RawValue(); err != nil || string(raw) != `[1, {"a":2}]` {
+		t.Errorf("RawValue = %s, %v", raw, err)
+	}
+	if _, err := p.RawValue(); err == nil {
+		t.Error("RawValue accepted x")
+	}
+	if err := p.DecodeValue(blob); err == nil {
+		t.Error("DecodeValue into a non-pointer accepted")
+	}
+}
+
+var errFailing = errors.New("failing marshaler")
+
+// Types whose marshal methods fail, or write invalid JSON
+type (
+	failJSON    struct{}
+	failPtrJSON struct{}
+	failText    int
+	failTo      struct{}
+	badJSON     struct{}
+)
+
+func (failJSON) MarshalJSON() ([]byte, error)             { return nil, errFailing }
+func (*failPtrJSON) MarshalJSON() ([]byte, error)         { return nil, errFailing }
+func (failText) MarshalText() ([]byte, error)             { return nil, errFailing }
+func (failTo) MarshalApexJSON(buf *apexJSON.Buffer) error { return errFailing }
+func (badJSON) MarshalJSON() ([]byte, error)              { return []byte(`{"a":`), nil }
+
+func TestMarshalerError(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		typ    reflect.Type
+		method string
+	}{
+		{struct{ F failJSON }{}, reflect.TypeOf(failJSON{}), "MarshalJSON"},
+		{&struct{ F failPtrJSON }{}, reflect.TypeOf(failPtrJSON{}), "MarshalJSON"},
+		{[]failText{1}, reflect.TypeOf(failText(0)), "MarshalText"},
+		{map[string]failTo{"k": {}}, reflect.TypeOf(failTo{}), "MarshalApexJSON"},
+		{[]interface{}{&failJSON{}}, reflect.TypeOf(failJSON{}), "MarshalJSON"},
+	}
+	for _, tt := range tests {
+		_, err := apexJSON.Marshal(tt.value)
+		var merr *apexJSON.MarshalerError
+		if !errors.As(err, &merr) || merr.Type != tt.typ || !errors.Is(err, errFailing) {
+			t.Errorf("Marshal(%T) error = %#v, want MarshalerError for %v wrapping errFailing", tt.value, err, tt.typ)
+			continue
+		}
+		if want := "json: error calling " + tt.method + " for type " + tt.typ.String() + ": failing marshaler"; err.Error() != want {
+			t.Errorf("Marshal(%T) error = %q, want %q", tt.value, err, want)
+		}
+	}
+
+	// Output found to be invalid is reported against the type that wrote it
+	var merr *apexJSON.MarshalerError
+	_, err := apexJSON.MarshalWithOptions([]badJSON{{}}, apexJSON.MarshalOptions{StdlibCompat: true})
+	if !errors.As(err, &merr) || merr.Type != reflect.TypeOf(badJSON{}) || merr.Unwrap() == nil {
+		t.Errorf("invalid MarshalJSON output: %v", err)
+	}
+	_, err = apexJSON.Marshal(apexJSON.RawMessage(`{"a":`))
+	if !errors.As(err, &merr) || merr.Type != reflect.TypeOf(apexJSON.RawMessage(nil)) {
+		t.Errorf("invalid RawMessage: %v", err)
+	}
+}
+
+// spacedJSON writes valid output padded with insignificant whitespace
+type spacedJSON struct{}
+
+func (spacedJSON) MarshalJSON() ([]byte, error) {
+	return []byte(" {\n\t\"a\" : [ 1 , \"x y\" ]\n} "), nil
+}
+
+func TestMarshalerOutputChecked(t *testing.T) {
+	v := struct {
+		S spacedJSON
+		B []badJSON `json:",omitempty"`
+	}{}
+	data, err := apexJSON.Marshal(v)
+	std, _ := json.Marshal(v)
+	if err != nil || string(data) != `{"S":{"a":[1,"x y"]}}` || string(data) != string(std) {
+		t.Errorf("Marshal = %s, %v; encoding/json %s", data, err, std)
+	}
+
+	// Invalid output fails naming the type, instead of the document
+	// becoming invalid far from it
+	v.B = []badJSON{{}}
+	var merr *apexJSON.MarshalerError
+	if _, err := apexJSON.Marshal(v); !errors.As(err, &merr) || merr.Type != reflect.TypeOf(badJSON{}) {
+		t.Errorf("invalid MarshalJSON output: %v", err)
+	}
+
+	// Trusted output is written as is
+	trust := apexJSON.MarshalOptions{TrustMarshalers: true}
+	data, err = apexJSON.MarshalWithOptions(v, trust)
+	if err != nil || string(data) != "{\"S\": {\n\t\"a\" : [ 1 , \"x y\" ]\n} ,\"B\":[{\"a\":]}" {
+		t.Errorf("TrustMarshalers: %s, %v", data, err)
+	}
+	trust.StdlibCompat = true
+	if _, err := apexJSON.MarshalWithOptions(v, trust); !errors.As(err, &merr) {
+		t.Errorf("TrustMarshalers with StdlibCompat: %v", err)
+	}
+}
+
+// largeBlob is a custom type around a 64 KiB payload
+func largeBlob() (blobJSON, blobTo) {
+	data := strings.Repeat("payload ", 8192)
+	return blobJSON{"large", data}, blobTo{"large", data}
+}
+
+func BenchmarkApexMarshalBlobMarshalJSON(b *testing.B) {
+	v, _ := largeBlob()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = apexJSON.Marshal(&v)
+	}
+}
+
+func BenchmarkApexMarshalBlobMarshalApexJSON(b *testing.B) {
+	_, v := largeBlob()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = apexJSON.Marshal(&v)
+	}
+}
+
+func BenchmarkApexUnmarshalBlobUnmarshalJSON(b *testing.B) {
+	v, _ := largeBlob()
+	data, _ := apexJSON.Marshal(v)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out blobJSON
+		_ = apexJSON.Unmarshal(data, &out)
+	}
+}
+
+func BenchmarkApexUnmarshalBlobUnmarshalApexJSON(b *testing.B) {
+	_, v := largeBlob()
+	data, _ := apexJSON.Marshal(v)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out blobTo
+		_ = apexJSON.Unmarshal(data, &out)
+	}
+}
+
+type sizedRow struct {
+	ID   int    `json:"id"`
+	Note string `json:"note"`
+}
+
+type sizedReport struct {
+	Rows []sizedRow `json:"rows"`
+}
+
+func TestSizeHint(t *testing.T) {
+	report := sizedReport{Rows: make([]sizedRow, 5000)}
+	for i := range report.Rows {
+		report.Rows[i] = sizedRow{ID: i, Note: strings.Repeat("x", 200)}
+	}
+	want, err := apexJSON.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grows := 0
+	defer apexJSON.SetGrowHook(func(int, int) { grows++ })()
+	count := func(name string, max int, encode func() []byte) {
+		t.Helper()
+		grows = 0
+		if got := encode(); string(got) != string(want) {
+			t.Errorf("%s: output differs from Marshal", name)
+		}
+		if grows > max {
+			t.Errorf("%s: buffer reallocated %d times, want at most %d", name, grows, max)
+		}
+	}
+	marshal := func() []byte {
+		out, err := apexJSON.Marshal(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// Without a hint the pooled buffer grows several times
+	grows = 0
+	marshal()
+	if grows < 2 {
+		t.Fatalf("unhinted Marshal reallocated %d times; the test value is too small", grows)
+	}
+
+	// The encoder reserves a little room ahead of long strings, so a good
+	// hint leaves some slack over the exact output size
+	hint := len(want) + 256
+	reportType := reflect.TypeOf(report)
+	apexJSON.SetTypeSizeHint(reportType, hint)
+	defer apexJSON.SetTypeSizeHint(reportType, 0)
+
+	count("Marshal with type hint", 0, marshal)
+	count("Marshal pointer with type hint", 0, func() []byte {
+		out, err := apexJSON.Marshal(&report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	})
+	count("MarshalToWriter with type hint", 0, func() []byte {
+		var w strings.Builder
+		if err := apexJSON.MarshalToWriter(report, &w); err != nil {
+			t.Fatal(err)
+		}
+		return []byte(w.String())
+	})
+
+	// MarshalOptions.SizeHint needs no registration
+	apexJSON.SetTypeSizeHint(reportType, 0)
+	count("MarshalValue with SizeHint", 1, func() []byte {
+		buf := &apexJSON.Buffer{}
+		opts := &apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{SizeHint: hint}}
+		if err := apexJSON.MarshalValueWithOptions(reflect.ValueOf(report), buf, opts); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	})
+
+	var out strings.Builder
+	enc := apexJSON.NewEncoder(&out)
+	if err := enc.SetMarshalOptions(apexJSON.MarshalOptions{SizeHint: hint}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		count("Encoder.Encode with SizeHint", 1, func() []byte {
+			out.Reset()
+			if err := enc.Encode(report); err != nil {
+				t.Fatal(err)
+			}
+			return []byte(strings.TrimSuffix(out.String(), "\n"))
+		})
+	}
+}
+
+func TestUnmarshalIntegerKinds(t *testing.T) {
+	numbers := []string{
+		"0", "-0", "7", "-7", "127", "128", "-128", "-129", "255", "256",
+		"32767", "32768", "-32769", "65535", "65536",
+		"2147483647", "2147483648", "-2147483648", "-2147483649", "4294967295", "4294967296",
+		"123456789012345678", "-123456789012345678",
+		"1234567890123456789", "-1234567890123456789",
+		"9223372036854775807", "9223372036854775808", "-9223372036854775808", "-9223372036854775809",
+		"9999999999999999999", "-9999999999999999999",
+		"18446744073709551615", "18446744073709551616", "99999999999999999999", "-18446744073709551615",
+		"1.5", "1e3",
+	}
+	targets := []interface{}{
+		new(int), new(int8), new(int16), new(int32), new(int64),
+		new(uint), new(uint8), new(uint16), new(uint32), new(uint64),
+	}
+
+	for _, target := range targets {
+		v := reflect.ValueOf(target).Elem()
+		for _, s := range numbers {
+			var want interface{}
+			var wantErr error
+			switch v.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				var n int64
+				n, wantErr = strconv.ParseInt(s, 10, v.Type().Bits())
+				want = reflect.ValueOf(n).Convert(v.Type()).Interface()
+			default:
+				var n uint64
+				n, wantErr = strconv.ParseUint(s, 10, v.Type().Bits())
+				want = reflect.ValueOf(n).Convert(v.Type()).Interface()
+			}
+
+			v.Set(reflect.Zero(v.Type()))
+			err := apexJSON.Unmarshal([]byte(s), target)
+			if wantErr != nil {
+				var typeErr *apexJSON.UnmarshalTypeError
+				if !errors.As(err, &typeErr) {
+					t.Errorf("%s into %s: error = %v, want UnmarshalTypeError like strconv's %v", s, v.Type(), err, wantErr)
+				}
+				continue
+			}
+			if err != nil || v.Interface() != want {
+				t.Errorf("%s into %s = %v, %v; want %v", s, v.Type(), v.Interface(), err, want)
+			}
+		}
+	}
+}
+
+func TestSortMapKeys(t *testing.T) {
+	type event struct {
+		Name   string                 `json:"name"`
+		Attrs  map[string]interface{} `json:"attrs"`
+		Labels map[string]string      `json:"labels"`
+		Counts map[string]int         `json:"counts"`
+		ByCode map[int]string         `json:"by_code"`
+		Nested []map[string]float64   `json:"nested"`
+	}
+	value := event{
+		Name: "deploy",
+		Attrs: map[string]interface{}{
+			"zone": "b", "attempt": 3, "ok": true, "owner": nil,
+			"inner": map[string]interface{}{"y": 1, "x": []interface{}{map[string]interface{}{"d": 1, "c": 2}}, "w": "v"},
+		},
+		Labels: map[string]string{"team": "infra", "env": "prod", "app": "api", "region": "eu"},
+		Counts: map[string]int{"retries": 2, "hosts": 12, "errors": 0},
+		ByCode: map[int]string{500: "error", 200: "ok", 1000: "custom", -1: "unknown"},
+		Nested: []map[string]float64{{"p99": 1.5, "p50": 0.25, "max": 9}},
+	}
+
+	want, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{SortMapKeys: true}}
+	for i := 0; i < 200; i++ {
+		buf := &apexJSON.Buffer{}
+		if err := apexJSON.MarshalValueWithOptions(reflect.ValueOf(value), buf, opts); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf.Bytes()) != string(want) {
+			t.Fatalf("run %d: got %s, want %s", i, buf.Bytes(), want)
+		}
+	}
+
+	// The keys of interface-keyed maps sort by their resolved text
+	buf := &apexJSON.Buffer{}
+	mixed := map[interface{}]int{"b": 1, 10: 2, "a": 3, 2: 4}
+	if err := apexJSON.MarshalValueWithOptions(reflect.ValueOf(mixed), buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"10":2,"2":4,"a":3,"b":1}`; string(buf.Bytes()) != want {
+		t.Errorf("got %s, want %s", buf.Bytes(), want)
+	}
+}
+
+var errBrokenField = errors.New("broken field")
+
+type brokenField struct{}
+
+func (brokenField) MarshalJSON() ([]byte, error) { return nil, errBrokenField }
+
+func TestMarshalPartial(t *testing.T) {
+	type inner struct {
+		OK     int         `json:"ok"`
+		Broken brokenField `json:"broken"`
+	}
+	type record struct {
+		First  float64                `json:"first"`
+		Name   string                 `json:"name"`
+		Ratio  float64                `json:"ratio,string"`
+		Items  []inner                `json:"items"`
+		Attrs  map[string]interface{} `json:"attrs"`
+		Bad    map[interface{}]int    `json:"bad"`
+		Values []float64              `json:"values"`
+		Last   brokenField            `json:"last"`
+	}
+	value := record{
+		First:  math.NaN(),
+		Name:   "req",
+		Ratio:  math.Inf(1),
+		Items:  []inner{{OK: 1}, {OK: 2}},
+		Attrs:  map[string]interface{}{"nested": []interface{}{1, math.Inf(-1)}},
+		Bad:    map[interface{}]int{nil: 1},
+		Values: []float64{1, math.NaN()},
+	}
+
+	tests := []struct {
+		name        string
+		placeholder []byte
+		want        string
+	}{
+		{"null", nil,
+			`{"first":null,"name":"req","ratio":null,"items":[{"ok":1,"broken":null},{"ok":2,"broken":null}],` +
+				`"attrs":{"nested":[1,null]},"bad":null,"values":[1,null],"last":null}`},
+		{"placeholder", []byte(`{"error":true}`),
+			`{"first":{"error":true},"name":"req","ratio":{"error":true},"items":[{"ok":1,"broken":{"error":true}},{"ok":2,"broken":{"error":true}}],` +
+				`"attrs":{"nested":[1,{"error":true}]},"bad":{"error":true},"values":[1,{"error":true}],"last":{"error":true}}`},
+	}
+	wantPaths := []string{"first", "ratio", "items[0].broken", "items[1].broken", "attrs.nested[1]", "bad", "values[1]", "last"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &apexJSON.Buffer{}
+			opts := &apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{PartialPlaceholder: tt.placeholder}}
+			faults := apexJSON.MarshalPartialValue(reflect.ValueOf(value), buf, opts)
+			if string(buf.Bytes()) != tt.want {
+				t.Errorf("got  %s\nwant %s", buf.Bytes(), tt.want)
+			}
+			if !json.Valid(buf.Bytes()) {
+				t.Errorf("output is not valid JSON: %s", buf.Bytes())
+			}
+			if len(faults) != len(wantPaths) {
+				t.Fatalf("got %d field errors, want %d: %v", len(faults), len(wantPaths), faults)
+			}
+			for i, f := range faults {
+				if f.Path != wantPaths[i] {
+					t.Errorf("fault %d: path %q, want %q", i, f.Path, wantPaths[i])
+				}
+			}
+			if !errors.Is(&faults[2], errBrokenField) {
+				t.Errorf("fault %v does not wrap the MarshalJSON error", faults[2].Err)
+			}
+		})
+	}
+
+	// The root value itself failing leaves just the placeholder
+	data, faults := apexJSON.MarshalPartial(math.NaN())
+	if string(data) != "null" || len(faults) != 1 || faults[0].Path != "" {
+		t.Errorf("MarshalPartial(NaN) = %s, %v", data, faults)
+	}
+
+	// Without failures the output matches Marshal
+	want, _ := apexJSON.Marshal(simple)
+	if data, faults := apexJSON.MarshalPartial(simple); string(data) != string(want) || faults != nil {
+		t.Errorf("MarshalPartial(simple) = %s, %v; want %s", data, faults, want)
+	}
+
+	buf := &apexJSON.Buffer{}
+	opts := &apexJSON.Options{MarshalOptions: apexJSON.MarshalOptions{PartialPlaceholder: []byte(`{"error"`)}}
+	if faults := apexJSON.MarshalPartialValue(reflect.ValueOf(simple), buf, opts); len(faults) != 1 || string(buf.Bytes()) != "null" {
+		t.Errorf("invalid placeholder: %s, %v", buf.Bytes(), faults)
+	}
+}
+
+// largeObject is a 5k-member object with string values, and with mixed
+// values when mixed is set
+func largeObject(mixed bool) []byte {
+	m := make(map[string]interface{}, 5000)
+	for i := 0; i < 5000; i++ {
+		key := "key_" + strconv.Itoa(i)
+		switch {
+		case !mixed || i%3 == 0:
+			m[key] = "value_" + strconv.Itoa(i)
+		case i%3 == 1:
+			m[key] = float64(i)
+		default:
+			m[key] = map[string]interface{}{"ok": i%2 == 0}
+		}
+	}
+	data, _ := json.Marshal(m)
+	return data
+}
+
+func BenchmarkApexUnmarshalStringStringMap(b *testing.B) {
+	data := largeObject(false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var m map[string]string
+		_ = apexJSON.Unmarshal(data, &m)
+	}
+}
+
+func BenchmarkApexUnmarshalStringInterfaceMap(b *testing.B) {
+	data := largeObject(true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var m map[string]interface{}
+		_ = apexJSON.Unmarshal(data, &m)
+	}
+}
+
+func TestUnmarshalMapFastPaths(t *testing.T) {
+	// Named map types take the generic reflect path, so they give the
+	// expected result for each input
+	type namedStrings map[string]string
+	type namedValues map[string]interface{}
+
+	inputs := []string{
+		`{}`,
+		`{"a":"x","b":"yé","a":"dup"}`,
+		`{ "a" : null , "b":"z" }`,
+		`{"n":12345678901234567890,"f":1.5,"o":{"k":[1,"s",null,true]},"e":"\n"}`,
+		`{"a":1}`,
+		`{"a":"x",}`,
+		`{"a" "x"}`,
+		`{"a":"x"`,
+	}
+	for _, useNumber := range []bool{false, true} {
+		opts := &apexJSON.Options{UseNumber: useNumber}
+		for _, in := range inputs {
+			var fast map[string]string
+			var slow namedStrings
+			fastErr := apexJSON.UnmarshalValue([]byte(in), reflect.ValueOf(&fast), opts)
+			slowErr := apexJSON.UnmarshalValue([]byte(in), reflect.ValueOf(&slow), opts)
+			if fmt.Sprint(fastErr) != fmt.Sprint(slowErr) || (fastErr == nil && !reflect.DeepEqual(fast, map[string]string(slow))) {
+				t.Errorf("map[string]string %s: got %v, %v; want %v, %v", in, fast, fastErr, slow, slowErr)
+			}
+
+			var fastAny map[string]interface{}
+			var slowAny namedValues
+			fastErr = apexJSON.UnmarshalValue([]byte(in), reflect.ValueOf(&fastAny), opts)
+			slowErr = apexJSON.UnmarshalValue([]byte(in), reflect.ValueOf(&slowAny), opts)
+			if fmt.Sprint(fastErr) != fmt.Sprint(slowErr) || (fastErr == nil && !reflect.DeepEqual(fastAny, map[string]interface{}(slowAny))) {
+				t.Errorf("map[string]interface{} %s (UseNumber %v): got %v, %v; want %v, %v", in, useNumber, fastAny, fastErr, slowAny, slowErr)
+			}
+		}
+	}
+
+	// Decoding into a non-nil map adds to it, and the element budget applies
+	m := map[string]string{"keep": "1"}
+	if err := apexJSON.Unmarshal([]byte(`{"new":"2"}`), &m); err != nil || len(m) != 2 {
+		t.Errorf("Unmarshal into existing map = %v, %v", m, err)
+	}
+	var budget map[string]interface{}
+	err := apexJSON.UnmarshalValue([]byte(`{"a":1,"b":2,"c":3}`), reflect.ValueOf(&budget), &apexJSON.Options{MaxDecodedElements: 2})
+	if !errors.Is(err, apexJSON.ErrDecodeBudgetExceeded) {
+		t.Errorf("MaxDecodedElements: err = %v", err)
+	}
+}
+
+type proxiedRequest struct {
+	ID     int    `json:"id"`
+	Method string `json:"method"`
+	apexJSON.Unknown
+}
+
+func TestUnknownRoundTrip(t *testing.T) {
+	in := `{"trace":{"span":[1,2.50,{"deep":"é"}],"sampled":true},"id":7,"extra":null,` +
+		`"method":"GET","Unknown":"not special","big":12345678901234567890}`
+
+	var req proxiedRequest
+	if err := apexJSON.Unmarshal([]byte(in), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.ID != 7 || req.Method != "GET" || len(req.Unknown) != 4 {
+		t.Fatalf("decoded %+v", req)
+	}
+	if got := string(req.Unknown["trace"]); got != `{"span":[1,2.50,{"deep":"é"}],"sampled":true}` {
+		t.Errorf("trace kept as %s", got)
+	}
+
+	// Change a declared field and encode again: extra members follow the
+	// fields in key order with their bytes untouched
+	req.Method = "POST"
+	out, err := apexJSON.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":7,"method":"POST","Unknown":"not special","big":12345678901234567890,"extra":null,` +
+		`"trace":{"span":[1,2.50,{"deep":"é"}],"sampled":true}}`
+	if string(out) != want {
+		t.Errorf("got  %s\nwant %s", out, want)
+	}
+
+	// A second round trip is stable, and the source bytes are not retained
+	data := []byte(in)
+	var again proxiedRequest
+	if err := apexJSON.Unmarshal(data, &again); err != nil {
+		t.Fatal(err)
+	}
+	clear(data)
+	if again.Method = "POST"; !reflect.DeepEqual(again, req) {
+		t.Errorf("second decode = %+v, want %+v", again, req)
+	}
+
+	// Unknown members never replace declared ones, and nil values are null
+	req.Unknown = apexJSON.Unknown{"id": apexJSON.RawMessage(`99`), "z": nil}
+	if out, _ := apexJSON.Marshal(req); string(out) != `{"id":7,"method":"POST","z":null}` {
+		t.Errorf("collisions: got %s", out)
+	}
+
+	// Unknown values are checked like RawMessage values
+	req.Unknown = apexJSON.Unknown{"bad": apexJSON.RawMessage(`{"a":`)}
+	_, err = apexJSON.Marshal(req)
+	var me *apexJSON.MarshalerError
+	if !errors.As(err, &me) || !strings.Contains(err.Error(), `"bad"`) {
+		t.Errorf("invalid unknown member: got %v, want MarshalerError naming bad", err)
+	}
+
+	// Without unknown members the output is the struct alone
+	if out, _ := apexJSON.Marshal(proxiedRequest{ID: 1}); string(out) != `{"id":1,"method":""}` {
+		t.Errorf("no unknown members: got %s", out)
+	}
+	schema, err := apexJSON.TypeSchema(reflect.TypeOf(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := schema[len(schema)-1]; !last.Options.Unknown {
+		t.Errorf("TypeSchema does not flag the Unknown field: %+v", last)
+	}
+
+	if err := apexJSON.Unmarshal([]byte(`{"id":1,"x":[1,}`), &req); err == nil {
+		t.Error("malformed unknown member accepted")
+	}
+
+	// RawMessage fields round-trip the same way on their own
+	var raw struct {
+		V apexJSON.RawMessage `json:"v"`
+	}
+	if err := apexJSON.Unmarshal([]byte(`{"v":[1, 2]}`), &raw); err != nil || string(raw.V) != `[1, 2]` {
+		t.Errorf("RawMessage field = %s, %v", raw.V, err)
+	}
+	if out, _ := apexJSON.Marshal(raw); string(out) != `{"v":[1, 2]}` {
+		t.Errorf("RawMessage marshal = %s", out)
+	}
+}
+
+// mergedRecord has explicit fields and two Unknown fields, the second of
+// which is ignored
+type mergedRecord struct {
+	apexJSON.Unknown
+	ID       int              `json:"id"`
+	Note     string           `json:"note,omitempty"`
+	GoName   string           `json:"renamed"`
+	Unknown2 apexJSON.Unknown `json:"rest"`
+}
+
+func TestUnknownMergeOrder(t *testing.T) {
+	rec := mergedRecord{
+		ID:     1,
+		GoName: "r",
+		Unknown: apexJSON.Unknown{
+			"id": apexJSON.RawMessage(`2`), "note": apexJSON.RawMessage(`"lost"`), "renamed": apexJSON.RawMessage(`0`),
+			"GoName": apexJSON.RawMessage(`3`), "": apexJSON.RawMessage(`4`), "é": apexJSON.RawMessage(`5`),
+			"a\"": apexJSON.RawMessage(`6`), "Z": apexJSON.RawMessage(`7`), "a": apexJSON.RawMessage(`8`),
+		},
+		Unknown2: apexJSON.Unknown{"Z": apexJSON.RawMessage(`9`), "zz": apexJSON.RawMessage(`10`)},
+	}
+	// Explicit fields first, in declaration order, even the omitted note
+	// winning over its Unknown member; then the other members by key
+	const want = `{"id":1,"renamed":"r","":4,"GoName":3,"Z":7,"a":8,"a\"":6,"é":5}`
+	for i := 0; i < 20; i++ {
+		got, err := apexJSON.Marshal(rec)
+		if err != nil || string(got) != want {
+			t.Fatalf("Marshal = %s, %v, want %s", got, err, want)
+		}
+	}
+
+	_, err := apexJSON.MarshalWithOptions(rec, apexJSON.MarshalOptions{StrictUnknown: true})
+	var collision *apexJSON.UnknownCollisionError
+	if !errors.As(err, &collision) || collision.Key != "id" || collision.Type != reflect.TypeOf(rec) {
+		t.Errorf("StrictUnknown: got %v, want UnknownCollisionError for id", err)
+	}
+	rec.Unknown = apexJSON.Unknown{"GoName": apexJSON.RawMessage(`3`)}
+	if got, err := apexJSON.MarshalWithOptions(rec, apexJSON.MarshalOptions{StrictUnknown: true}); err != nil ||
+		string(got) != `{"id":1,"renamed":"r","GoName":3}` {
+		t.Errorf("StrictUnknown without collisions: %s, %v", got, err)
+	}
+
+	// A malformed member fails the encode even after colliding ones are
+	// dropped, and a colliding member is dropped without being checked
+	rec.Unknown = apexJSON.Unknown{"id": apexJSON.RawMessage(`{`), "a": apexJSON.RawMessage(`1`), "b": apexJSON.RawMessage(`1 2`)}
+	_, err = apexJSON.Marshal(rec)
+	var me *apexJSON.MarshalerError
+	if !errors.As(err, &me) || !strings.Contains(err.Error(), `"b"`) {
+		t.Errorf("malformed member: got %v, want MarshalerError naming b", err)
+	}
+	rec.Unknown = apexJSON.Unknown{"id": apexJSON.RawMessage(`{`), "a": apexJSON.RawMessage(` [ 1 ] `)}
+	if got, err := apexJSON.Marshal(rec); err != nil || string(got) != `{"id":1,"renamed":"r","a": [ 1 ] }` {
+		t.Errorf("dropped malformed collision: %s, %v", got, err)
+	}
+
+	// The first Unknown collects the members no field takes on decode too
+	var back mergedRecord
+	if err := apexJSON.Unmarshal([]byte(`{"id":5,"rest":{"a":1},"x":2}`), &back); err != nil ||
+		back.ID != 5 || back.Unknown2 != nil || len(back.Unknown) != 2 || string(back.Unknown["rest"]) != `{"a":1}` {
+		t.Errorf("Unmarshal = %+v, %v", back, err)
+	}
+
+	// Writing the members allocates nothing beyond the struct alone
+	rec.Unknown = apexJSON.Unknown{"b": apexJSON.RawMessage(`1`), "a": nil, "c": apexJSON.RawMessage(`[]`)}
+	withMembers := testing.AllocsPerRun(100, func() { _, _ = apexJSON.Marshal(rec) })
+	rec.Unknown = nil
+	without := testing.AllocsPerRun(100, func() { _, _ = apexJSON.Marshal(rec) })
+	if withMembers > without && !raceEnabled {
+		t.Errorf("Marshal with Unknown members: %v allocs, %v without", withMembers, without)
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	type event struct {
+		Type    string                         `json:"type"`
+		Payload apexJSON.RawMessage            `json:"payload"`
+		Ptr     *apexJSON.RawMessage           `json:"ptr"`
+		List    []apexJSON.RawMessage          `json:"list"`
+		ByName  map[string]apexJSON.RawMessage `json:"by_name"`
+		Nested  struct {
+			Raw apexJSON.RawMessage `json:"raw"`
+		} `json:"nested"`
+	}
+	in := []byte(`{"type":"order","payload": {"id": 7, "s": "a\"b"} ,"ptr":null,` +
+		`"list":[1, "x", null, [ ]],"by_name":{"a":{"b":[true]}},"nested":{"raw":"s"}}`)
+
+	var got event
+	if err := apexJSON.Unmarshal(in, &got); err != nil {
+		t.Fatal(err)
+	}
+	var want event
+	if err := json.Unmarshal(in, &want); err != nil {
+		t.Fatal(err)
+	}
+	// encoding/json's RawMessage keeps the same bytes under another type
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) || string(got.Payload) != `{"id": 7, "s": "a\"b"}` {
+		t.Errorf("decoded %s\nwant %s", gotJSON, wantJSON)
+	}
+
+	out, err := apexJSON.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"order","payload":{"id": 7, "s": "a\"b"},"ptr":null,` +
+		`"list":[1,"x",null,[ ]],"by_name":{"a":{"b":[true]}},"nested":{"raw":"s"}}`; string(out) != want {
+		t.Errorf("Marshal = %s\nwant %s", out, want)
+	}
+
+	// The captured bytes are copies
+	for i := range in {
+		in[i] = '#'
+	}
+	for _, raw := range got.ByName {
+		if string(raw) != `{"b":[true]}` {
+			t.Errorf("map RawMessage aliases the input: %s", raw)
+		}
+	}
+	if string(got.Payload) != `{"id": 7, "s": "a\"b"}` || string(got.List[1]) != `"x"` || string(got.Nested.Raw) != `"s"` {
+		t.Errorf("RawMessage aliases the input: %s %s %s", got.Payload, got.List[1], got.Nested.Raw)
+	}
+
+	// nil is null and invalid bytes are an error, wherever they are
+	if out, err := apexJSON.Marshal([]apexJSON.RawMessage{nil, {}}); err == nil {
+		t.Errorf("empty RawMessage accepted: %s", out)
+	}
+	if out, err := apexJSON.Marshal(map[string]apexJSON.RawMessage{"a": nil}); err != nil || string(out) != `{"a":null}` {
+		t.Errorf("nil RawMessage = %s, %v", out, err)
+	}
+	for _, v := range []interface{}{
+		apexJSON.RawMessage(`{"a":`),
+		struct{ R apexJSON.RawMessage }{apexJSON.RawMessage(`1 2`)},
+		map[string]apexJSON.RawMessage{"a": apexJSON.RawMessage(`tru`)},
+	} {
+		if out, err := apexJSON.Marshal(v); err == nil {
+			t.Errorf("Marshal(%T) of invalid RawMessage = %s", v, out)
+		}
+	}
+}
+
+func TestTraceHooks(t *testing.T) {
+	var decStarts, decEnds, encStarts, encEnds int
+	var sizes []int
+	var errs []error
+	apexJSON.SetTraceHooks(apexJSON.Hooks{
+		OnDecodeStart: func(size int) func(error) {
+			decStarts++
+			sizes = append(sizes, size)
+			return func(err error) {
+				decEnds++
+				errs = append(errs, err)
+			}
+		},
+		OnEncodeStart: func(typ reflect.Type) func(int, error) {
+			encStarts++
+			return func(size int, err error) {
+				encEnds++
+				sizes = append(sizes, size)
+				errs = append(errs, err)
+			}
+		},
+	})
+	defer apexJSON.SetTraceHooks(apexJSON.Hooks{})
+
+	var s SimpleStruct
+	apexJSON.Marshal(simple)
+	apexJSON.Marshal(make(chan int))
+	apexJSON.Unmarshal(simpleJSON, &s)
+	apexJSON.Unmarshal([]byte(`{"name":`), &s)
+
+	var out bytes.Buffer
+	enc := apexJSON.NewEncoder(&out)
+	enc.Encode(simple)
+	enc.Encode(make(chan int))
+	dec := apexJSON.NewDecoder(strings.NewReader(`{"name":"a"} [`))
+	dec.Decode(&s)
+	dec.Decode(&s)
+
+	// Every public call starts and ends exactly once, failures included,
+	// and calls made inside them, such as by Optional, aren't traced
+	if decStarts != 4 || decEnds != 4 || encStarts != 4 || encEnds != 4 {
+		t.Fatalf("decode %d/%d, encode %d/%d; want 4 of each", decStarts, decEnds, encStarts, encEnds)
+	}
+	encoded := len(bytes.TrimSpace(out.Bytes()))
+	wantSizes := []int{len(simpleJSON), 0, len(simpleJSON), 8, encoded, 0, -1, -1}
+	if !reflect.DeepEqual(sizes, wantSizes) {
+		t.Errorf("sizes = %v, want %v", sizes, wantSizes)
+	}
+	for i, failed := range []bool{false, true, false, true, false, true, false, true} {
+		if (errs[i] != nil) != failed {
+			t.Errorf("call %d ended with %v", i, errs[i])
+		}
+	}
+
+	var opt struct {
+		V apexJSON.Optional[int] `json:"v"`
+	}
+	apexJSON.Unmarshal([]byte(`{"v":1}`), &opt)
+	apexJSON.Marshal(opt)
+	if decStarts != 5 || encStarts != 5 {
+		t.Errorf("Optional traced its own calls: %d decodes, %d encodes", decStarts, encStarts)
+	}
+
+	apexJSON.SetTraceHooks(apexJSON.Hooks{})
+	apexJSON.Marshal(simple)
+	if encStarts != 5 {
+		t.Error("hooks still called after removal")
+	}
+}
+
+func TestControlCharacterKeys(t *testing.T) {
+	keys := []string{"nul\x00key", "line\nbreak", `say "hi"`, `back\slash`, "\x1f", "tab\t", "plain"}
+
+	ints := map[string]int{}
+	anys := map[string]interface{}{}
+	for i, k := range keys {
+		ints[k] = i
+		anys[k] = k
+	}
+
+	for _, v := range []interface{}{ints, anys} {
+		data, err := apexJSON.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !json.Valid(data) {
+			t.Fatalf("Marshal(%T) wrote invalid JSON: %q", v, data)
+		}
+
+		// The standard library reads back the same keys, and so does
+		// Unmarshal, into maps and a struct's Unknown
+		std := reflect.New(reflect.TypeOf(v))
+		if err := json.Unmarshal(data, std.Interface()); err != nil || !reflect.DeepEqual(std.Elem().Interface(), v) {
+			t.Errorf("encoding/json read %q as %v, %v", data, std.Elem(), err)
+		}
+		got := reflect.New(reflect.TypeOf(v))
+		if err := apexJSON.Unmarshal(data, got.Interface()); err != nil || !reflect.DeepEqual(got.Elem().Interface(), v) {
+			t.Errorf("Unmarshal(%q) = %v, %v", data, got.Elem(), err)
+		}
+		var rest struct {
+			Plain interface{} `json:"plain"`
+			apexJSON.Unknown
+		}
+		if err := apexJSON.Unmarshal(data, &rest); err != nil || len(rest.Unknown) != len(keys)-1 {
+			t.Errorf("Unknown = %q, %v", rest.Unknown, err)
+		}
+		again, err := apexJSON.Marshal(rest)
+		if err != nil || !json.Valid(again) {
+			t.Errorf("Marshal of Unknown = %q, %v", again, err)
+		}
+
+		// Every key is found by its decoded text
+		for _, k := range keys {
+			raw, err := apexJSON.ExtractErr(data, k)
+			if err != nil {
+				t.Errorf("ExtractErr(%q) in %q: %v", k, data, err)
+				continue
+			}
+			var want []byte
+			want, _ = json.Marshal(reflect.ValueOf(v).MapIndex(reflect.ValueOf(k)).Interface())
+			if string(raw) != string(want) {
+				t.Errorf("ExtractErr(%q) = %s, want %s", k, raw, want)
+			}
+		}
+	}
+
+	// Segments match keys however they are escaped, at any depth
+	doc := []byte(`{"out\u0000er":{"say \"hi\"":{"ab\n":[1]}},"x":2}`)
+	if raw, err := apexJSON.ExtractErr(doc, "out\x00er", `say "hi"`, "ab\n"); err != nil || string(raw) != "[1]" {
+		t.Errorf("nested ExtractErr = %s, %v", raw, err)
+	}
+	if _, err := apexJSON.ExtractErr(doc, `out\u0000er`); !errors.Is(err, apexJSON.ErrPathNotFound) {
+		t.Errorf("the escaped spelling matched a key: %v", err)
+	}
+	if obj, err := apexJSON.GetObjectErr(doc, "out\x00er"); err != nil || obj[`say "hi"`] == nil {
+		t.Errorf("GetObjectErr = %v, %v", obj, err)
+	}
+}
+
+// wideRecord declares 5 of the 200 members of wideJSON
+type wideRecord struct {
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Active bool    `json:"active"`
+	Score  float64 `json:"score"`
+	Region string  `json:"region"`
+}
+
+// wideJSON is a 200-member object, like a third-party payload of which
+// only a few members are wanted. Most unknown members are scalars.
+var wideJSON = func() []byte {
+	var b strings.Builder
+	b.WriteString(`{`)
+	for i := 0; i < 195; i++ {
+		fmt.Fprintf(&b, `"attr_%03d":`, i)
+		switch i % 5 {
+		case 0, 1:
+			fmt.Fprintf(&b, `"value %d",`, i)
+		case 2:
+			fmt.Fprintf(&b, `%d.5,`, i*1000)
+		case 3:
+			b.WriteString(`true,`)
+		default:
+			fmt.Fprintf(&b, `{"n":%d,"tags":["a","b"]},`, i)
+		}
+	}
+	b.WriteString(`"id":42,"name":"wide","active":true,"score":9.5,"region":"eu"}`)
+	return []byte(b.String())
+}()
+
+func BenchmarkApexUnmarshalWideSparse(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(wideJSON)))
+	for i := 0; i < b.N; i++ {
+		var r wideRecord
+		_ = apexJSON.Unmarshal(wideJSON, &r)
+	}
+}
+
+func TestUnmarshalUnknownKeys(t *testing.T) {
+	var r wideRecord
+	if err := apexJSON.Unmarshal(wideJSON, &r); err != nil {
+		t.Fatal(err)
+	}
+	if want := (wideRecord{42, "wide", true, 9.5, "eu"}); r != want {
+		t.Fatalf("wideJSON: got %+v, want %+v", r, want)
+	}
+
+	// Keys sharing a field name's length and end bytes, escaped names and
+	// unknown values of every kind
+	in := `{"nXme":"x","rXXXXn":1,"":null,"i":false,"na\u006de":"escaped",` +
+		`"u1":-1.5e3,"u2":[1,{"a":"]"}],"u3":{"}":"{"},"u4":"q\"uote","id":7}`
+	r = wideRecord{}
+	if err := apexJSON.Unmarshal([]byte(in), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "escaped" || r.ID != 7 || r.Region != "" {
+		t.Errorf("got %+v", r)
+	}
+
+	for _, bad := range []string{`{"u":tru}`, `{"u":-}`, `{"u":"open}`, `{"u":nul,"id":1}`, `{"u":}`} {
+		if err := apexJSON.Unmarshal([]byte(bad), &r); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+type embeddedOrder struct {
+	ID   int    `json:"id"`
+	Note string `json:"note"`
+}
+
+type webhook struct {
+	Event   string         `json:"event"`
+	Payload embeddedOrder  `json:"payload,jsonstring"`
+	Extra   *embeddedOrder `json:"extra,jsonstring,omitempty"`
+}
+
+func TestJSONStringFields(t *testing.T) {
+	hook := webhook{Event: "order", Payload: embeddedOrder{ID: 1, Note: `say "hi" \ or C:\dir` + "\n"}}
+	inner, _ := json.Marshal(hook.Payload)
+	payload, _ := json.Marshal(string(inner))
+	want := `{"event":"order","payload":` + string(payload) + `}`
+
+	data, err := apexJSON.Marshal(hook)
+	if err != nil || string(data) != want {
+		t.Fatalf("Marshal = %s, %v, want %s", data, err, want)
+	}
+	var got webhook
+	if err := apexJSON.Unmarshal(data, &got); err != nil || !reflect.DeepEqual(got, hook) {
+		t.Errorf("Unmarshal(%s) = %+v, %v, want %+v", data, got, err, hook)
+	}
+
+	// The embedded document stays compact in indented output
+	indented, err := apexJSON.MarshalIndent(hook, "", "  ")
+	if err != nil || !strings.Contains(string(indented), string(payload)) {
+		t.Errorf("MarshalIndent = %s, %v, want payload %s", indented, err, payload)
+	}
+
+	got = webhook{Payload: embeddedOrder{ID: 5}}
+	if err := apexJSON.Unmarshal([]byte(`{"payload":null,"extra":null}`), &got); err != nil || got.Payload.ID != 5 || got.Extra != nil {
+		t.Errorf("null payload: %+v, %v", got, err)
+	}
+
+	err = apexJSON.Unmarshal([]byte(`{"event":"x","payload":"{\"id\":\"one\"}"}`), &got)
+	var embErr *apexJSON.EmbeddedError
+	var typeErr *apexJSON.UnmarshalTypeError
+	if !errors.As(err, &embErr) || embErr.Path != "payload" || !errors.As(err, &typeErr) || typeErr.Field != "id" {
+		t.Errorf("bad embedded value: %v", err)
+	}
+	err = apexJSON.Unmarshal([]byte(`{"payload":"{\"id\":1,\"note\":\"\\\"}"}`), &got)
+	if !errors.As(err, &embErr) || !strings.Contains(err.Error(), "payload: offset 19 of embedded document") {
+		t.Errorf("truncated embedded document: %v", err)
+	}
+	if err := apexJSON.Unmarshal([]byte(`{"payload":{"id":1}}`), &got); !errors.As(err, &typeErr) {
+		t.Errorf("unquoted payload: got %v, want UnmarshalTypeError", err)
+	}
+}
+
+func TestDecodeEmbedded(t *testing.T) {
+	order := embeddedOrder{ID: 7, Note: `a "quoted" \back\slash\`}
+	inner, _ := json.Marshal(order)
+	payload, _ := json.Marshal(string(inner))
+	data := []byte(`{"hook":{"id":"h1","payload":` + string(payload) + `}}`)
+
+	var got embeddedOrder
+	if err := apexJSON.DecodeEmbedded(data, []string{"hook", "payload"}, &got); err != nil || got != order {
+		t.Errorf("DecodeEmbedded = %+v, %v, want %+v", got, err, order)
+	}
+
+	err := apexJSON.DecodeEmbedded([]byte(`{"hook":{"payload":"{\"id\":1,\"note\":\"x}"}}`), []string{"hook", "payload"}, &got)
+	const wantMsg = "json: hook.payload: offset 18 of embedded document: "
+	var embErr *apexJSON.EmbeddedError
+	var syntaxErr *apexJSON.SyntaxError
+	if !errors.As(err, &embErr) || !errors.As(err, &syntaxErr) || !strings.HasPrefix(err.Error(), wantMsg) {
+		t.Errorf("DecodeEmbedded error = %v, want %s...", err, wantMsg)
+	}
+
+	if err := apexJSON.DecodeEmbedded(data, []string{"hook", "id", "x"}, &got); !errors.Is(err, apexJSON.ErrPathNotFound) {
+		t.Errorf("missing path: got %v, want ErrPathNotFound", err)
+	}
+	var typeErr *apexJSON.UnmarshalTypeError
+	err = apexJSON.DecodeEmbedded(data, []string{"hook"}, &got)
+	if !errors.As(err, &typeErr) || typeErr.Type != reflect.TypeOf(got) || typeErr.Field != "hook" || typeErr.Offset != 8 {
+		t.Errorf("object at path: got %#v, want UnmarshalTypeError for hook at offset 8", err)
+	}
+	err = apexJSON.DecodeEmbedded([]byte(`{"a": {"b": 12}}`), []string{"a", "b"}, &got)
+	if !errors.As(err, &typeErr) || typeErr.Value != "number" || typeErr.Field != "a.b" || typeErr.Offset != 12 {
+		t.Errorf("number at path: got %#v, want UnmarshalTypeError for a.b at offset 12", err)
+	}
+}
+
+type retryPolicy struct {
+	Timeout  time.Duration  `json:"timeout,duration:string"`
+	Backoff  time.Duration  `json:"backoff,duration:string,omitempty"`
+	Interval time.Duration  `json:"interval"`
+	Note     string         `json:"note,duration:string"`
+	Max      *time.Duration `json:"max,omitempty"`
+}
+
+func TestDurationOption(t *testing.T) {
+	p := retryPolicy{Timeout: 5*time.Minute + 30*time.Second, Interval: time.Second, Note: "n"}
+	const want = `{"timeout":"5m30s","interval":1000000000,"note":"n"}`
+	data, err := apexJSON.Marshal(p)
+	if err != nil || string(data) != want {
+		t.Fatalf("Marshal = %s, %v, want %s", data, err, want)
+	}
+	var got retryPolicy
+	if err := apexJSON.Unmarshal(data, &got); err != nil || got != p {
+		t.Errorf("Unmarshal(%s) = %+v, %v, want %+v", data, got, err, p)
+	}
+
+	// Either form decodes with the option; without it only numbers do
+	got = retryPolicy{}
+	err = apexJSON.Unmarshal([]byte(`{"timeout":1500,"backoff":"1h2m3.5s","max":null}`), &got)
+	if err != nil || got.Timeout != 1500 || got.Backoff != time.Hour+2*time.Minute+3500*time.Millisecond {
+		t.Errorf("mixed forms: %+v, %v", got, err)
+	}
+	var typeErr *apexJSON.UnmarshalTypeError
+	for _, doc := range []string{`{"timeout":"5 minutes"}`, `{"interval":"5s"}`, `{"timeout":true}`} {
+		if err := apexJSON.Unmarshal([]byte(doc), &got); !errors.As(err, &typeErr) {
+			t.Errorf("Unmarshal(%s) = %v, want UnmarshalTypeError", doc, err)
+		}
+	}
+
+	schema, _ := apexJSON.TypeSchema(reflect.TypeOf(p))
+	if !schema[0].Options.Duration || schema[2].Options.Duration || schema[3].Options.Duration {
+		t.Errorf("TypeSchema options: %+v", schema)
+	}
+}
+
+type promoBase struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type PromoMeta struct {
+	Tags  []string `json:"tags,omitempty"`
+	Owner string   `json:"owner"`
+}
+
+type promoRecord struct {
+	promoBase
+	*PromoMeta
+	Name  string    `json:"name"` // hides promoBase.Name
+	Extra promoBase `json:"extra"`
+	Named PromoMeta `json:"meta"`
+}
+
+func TestEmbeddedPromotion(t *testing.T) {
+	values := []promoRecord{
+		{promoBase: promoBase{ID: 1, Name: "hidden"}, PromoMeta: &PromoMeta{Tags: []string{"a"}, Owner: "o"}, Name: "outer"},
+		{promoBase: promoBase{ID: 2}, Named: PromoMeta{Owner: "n"}},
+	}
+	for _, v := range values {
+		got, err := apexJSON.Marshal(v)
+		want, _ := json.Marshal(v)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("Marshal(%+v) = %s, %v, want %s", v, got, err, want)
+		}
+	}
+
+	// Decoding allocates the embedded pointer, and the outer field takes
+	// the name it hides
+	const doc = `{"id":3,"name":"n","owner":"me","tags":["x"],"meta":{"owner":"m"}}`
+	var got, want promoRecord
+	if err := apexJSON.Unmarshal([]byte(doc), &got); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal([]byte(doc), &want)
+	if !reflect.DeepEqual(got, want) || got.PromoMeta == nil || got.promoBase.Name != "" {
+		t.Errorf("Unmarshal = %+v, want %+v", got, want)
+	}
+
+	schema, _ := apexJSON.TypeSchema(reflect.TypeOf(promoRecord{}))
+	var names []string
+	for _, f := range schema {
+		names = append(names, f.Name)
+	}
+	if want := []string{"id", "tags", "owner", "name", "extra", "meta"}; !slices.Equal(names, want) {
+		t.Errorf("TypeSchema names = %v, want %v", names, want)
+	}
+}
+
+type diamondTop struct {
+	X    int `json:"x"`
+	Y    int
+	Code string `json:"code"`
+}
+
+type diamondLeft struct {
+	diamondTop
+	L int `json:"l"`
+}
+
+type diamondRight struct {
+	diamondTop
+	R int `json:"r"`
+}
+
+type diamondBottom struct {
+	diamondLeft
+	diamondRight
+	Code string `json:"code"` // shallower than both promoted codes
+}
+
+type conflictTagged struct {
+	ID int `json:"ID"` // beats conflictPlain.ID
+}
+
+type conflictPlain struct {
+	ID int
+	N  int `json:"n"`
+}
+
+type conflictRecord struct {
+	conflictTagged
+	conflictPlain
+}
+
+func TestFieldConflicts(t *testing.T) {
+	values := []interface{}{
+		diamondBottom{
+			diamondLeft:  diamondLeft{diamondTop: diamondTop{X: 1, Y: 2, Code: "left"}, L: 3},
+			diamondRight: diamondRight{diamondTop: diamondTop{X: 4, Y: 5, Code: "right"}, R: 6},
+			Code:         "bottom",
+		},
+		conflictRecord{conflictTagged{ID: 1}, conflictPlain{ID: 2, N: 3}},
+	}
+
+	// Two tags naming the same member, which vet reports in a declared type
+	intType := reflect.TypeOf(0)
+	dup := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "A", Type: intType, Tag: `json:"same"`},
+		{Name: "B", Type: intType, Tag: `json:"same"`},
+		{Name: "C", Type: intType},
+	})).Elem()
+	for i := 0; i < dup.NumField(); i++ {
+		dup.Field(i).SetInt(int64(i + 1))
+	}
+	values = append(values, dup.Interface())
+
+	for _, v := range values {
+		got, err := apexJSON.Marshal(v)
+		want, _ := json.Marshal(v)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("Marshal(%T) = %s, %v, want %s", v, got, err, want)
+		}
+
+		// Dropped names are unknown keys on decode
+		const doc = `{"x":1,"Y":2,"code":"c","l":3,"r":4,"ID":5,"n":6,"same":7,"C":8}`
+		gotV := reflect.New(reflect.TypeOf(v))
+		wantV := reflect.New(reflect.TypeOf(v))
+		err = apexJSON.Unmarshal([]byte(doc), gotV.Interface())
+		json.Unmarshal([]byte(doc), wantV.Interface())
+		if err != nil || !reflect.DeepEqual(gotV.Interface(), wantV.Interface()) {
+			t.Errorf("Unmarshal into %T = %+v, %v, want %+v", v, gotV.Elem(), err, wantV.Elem())
+		}
+	}
+
+	schema, _ := apexJSON.TypeSchema(reflect.TypeOf(diamondBottom{}))
+	var names []string
+	for _, f := range schema {
+		names = append(names, f.Name)
+	}
+	if want := []string{"l", "r", "code"}; !slices.Equal(names, want) {
+		t.Errorf("TypeSchema names = %v, want %v", names, want)
+	}
+}
+
+func TestDashFieldName(t *testing.T) {
+	type flags struct {
+		Dash    string `json:"-,"`
+		Skipped string `json:"-"`
+		Minus   int    `json:"-x,omitempty"`
+	}
+	for _, v := range []flags{{Dash: "d", Skipped: "s", Minus: 1}, {}} {
+		got, err := apexJSON.Marshal(v)
+		want, _ := json.Marshal(v)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("Marshal(%+v) = %s, %v, want %s", v, got, err, want)
+		}
+	}
+
+	var got flags
+	err := apexJSON.Unmarshal([]byte(`{"-":"d","Skipped":"s","-x":2}`), &got)
+	if want := (flags{Dash: "d", Minus: 2}); err != nil || got != want {
+		t.Errorf("Unmarshal = %+v, %v, want %+v", got, err, want)
+	}
+
+	schema, _ := apexJSON.TypeSchema(reflect.TypeOf(flags{}))
+	if len(schema) != 2 || schema[0].Name != "-" || schema[0].Options.OmitEmpty {
+		t.Errorf("TypeSchema = %+v", schema)
+	}
+}
+
+// objectID stands in for a type from another package with no methods of
+// its own, encoded by registered functions as a hex string
+type objectID [4]byte
+
+// legacyAmount has a MarshalJSON method the registered function overrides
+type legacyAmount struct{ Cents int64 }
+
+func (a legacyAmount) MarshalJSON() ([]byte, error) { return []byte(`"legacy"`), nil }
+
+var errBadID = errors.New("bad object id")
+
+func init() {
+	apexJSON.RegisterMarshaler(func(id objectID, buf *apexJSON.Buffer) error {
+		const digits = "0123456789abcdef"
+		buf.WriteByte('"')
+		for _, b := range id {
+			buf.WriteByte(digits[b>>4])
+			buf.WriteByte(digits[b&15])
+		}
+		buf.WriteByte('"')
+		return nil
+	})
+	apexJSON.RegisterUnmarshaler(func(data []byte, id *objectID) error {
+		if string(data) == "null" {
+			return nil
+		}
+		if len(data) != 2+2*len(id) || data[0] != '"' {
+			return errBadID
+		}
+		for i := range id {
+			n, err := strconv.ParseUint(string(data[1+2*i:3+2*i]), 16, 8)
+			if err != nil {
+				return errBadID
+			}
+			id[i] = byte(n)
+		}
+		return nil
+	})
+	apexJSON.RegisterMarshaler(func(a legacyAmount, buf *apexJSON.Buffer) error {
+		if a.Cents < 0 {
+			return errors.New("negative amount")
+		}
+		buf.WriteInt(a.Cents)
+		return nil
+	})
+}
+
+func TestRegisteredFuncs(t *testing.T) {
+	type doc struct {
+		ID     objectID                    `json:"id"`
+		Parent *objectID                   `json:"parent"`
+		Refs   []objectID                  `json:"refs"`
+		ByName map[string]objectID         `json:"by_name"`
+		Any    interface{}                 `json:"any"`
+		Amount legacyAmount                `json:"amount"`
+		Opt    apexJSON.Optional[objectID] `json:"opt"`
+	}
+	id := objectID{0xde, 0xad, 0xbe, 0xef}
+	v := doc{ID: id, Refs: []objectID{{1}, {2}}, ByName: map[string]objectID{"a": {0xff}}, Any: id, Amount: legacyAmount{250}}
+	const want = `{"id":"deadbeef","parent":null,"refs":["01000000","02000000"],"by_name":{"a":"ff000000"},"any":"deadbeef","amount":250}`
+	got, err := apexJSON.Marshal(v)
+	if err != nil || string(got) != want {
+		t.Fatalf("Marshal = %s, %v, want %s", got, err, want)
+	}
+	indented, err := apexJSON.MarshalIndent([]objectID{id}, "", " ")
+	if err != nil || string(indented) != "[\n \"deadbeef\"\n]" {
+		t.Errorf("MarshalIndent = %q, %v", indented, err)
+	}
+
+	var back doc
+	err = apexJSON.Unmarshal([]byte(`{"id":"deadbeef","parent":"00000001","refs":["01000000"],"by_name":{"a":"ff000000"},"opt":null}`), &back)
+	if err != nil || back.ID != id || back.Parent == nil || *back.Parent != (objectID{0, 0, 0, 1}) ||
+		len(back.Refs) != 1 || back.Refs[0] != (objectID{1}) || back.ByName["a"] != (objectID{0xff}) || !back.Opt.Null {
+		t.Errorf("Unmarshal = %+v, %v", back, err)
+	}
+
+	// Errors are reported as a method's would be
+	var marshalerErr *apexJSON.MarshalerError
+	if _, err := apexJSON.Marshal(legacyAmount{-1}); !errors.As(err, &marshalerErr) {
+		t.Errorf("Marshal error = %v, want MarshalerError", err)
+	}
+	var unmarshalerErr *apexJSON.UnmarshalerError
+	if err := apexJSON.Unmarshal([]byte(`{"refs":["zz"]}`), &back); !errors.As(err, &unmarshalerErr) || !errors.Is(err, errBadID) {
+		t.Errorf("Unmarshal error = %v, want UnmarshalerError wrapping errBadID", err)
+	}
+
+	// Encoding through the function doesn't allocate
+	var dst []byte
+	if n := testing.AllocsPerRun(100, func() { dst, _ = apexJSON.MarshalAppend(dst[:0], &v.Refs) }); n != 0 && !raceEnabled {
+		t.Errorf("MarshalAppend allocated %v times", n)
+	}
+
+	for name, register := range map[string]func(){
+		"predeclared": func() { apexJSON.RegisterMarshaler(func(int, *apexJSON.Buffer) error { return nil }) },
+		"interface":   func() { apexJSON.RegisterUnmarshaler(func([]byte, *error) error { return nil }) },
+		"own package": func() { apexJSON.RegisterMarshaler(func(apexJSON.Number, *apexJSON.Buffer) error { return nil }) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: registration accepted", name)
+				}
+			}()
+			register()
+		}()
+	}
+}
@@ -1,10 +1,15 @@
 package apexJSON
 
 import (
+	"encoding"
 	"io"
 	"reflect"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -34,14 +39,13 @@ var (
 		},
 	}
 
-	objectMapPool = sync.Pool{
+	treeStackPool = sync.Pool{
 		New: func() interface{} {
-			return make(map[string]interface{}, 16)
-		},
-	}
-	arraySlicePool = sync.Pool{
-		New: func() interface{} {
-			return make([]interface{}, 0, 16)
+			return &treeStack{
+				frames: make([]treeFrame, 0, 8),
+				keys:   make([]string, 0, 64),
+				values: make([]interface{}, 0, 64),
+			}
 		},
 	}
 
@@ -62,9 +66,10 @@ var (
 			return &ksPool
 		},
 	}
-	fieldMapPool = sync.Pool{
+	namesPool = sync.Pool{
 		New: func() interface{} {
-			return make(map[string]Field, 16) // Start with reasonable capacity
+			nPool := make([]string, 0, 16)
+			return &nPool
 		},
 	}
 	numberBufPool = sync.Pool{
@@ -87,7 +92,45 @@ var (
 		},
 	}
 
-	fieldCache sync.Map
+	fieldCache sync.Map // fieldCacheKey -> []Field
+	planCache  sync.Map // fieldCacheKey -> *decodePlan
+	elemCache  sync.Map // reflect.Type -> *elemPlan
+	escCache   sync.Map // string of escaped bytes -> *escapeTable
+
+	mappingCache sync.Map // [2]reflect.Type{dst, src} -> *structMapping, see MapStructs
+
+	typeSizeHints sync.Map    // reflect.Type -> int, see SetTypeSizeHint
+	haveSizeHints atomic.Bool // set once any hint is registered so Marshal can skip the lookup
+
+	marshalFuncs   sync.Map    // reflect.Type -> marshalFunc, see RegisterMarshaler
+	unmarshalFuncs sync.Map    // reflect.Type -> unmarshalFunc, see RegisterUnmarshaler
+	haveFuncs      atomic.Bool // set once any function is registered so lookups by type can be skipped
+
+	traceHooks   atomic.Pointer[Hooks] // see SetTraceHooks; nil when no hook is set
+	stdlibCompat atomic.Bool           // see SetStdlibCompat
+
+	// growHook, when set by tests, is called every time a Buffer reallocates
+	growHook func(oldCap, newCap int)
+
+	// ignoreGenerated, when set by tests, has getElemPlan pass over the
+	// methods of Generated types so they are encoded by reflection
+	ignoreGenerated bool
+
+	optionalType        = reflect.TypeOf((*optionalValue)(nil)).Elem()
+	unknownType         = reflect.TypeOf(Unknown(nil))
+	marshalerType       = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	marshalerToType     = reflect.TypeOf((*MarshalerTo)(nil)).Elem()
+	unmarshalerFromType = reflect.TypeOf((*UnmarshalerFrom)(nil)).Elem()
+	generatedType       = reflect.TypeOf((*Generated)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	isZeroerType        = reflect.TypeOf((*isZeroer)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+	durationType        = reflect.TypeOf(time.Duration(0))
+	bytesType           = reflect.TypeOf([]byte(nil))
+	rawMessageType      = reflect.TypeOf(RawMessage(nil))
+	numberType          = reflect.TypeOf(Number(""))
 )
 
 func init() {
@@ -171,12 +214,129 @@ func getBufferSize(sizeHint int) *Buffer {
 	return buf
 }
 
+// SetTypeSizeHint registers n as the usual encoded size, in bytes, of values
+// of type t. Marshal, MarshalToWriter and Encoder.Encode then start encoding
+// a t, or a pointer to one, from a buffer of at least n bytes instead of
+// growing a small pooled buffer step by step. MarshalOptions.SizeHint takes
+// precedence. A hint of 0 or less removes the registration.
+func SetTypeSizeHint(t reflect.Type, n int) {
+	if n <= 0 {
+		typeSizeHints.Delete(t)
+		return
+	}
+	typeSizeHints.Store(t, n)
+	haveSizeHints.Store(true)
+}
+
+// RegisterMarshaler has values of type T encoded by fn, which writes one
+// JSON value to the Buffer, in place of T's own methods and its kind. It is
+// for types from other packages, which can't be given a MarshalApexJSON
+// method. T must be a type declared in a package other than this one, and
+// not an interface.
+//
+// Register in an init function, before any value of T is encoded; how a
+// type is encoded is cached on first use. A second registration for T
+// replaces the first. Generated MarshalApexJSON methods write their
+// time.Time fields, and fields of other generated types, themselves.
+func RegisterMarshaler[T any](fn func(T, *Buffer) error) {
+	t := registerable[T]("RegisterMarshaler")
+	marshalFuncs.Store(t, marshalFunc(func(v reflect.Value, buf *Buffer) error {
+		// An addressable value is passed on without boxing a copy
+		if v.CanAddr() {
+			return fn(*v.Addr().Interface().(*T), buf)
+		}
+		return fn(v.Interface().(T), buf)
+	}))
+	haveFuncs.Store(true)
+	elemCache.Clear()
+}
+
+// RegisterUnmarshaler has values of type T decoded by fn, in place of T's
+// own methods and its kind. fn is given the bytes of one JSON value, null
+// included, which it must not keep or modify after returning. The rules of
+// RegisterMarshaler for T and when to register apply.
+func RegisterUnmarshaler[T any](fn func([]byte, *T) error) {
+	t := registerable[T]("RegisterUnmarshaler")
+	unmarshalFuncs.Store(t, unmarshalFunc(func(data []byte, v reflect.Value) error {
+		return fn(data, v.Addr().Interface().(*T))
+	}))
+	haveFuncs.Store(true)
+	elemCache.Clear()
+}
+
+// registerable returns the type T, panicking when name can't register a
+// function for it
+func registerable[T any](name string) reflect.Type {
+	t := reflect.TypeFor[T]()
+	if t.PkgPath() == "" || t.PkgPath() == numberType.PkgPath() || t.Kind() == reflect.Interface {
+		panic("json: " + name + " of " + t.String() + ", which is not a non-interface type declared in another package")
+	}
+	return t
+}
+
+// mayBeRegistered reports whether t is a type a function may be registered
+// for, once any is
+func mayBeRegistered(t reflect.Type) bool {
+	return haveFuncs.Load() && t.PkgPath() != ""
+}
+
+// SetTraceHooks installs h for every later Marshal, Unmarshal,
+// Encoder.Encode and Decoder.Decode call, replacing any hooks set before. A
+// Hooks with no funcs set removes them. It is safe to call concurrently
+// with encoding and decoding; calls already under way keep the hooks they
+// started with.
+func SetTraceHooks(h Hooks) {
+	if h.OnDecodeStart == nil && h.OnEncodeStart == nil {
+		traceHooks.Store(nil)
+		return
+	}
+	traceHooks.Store(&h)
+}
+
+// SetStdlibCompat turns MarshalOptions.StdlibCompat on or off for Marshal,
+// MarshalIndent and Unmarshal, and for Encoders and Decoders created
+// afterwards, so code moving from encoding/json can match its output with
+// one call before opting into this package's defaults piece by piece.
+// Calls with explicit options are not affected.
+func SetStdlibCompat(on bool) {
+	stdlibCompat.Store(on)
+}
+
+// sizeHint returns the initial buffer size for encoding a value of type t:
+// opts.SizeHint if set, else the hint registered for t or the type it points
+// to, else 0
+func sizeHint(t reflect.Type, opts *MarshalOptions) int {
+	if opts != nil && opts.SizeHint > 0 {
+		return opts.SizeHint
+	}
+	if !haveSizeHints.Load() {
+		return 0
+	}
+	for t != nil {
+		if n, ok := typeSizeHints.Load(t); ok {
+			return n.(int)
+		}
+		if t.Kind() != reflect.Ptr {
+			break
+		}
+		t = t.Elem()
+	}
+	return 0
+}
+
 // Return a buffer to the appropriate pool after use
 func putBuffer(buf *Buffer) {
 	if buf == nil || cap(buf.buf) > 65536 {
 		return
 	}
 	buf.Reset()
+	buf.opts = nil
+	buf.esc = nil
+	buf.ind = nil
+	buf.yield = nil
+	buf.seen = nil
+	buf.tracked = nil
+	buf.level = 0
 
 	// Use bitmask for size classification
 	switch {
@@ -210,31 +370,22 @@ func putBuilder(b *strings.Builder) {
 	builderPool.Put(b)
 }
 
-// ### Object Map Pool Management ###
+// ### Tree Stack Pool Management ###
 
-func getObjectMap() map[string]interface{} {
-	return objectMapPool.Get().(map[string]interface{})
+func getTreeStack() *treeStack {
+	return treeStackPool.Get().(*treeStack)
 }
 
-func putObjectMap(m map[string]interface{}) {
-	if len(m) > 1024 {
-		return // Don't pool oversize maps
-	}
-	for k := range m {
-		delete(m, k)
+// putTreeStack returns st to the pool. Scratch that grew for one huge
+// container is dropped instead of pinned in the pool.
+func putTreeStack(st *treeStack) {
+	const maxTreeScratch = 64 * 1024
+	if cap(st.values) > maxTreeScratch || cap(st.keys) > maxTreeScratch {
+		return
 	}
-	objectMapPool.Put(m)
-}
-
-// ### Array Slice Pool Management ###
-
-func getArraySlice() []interface{} {
-	return arraySlicePool.Get().([]interface{})
-}
-
-func putArraySlice(s []interface{}) {
-	s = s[:0]
-	arraySlicePool.Put(s)
+	clear(st.values)
+	st.frames, st.keys, st.values = st.frames[:0], st.keys[:0], st.values[:0]
+	treeStackPool.Put(st)
 }
 
 // ### Syntax Error Pool Management ###
@@ -244,8 +395,10 @@ func getSyntaxError() *SyntaxError {
 }
 
 func putSyntaxError(e *SyntaxError) {
+	e.err = nil
 	e.Offset = 0
 	e.Msg = ""
+	e.ContextSnippet = ""
 	syntaxErrorPool.Put(e)
 }
 
@@ -271,17 +424,14 @@ func putKeysSlice(keys *[]reflect.Value) {
 	keySlicePool.Put(keys)
 }
 
-// ### Field Map Pool Management ###
-
-func getFieldMap() map[string]Field {
-	return fieldMapPool.Get().(map[string]Field)
+func getNamesSlice() *[]string {
+	return namesPool.Get().(*[]string)
 }
 
-func putFieldMap(m map[string]Field) {
-	for k := range m {
-		delete(m, k)
-	}
-	fieldMapPool.Put(m)
+func putNamesSlice(names *[]string) {
+	clear(*names) // Don't keep the strings alive from the pool
+	*names = (*names)[:0]
+	namesPool.Put(names)
 }
 
 // ### Number Buffer Pool Management ###
@@ -361,11 +511,367 @@ func (b *Buffer) grow(n int) {
 		newCap = maxBufferSize
 	}
 
+	if growHook != nil {
+		growHook(curCap, newCap)
+	}
 	newBuf := make([]byte, needed, newCap)
 	copy(newBuf, b.buf[:b.off])
 	b.buf = newBuf
 }
 
+// marshalOptions returns the encode options in effect for b
+func (b *Buffer) marshalOptions() *MarshalOptions {
+	if b.opts == nil {
+		return &defaultOptions.MarshalOptions
+	}
+	return b.opts
+}
+
+// compat reports whether b encodes under MarshalOptions.StdlibCompat
+func (b *Buffer) compat() bool {
+	return b.opts != nil && b.opts.StdlibCompat
+}
+
+// sortKeys reports whether map keys are written in order
+func (o *MarshalOptions) sortKeys() bool {
+	return o.SortMapKeys || o.StdlibCompat
+}
+
+// writeNilSlice writes a nil slice as null, or as [] when the options ask
+// for NilSliceAsEmptyArray
+func (b *Buffer) writeNilSlice() {
+	if b.opts != nil && b.opts.NilSliceAsEmptyArray {
+		b.WriteByte(jsonOpenBracket)
+		b.WriteByte(jsonCloseBracket)
+		return
+	}
+	b.Write(jsonNull)
+}
+
+// writeNilMap writes a nil map as null, or as {} when the options ask for
+// NilMapAsEmptyObject
+func (b *Buffer) writeNilMap() {
+	if b.opts != nil && b.opts.NilMapAsEmptyObject {
+		b.WriteByte(jsonOpenBrace)
+		b.WriteByte(jsonCloseBrace)
+		return
+	}
+	b.Write(jsonNull)
+}
+
+// escapes returns the string escape table in effect for b
+func (b *Buffer) escapes() *escapeTable {
+	if b.esc == nil {
+		return &defaultEscapes
+	}
+	return b.esc
+}
+
+// setName sets the name f is written and looked up by. nameBytes is the
+// decoded name used for lookups; the quoted form is escaped so it can be
+// written to the output as is.
+func (f *Field) setName(name string) {
+	f.dangerous = isDangerousKey(name)
+	f.nameBytes = []byte(name)
+	f.nameWithQuotesBytes = make([]byte, 0, len(name)+3) // "name":
+	f.nameWithQuotesBytes = append(f.nameWithQuotesBytes, '"')
+	f.nameWithQuotesBytes = appendEscapedName(f.nameWithQuotesBytes, name)
+	f.nameWithQuotesBytes = append(f.nameWithQuotesBytes, '"', ':')
+}
+
+// isDangerousKey reports whether k is an object key that reaches an
+// object's prototype in JavaScript that copies members naively
+func isDangerousKey(k string) bool {
+	return k == "__proto__" || k == "constructor" || k == "prototype"
+}
+
+// checksKeys reports whether b encodes under a DangerousKeyPolicy that
+// needs each object key looked at
+func (b *Buffer) checksKeys() bool {
+	return b.opts != nil && b.opts.DangerousKeyPolicy != KeysAllow
+}
+
+// keepKey applies the DangerousKeyPolicy of o to the object key k, reporting
+// whether its member is written
+func (o *MarshalOptions) keepKey(k string) (bool, error) {
+	if o == nil || o.DangerousKeyPolicy == KeysAllow || !isDangerousKey(k) {
+		return true, nil
+	}
+	if o.DangerousKeyPolicy == KeysStrip {
+		return false, nil
+	}
+	return false, &DangerousKeyError{Key: strings.Clone(k)}
+}
+
+// isEmpty reports whether the value v of the omitempty field f is empty,
+// asking the MarshalOptions.IsEmpty hook first when one is set
+func (b *Buffer) isEmpty(f *Field, v reflect.Value) bool {
+	if b.opts == nil {
+		return isEmptyValue(v)
+	}
+	if b.opts.IsEmpty != nil {
+		if empty, ok := b.opts.IsEmpty(v); ok {
+			return empty
+		}
+	}
+	if !b.opts.DeepOmitEmpty {
+		return isEmptyValue(v)
+	}
+	if f.zeroer {
+		if zero, ok := isZeroValue(v); ok {
+			return zero
+		}
+	}
+	return isDeepEmptyValue(v, 0)
+}
+
+// writeFieldName writes the quoted name of f and the colon after it. The
+// cached form is escaped with defaultEscapes, so other tables re-escape.
+func (b *Buffer) writeFieldName(f *Field) {
+	if b.esc == nil {
+		b.Write(f.nameWithQuotesBytes)
+	} else {
+		b.WriteByte(jsonQuote)
+		writeEscapedString(b, f.nameBytes)
+		b.Write(jsonQuoteColon)
+	}
+	if b.ind != nil {
+		b.WriteByte(' ')
+	}
+}
+
+// beginContainer writes c, the opening brace or bracket of an object or
+// array whose members follow
+func (b *Buffer) beginContainer(c byte) {
+	b.WriteByte(c)
+	if b.ind != nil {
+		b.ind.depth++
+	}
+}
+
+// startYields has b yield every MarshalOptions.YieldEvery bytes from here
+// on, writing what it holds to w first when w isn't nil
+func (b *Buffer) startYields(w io.Writer) {
+	b.yield = nil
+	if b.opts != nil && b.opts.YieldEvery > 0 {
+		b.yield = &yielder{w: w, every: b.opts.YieldEvery, next: b.off + b.opts.YieldEvery}
+	}
+}
+
+// stopYields ends the yields startYields began and returns the number of
+// bytes written at them
+func (b *Buffer) stopYields() int {
+	if b.yield == nil {
+		return 0
+	}
+	n := b.yield.written
+	b.yield = nil
+	return n
+}
+
+// yieldPoint yields, when it is time to, between two members or elements.
+// It is kept small enough to inline so encodes without YieldEvery pay only
+// for the nil check.
+func (b *Buffer) yieldPoint() error {
+	if b.yield == nil || b.off < b.yield.next {
+		return nil
+	}
+	return b.yieldNow()
+}
+
+// yieldNow writes out the output so far, if b has a writer and nothing
+// will go back over it, and lets other goroutines run
+func (b *Buffer) yieldNow() error {
+	y := b.yield
+	if y.w != nil && b.faults == nil {
+		if _, err := y.w.Write(b.Bytes()); err != nil {
+			return err
+		}
+		y.written += b.off
+		b.Reset()
+	}
+	runtime.Gosched()
+	y.next = b.off + y.every
+	return nil
+}
+
+// breakLine starts the line of an object member or array element, after
+// its comma, when the output is indented. It is kept small enough to inline
+// so compact output pays only for the nil check.
+func (b *Buffer) breakLine() {
+	if b.ind != nil {
+		b.newline()
+	}
+}
+
+// endContainer writes c, the closing brace or bracket of an object or array
+// begun by beginContainer. Empty containers stay on one line.
+func (b *Buffer) endContainer(c byte, empty bool) {
+	if b.ind != nil {
+		b.ind.depth--
+		if !empty {
+			b.newline()
+		}
+	}
+	b.WriteByte(c)
+}
+
+// writeColon writes the closing quote of an object key and the colon after it
+func (b *Buffer) writeColon() {
+	b.Write(jsonQuoteColon)
+	if b.ind != nil {
+		b.WriteByte(' ')
+	}
+}
+
+// enter records that v, a struct, map or slice, is being encoded, and must
+// be matched by a call to leave once it is written. Past cycleDepth levels
+// v is remembered, and encoding it again while still inside it is a cycle.
+func (b *Buffer) enter(v reflect.Value) error {
+	b.level++
+	if b.level > cycleDepth {
+		return b.track(v)
+	}
+	return nil
+}
+
+// leave ends the encoding of the value last passed to enter
+func (b *Buffer) leave() {
+	if b.level > cycleDepth {
+		b.untrack()
+	}
+	b.level--
+}
+
+// track remembers v for enter, failing if it is already being encoded
+func (b *Buffer) track(v reflect.Value) error {
+	key, ok := cycleKeyOf(v)
+	if ok {
+		if _, cycle := b.seen[key]; cycle {
+			b.level--
+			t := v.Type()
+			if t.Kind() == reflect.Struct {
+				t = reflect.PointerTo(t)
+			}
+			return &UnsupportedValueError{Value: v, Str: "encountered a cycle via " + t.String()}
+		}
+		if b.seen == nil {
+			b.seen = make(map[cycleKey]struct{})
+		}
+		b.seen[key] = struct{}{}
+	}
+	b.tracked = append(b.tracked, key)
+	return nil
+}
+
+// untrack forgets the value tracked last
+func (b *Buffer) untrack() {
+	key := b.tracked[len(b.tracked)-1]
+	b.tracked = b.tracked[:len(b.tracked)-1]
+	delete(b.seen, key)
+}
+
+// cycleKeyOf returns the key of v for Buffer.seen. A struct that isn't
+// addressable is a copy, which can't be part of a cycle itself.
+func cycleKeyOf(v reflect.Value) (cycleKey, bool) {
+	switch v.Kind() {
+	case reflect.Map:
+		return cycleKey{t: v.Type(), ptr: v.UnsafePointer()}, true
+	case reflect.Slice:
+		return cycleKey{t: v.Type(), ptr: v.UnsafePointer(), len: v.Len()}, true
+	case reflect.Struct:
+		if v.CanAddr() {
+			return cycleKey{t: v.Type(), ptr: v.Addr().UnsafePointer()}, true
+		}
+	}
+	return cycleKey{}, false
+}
+
+// newline starts a new line of indented output at the current depth
+func (b *Buffer) newline() {
+	b.WriteByte('\n')
+	b.WriteString(b.ind.prefix)
+	for range b.ind.depth {
+		b.WriteString(b.ind.indent)
+	}
+}
+
+// writeRaw writes data, an encoded JSON value such as MarshalJSON output,
+// re-indented to match when the output is indented
+func (b *Buffer) writeRaw(data []byte) {
+	if b.ind == nil {
+		b.Write(data)
+		return
+	}
+
+	open := false // the last byte written opened an object or array
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if isWhitespace(c) {
+			continue
+		}
+		if open {
+			open = false
+			if c == '}' || c == ']' {
+				b.ind.depth--
+				b.WriteByte(c)
+				continue
+			}
+			b.newline()
+		}
+
+		switch c {
+		case '"':
+			j := i + 1
+			for j < len(data) && data[j] != '"' {
+				if data[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			b.Write(data[i:min(j+1, len(data))])
+			i = j
+		case '{', '[':
+			b.beginContainer(c)
+			open = true
+		case '}', ']':
+			b.endContainer(c, false)
+		case ',':
+			b.WriteByte(jsonComma)
+			b.newline()
+		case ':':
+			b.WriteByte(':')
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// substitute recovers from err, the failure of a value whose encoding began
+// at offset start. Under MarshalPartial the partial output is discarded, the
+// placeholder written in its place and err recorded, and it reports true;
+// otherwise the caller returns err as usual.
+func (b *Buffer) substitute(start int, err error) bool {
+	if b.faults == nil {
+		return false
+	}
+	// Failures recorded inside the discarded output are replaced by this one
+	faults := *b.faults
+	for len(faults) > 0 && faults[len(faults)-1].offset >= start {
+		faults = faults[:len(faults)-1]
+	}
+	*b.faults = append(faults, FieldError{Err: err, offset: start})
+
+	b.off = start
+	if p := b.marshalOptions().PartialPlaceholder; p != nil {
+		b.Write(p)
+	} else {
+		b.Write(jsonNull)
+	}
+	return true
+}
+
 func (b *Buffer) Reset() {
 	b.buf = b.buf[:0]
 	b.off = 0
@@ -484,17 +990,121 @@ func (b *Buffer) WriteString(s string) (int, error) {
 	return sLen, nil
 }
 
-// computeStructFields analyzes a struct type and extracts field information
-func computeStructFields(t reflect.Type) []Field {
-	// Pre-allocate fields slice with exact capacity needed
-	numField := t.NumField()
-	fields := make([]Field, 0, numField)
+// WriteJSONString writes s as a JSON string, quoted and escaped as the
+// rest of the output is
+func (b *Buffer) WriteJSONString(s string) {
+	b.WriteByte(jsonQuote)
+	writeEscapedStringString(b, s)
+	b.WriteByte(jsonQuote)
+}
 
+// WriteValue encodes v into b with the options of the encode in progress,
+// for use by MarshalApexJSON methods
+func (b *Buffer) WriteValue(v interface{}) error {
+	return marshalValue(reflect.ValueOf(v), b)
+}
+
+// computeStructFields analyzes a struct type and extracts field information.
+// The fields of embedded structs whose json tag gives no name are promoted
+// into it, as by encoding/json. namer, if not nil, names the fields whose
+// tag doesn't, before fields sharing a name are resolved by dominantFields.
+func computeStructFields(t reflect.Type, namer func(string) string) []Field {
+	fields := appendStructFields(nil, t, nil, map[reflect.Type]bool{t: true})
+	if namer != nil {
+		for i := range fields {
+			if f := &fields[i]; !f.tagged && !f.unknown {
+				// Names encoding/json would reject keep the Go field name
+				if name := namer(string(f.nameBytes)); isValidTag(name) {
+					f.setName(name)
+				}
+			}
+		}
+	}
+	fields = dominantFields(fields)
+
+	// The first Unknown field moves after all the others, as it is written
+	// last; any further ones are dropped
+	var unknown []Field
+	known := fields[:0]
+	for _, f := range fields {
+		if f.unknown {
+			unknown = append(unknown, f)
+		} else {
+			known = append(known, f)
+		}
+	}
+	if len(unknown) > 0 {
+		fields = append(known, unknown[0])
+	}
+
+	return fields
+}
+
+// dominantFields keeps, of each set of fields with the same JSON name, the
+// one encoding/json would: the shallowest, then among those the only one
+// named by its tag. When that leaves more than one the name is ambiguous,
+// and all of them are dropped. The rest keep their order.
+func dominantFields(fields []Field) []Field {
+	byName := make(map[string][]int, len(fields))
+	for i, f := range fields {
+		if !f.unknown {
+			name := GetString(f.nameBytes)
+			byName[name] = append(byName[name], i)
+		}
+	}
+
+	drop := make([]bool, len(fields))
+	for _, group := range byName {
+		if len(group) == 1 {
+			continue
+		}
+		depth := len(fields[group[0]].index)
+		for _, i := range group[1:] {
+			depth = min(depth, len(fields[i].index))
+		}
+		winner, tagged, count := -1, false, 0
+		for _, i := range group {
+			f := &fields[i]
+			switch {
+			case len(f.index) > depth:
+			case f.tagged && !tagged:
+				winner, tagged, count = i, true, 1
+			case f.tagged == tagged:
+				winner = i
+				count++
+			}
+		}
+		for _, i := range group {
+			drop[i] = i != winner || count > 1
+		}
+	}
+
+	kept := fields[:0]
+	for i, f := range fields {
+		if !drop[i] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// appendStructFields appends the fields of t, a struct found at index in
+// the type being analyzed, in declaration order with those of embedded
+// structs in their place. visiting holds the struct types on the way down,
+// so embedding that leads back to one of them ends there.
+func appendStructFields(fields []Field, t reflect.Type, index []int, visiting map[reflect.Type]bool) []Field {
+	numField := t.NumField()
 	for i := 0; i < numField; i++ {
 		f := t.Field(i)
 
-		// Skip unexported fields
-		if f.PkgPath != "" {
+		// Skip unexported fields, except embedded structs, whose exported
+		// fields are promoted all the same
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		embedded := f.Anonymous && ft.Kind() == reflect.Struct && !reflect.PointerTo(ft).Implements(optionalType)
+		if f.PkgPath != "" && !embedded {
 			continue
 		}
 
@@ -503,13 +1113,17 @@ func computeStructFields(t reflect.Type) []Field {
 		tag := f.Tag.Get("json")
 
 		if tag == "-" {
-			// Field is explicitly excluded
+			// Field is explicitly excluded; "-," instead names it "-",
+			// which the name parsing below takes as any other name
 			continue
 		}
 
 		// Parse tag without allocations
 		omitEmpty := false
 		stringOpt := false // Add this variable
+		jsonString := false
+		duration := false
+		tagged := false
 		if tag != "" {
 			// Find first comma in tag
 			commaIndex := -1
@@ -523,7 +1137,7 @@ func computeStructFields(t reflect.Type) []Field {
 			// Extract name part
 			if commaIndex != -1 {
 				if commaIndex > 0 {
-					name = tag[:commaIndex]
+					name, tagged = tag[:commaIndex], true
 				}
 
 				// Check for options without allocations
@@ -538,12 +1152,16 @@ func computeStructFields(t reflect.Type) []Field {
 						j++
 					}
 
-					// Check if this option is "omitempty" or "string"
+					// Check if this option is "omitempty", "string" or "jsonstring"
 					option := tagRest[optionStart:j]
 					if option == "omitempty" {
 						omitEmpty = true
 					} else if option == "string" {
 						stringOpt = true // Set this to true when option found
+					} else if option == "jsonstring" {
+						jsonString = true
+					} else if option == "duration:string" {
+						duration = f.Type == durationType
 					}
 
 					// Move past comma
@@ -551,29 +1169,48 @@ func computeStructFields(t reflect.Type) []Field {
 				}
 			} else if tag != "" {
 				// No comma, the whole tag is the name
-				name = tag
+				name, tagged = tag, true
 			}
 		}
 
-		// Create and append Field
-		index := make([]int, len(f.Index))
-		copy(index, f.Index)
+		// Names encoding/json would reject fall back to the Go field name
+		if !isValidTag(name) {
+			name, tagged = f.Name, false
+		}
 
-		nameBytes := []byte(name)
-		nameWithQuotesBytes := make([]byte, len(name)+3) // "name":
-		nameWithQuotesBytes[0] = '"'
-		copy(nameWithQuotesBytes[1:], nameBytes)
-		nameWithQuotesBytes[len(name)+1] = '"'
-		nameWithQuotesBytes[len(name)+2] = ':'
+		// An embedded struct is a field of its own only when its tag names
+		// it; an unexported one never is
+		fieldIndex := append(slices.Clip(index), i)
+		if embedded && !tagged {
+			if !visiting[ft] {
+				visiting[ft] = true
+				fields = appendStructFields(fields, ft, fieldIndex, visiting)
+				delete(visiting, ft)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
 
-		fields = append(fields, Field{
-			nameBytes:           nameBytes,
-			nameWithQuotesBytes: nameWithQuotesBytes,
-			index:               index,
-			omitEmpty:           omitEmpty,
-			stringOpt:           stringOpt,
-		})
+		field := Field{
+			index:      fieldIndex,
+			omitEmpty:  omitEmpty,
+			stringOpt:  stringOpt,
+			jsonString: jsonString,
+			duration:   duration,
+			optional:   reflect.PointerTo(f.Type).Implements(optionalType),
+			unknown:    f.Type == unknownType,
+			tagged:     tagged,
+		}
+		// omitempty asks the value an Optional holds, not the Optional
+		vt := f.Type
+		if field.optional {
+			vt = vt.Field(0).Type
+		}
+		field.zeroer = omitEmpty && vt.Kind() == reflect.Struct && vt.Implements(isZeroerType)
+		field.setName(name)
+		fields = append(fields, field)
 	}
-
 	return fields
 }
@@ -1,7 +1,11 @@
 package apexJSON
 
 import (
+	"io"
+	"reflect"
 	"strconv"
+	"unicode/utf8"
+	"unsafe"
 )
 
 func (p *Parser) skipWhitespace() {
@@ -23,31 +27,405 @@ func (p *Parser) parseString() (int, []byte) {
 	start := p.pos
 	p.pos++
 
-	for p.pos < len(p.data) {
-		if p.data[p.pos] == '\\' {
-			p.pos += 2
-			continue
-		}
-		if p.data[p.pos] == '"' {
+	// Bound the scan instead of counting inside the loop so that an unset
+	// limit costs nothing
+	end := p.stringEnd(start)
+	for p.pos < end {
+		c := p.data[p.pos]
+		if c == '"' {
 			p.pos++
 			return TokenString, p.data[start+1 : p.pos-1]
 		}
+		if c == '\\' {
+			if !p.skipEscape() {
+				return TokenError, nil
+			}
+			continue
+		}
+		if c < 0x20 {
+			// Control characters must be escaped
+			return TokenError, nil
+		}
 		p.pos++
 	}
 
+	if end < len(p.data) {
+		p.limitExceeded(end-1, "string", "MaxStringBytes", p.opts.MaxStringBytes)
+	}
 	return TokenError, nil
 }
 
+// skipEscape moves past the escape sequence at the current position,
+// reporting false and leaving pos on the backslash if it is not one JSON
+// allows. A sequence cut off by the end of the input consumes the rest so
+// the error is reported as truncation.
+func (p *Parser) skipEscape() bool {
+	n := 2
+	if p.pos+1 < len(p.data) && p.data[p.pos+1] == 'u' {
+		n = 6
+	}
+	if p.pos+n > len(p.data) {
+		p.pos = len(p.data)
+		return false
+	}
+
+	switch p.data[p.pos+1] {
+	case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+	case 'u':
+		if _, ok := decodeHex4(p.data[p.pos+2:]); !ok {
+			return false
+		}
+	default:
+		return false
+	}
+	p.pos += n
+	return true
+}
+
+// stringEnd returns the position just past the last byte a string token
+// starting at start may occupy, closing quote included
+func (p *Parser) stringEnd(start int) int {
+	if max := p.opts.MaxStringBytes; max > 0 && max < len(p.data)-start-1 {
+		return start + max + 2
+	}
+	return len(p.data)
+}
+
+// limitExceeded records a SyntaxError for a token that crossed one of the
+// Options size limits at offset
+func (p *Parser) limitExceeded(offset int, token, limit string, max int) {
+	p.err = &SyntaxError{
+		Offset: int64(offset),
+		Msg:    token + " exceeds " + limit + " (" + strconv.Itoa(max) + " bytes)",
+	}
+}
+
+// tokenError returns the limit violation recorded by the last token, a
+// truncation error if the token ran into the end of the input, or a
+// SyntaxError with msg at the current position
+func (p *Parser) tokenError(msg string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.pos >= len(p.data) {
+		return unexpectedEnd(int64(len(p.data)))
+	}
+	return &SyntaxError{Offset: int64(p.pos), Msg: msg}
+}
+
+// countElement records one materialized array element, map entry or struct
+// value against Options.MaxDecodedElements
+func (p *Parser) countElement() error {
+	p.elements++
+	if max := p.opts.MaxDecodedElements; max > 0 && p.elements > max {
+		return &DecodeBudgetError{Offset: int64(p.pos), Elements: p.elements, Limit: max}
+	}
+	return nil
+}
+
+// tracksPrecision reports whether stored numbers need to be checked for
+// precision loss; the check formats every float, so it is opt-in
+func (p *Parser) tracksPrecision() bool {
+	return p.opts.Stats != nil || p.opts.FailOnPrecisionLoss
+}
+
+// checkPrecision inspects the number token s starting at start after setNumber
+// stored it in v with result err. Lossy values are counted and, with
+// FailOnPrecisionLoss, turned into an error.
+func (p *Parser) checkPrecision(v reflect.Value, s string, start int, err error) error {
+	if err != nil {
+		// Out of range numbers already fail; count them so the stats show
+		// why. Fractions into integer fields are type mismatches, not loss.
+		switch {
+		case v.Kind() == reflect.Float32, v.Kind() == reflect.Float64,
+			v.Kind() == reflect.Interface && v.NumMethod() == 0,
+			isIntegerKind(v.Kind()) && isIntegerToken(s):
+			p.recordLoss(start)
+		}
+		return err
+	}
+
+	var f float64
+	bits := 64
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f, bits = v.Float(), v.Type().Bits()
+	case reflect.Interface:
+		n, ok := v.Interface().(float64)
+		if !ok {
+			return nil
+		}
+		f = n
+	default:
+		return nil
+	}
+	if floatRoundTrips(s, f, bits) {
+		return nil
+	}
+	return p.precisionLoss(s, start, v.Type())
+}
+
+// precisionLoss records the lossy number token s at start and returns the
+// error to report for it, nil unless FailOnPrecisionLoss is set
+func (p *Parser) precisionLoss(s string, start int, t reflect.Type) error {
+	p.recordLoss(start)
+	if !p.opts.FailOnPrecisionLoss {
+		return nil
+	}
+	return &UnmarshalTypeError{
+		Value:  "number " + s + " (precision loss)",
+		Type:   t,
+		Field:  pathAt(p.data, start),
+		Offset: int64(start),
+	}
+}
+
+func (p *Parser) recordLoss(start int) {
+	if p.losses == 0 {
+		p.lossPos = start
+	}
+	p.losses++
+}
+
+// finishDecode records DecodeStats for the decode, classifies err and
+// attaches the input around the failure when requested
+func (p *Parser) finishDecode(err error) error {
+	if st := p.opts.Stats; st != nil {
+		st.Elements = p.elements
+		st.PrecisionLoss = p.losses
+		st.FirstLossOffset = -1
+		st.FirstLossPath = ""
+		if p.losses > 0 {
+			st.FirstLossOffset = int64(p.lossPos)
+			st.FirstLossPath = pathAt(p.data, p.lossPos)
+		}
+	}
+	err = p.decodeError(err)
+	if n := p.opts.ErrorContextBytes; n > 0 && err != nil {
+		switch e := err.(type) {
+		case *SyntaxError:
+			e.ContextSnippet = contextSnippet(p.data, e.Offset, n)
+		case *UnmarshalTypeError:
+			// Type errors raised below the parser carry no offset; the
+			// decode stops right after the offending token
+			if e.Offset == 0 {
+				e.Offset = int64(p.pos)
+			}
+			e.ContextSnippet = contextSnippet(p.data, e.Offset, n)
+		}
+	}
+	return err
+}
+
+// contextSnippet copies up to n bytes of data centered on offset, clipped to
+// the input, with control characters escaped so the result is safe to log
+func contextSnippet(data []byte, offset int64, n int) string {
+	start := offset - int64(n/2)
+	end := start + int64(n)
+	if start < 0 {
+		start = 0
+	}
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	if start >= end {
+		return ""
+	}
+
+	b := getBuilder()
+	defer putBuilder(b)
+	for _, c := range data[start:end] {
+		switch {
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f:
+			b.WriteString(`\u00`)
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// decodeError reports any syntax error hit at the end of the input as
+// truncation so callers can rely on errors.Is(err, io.ErrUnexpectedEOF)
+func (p *Parser) decodeError(err error) error {
+	if _, ok := err.(*SyntaxError); ok && p.err == nil && p.pos >= len(p.data) {
+		return unexpectedEnd(int64(len(p.data)))
+	}
+	return err
+}
+
+// unescape decodes the escape sequences in a raw string token. Tokens
+// without escapes are returned unchanged; escaped tokens are decoded into
+// the parser's scratch buffer, which is only valid until the next call
+func (p *Parser) unescape(raw []byte) ([]byte, bool) {
+	i := 0
+	for i < len(raw) && raw[i] != '\\' {
+		i++
+	}
+	if i == len(raw) {
+		return raw, true
+	}
+
+	dst := append(p.scratch[:0], raw[:i]...)
+	for i < len(raw) {
+		c := raw[i]
+		if c != '\\' {
+			dst = append(dst, c)
+			i++
+			continue
+		}
+
+		i++
+		if i >= len(raw) {
+			return nil, false
+		}
+
+		switch raw[i] {
+		case '"', '\\', '/':
+			dst = append(dst, raw[i])
+		case 'b':
+			dst = append(dst, '\b')
+		case 'f':
+			dst = append(dst, '\f')
+		case 'n':
+			dst = append(dst, '\n')
+		case 'r':
+			dst = append(dst, '\r')
+		case 't':
+			dst = append(dst, '\t')
+		case 'u':
+			r, ok := decodeHex4(raw[i+1:])
+			if !ok {
+				return nil, false
+			}
+			i += 4
+
+			// Combine UTF-16 surrogate pairs into a single rune
+			if r >= 0xD800 && r < 0xDC00 {
+				if i+2 < len(raw) && raw[i+1] == '\\' && raw[i+2] == 'u' {
+					if r2, ok := decodeHex4(raw[i+3:]); ok && r2 >= 0xDC00 && r2 < 0xE000 {
+						r = (r-0xD800)<<10 | (r2 - 0xDC00) + 0x10000
+						i += 6
+					} else {
+						r = utf8.RuneError
+					}
+				} else {
+					r = utf8.RuneError
+				}
+			} else if r >= 0xDC00 && r < 0xE000 {
+				r = utf8.RuneError
+			}
+			dst = utf8.AppendRune(dst, r)
+		default:
+			return nil, false
+		}
+		i++
+	}
+
+	p.scratch = dst
+	return dst, true
+}
+
+// stringValue returns the decoded string for a raw string token. Unescaped
+// tokens alias the input; escaped tokens are copied out of the scratch buffer
+func (p *Parser) stringValue(raw []byte) (string, bool) {
+	value, ok := p.unescape(raw)
+	if !ok {
+		return "", false
+	}
+	// Every escape sequence decodes to fewer bytes than it occupies, so an
+	// unchanged length means unescape handed back the input itself
+	if len(value) == len(raw) {
+		return GetString(value), true
+	}
+	return string(value), true
+}
+
+// valueString is stringValue for a string value just parsed, passed
+// through Options.StringTransform when one is set
+func (p *Parser) valueString(raw []byte) (string, bool) {
+	if p.opts.StringTransform == nil {
+		return p.stringValue(raw)
+	}
+	value, ok := p.unescape(raw)
+	if !ok {
+		return "", false
+	}
+
+	// raw is the token between its quotes, and p.pos is past the closing one
+	if p.path == nil {
+		p.path = &pathScanner{}
+	}
+	p.path.advance(p.data, p.pos-len(raw)-2)
+	out := p.opts.StringTransform(p.path.String(), value)
+
+	// Only the input may be aliased; the scratch buffer is reused and the
+	// transform may hand back memory of its own
+	if within(out, p.data) {
+		return GetString(out), true
+	}
+	return string(out), true
+}
+
+// within reports whether b is a non-empty slice of data's memory
+func within(b, data []byte) bool {
+	if len(b) == 0 || len(data) == 0 {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(data)))
+	at := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	return at >= start && at < start+uintptr(len(data))
+}
+
+// decodeHex4 parses the four hex digits of a \u escape
+func decodeHex4(b []byte) (rune, bool) {
+	if len(b) < 4 {
+		return 0, false
+	}
+
+	var r rune
+	for i := 0; i < 4; i++ {
+		c := b[i]
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		r = r<<4 | rune(c)
+	}
+	return r, true
+}
+
 func (p *Parser) parseStringToBuffer(buf *Buffer) int {
 	if p.pos >= len(p.data) || p.data[p.pos] != '"' {
 		return TokenError
 	}
 
+	end := p.stringEnd(p.pos)
 	p.pos++     // Skip opening quote
 	buf.off = 0 // Reset buffer position
 
-	for p.pos < len(p.data) {
+	for p.pos < end {
 		if p.data[p.pos] == '\\' {
+			// An escape cut off by the end of the input is truncation,
+			// reported at the end like parseString does
+			if p.pos+1 >= end {
+				p.pos = end
+				break
+			}
 			buf.WriteByte(p.data[p.pos+1])
 			p.pos += 2
 			continue
@@ -62,6 +440,9 @@ func (p *Parser) parseStringToBuffer(buf *Buffer) int {
 		p.pos++
 	}
 
+	if end < len(p.data) {
+		p.limitExceeded(end-1, "string", "MaxStringBytes", p.opts.MaxStringBytes)
+	}
 	return TokenError
 }
 
@@ -78,12 +459,16 @@ func (p *Parser) parseNumber() (int, []byte) {
 		return TokenError, nil
 	}
 
-	// Skip first digit (could be 0)
-	p.pos++
-
-	// Parse remaining digits
-	for p.pos < len(p.data) && isDigit(p.data[p.pos]) {
+	// A leading 0 stands alone; 0 followed by more digits is not a number
+	if p.data[p.pos] == '0' {
 		p.pos++
+		if p.pos < len(p.data) && isDigit(p.data[p.pos]) {
+			return TokenError, nil
+		}
+	} else {
+		for p.pos < len(p.data) && isDigit(p.data[p.pos]) {
+			p.pos++
+		}
 	}
 
 	// Parse fractional part
@@ -121,11 +506,22 @@ func (p *Parser) parseNumber() (int, []byte) {
 		}
 	}
 
+	if max := p.opts.MaxNumberBytes; max > 0 && p.pos-start > max {
+		p.limitExceeded(start+max, "number", "MaxNumberBytes", max)
+		return TokenError, nil
+	}
+
 	return TokenNumber, p.data[start:p.pos]
 }
 
+// matchLiteral consumes literal if it is next in the input. Input that
+// stops partway through the literal is consumed to the end so the caller's
+// error is reported as truncation.
 func (p *Parser) matchLiteral(literal string) bool {
 	if p.pos+len(literal) > len(p.data) {
+		if rest := p.data[p.pos:]; string(rest) == literal[:len(rest)] {
+			p.pos = len(p.data)
+		}
 		return false
 	}
 
@@ -139,166 +535,351 @@ func (p *Parser) matchLiteral(literal string) bool {
 	return true
 }
 
+// skipValue moves past the value at the current position, reporting
+// whether it is valid JSON. It is the grammar Valid, Extract and the
+// decoders share: containers are walked with nextMember and scalars with the
+// same token parsers the decoders use. Nesting is tracked in a bit stack
+// rather than by recursion, so depth costs one bit per level and nothing
+// is allocated for the first 256 levels.
 func skipValue(p *Parser) bool {
-	p.skipWhitespace()
-
-	if p.pos >= len(p.data) {
-		return false
-	}
+	var small [4]uint64
+	objects := small[:0] // bit i is set when level i is an object
+	depth := 0
+
+	for {
+		// A value starts here
+		p.skipWhitespace()
+		if p.pos >= len(p.data) {
+			return false
+		}
 
-	switch p.data[p.pos] {
-	case '{': // object
-		p.pos++ // Skip opening brace
-		for {
-			p.skipWhitespace()
-			if p.pos >= len(p.data) {
-				return false
+		switch p.data[p.pos] {
+		case '{', '[': // object or array
+			object := p.data[p.pos] == '{'
+			p.pos++ // Skip opening brace or bracket
+			if depth/64 == len(objects) {
+				objects = append(objects, 0)
 			}
-
-			if p.data[p.pos] == '}' {
-				p.pos++ // Skip closing brace
-				return true
+			if object {
+				objects[depth/64] |= 1 << (depth % 64)
+			} else {
+				objects[depth/64] &^= 1 << (depth % 64)
 			}
+			depth++
 
-			if p.data[p.pos] == ',' {
-				p.pos++ // Skip comma
+			done, err := p.nextMember(closer(object), true)
+			if err != nil {
+				return false
+			}
+			if !done {
+				if object && !p.skipKey() {
+					return false
+				}
 				continue
 			}
+			depth--
 
-			// Skip key
-			tokenType, _ := p.parseString()
-			if tokenType != TokenString {
+		case '"': // string
+			if tokenType, _ := p.parseString(); tokenType != TokenString {
 				return false
 			}
 
-			// Skip colon
-			p.skipWhitespace()
-			if p.pos >= len(p.data) || p.data[p.pos] != ':' {
+		case 't': // true
+			if !p.matchLiteral("true") {
 				return false
 			}
-			p.pos++ // Skip colon
 
-			// Skip value
-			if !skipValue(p) {
+		case 'f': // false
+			if !p.matchLiteral("false") {
 				return false
 			}
-		}
 
-	case '[': // array
-		p.pos++ // Skip opening bracket
-		for {
-			p.skipWhitespace()
-			if p.pos >= len(p.data) {
+		case 'n': // null
+			if !p.matchLiteral("null") {
 				return false
 			}
 
-			if p.data[p.pos] == ']' {
-				p.pos++ // Skip closing bracket
-				return true
+		case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9': // number
+			if tokenType, _ := p.parseNumber(); tokenType != TokenNumber {
+				return false
 			}
 
-			if p.data[p.pos] == ',' {
-				p.pos++ // Skip comma
-				continue
-			}
+		default:
+			return false
+		}
 
-			// Skip value
-			if !skipValue(p) {
+		// The value is complete: move to the next member of the innermost
+		// open container, closing every container that ends here
+		for {
+			if depth == 0 {
+				return true
+			}
+			object := objects[(depth-1)/64]&(1<<((depth-1)%64)) != 0
+			done, err := p.nextMember(closer(object), false)
+			if err != nil {
 				return false
 			}
+			if !done {
+				if object && !p.skipKey() {
+					return false
+				}
+				break
+			}
+			depth--
 		}
+	}
+}
 
-	case '"': // string
+// skipScalarOrValue is skipValue with strings, numbers and literals, the
+// usual values of members a struct doesn't declare, skipped directly
+func (p *Parser) skipScalarOrValue() bool {
+	p.skipWhitespace()
+	if p.pos >= len(p.data) {
+		return false
+	}
+	switch p.data[p.pos] {
+	case '"':
 		tokenType, _ := p.parseString()
 		return tokenType == TokenString
-
-	case 't': // true
+	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		tokenType, _ := p.parseNumber()
+		return tokenType == TokenNumber
+	case 't':
 		return p.matchLiteral("true")
-
-	case 'f': // false
+	case 'f':
 		return p.matchLiteral("false")
-
-	case 'n': // null
+	case 'n':
 		return p.matchLiteral("null")
+	}
+	return skipValue(p)
+}
 
-	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9': // number
-		tokenType, _ := p.parseNumber()
-		return tokenType == TokenNumber
-
-	default:
+// skipKey moves past an object key and the colon after it
+func (p *Parser) skipKey() bool {
+	if tokenType, _ := p.parseString(); tokenType != TokenString {
+		return false
+	}
+	p.skipWhitespace()
+	if p.pos >= len(p.data) || p.data[p.pos] != ':' {
 		return false
 	}
+	p.pos++ // Skip colon
+	return true
+}
+
+// closer returns the byte that ends an object or an array
+func closer(object bool) byte {
+	if object {
+		return '}'
+	}
+	return ']'
+}
+
+// nextMember moves to the next element or member of the array or object
+// closed by end, consuming the comma before it. It reports true once the
+// container is closed, with end consumed. first is set for the call right
+// after the opening bracket. Every container walker goes through it so they
+// all reject missing, leading and trailing commas alike.
+func (p *Parser) nextMember(end byte, first bool) (bool, error) {
+	p.skipWhitespace()
+	if p.pos >= len(p.data) {
+		return false, unexpectedEnd(int64(p.pos))
+	}
+	if p.data[p.pos] == end {
+		p.pos++
+		return true, nil
+	}
+	if first {
+		return false, nil
+	}
+
+	if p.data[p.pos] != ',' {
+		msg := "expected comma after object property"
+		if end == ']' {
+			msg = "expected comma after array element"
+		}
+		return false, &SyntaxError{Offset: int64(p.pos), Msg: msg}
+	}
+	p.pos++ // Skip comma
+
+	p.skipWhitespace()
+	if p.pos >= len(p.data) {
+		return false, unexpectedEnd(int64(p.pos))
+	}
+	if p.data[p.pos] == end {
+		return false, &SyntaxError{Offset: int64(p.pos), Msg: "trailing comma before " + string(end)}
+	}
+	return false, nil
+}
+
+// document checks that the input is exactly one valid value surrounded by
+// optional whitespace and returns the bounds of the value
+func (p *Parser) document() (int, int, error) {
+	p.skipWhitespace()
+	start := p.pos
+	if !skipValue(p) {
+		return 0, 0, p.tokenError("invalid JSON value")
+	}
+	end := p.pos
+	return start, end, p.endOfInput(nil)
 }
 
-// ExtractNumber extracts a number value at the current position
+// precheck validates the rest of the input up front when
+// Options.AtomicDecode is set, rewinding to where it started if it is well
+// formed
+func (p *Parser) precheck() error {
+	if !p.opts.AtomicDecode && !p.opts.StdlibCompat {
+		return nil
+	}
+	pos := p.pos
+	if _, _, err := p.document(); err != nil {
+		return err
+	}
+	p.pos = pos
+	return nil
+}
+
+// endOfInput returns err, or a SyntaxError if anything but whitespace
+// follows the top-level value
+func (p *Parser) endOfInput(err error) error {
+	if err != nil {
+		return err
+	}
+	p.skipWhitespace()
+	if p.pos < len(p.data) {
+		return &SyntaxError{Offset: int64(p.pos), Msg: "invalid character after top-level value"}
+	}
+	return nil
+}
+
+// ExtractNumber extracts a number value at the current position. See
+// ExtractNumberErr for why it fails.
 func (p *Parser) ExtractNumber() (float64, bool) {
+	n, err := p.ExtractNumberErr()
+	return n, err == nil
+}
+
+// ExtractNumberErr extracts a number value at the current position. A
+// malformed token is a *SyntaxError and a number too large for a float64
+// an *UnmarshalTypeError; either way the position is left unchanged.
+func (p *Parser) ExtractNumberErr() (float64, error) {
+	p.skipWhitespace()
+	start := p.pos
 	tokenType, value := p.parseNumber()
 	if tokenType != TokenNumber {
-		return 0, false
+		err := p.tokenError("invalid number")
+		p.pos = start
+		return 0, err
 	}
 
 	n, err := strconv.ParseFloat(GetString(value), 64)
 	if err != nil {
-		return 0, false
+		p.pos = start
+		rangeErr := numberRangeError(string(value), reflect.TypeOf(n))
+		rangeErr.Offset = int64(start)
+		return 0, rangeErr
 	}
-
-	return n, true
+	return n, nil
 }
 
-// ExtractBool extracts a boolean value at the current position
+// ExtractBool extracts a boolean value at the current position. See
+// ExtractBoolErr for why it fails.
 func (p *Parser) ExtractBool() (bool, bool) {
-	p.skipWhitespace()
+	b, err := p.ExtractBoolErr()
+	return b, err == nil
+}
 
+// ExtractBoolErr extracts a boolean value at the current position, leaving
+// the position unchanged on error
+func (p *Parser) ExtractBoolErr() (bool, error) {
+	p.skipWhitespace()
+	start := p.pos
 	if p.pos >= len(p.data) {
-		return false, false
+		return false, unexpectedEnd(int64(p.pos))
 	}
 
-	if p.data[p.pos] == 't' {
+	switch p.data[p.pos] {
+	case 't':
 		if p.matchLiteral("true") {
-			return true, true
+			return true, nil
 		}
-	} else if p.data[p.pos] == 'f' {
+	case 'f':
 		if p.matchLiteral("false") {
-			return false, true
+			return false, nil
 		}
 	}
-
-	return false, false
+	// A literal cut off by the end of the input is reported as truncation
+	err := p.tokenError("expected true or false")
+	p.pos = start
+	return false, err
 }
 
-// ExtractString extracts a string value at the current position
+// ExtractString extracts a string value at the current position. See
+// ExtractStringErr for why it fails.
 func (p *Parser) ExtractString() (string, bool) {
+	s, err := p.ExtractStringErr()
+	return s, err == nil
+}
+
+// ExtractStringErr extracts a string value at the current position with
+// its escape sequences decoded. On error, a *SyntaxError at the offending
+// byte, the position is left unchanged.
+func (p *Parser) ExtractStringErr() (string, error) {
+	p.skipWhitespace()
 	start := p.pos
+	if p.pos >= len(p.data) {
+		return "", unexpectedEnd(int64(p.pos))
+	}
 	if p.data[p.pos] != '"' {
-		return "", false
+		return "", p.tokenError("expected string")
 	}
 
-	p.pos++ // Skip opening quote
-	startContent := p.pos
-
-	for p.pos < len(p.data) {
-		if p.data[p.pos] == '\\' {
-			// Need to process escapes, can't use direct slice
-			p.pos = start
-			tokenType, value := p.parseString()
-			if tokenType != TokenString {
-				return "", false
-			}
-			return GetString(value), true
+	tokenType, raw := p.parseString()
+	if tokenType != TokenString {
+		var err error
+		switch {
+		case p.err != nil:
+			err = p.err
+		case p.pos >= len(p.data):
+			err = &SyntaxError{err: io.ErrUnexpectedEOF, Offset: int64(start), Msg: "unterminated string"}
+		case p.data[p.pos] == '\\':
+			err = &SyntaxError{Offset: int64(p.pos), Msg: "invalid escape sequence in string"}
+		default:
+			err = &SyntaxError{Offset: int64(p.pos), Msg: "invalid control character in string"}
 		}
+		p.pos = start
+		return "", err
+	}
 
-		if p.data[p.pos] == '"' {
-			s := GetString(p.data[startContent:p.pos])
-			p.pos++ // Skip closing quote
-			return s, true
-		}
+	s, ok := p.stringValue(raw)
+	if !ok {
+		p.pos = start
+		return "", &SyntaxError{Offset: int64(start), Msg: "invalid escape sequence in string"}
+	}
+	return s, nil
+}
 
-		p.pos++
+// DecodeValue decodes the next value into v, a non-nil pointer, with the
+// options of the decode in progress, for use by UnmarshalApexJSON methods
+func (p *Parser) DecodeValue(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
 	}
+	return unmarshalValue(p, rv.Elem())
+}
 
-	// Reset position if we didn't find closing quote
-	p.pos = start
-	return "", false
+// RawValue moves past the next value and returns its bytes, which share
+// the input's memory. On error the position is left unchanged.
+func (p *Parser) RawValue() ([]byte, error) {
+	p.skipWhitespace()
+	start := p.pos
+	if !skipValue(p) {
+		err := p.tokenError("invalid JSON value")
+		p.pos = start
+		return nil, err
+	}
+	return p.data[start:p.pos], nil
 }
 
 func countEscapeChars(s string) int {
@@ -0,0 +1,7 @@
+//go:build race
+
+package apexJSON_test
+
+// raceEnabled reports whether the race detector is on. It allocates and
+// slows down every call, so allocation counts and timings are not checked.
+const raceEnabled = true
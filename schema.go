@@ -0,0 +1,74 @@
+package apexJSON
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// TypeSchema returns the fields apexJSON encodes for the struct type t, in
+// encoding order. It reads the same cached field data Marshal and Unmarshal
+// use, so it always reflects actual encoding behavior. Struct types reached
+// through a field, directly or as the element of a pointer, slice, array or
+// map, are described in FieldInfo.Fields unless they encode themselves
+// with methods other than the Generated ones.
+func TypeSchema(t reflect.Type) ([]FieldInfo, error) {
+	if t == nil {
+		return nil, fmt.Errorf("json: TypeSchema(nil)")
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("json: TypeSchema of non-struct type %s", t)
+	}
+	return typeSchema(t, make(map[reflect.Type]bool)), nil
+}
+
+// typeSchema builds the schema for t. Types already being described higher
+// up are left without nested fields so recursive types terminate.
+func typeSchema(t reflect.Type, visiting map[reflect.Type]bool) []FieldInfo {
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	fields := getCachedFields(t)
+	infos := make([]FieldInfo, len(fields))
+	for i := range fields {
+		f := &fields[i]
+		sf := t.FieldByIndex(f.index)
+		infos[i] = FieldInfo{
+			Name:    string(f.nameBytes),
+			GoField: sf.Name,
+			Type:    sf.Type,
+			Options: FieldOptions{
+				OmitEmpty:  f.omitEmpty,
+				String:     f.stringOpt,
+				JSONString: f.jsonString,
+				Duration:   f.duration,
+				Optional:   f.optional,
+				Unknown:    f.unknown,
+			},
+		}
+		if nested := schemaStruct(sf.Type); nested != nil && !visiting[nested] {
+			infos[i].Fields = typeSchema(nested, visiting)
+		}
+	}
+	return infos
+}
+
+// schemaStruct returns the struct type whose fields are encoded for a value
+// of type t, or nil if there is none
+func schemaStruct(t reflect.Type) reflect.Type {
+	for {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+			t = t.Elem()
+			continue
+		case reflect.Struct:
+			if plan := getElemPlan(t); (plan.marshaler || plan.addrMarshal) && !t.Implements(generatedType) {
+				return nil
+			}
+			return t
+		}
+		return nil
+	}
+}
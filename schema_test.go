@@ -0,0 +1,99 @@
+package apexJSON_test
+
+import (
+	"apexJSON"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const userSchemaGolden = `
+id ID int
+username Username string
+email Email string
+created_at CreatedAt time.Time
+profile Profile apexJSON_test.Profile
+  full_name FullName string
+  age Age int
+  bio Bio string
+  interests Interests []string
+  avatar_url AvatarURL string
+  social_links SocialLinks []string
+posts Posts []apexJSON_test.Post
+  id ID int
+  title Title string
+  content Content string
+  created_at CreatedAt time.Time
+  tags Tags []string
+  likes Likes int
+  comments Comments []apexJSON_test.Comment
+    id ID int
+    user_id UserID int
+    content Content string
+    created_at CreatedAt time.Time
+settings Settings apexJSON_test.Settings
+  notifications Notifications bool
+  privacy Privacy string
+  theme Theme string
+  preferences Preferences map[string]string
+`
+
+func renderSchema(b *strings.Builder, fields []apexJSON.FieldInfo, indent string) {
+	for _, f := range fields {
+		fmt.Fprintf(b, "%s%s %s %s", indent, f.Name, f.GoField, f.Type)
+		if f.Options.OmitEmpty {
+			b.WriteString(" omitempty")
+		}
+		if f.Options.String {
+			b.WriteString(" string")
+		}
+		if f.Options.Optional {
+			b.WriteString(" optional")
+		}
+		b.WriteByte('\n')
+		renderSchema(b, f.Fields, indent+"  ")
+	}
+}
+
+func TestTypeSchemaGolden(t *testing.T) {
+	fields, err := apexJSON.TypeSchema(reflect.TypeOf(&User{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	b.WriteByte('\n')
+	renderSchema(&b, fields, "")
+	if got := b.String(); got != userSchemaGolden {
+		t.Errorf("TypeSchema(User) =%s\nwant%s", got, userSchemaGolden)
+	}
+}
+
+type schemaOptions struct {
+	Count   int                    `json:"count,string,omitempty"`
+	Patch   apexJSON.Optional[int] `json:"patch"`
+	Next    *schemaOptions         `json:"next"`
+	Skipped string                 `json:"-"`
+	private int
+}
+
+func TestTypeSchemaOptions(t *testing.T) {
+	fields, err := apexJSON.TypeSchema(reflect.TypeOf(schemaOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	renderSchema(&b, fields, "")
+	want := "count Count int omitempty string\n" +
+		"patch Patch apexJSON.Optional[int] optional\n" +
+		"next Next *apexJSON_test.schemaOptions\n"
+	if got := b.String(); got != want {
+		t.Errorf("TypeSchema(schemaOptions) =\n%s\nwant\n%s", got, want)
+	}
+
+	if _, err := apexJSON.TypeSchema(reflect.TypeOf(0)); err == nil {
+		t.Error("expected error for non-struct type")
+	}
+}
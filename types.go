@@ -1,8 +1,12 @@
 package apexJSON
 
 import (
+	"bufio"
 	"io"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 // ### Type Definitions ###
@@ -17,41 +21,449 @@ type Unmarshaler interface {
 	UnmarshalJSON([]byte) error
 }
 
+// MarshalerTo is the interface implemented by types that write their JSON
+// straight into the output, without the []byte MarshalJSON returns. It takes
+// precedence over Marshaler and encoding.TextMarshaler; methods declared on
+// *T are used for addressable values, as for Marshaler. The method must
+// write exactly one JSON value, which is not checked.
+type MarshalerTo interface {
+	MarshalApexJSON(*Buffer) error
+}
+
+// UnmarshalerFrom is the interface implemented by types that read their JSON
+// straight from the input. UnmarshalApexJSON is called with the Parser at the
+// start of the value and must consume exactly that value. It takes
+// precedence over Unmarshaler.
+type UnmarshalerFrom interface {
+	UnmarshalApexJSON(*Parser) error
+}
+
+// Generated marks the struct types cmd/apexjsongen writes MarshalApexJSON
+// and UnmarshalApexJSON methods for. Those methods encode the fields just as
+// reflection would, so their errors are passed on as is rather than as a
+// *MarshalerError, and TypeSchema still describes the fields.
+type Generated interface {
+	ApexJSONGenerated()
+}
+
+// marshalerAdapter is the MarshalerTo returned by AsMarshalerTo
+type marshalerAdapter struct {
+	m Marshaler // 16 bytes (interface)
+}
+
+// unmarshalerAdapter is the UnmarshalerFrom returned by AsUnmarshalerFrom
+type unmarshalerAdapter struct {
+	u Unmarshaler // 16 bytes (interface)
+}
+
 // SyntaxError optimized for 8-byte alignment
 type SyntaxError struct {
-	Msg    string // 16 bytes (ptr + len)
-	Offset int64  // 8 bytes
+	err            error  // 16 bytes (interface) - cause, io.ErrUnexpectedEOF for truncated input
+	Msg            string // 16 bytes (ptr + len)
+	ContextSnippet string // 16 bytes (ptr + len) - input around Offset, see Options.ErrorContextBytes
+	Offset         int64  // 8 bytes
 }
 
 // UnmarshalTypeError with fields arranged from largest to smallest
 type UnmarshalTypeError struct {
+	Type           reflect.Type // 16 bytes (interface)
+	Value          string       // 16 bytes (ptr + len)
+	Field          string       // 16 bytes (ptr + len)
+	ContextSnippet string       // 16 bytes (ptr + len) - input around Offset, see Options.ErrorContextBytes
+	Offset         int64        // 8 bytes
+}
+
+// UnsupportedTypeError is returned when marshaling a value of a type JSON
+// has no encoding for: channels, functions, unsafe pointers and, as with
+// encoding/json, complex numbers, which no JSON number can hold. Path names
+// the field or map member holding the value, like "settings.hooks[1].fn",
+// and is "" for the root value or an element of a root array; the message
+// is then encoding/json's.
+type UnsupportedTypeError struct {
+	Type reflect.Type // 16 bytes (interface)
+	Path string       // 16 bytes (ptr + len)
+}
+
+// UnsupportedValueError is returned when marshaling a value JSON has no
+// encoding for, such as a data structure that contains itself
+type UnsupportedValueError struct {
+	Value reflect.Value // 24 bytes
+	Str   string        // 16 bytes (ptr + len)
+}
+
+// cycleKey identifies a struct, map or slice being encoded, see Buffer.enter
+type cycleKey struct {
+	t   reflect.Type   // 16 bytes (interface) - a struct and its first field share an address
+	ptr unsafe.Pointer // 8 bytes
+	len int            // 8 bytes - slice length, as a shorter slice of the same array is another value
+}
+
+// InvalidUnmarshalError describes an invalid destination passed to
+// Unmarshal or UnmarshalValue
+type InvalidUnmarshalError struct {
 	Type   reflect.Type // 16 bytes (interface)
-	Value  string       // 16 bytes (ptr + len)
-	Field  string       // 16 bytes (ptr + len)
-	Offset int64        // 8 bytes
+	reason string       // 16 bytes (ptr + len)
+}
+
+// KV is an object member returned by ExtractMatch
+type KV struct {
+	Key   string // 16 bytes (ptr + len) - unescaped
+	Value []byte // 24 bytes (ptr + len + cap) - raw JSON, copied from the input
+}
+
+// DocumentError reports a failure in one value of the input to
+// UnmarshalMulti
+type DocumentError struct {
+	Err    error // 16 bytes (interface) - the SyntaxError, UnmarshalTypeError, ... for the value
+	Index  int   // 8 bytes - position of the value in the input, from 0
+	Offset int64 // 8 bytes - input offset where the value starts
+}
+
+// DecodeStats describes the work done by a single decode
+type DecodeStats struct {
+	Elements int // 8 bytes - array elements, map entries and struct values materialized
+
+	// PrecisionLoss counts numbers whose stored value does not read back as
+	// the token text: floats that round to a different decimal, underflow to
+	// zero or overflow, and integers too large for their field. Only counted
+	// when Stats is set or FailOnPrecisionLoss is on.
+	PrecisionLoss   int    // 8 bytes
+	FirstLossOffset int64  // 8 bytes - offset of the first lossy number token, -1 if none
+	FirstLossPath   string // 16 bytes (ptr + len) - path to it, like "items[2].id"; "" for the root value
+}
+
+// DecodeBudgetError reports a decode stopped by Options.MaxDecodedElements.
+// It matches ErrDecodeBudgetExceeded with errors.Is.
+type DecodeBudgetError struct {
+	Offset   int64 // 8 bytes
+	Elements int   // 8 bytes - count reached when the decode was stopped
+	Limit    int   // 8 bytes
+}
+
+// Framing selects how values are delimited in an Encoder or Decoder stream
+type Framing uint8
+
+// Coercion is a bitmask of weak type conversions allowed while decoding
+type Coercion uint8
+
+// numberState is the position within a number token, see Decoder.readScalar
+type numberState uint8
+
+// KeyPolicy selects what an encode does with object keys that are unsafe
+// for JavaScript consumers, see MarshalOptions.DangerousKeyPolicy
+type KeyPolicy uint8
+
+// ClosePolicy selects what MappedRegion.Close does while decoded strings
+// still alias the region
+type ClosePolicy uint8
+
+// Options configures a single decode. The zero value matches the behavior
+// of the package-level Unmarshal
+type Options struct {
+	Stats              *DecodeStats // Filled in after each decode when non-nil; not safe to share between concurrent decodes
+	MaxStringBytes     int          // Longest raw (still escaped) string token accepted; 0 means unlimited
+	MaxNumberBytes     int          // Longest number token accepted; 0 means unlimited
+	MaxDecodedElements int          // Most array elements, map entries and struct values one decode may materialize; 0 means unlimited
+	ErrorContextBytes  int          // Input bytes around the failure copied into error ContextSnippets; 0 disables
+	MaxDepth           int          // Deepest nesting of objects and arrays in a value decoded into interface{}, counted from that value; 0 means unlimited
+	UseNumber          bool         // Decode numbers into interface{} as Number instead of float64
+
+	// FailOnPrecisionLoss rejects numbers that cannot be stored without
+	// changing their value, see DecodeStats.PrecisionLoss
+	FailOnPrecisionLoss bool
+
+	// StringTransform, when set, rewrites each decoded string value before
+	// it is stored, such as to trim or normalize it. field is the value's
+	// path, as in UnmarshalTypeError.Field, and s holds the unescaped bytes.
+	// s may alias the input and must not be modified; returning it, or a
+	// subslice of it, unchanged costs no copy. Object keys are not passed.
+	StringTransform func(field string, s []byte) []byte
+
+	// WeakTypeCoercion lets mismatched scalar tokens decode into the declared
+	// type when the conversion is lossless. Off by default.
+	WeakTypeCoercion Coercion
+
+	// AtomicDecode checks the whole input against the JSON grammar before
+	// storing anything, so malformed input leaves the destination as it
+	// was instead of partly filled. It costs one extra scan of the input,
+	// about what Valid costs. Well-formed values that don't fit the
+	// destination, such as a string for an int field, are still found
+	// midway and may leave the fields before them set.
+	AtomicDecode bool
+
+	// ZeroBeforeDecode sets the destination to its zero value before
+	// decoding, so members absent from the input don't keep values from an
+	// earlier decode into the same destination. With AtomicDecode,
+	// malformed input is found first and the destination is left as it was.
+	ZeroBeforeDecode bool
+
+	// MarshalOptions apply when the same Options are passed to
+	// MarshalValueWithOptions
+	MarshalOptions
+}
+
+// MarshalOptions configures a single encode. The zero value matches the
+// behavior of the package-level Marshal
+type MarshalOptions struct {
+	// ExtraEscapes lists ASCII bytes to always write escaped in strings and
+	// keys, as \u00XX, for consumers that need more than JSON requires
+	ExtraEscapes []byte
+
+	// FieldNamer, when set, gives the JSON name of each field whose json tag
+	// doesn't name it, from its Go name, as SnakeCase and CamelCase do. A
+	// returned name that would be invalid as a tag falls back to the Go
+	// field name. Decoding, set through Options, matches keys against the
+	// same names. Fields are cached per namer, so use the same func value
+	// across calls rather than a new closure each time.
+	FieldNamer func(string) string
+
+	// IsEmpty decides omitempty for values it recognizes, returning ok
+	// false to fall back to DefaultIsEmpty, or DeepIsEmpty with
+	// DeepOmitEmpty. It is only called for fields tagged omitempty.
+	IsEmpty func(v reflect.Value) (empty bool, ok bool)
+
+	// PartialPlaceholder is written by MarshalPartialValue in place of each
+	// value that fails to encode. It must be a complete JSON value, and is
+	// checked with Valid; nil writes null.
+	PartialPlaceholder []byte
+
+	// SizeHint is the initial buffer capacity, in bytes, for an encode that
+	// is expected to produce a large document; 0 uses the hint registered
+	// with SetTypeSizeHint, if any
+	SizeHint int
+
+	// YieldEvery, when positive, has an encode call runtime.Gosched each
+	// time about that many more bytes are encoded, so a large value doesn't
+	// hold its goroutine's thread for the whole encode. An Encoder also
+	// writes the output so far to its writer first, unless it is shared or
+	// its framing is LengthPrefixed32. Yields come between the members of
+	// objects and elements of arrays, so what is written is always the
+	// start of the value, and an Encode that fails after one leaves it
+	// written.
+	YieldEvery int
+
+	// TimeFormat is the layout, as for time.Time.Format, used to write
+	// time.Time values; empty uses time.RFC3339
+	TimeFormat string
+
+	// DangerousKeyPolicy selects what is done with object members keyed
+	// __proto__, constructor or prototype, which can pollute prototypes in
+	// JavaScript that copies objects naively. Keys are matched as decoded,
+	// so escaped spellings match too. It applies to struct fields, map
+	// entries and Unknown members, and to TranscodeBytes.
+	DangerousKeyPolicy KeyPolicy
+
+	AllowMarshalerKeys   bool // Accept map keys whose MarshalJSON output is a JSON string
+	StrictUnknown        bool // Fail with *UnknownCollisionError when an Unknown member is named like a field, instead of dropping it
+	DeepOmitEmpty        bool // Have omitempty leave out structs that are zero by their IsZero method or have only empty fields, and pointers to empty values; see DeepIsEmpty
+	EscapeSolidus        bool // Write '/' as \/
+	SortMapKeys          bool // Write map entries in key order, at any depth, so output is byte-for-byte stable
+	NilSliceAsEmptyArray bool // Write nil slices as [] instead of null, and nil []byte as ""
+	NilMapAsEmptyObject  bool // Write nil maps as {} instead of null; nil pointers are still null
+	RawLineSeparators    bool // Write U+2028 and U+2029 as is instead of as \u2028 and \u2029, like Encoder.SetEscapeHTML(false)
+	TrustMarshalers      bool // Write MarshalJSON output unchecked and uncompacted; invalid output corrupts the document
+
+	// StdlibCompat makes encoding and decoding match encoding/json byte for
+	// byte wherever this package's defaults differ, for migrating code and
+	// diffing output against it. Encoding sorts map keys, escapes <, > and &
+	// (unless RawLineSeparators or Encoder.SetEscapeHTML(false) turn that
+	// off), replaces invalid UTF-8 with \ufffd, formats time.Time the same
+	// way, and checks and compacts MarshalJSON output even with
+	// TrustMarshalers. Decoding, set through Options, checks the whole input
+	// before storing anything, ignores null for values that can't be nil,
+	// and falls back to a case-insensitive match of field names. Error
+	// messages are not changed.
+	StdlibCompat bool
+}
+
+// escapeTable maps each byte to the sequence written in its place inside a
+// JSON string, or nil to write it unchanged. An empty, non-nil entry marks
+// a byte whose whole UTF-8 sequence is checked, see multiByteEscape.
+type escapeTable [256][]byte
+
+// FieldError reports a value MarshalPartial replaced because it failed to
+// encode, or a field MapStructs could not convert
+type FieldError struct {
+	Path   string // 16 bytes (ptr + len) - like "items[2].id"; "" for the root value
+	Err    error  // 16 bytes (interface)
+	offset int    // 8 bytes - output offset of the substituted value
+}
+
+// Hooks are called around top-level encodes and decodes so callers can
+// trace them, such as with spans, see SetTraceHooks. Each start func is
+// called when a call begins and returns the func to call when it ends,
+// which must not be nil; every call that starts also ends, errors included.
+type Hooks struct {
+	// OnDecodeStart is called by Unmarshal and Decoder.Decode with the size
+	// of the input, or -1 for Decoder.Decode, which reads its value during
+	// the call. The func it returns gets the decode's error.
+	OnDecodeStart func(size int) func(err error)
+
+	// OnEncodeStart is called by Marshal and Encoder.Encode with the type of
+	// the value. The func it returns gets the size of the encoded value, 0
+	// if encoding failed, and the call's error.
+	OnEncodeStart func(t reflect.Type) func(size int, err error)
+}
+
+// MultiError collects the errors of an operation that carries on past
+// failures, such as MapStructs
+type MultiError []error
+
+// MarshalerError reports an error returned by a MarshalApexJSON, MarshalJSON
+// or MarshalText method, or invalid JSON written by one
+type MarshalerError struct {
+	Type       reflect.Type // 16 bytes (interface) - type whose method failed
+	Err        error        // 16 bytes (interface)
+	sourceFunc string       // 16 bytes (ptr + len) - method name, "" for MarshalJSON, or "registered marshaler"
+}
+
+// UnmarshalerError reports an error returned by an UnmarshalJSON method,
+// with where in the input the value handed to it starts
+type UnmarshalerError struct {
+	Type   reflect.Type // 16 bytes (interface) - type whose method failed
+	Err    error        // 16 bytes (interface)
+	Field  string       // 16 bytes (ptr + len) - path of the value, "" at the top level
+	Offset int64        // 8 bytes - offset of the value's first byte
+}
+
+// DangerousKeyError reports an object key refused under KeysError, see
+// MarshalOptions.DangerousKeyPolicy
+type DangerousKeyError struct {
+	Key string // 16 bytes (ptr + len) - the key as decoded
+}
+
+// UnknownCollisionError reports an Unknown member named like a field of the
+// struct it is written in, under MarshalOptions.StrictUnknown
+type UnknownCollisionError struct {
+	Type reflect.Type // 16 bytes (interface) - the struct type
+	Key  string       // 16 bytes (ptr + len)
+}
+
+// EmbeddedError reports a JSON document held in a string, from a jsonstring
+// field or DecodeEmbedded, that failed to decode
+type EmbeddedError struct {
+	Path   string // 16 bytes (ptr + len) - where the string sits in the outer document
+	Err    error  // 16 bytes (interface) - error decoding the embedded document
+	Offset int64  // 8 bytes - offset of the error in the embedded document, -1 if unknown
+}
+
+// MapKeyError reports a map key that cannot be written as an object key
+type MapKeyError struct {
+	Type   reflect.Type // 16 bytes (interface) - key type
+	Err    error        // 16 bytes (interface) - error from MarshalText or MarshalJSON, if any
+	reason string       // 16 bytes (ptr + len)
 }
 
 // Parser with slice first for better alignment
 type Parser struct {
+	data     []byte       // 24 bytes (ptr + len + cap)
+	scratch  []byte       // 24 bytes (ptr + len + cap) - unescape buffer
+	opts     *Options     // 8 bytes (ptr) - never nil
+	err      *SyntaxError // 8 bytes (ptr) - limit violation from the last token
+	pos      int          // 8 bytes
+	elements int          // 8 bytes - values materialized, see Options.MaxDecodedElements
+	losses   int          // 8 bytes - lossy numbers, see DecodeStats.PrecisionLoss
+	lossPos  int          // 8 bytes - offset of the first lossy number
+	path     *pathScanner // 8 bytes (ptr) - paths for Options.StringTransform, allocated on first use
+}
+
+// Codec owns the scratch state used by Marshal and Unmarshal so that tight
+// loops on one goroutine can reuse it instead of going through the pools.
+// A Codec is not safe for concurrent use.
+type Codec struct {
+	parser Parser  // 104 bytes
+	buf    *Buffer // 8 bytes (ptr)
+}
+
+// Memo holds a value together with its encoding, made on first use, for a
+// value that is sent many times over. It is safe for concurrent use.
+type Memo struct {
+	v       interface{}                // 16 bytes (interface)
+	encoded atomic.Pointer[memoResult] // 8 bytes (ptr) - nil until encoded or after Invalidate
+	mu      sync.Mutex                 // 8 bytes - held while encoding, so v is encoded once
+}
+
+// memoResult is the outcome of encoding a Memo's value
+type memoResult struct {
 	data []byte // 24 bytes (ptr + len + cap)
-	pos  int    // 8 bytes
+	err  error  // 16 bytes (interface)
 }
 
 // Encoder optimized to minimize padding
 type Encoder struct {
-	w          io.Writer // 16 bytes (interface)
-	buf        *Buffer   // 8 bytes (ptr)
-	escapeHTML bool      // 1 byte (padded to 8)
-	// 7 bytes padding here, could add future fields
+	w          io.Writer     // 16 bytes (interface)
+	buf        *Buffer       // 8 bytes (ptr)
+	mu         *sync.Mutex   // 8 bytes (ptr) - serializes writes, set by NewSharedEncoder
+	bw         *bufio.Writer // 8 bytes (ptr) - w when set by NewEncoderBuffered
+	escapeHTML bool          // 1 byte
+	noNewline  bool          // 1 byte - set by SetWriteNewline(false)
+	framing    Framing       // 1 byte (padded to 8)
+	// 5 bytes padding here, could add future fields
+}
+
+// ObjectEncoder writes one JSON object through an Encoder member by member,
+// see Encoder.BeginObject
+type ObjectEncoder struct {
+	e    *Encoder    // 8 bytes (ptr)
+	buf  *Buffer     // 8 bytes (ptr) - the document so far, nil once it is written
+	open []openValue // 24 bytes (ptr + len + cap) - open objects and arrays, innermost last
+}
+
+// openValue is an object or array an ObjectEncoder has begun but not ended
+type openValue struct {
+	members int  // 8 bytes - values written so far
+	object  bool // 1 byte
+	keyed   bool // 1 byte (padded to 8) - Key was called and its value is still due
 }
 
 // Decoder optimized with slices grouped together and largest fields first
 type Decoder struct {
-	buf       []byte    // 24 bytes (ptr + len + cap)
-	tokenBuf  []byte    // 24 bytes (ptr + len + cap)
-	r         io.Reader // 16 bytes (interface)
-	readPos   int       // 8 bytes
-	useNumber bool
+	buf      []byte         // 24 bytes (ptr + len + cap)
+	tokenBuf []byte         // 24 bytes (ptr + len + cap)
+	r        io.Reader      // 16 bytes (interface)
+	readPos  int            // 8 bytes
+	offset   int64          // 8 bytes - stream offset of buf[0]
+	skipped  []SkippedRange // 24 bytes (ptr + len + cap) - garbage skipped in lenient mode
+	opts     Options
+	maxFrame int     // 8 bytes - see SetMaxFrameSize, 0 means the default
+	framing  Framing // 1 byte
+	lenient  bool    // 1 byte (padded to 8) - see SetLenientStream
+}
+
+// SkippedRange is a run of bytes a lenient Decoder discarded between values
+type SkippedRange struct {
+	Offset int64 // 8 bytes - stream offset of the first skipped byte
+	Length int   // 8 bytes
+}
+
+// DecodeOption configures DecodeToChannel
+type DecodeOption func(*streamConfig)
+
+// streamConfig holds the settings applied by DecodeOption values
+type streamConfig struct {
+	onSkip        func(index int, err error) // 8 bytes (ptr)
+	opts          *Options                   // 8 bytes (ptr) - nil unless WithDecodeOptions is given
+	skipMalformed bool                       // 1 byte (padded to 8)
+}
+
+// FieldInfo describes how one struct field is encoded, as reported by
+// TypeSchema
+type FieldInfo struct {
+	Name    string       // JSON member name
+	GoField string       // Go struct field name
+	Type    reflect.Type // Go type of the field
+	Fields  []FieldInfo  // Schema of a struct type reached through the field, nil otherwise
+	Options FieldOptions
+}
+
+// FieldOptions are the tag options that affect a field's encoding
+type FieldOptions struct {
+	OmitEmpty  bool // omitempty
+	String     bool // string
+	JSONString bool // jsonstring
+	Duration   bool // duration:string, on a time.Duration field
+	Optional   bool // field is an Optional[T]
+	Unknown    bool // field is an Unknown collecting undeclared members
 }
 
 // Field with slices grouped together and bool at the end to minimize padding
@@ -61,19 +473,205 @@ type Field struct {
 	index               []int  // 24 bytes (ptr + len + cap)
 	omitEmpty           bool   // 1 byte (padded to 8)
 	stringOpt           bool   // 1 byte (padded to 8)
-	// 6 bytes padding here, could add future fields
+	optional            bool   // 1 byte (padded to 8) - field is an Optional[T]
+	unknown             bool   // 1 byte (padded to 8) - field is the struct's Unknown
+	tagged              bool   // 1 byte (padded to 8) - name comes from the json tag, not the Go field name
+	dangerous           bool   // 1 byte (padded to 8) - name is one MarshalOptions.DangerousKeyPolicy applies to
+	jsonString          bool   // 1 byte (padded to 8) - value is a JSON document held in a string, see marshalJSONString
+	duration            bool   // 1 byte (padded to 8) - time.Duration written as a string like "5m30s", see unmarshalDuration
+	zeroer              bool   // 1 byte (padded to 8) - omitempty struct whose type has an IsZero method, for DeepOmitEmpty
+}
+
+// decodePlan is the cached unmarshal layout of a struct type
+type decodePlan struct {
+	fields  []Field        // 24 bytes (ptr + len + cap)
+	byName  map[string]int // 8 bytes (ptr) - JSON name to index in fields
+	kinds   []reflect.Kind // 24 bytes (ptr + len + cap) - field kinds, only set when flat
+	unknown []int          // 24 bytes (ptr + len + cap) - index of the Unknown field, nil if there is none
+	names   nameFilter     // 32 bytes - field names, to turn away other keys before the byName lookup
+	flat    bool           // 1 byte - every field is a direct string, number or bool, see unmarshalFlatStruct
+}
+
+// nameFilter is a 256-bit set over a hash of a name's length and first and
+// last bytes. A key whose bit is clear is no name in the set; one whose bit
+// is set may be.
+type nameFilter [4]uint64
+
+// treeStack is the scratch state extractTree builds interface{} values in
+type treeStack struct {
+	frames []treeFrame   // 24 bytes (ptr + len + cap) - open containers, innermost last
+	keys   []string      // 24 bytes (ptr + len + cap) - member keys of open objects
+	values []interface{} // 24 bytes (ptr + len + cap) - member values of open containers
+}
+
+// treeFrame is one open object or array in a treeStack
+type treeFrame struct {
+	values int  // 8 bytes - index of its first member in treeStack.values
+	keys   int  // 8 bytes - index of its first key in treeStack.keys
+	object bool // 1 byte (padded to 8)
 }
 
+// structMapping pairs the fields of a source struct type with those of a
+// destination struct type by JSON name, see MapStructs
+type structMapping struct {
+	dst        *decodePlan // 8 bytes (ptr)
+	pairs      []fieldPair // 24 bytes (ptr + len + cap) - fields of both types
+	unmatched  []*Field    // 24 bytes (ptr + len + cap) - source fields dst has no field for
+	srcUnknown *Field      // 8 bytes (ptr) - the source's Unknown field, if any
+}
+
+// fieldPair is a source field and the destination field of the same name
+type fieldPair struct {
+	src *Field // 8 bytes (ptr)
+	dst *Field // 8 bytes (ptr)
+}
+
+// MappedRegion is memory, typically a memory-mapped file, that values
+// decoded by UnmarshalMapped may alias. It counts the decoded strings that
+// share its memory, so the mapping is released only once none are left or
+// they have been copied out; see ClosePolicy. It is safe for concurrent use.
+type MappedRegion struct {
+	data     []byte                          // 24 bytes (ptr + len + cap)
+	unmap    func() error                    // 8 bytes (ptr) - releases data, may be nil
+	aliases  map[interface{}][]reflect.Value // 8 bytes (ptr) - settable strings and interfaces aliasing data, by destination
+	refs     int                             // 8 bytes - total length of aliases
+	decoding int                             // 8 bytes - UnmarshalMapped calls in progress
+	mu       sync.Mutex                      // 8 bytes
+	idle     sync.Cond                       // 48 bytes - signaled when refs or decoding drop, L is &mu
+	policy   ClosePolicy                     // 1 byte
+	closed   bool                            // 1 byte (padded to 8) - Close has begun
+}
+
+// aliasTracker walks a value decoded by UnmarshalMapped for strings
+// aliasing its region
+type aliasTracker struct {
+	region *MappedRegion           // 8 bytes (ptr)
+	refs   []reflect.Value         // 24 bytes (ptr + len + cap) - settable strings and interfaces to count
+	seen   map[unsafe.Pointer]bool // 8 bytes (ptr) - pointers already walked, allocated on first use
+}
+
+// pathScanner follows the nesting of a document up to an offset, see pathAt
+type pathScanner struct {
+	data      []byte      // 24 bytes (ptr + len + cap) - document being scanned
+	stack     []pathFrame // 24 bytes (ptr + len + cap)
+	pos       int         // 8 bytes - offset scanned up to
+	expectKey bool        // 1 byte (padded to 8) - the next string is an object key
+}
+
+// pathFrame is one open object or array in a pathScanner
+type pathFrame struct {
+	key    string // 16 bytes (ptr + len) - member being scanned, for objects
+	index  int    // 8 bytes - element being scanned, for arrays
+	object bool   // 1 byte (padded to 8)
+}
+
+// elemPlan records how the elements of a slice, array or map type are
+// encoded and decoded, resolved once per element type by getElemPlan
+type elemPlan struct {
+	marshaler   bool // 1 byte - elements are encoded by calling MarshalApexJSON or MarshalJSON directly
+	text        bool // 1 byte - elements are encoded as the JSON string of MarshalText
+	addrMarshal bool // 1 byte - only the pointer type has MarshalApexJSON or MarshalJSON, called for addressable elements
+	addrText    bool // 1 byte - only the pointer type has MarshalText, used for addressable elements
+	unmarshaler bool // 1 byte - elements are decoded by calling UnmarshalApexJSON or UnmarshalJSON directly
+
+	marshalFunc   marshalFunc   // 8 bytes (ptr) - registered with RegisterMarshaler, which takes precedence over methods
+	unmarshalFunc unmarshalFunc // 8 bytes (ptr) - registered with RegisterUnmarshaler, which takes precedence over methods
+}
+
+// marshalFunc writes v, a value of the type it was registered for, as
+// RegisterMarshaler's function does
+type marshalFunc func(v reflect.Value, buf *Buffer) error
+
+// unmarshalFunc decodes data into v, an addressable value of the type it was
+// registered for, as RegisterUnmarshaler's function does
+type unmarshalFunc func(data []byte, v reflect.Value) error
+
 // Buffer with largest field first
 type Buffer struct {
-	buf []byte // 24 bytes (ptr + len + cap)
-	off int    // 8 bytes
+	buf     []byte                // 24 bytes (ptr + len + cap)
+	tracked []cycleKey            // 24 bytes (ptr + len + cap) - keys of the values in seen, innermost last
+	opts    *MarshalOptions       // 8 bytes (ptr) - nil means defaults
+	esc     *escapeTable          // 8 bytes (ptr) - nil means defaultEscapes
+	faults  *[]FieldError         // 8 bytes (ptr) - set by MarshalPartialValue, see substitute
+	ind     *indenter             // 8 bytes (ptr) - set by MarshalIndent, nil for compact output
+	yield   *yielder              // 8 bytes (ptr) - set when MarshalOptions.YieldEvery is, see yieldPoint
+	seen    map[cycleKey]struct{} // 8 bytes (ptr) - values being encoded past cycleDepth, see enter
+	off     int                   // 8 bytes
+	level   int                   // 8 bytes - structs, maps and slices being encoded
+}
+
+// yielder paces an encode with MarshalOptions.YieldEvery
+type yielder struct {
+	w       io.Writer // 16 bytes (interface) - where output is written at each yield, nil to keep it
+	every   int       // 8 bytes
+	next    int       // 8 bytes - Buffer offset at which to yield next
+	written int       // 8 bytes - output already written to w
+}
+
+// indenter lays out the output of MarshalIndent
+type indenter struct {
+	prefix string // 16 bytes (ptr + len) - written at the start of every line after the first
+	indent string // 16 bytes (ptr + len) - written once per level of nesting
+	depth  int    // 8 bytes - objects and arrays currently open
 }
 
+// fieldCacheKey identifies the fields of a struct type as named under one
+// set of options
 type fieldCacheKey struct {
-	rtype reflect.Type
+	rtype  reflect.Type // 16 bytes (interface)
+	naming fieldNaming  // 8 bytes
+}
+
+// fieldNaming is the comparable fingerprint of the options that decide how
+// struct fields resolve to JSON names. The zero value is the names the tags
+// and Go field names give.
+type fieldNaming struct {
+	// namer is the func value of MarshalOptions.FieldNamer. Holding the
+	// pointer keeps it alive, so a later func can't reuse its address
+	// while it names cached fields.
+	namer unsafe.Pointer // 8 bytes
 }
 
 type tagOptions string
 
 type Number string
+
+// Optional wraps a struct field so callers can tell whether its key was
+// present in the decoded document. Present is set whenever the key appears,
+// including an explicit null, which additionally sets Null. On marshal a
+// field that isn't Present is omitted and a Null one is written as null.
+type Optional[T any] struct {
+	Value   T
+	Present bool
+	Null    bool
+}
+
+// RawMessage is an encoded JSON value. Marshal writes it unchanged, and
+// Unmarshal stores a copy of the value's bytes in it.
+type RawMessage []byte
+
+// Unknown keeps the members of a JSON object that match no field of the
+// struct it is declared in, so a typed struct can be decoded, changed and
+// encoded again without losing what it doesn't declare. Embed it, or declare
+// a field of this type under any name; it is never matched by a member
+// name itself. Values are kept byte for byte.
+//
+// On marshal its members follow all of the struct's fields, sorted by key,
+// so the output is the same from one encode to the next. Fields always win:
+// a member named like a field, whether or not the field is written, is
+// dropped, or is an *UnknownCollisionError under
+// MarshalOptions.StrictUnknown. Only the first Unknown of a struct is used;
+// any others are ignored on marshal and unmarshal alike.
+type Unknown map[string]RawMessage
+
+// isZeroer is implemented by types that know when they are zero, such as
+// time.Time; omitempty asks them instead of looking at their fields
+type isZeroer interface {
+	IsZero() bool
+}
+
+// optionalValue is implemented by every Optional instantiation so the
+// reflection paths can recognize it without knowing T
+type optionalValue interface {
+	setOptional(present, null bool)
+}